@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Images are grouped by their proportions, computed from the stored width and
+// height: three shapes splitting the library, and the SDXL training buckets.
+// An SDXL bucket matches by ratio rather than size, so upscaled images stay in
+// the bucket they were generated in.
+
+const (
+	// Ratios within this share of 1 are square
+	squareTolerance = 0.05
+	// Ratios within this share of an SDXL bucket belong to it; the closest
+	// buckets are 11% apart
+	sdxlBucketTolerance = 0.03
+
+	sortByMegapixels = "megapixels"
+)
+
+// knownDimensions leaves out images without a width or height.
+const knownDimensions = "i.width > 0 AND i.height > 0"
+
+const aspectRatioColumn = "(CAST(i.width AS REAL) / i.height)"
+
+type aspectBucket struct {
+	Name      string
+	Label     string
+	Group     string // "shape" or "sdxl"
+	condition string
+}
+
+type AspectStat struct {
+	Name       string `json:"name"`
+	Label      string `json:"label"`
+	Group      string `json:"group"`
+	ImageCount int    `json:"image_count"`
+}
+
+type AspectStatsResponse struct {
+	Buckets []AspectStat `json:"buckets"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// aspectBuckets are the values of the aspect filter, in the order they are
+// offered.
+var aspectBuckets = buildAspectBuckets()
+
+func buildAspectBuckets() []aspectBucket {
+	buckets := []aspectBucket{
+		{"portrait", "Portrait", "shape", fmt.Sprintf("%s < %g", aspectRatioColumn, 1-squareTolerance)},
+		{"square", "Square", "shape", fmt.Sprintf("%s BETWEEN %g AND %g", aspectRatioColumn, 1-squareTolerance, 1+squareTolerance)},
+		{"landscape", "Landscape", "shape", fmt.Sprintf("%s > %g", aspectRatioColumn, 1+squareTolerance)},
+	}
+	sdxlSizes := [][2]int{
+		{640, 1536}, {768, 1344}, {832, 1216}, {896, 1152}, {1024, 1024},
+		{1152, 896}, {1216, 832}, {1344, 768}, {1536, 640},
+	}
+	for _, size := range sdxlSizes {
+		name := fmt.Sprintf("%dx%d", size[0], size[1])
+		ratio := float64(size[0]) / float64(size[1])
+		buckets = append(buckets, aspectBucket{
+			Name:      name,
+			Label:     name,
+			Group:     "sdxl",
+			condition: fmt.Sprintf("ABS(%s / %g - 1) <= %g", aspectRatioColumn, ratio, sdxlBucketTolerance),
+		})
+	}
+	return buckets
+}
+
+// cleanAspectFilter returns a known aspect bucket, or "" for any proportions.
+func cleanAspectFilter(filter string) string {
+	filter = strings.ToLower(strings.TrimSpace(filter))
+	for _, bucket := range aspectBuckets {
+		if bucket.Name == filter {
+			return bucket.Name
+		}
+	}
+	return ""
+}
+
+func aspectFilterCondition(filter string) string {
+	filter = cleanAspectFilter(filter)
+	for _, bucket := range aspectBuckets {
+		if bucket.Name == filter {
+			return knownDimensions + " AND " + bucket.condition
+		}
+	}
+	return ""
+}
+
+// cleanMegapixels reads a resolution filter in megapixels, 0 for none.
+func cleanMegapixels(value string) float64 {
+	megapixels, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || megapixels <= 0 || math.IsInf(megapixels, 0) {
+		return 0
+	}
+	return megapixels
+}
+
+// formatMegapixels writes a resolution filter as it is read, "" for none.
+func formatMegapixels(megapixels float64) string {
+	if megapixels <= 0 {
+		return ""
+	}
+	return strconv.FormatFloat(megapixels, 'f', -1, 64)
+}
+
+// resolutionFilterConditions restricts results to images of at least and at
+// most the given number of megapixels.
+func resolutionFilterConditions(minMegapixels, maxMegapixels float64) ([]string, []any) {
+	var conditions []string
+	var args []any
+	if minMegapixels > 0 {
+		conditions = append(conditions, "i.width * i.height >= ?")
+		args = append(args, int64(math.Round(minMegapixels*1e6)))
+	}
+	if maxMegapixels > 0 {
+		conditions = append(conditions, "i.width * i.height <= ?")
+		args = append(args, int64(math.Round(maxMegapixels*1e6)))
+	}
+	return conditions, args
+}
+
+// getAspectStats counts the images of each aspect bucket for the current
+// content level filter.
+func (app *App) getAspectStats(nsfwFilter string) ([]AspectStat, error) {
+	conditions := []string{"i.trashed_at IS NULL", knownDimensions}
+	if condition := contentLevelCondition(nsfwFilter); condition != "" {
+		conditions = append(conditions, condition)
+	}
+
+	counts := make([]string, len(aspectBuckets))
+	for i, bucket := range aspectBuckets {
+		counts[i] = "COALESCE(SUM(CASE WHEN " + bucket.condition + " THEN 1 ELSE 0 END), 0)"
+	}
+
+	stats := make([]AspectStat, len(aspectBuckets))
+	dest := make([]any, len(aspectBuckets))
+	for i, bucket := range aspectBuckets {
+		stats[i] = AspectStat{Name: bucket.Name, Label: bucket.Label, Group: bucket.Group}
+		dest[i] = &stats[i].ImageCount
+	}
+	err := app.db.QueryRow(`
+		SELECT ` + strings.Join(counts, ", ") + `
+		FROM images i
+		WHERE ` + strings.Join(conditions, " AND ")).Scan(dest...)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func (app *App) handleAspectStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	buckets, err := app.getAspectStats(r.URL.Query().Get("nsfw"))
+	if err != nil {
+		log.Printf("Error getting aspect ratio stats: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(AspectStatsResponse{Buckets: []AspectStat{}, Error: "Failed to load aspect ratios"})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(AspectStatsResponse{Buckets: buckets})
+}
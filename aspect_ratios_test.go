@@ -0,0 +1,134 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestAspectAndResolutionFilters(t *testing.T) {
+	t.Chdir(t.TempDir())
+	app := &App{}
+	setupTestDB(t, app).Close()
+	t.Cleanup(func() { app.db.Close() })
+
+	if _, err := app.db.Exec(`
+		INSERT INTO images (id, filename, width, height, prompt, neg_prompt, steps, cfg_scale, sampler, scheduler, seed, thumbnail_path, is_nsfw, library_root, relative_path) VALUES
+			(1, 'portrait.png', 832, 1216, '', '', 20, 7, '', '', 1, '', 0, 'images', 'portrait.png'),
+			(2, 'upscaled.png', 1248, 1824, '', '', 20, 7, '', '', 2, '', 0, 'images', 'upscaled.png'),
+			(3, 'square.png', 1024, 1024, '', '', 20, 7, '', '', 3, '', 0, 'images', 'square.png'),
+			(4, 'sd15.png', 512, 512, '', '', 20, 7, '', '', 4, '', 0, 'images', 'sd15.png'),
+			(5, 'wide.png', 1344, 768, '', '', 20, 7, '', '', 5, '', 0, 'images', 'wide.png'),
+			(6, 'phone.png', 1080, 1920, '', '', 20, 7, '', '', 6, '', 0, 'images', 'phone.png'),
+			(7, 'unknown.png', 0, 0, '', '', 20, 7, '', '', 7, '', 0, 'images', 'unknown.png');
+	`); err != nil {
+		t.Fatalf("insert test images: %v", err)
+	}
+	if err := app.gradeContentLevels(); err != nil {
+		t.Fatalf("grade content levels: %v", err)
+	}
+
+	ids := func(params ImageSearchParams) []int {
+		t.Helper()
+		params.Page, params.Limit = 1, 10
+		images, _, err := app.queryImages(params)
+		if err != nil {
+			t.Fatalf("query images: %v", err)
+		}
+		var got []int
+		for _, img := range images {
+			got = append(got, img.ID)
+		}
+		sort.Ints(got)
+		return got
+	}
+	tests := []struct {
+		params ImageSearchParams
+		want   []int
+	}{
+		{ImageSearchParams{AspectFilter: "portrait"}, []int{1, 2, 6}},
+		{ImageSearchParams{AspectFilter: "square"}, []int{3, 4}},
+		{ImageSearchParams{AspectFilter: "landscape"}, []int{5}},
+		// Upscaled images stay in their bucket, and close ratios such as 9:16
+		// are in the nearest one
+		{ImageSearchParams{AspectFilter: "832x1216"}, []int{1, 2}},
+		{ImageSearchParams{AspectFilter: "768x1344"}, []int{6}},
+		{ImageSearchParams{AspectFilter: "1536x640"}, nil},
+		{ImageSearchParams{AspectFilter: "1024x1024"}, []int{3, 4}},
+		{ImageSearchParams{MinMegapixels: 1}, []int{1, 2, 3, 5, 6}},
+		{ImageSearchParams{MinMegapixels: 1.1}, []int{2, 6}},
+		{ImageSearchParams{MaxMegapixels: 0.5}, []int{4, 7}},
+		{ImageSearchParams{AspectFilter: "portrait", MinMegapixels: 1, MaxMegapixels: 2}, []int{1}},
+		// Unknown buckets are ignored
+		{ImageSearchParams{AspectFilter: "panorama"}, []int{1, 2, 3, 4, 5, 6, 7}},
+	}
+	for _, test := range tests {
+		if got := ids(test.params); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("aspect %q megapixels %g-%g = %v, want %v", test.params.AspectFilter, test.params.MinMegapixels, test.params.MaxMegapixels, got, test.want)
+		}
+	}
+
+	images, _, err := app.queryImages(ImageSearchParams{Page: 1, Limit: 3, SortOrder: sortByMegapixels})
+	if err != nil {
+		t.Fatalf("query images by megapixels: %v", err)
+	}
+	var largest []int
+	for _, img := range images {
+		largest = append(largest, img.ID)
+	}
+	if !reflect.DeepEqual(largest, []int{2, 6, 3}) {
+		t.Errorf("largest images = %v, want [2 6 3]", largest)
+	}
+
+	params := imageSearchParamsFromQuery(map[string][]string{"aspect": {" Portrait "}, "min_mp": {"1.5"}, "max_mp": {"-2"}})
+	if params.AspectFilter != "portrait" || params.MinMegapixels != 1.5 || params.MaxMegapixels != 0 {
+		t.Errorf("unexpected filters %q %g %g", params.AspectFilter, params.MinMegapixels, params.MaxMegapixels)
+	}
+	if formatMegapixels(params.MinMegapixels) != "1.5" || formatMegapixels(params.MaxMegapixels) != "" {
+		t.Errorf("unexpected formatted megapixels %q %q", formatMegapixels(params.MinMegapixels), formatMegapixels(params.MaxMegapixels))
+	}
+}
+
+func TestGetAspectStats(t *testing.T) {
+	t.Chdir(t.TempDir())
+	app := &App{}
+	setupTestDB(t, app).Close()
+	t.Cleanup(func() { app.db.Close() })
+
+	if _, err := app.db.Exec(`
+		INSERT INTO images (id, filename, width, height, prompt, neg_prompt, steps, cfg_scale, sampler, scheduler, seed, thumbnail_path, is_nsfw, library_root, relative_path) VALUES
+			(1, 'a.png', 832, 1216, '', '', 20, 7, '', '', 1, '', 0, 'images', 'a.png'),
+			(2, 'b.png', 832, 1216, '', '', 20, 7, '', '', 2, '', 1, 'images', 'b.png'),
+			(3, 'c.png', 1024, 1024, '', '', 20, 7, '', '', 3, '', 0, 'images', 'c.png'),
+			(4, 'd.png', 0, 0, '', '', 20, 7, '', '', 4, '', 0, 'images', 'd.png');
+	`); err != nil {
+		t.Fatalf("insert test images: %v", err)
+	}
+	if err := app.gradeContentLevels(); err != nil {
+		t.Fatalf("grade content levels: %v", err)
+	}
+
+	counts := func(nsfwFilter string) map[string]int {
+		t.Helper()
+		stats, err := app.getAspectStats(nsfwFilter)
+		if err != nil {
+			t.Fatalf("get aspect stats: %v", err)
+		}
+		if len(stats) != len(aspectBuckets) {
+			t.Fatalf("expected every bucket to be listed, got %d", len(stats))
+		}
+		got := make(map[string]int)
+		for _, stat := range stats {
+			if stat.ImageCount > 0 {
+				got[stat.Name] = stat.ImageCount
+			}
+		}
+		return got
+	}
+	if got, want := counts("all"), map[string]int{"portrait": 2, "square": 1, "832x1216": 2, "1024x1024": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("all images: %v, want %v", got, want)
+	}
+	if got, want := counts("sfw"), map[string]int{"portrait": 1, "square": 1, "832x1216": 1, "1024x1024": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SFW images: %v, want %v", got, want)
+	}
+}
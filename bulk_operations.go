@@ -0,0 +1,393 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Bulk actions accepted by /api/images/bulk
+const (
+	bulkActionDelete          = "delete"
+	bulkActionSetCategory     = "set_category"
+	bulkActionSetContentLevel = "set_content_level"
+	bulkActionRefreshMetadata = "refresh_metadata"
+	bulkActionDownload        = "download"
+
+	// Actions on images in the trash
+	bulkActionRestore = "restore"
+	bulkActionPurge   = "purge"
+)
+
+var errInvalidBulkOperation = errors.New("invalid bulk operation")
+
+// BulkOperationRequest selects images either by ID or by a snapshot of the
+// grid's URL query, as kept in the page URL and saved searches.
+type BulkOperationRequest struct {
+	Action   string `json:"action"`
+	ImageIDs []int  `json:"image_ids"`
+	Query    string `json:"query"`
+	Category string `json:"category"` // "sfw" or "nsfw" for set_category
+	Level    string `json:"level"`    // Content level name for set_content_level
+}
+
+type BulkItemResult struct {
+	ID       int    `json:"id"`
+	Filename string `json:"filename,omitempty"`
+	Success  bool   `json:"success"`
+	Error    string `json:"error,omitempty"`
+}
+
+type BulkOperationResponse struct {
+	Success   bool             `json:"success"`
+	Action    string           `json:"action,omitempty"`
+	Succeeded int              `json:"succeeded"`
+	Failed    int              `json:"failed"`
+	Results   []BulkItemResult `json:"results"`
+	Error     string           `json:"error,omitempty"`
+}
+
+// bulkItem is an image selected for a bulk action. Metadata is extracted
+// before the transaction starts, because extraction may register models.
+type bulkItem struct {
+	BulkItemResult
+	file         imageFile
+	contentLevel int
+	trashed      bool
+	metadata     *ImageMetadata
+}
+
+func (item *bulkItem) fail(err error) {
+	item.Success = false
+	item.Error = err.Error()
+}
+
+// resolveBulkImageIDs returns the selected image IDs in grid order for a
+// query snapshot, or the listed IDs without repeats.
+func (app *App) resolveBulkImageIDs(req BulkOperationRequest) ([]int, error) {
+	if (len(req.ImageIDs) == 0) == (req.Query == "") {
+		return nil, fmt.Errorf("%w: select images by image_ids or by query", errInvalidBulkOperation)
+	}
+
+	if req.Query == "" {
+		if len(req.ImageIDs) > maxBulkImageIDs {
+			return nil, fmt.Errorf("%w: at most %d images per request", errInvalidBulkOperation, maxBulkImageIDs)
+		}
+		seen := make(map[int]bool, len(req.ImageIDs))
+		ids := make([]int, 0, len(req.ImageIDs))
+		for _, id := range req.ImageIDs {
+			if id <= 0 {
+				return nil, fmt.Errorf("%w: invalid image ID %d", errInvalidBulkOperation, id)
+			}
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+		return ids, nil
+	}
+
+	params, err := imageSearchParamsFromSnapshot(req.Query)
+	if err != nil {
+		return nil, fmt.Errorf("%w: query is not a valid filter list", errInvalidBulkOperation)
+	}
+	whereClause, args := imageSearchWhereClause(params)
+	rows, err := app.db.Query(`
+		SELECT i.id
+		FROM images i
+		LEFT JOIN models m ON i.model_id = m.id
+		`+whereClause+`
+		ORDER BY `+app.imageOrderByClause(params)+`
+		LIMIT ?
+	`, append(args, maxBulkImageIDs+1)...)
+	if err != nil {
+		return nil, fmt.Errorf("select images: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("select images: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("select images: %w", err)
+	}
+	if len(ids) > maxBulkImageIDs {
+		return nil, fmt.Errorf("%w: the search matches more than %d images", errInvalidBulkOperation, maxBulkImageIDs)
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("%w: no images match the query", errInvalidBulkOperation)
+	}
+	return ids, nil
+}
+
+// loadBulkItems looks up the files of the selected images. Images that no
+// longer exist, or are not where the action applies, are returned as failed
+// items: restore and purge apply to the trash, the other actions to the
+// library.
+func (app *App) loadBulkItems(action string, ids []int) ([]*bulkItem, error) {
+	inTrash := action == bulkActionRestore || action == bulkActionPurge
+	items := make([]*bulkItem, 0, len(ids))
+	for _, id := range ids {
+		item := &bulkItem{BulkItemResult: BulkItemResult{ID: id, Success: true}}
+		var err error
+		item.file, err = scanImageFile(app.db.QueryRow("SELECT "+imageFileColumns+", COALESCE(i.content_level, 0), i.trashed_at IS NOT NULL FROM images i WHERE i.id = ?", id), &item.contentLevel, &item.trashed)
+		item.Filename = item.file.Filename
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			item.fail(errImageNotFound)
+		case err != nil:
+			return nil, fmt.Errorf("find image %d: %w", id, err)
+		case inTrash && !item.trashed:
+			item.fail(errImageNotInTrash)
+		case !inTrash && item.trashed:
+			item.fail(errImageNotFound)
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// runBulkOperation applies an action to every selected image in a single
+// transaction. Each image runs under its own savepoint, so a failing image is
+// reported and skipped while the rest are committed together. File moves are
+// undone when an image fails or the commit does.
+func (app *App) runBulkOperation(req BulkOperationRequest, items []*bulkItem) error {
+	var toNSFW bool
+	var level int
+	switch req.Action {
+	case bulkActionDelete, bulkActionRefreshMetadata, bulkActionRestore, bulkActionPurge:
+	case bulkActionSetCategory:
+		if req.Category != "sfw" && req.Category != "nsfw" {
+			return fmt.Errorf("%w: category must be sfw or nsfw", errInvalidBulkOperation)
+		}
+		toNSFW = req.Category == "nsfw"
+	case bulkActionSetContentLevel:
+		var err error
+		if level, err = parseContentLevel(req.Level); err != nil {
+			return fmt.Errorf("%w: level must be none, soft, mature or x", errInvalidBulkOperation)
+		}
+	default:
+		return fmt.Errorf("%w: unknown action %q", errInvalidBulkOperation, req.Action)
+	}
+
+	if req.Action == bulkActionRefreshMetadata {
+		for _, item := range items {
+			if !item.Success {
+				continue
+			}
+			path, err := app.imageFilePath(item.file.Location)
+			if err == nil {
+				item.metadata, err = app.extractImageMetadata(path, item.file.IsNSFW, "")
+			}
+			if err != nil {
+				item.fail(fmt.Errorf("extract metadata: %w", err))
+			}
+		}
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin bulk operation: %w", err)
+	}
+	defer tx.Rollback()
+
+	var undos, cleanups []func()
+	undoAll := func() {
+		for i := len(undos) - 1; i >= 0; i-- {
+			undos[i]()
+		}
+	}
+
+	for _, item := range items {
+		if !item.Success {
+			continue
+		}
+		if _, err := tx.Exec("SAVEPOINT bulk_item"); err != nil {
+			undoAll()
+			return fmt.Errorf("start image %d: %w", item.ID, err)
+		}
+
+		var undo, cleanup func()
+		switch req.Action {
+		case bulkActionDelete:
+			undo, cleanup, err = trashImageFiles(tx, item.file)
+		case bulkActionRestore:
+			undo, cleanup, err = restoreImageFiles(tx, item.file)
+		case bulkActionPurge:
+			undo, cleanup, err = purgeImageFiles(tx, item.file)
+		case bulkActionSetCategory:
+			undo, err = app.moveBulkItem(tx, item, toNSFW)
+		case bulkActionSetContentLevel:
+			undo, err = setContentLevelTx(tx, item.file, level)
+		case bulkActionRefreshMetadata:
+			err = updateImageMetadataRecord(tx, item.ID, item.metadata)
+		}
+
+		if err != nil {
+			item.fail(err)
+			if _, rollbackErr := tx.Exec("ROLLBACK TO bulk_item"); rollbackErr != nil {
+				undoAll()
+				return fmt.Errorf("roll back image %d: %w", item.ID, rollbackErr)
+			}
+		}
+		if _, err := tx.Exec("RELEASE bulk_item"); err != nil {
+			undoAll()
+			return fmt.Errorf("finish image %d: %w", item.ID, err)
+		}
+		if undo != nil {
+			undos = append(undos, undo)
+		}
+		if cleanup != nil {
+			cleanups = append(cleanups, cleanup)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		undoAll()
+		return fmt.Errorf("commit bulk operation: %w", err)
+	}
+	for _, cleanup := range cleanups {
+		cleanup()
+	}
+	return nil
+}
+
+// moveBulkItem moves an image to a category, see handleToggleCategory, with
+// the nearest content level of that category. Images already in the category
+// are left alone.
+func (app *App) moveBulkItem(tx *sql.Tx, item *bulkItem, toNSFW bool) (func(), error) {
+	if item.file.IsNSFW == toNSFW {
+		return nil, nil
+	}
+	return setContentLevelTx(tx, item.file, contentLevelForCategory(item.contentLevel, toNSFW))
+}
+
+// writeBulkArchive streams the selected image files as a zip archive. Images
+// that cannot be read are listed in skipped.txt instead.
+func (app *App) writeBulkArchive(w http.ResponseWriter, items []*bulkItem) {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="images-%s.zip"`, time.Now().Format("20060102-150405")))
+
+	archive := zip.NewWriter(w)
+	var skipped []string
+	for _, item := range items {
+		if !item.Success {
+			skipped = append(skipped, fmt.Sprintf("%d: %s", item.ID, item.Error))
+			continue
+		}
+		if err := app.addBulkArchiveFile(archive, item); err != nil {
+			skipped = append(skipped, fmt.Sprintf("%d %s: %v", item.ID, item.Filename, err))
+		}
+	}
+
+	if len(skipped) > 0 {
+		if entry, err := archive.Create("skipped.txt"); err == nil {
+			_, _ = io.WriteString(entry, strings.Join(skipped, "\n")+"\n")
+		}
+	}
+	if err := archive.Close(); err != nil {
+		log.Printf("Failed to finish image archive: %v", err)
+	}
+}
+
+func (app *App) addBulkArchiveFile(archive *zip.Writer, item *bulkItem) error {
+	path, err := app.imageFilePath(item.file.Location)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	// Images are already compressed
+	header.Method = zip.Store
+	entry, err := archive.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, file)
+	return err
+}
+
+func (app *App) handleBulkOperation(w http.ResponseWriter, r *http.Request) {
+	var req BulkOperationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBulkOperationError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	ids, err := app.resolveBulkImageIDs(req)
+	if err != nil {
+		writeBulkOperationResult(w, err)
+		return
+	}
+	items, err := app.loadBulkItems(req.Action, ids)
+	if err != nil {
+		writeBulkOperationResult(w, err)
+		return
+	}
+
+	if req.Action == bulkActionDownload {
+		app.writeBulkArchive(w, items)
+		return
+	}
+
+	if err := app.runBulkOperation(req, items); err != nil {
+		writeBulkOperationResult(w, err)
+		return
+	}
+
+	response := BulkOperationResponse{Success: true, Action: req.Action, Results: make([]BulkItemResult, 0, len(items))}
+	for _, item := range items {
+		if item.Success {
+			response.Succeeded++
+		} else {
+			response.Failed++
+		}
+		response.Results = append(response.Results, item.BulkItemResult)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+func writeBulkOperationResult(w http.ResponseWriter, err error) {
+	if errors.Is(err, errInvalidBulkOperation) {
+		writeBulkOperationError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	log.Printf("Failed to run bulk operation: %v", err)
+	writeBulkOperationError(w, http.StatusInternalServerError, "Failed to run the bulk operation")
+}
+
+func writeBulkOperationError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(BulkOperationResponse{
+		Success: false,
+		Results: []BulkItemResult{},
+		Error:   message,
+	})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBulkOperations(t *testing.T) {
+	t.Chdir(t.TempDir())
+	app := &App{}
+	setupTestDB(t, app).Close()
+	t.Cleanup(func() { app.db.Close() })
+
+	if _, err := app.db.Exec(`
+		INSERT INTO images (id, filename, width, height, prompt, neg_prompt, steps, cfg_scale, sampler, scheduler, seed, thumbnail_path, is_nsfw, display_timestamp) VALUES
+			(1, '1.png', 1, 1, 'red fox', '', 20, 7, '', '', 1, '', 0, '2024-05-04 00:00:00'),
+			(2, '2.png', 1, 1, 'red fox at night', '', 20, 7, '', '', 2, '', 0, '2024-05-03 00:00:00'),
+			(3, '3.png', 1, 1, 'grey wolf', '', 20, 7, '', '', 3, '', 0, '2024-05-02 00:00:00'),
+			(4, '4.png', 1, 1, 'owl', '', 20, 7, '', '', 4, '', 1, '2024-05-01 00:00:00');
+	`); err != nil {
+		t.Fatalf("insert test images: %v", err)
+	}
+	if err := app.gradeContentLevels(); err != nil {
+		t.Fatalf("grade test images: %v", err)
+	}
+	for _, dir := range []string{"images", "images_nsfw", "thumbnails"} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("create %s: %v", dir, err)
+		}
+	}
+	// Image 3 has no file, so it cannot be archived
+	for _, path := range []string{"images/1.png", "images/2.png", "images_nsfw/4.png", "thumbnails/1.png"} {
+		if err := os.WriteFile(path, []byte(path), 0644); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+	}
+
+	request := func(body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		app.handleBulkOperation(recorder, httptest.NewRequest(http.MethodPost, "/api/images/bulk", strings.NewReader(body)))
+		return recorder
+	}
+	listIDs := func(query string) []int {
+		rows, err := app.db.Query(query)
+		if err != nil {
+			t.Fatalf("list images: %v", err)
+		}
+		defer rows.Close()
+		var ids []int
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				t.Fatalf("scan: %v", err)
+			}
+			ids = append(ids, id)
+		}
+		return ids
+	}
+	decode := func(recorder *httptest.ResponseRecorder) BulkOperationResponse {
+		var response BulkOperationResponse
+		if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+		return response
+	}
+
+	t.Run("Download", func(t *testing.T) {
+		recorder := request(`{"action": "download", "query": "q=fox&nsfw=all"}`)
+		if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "application/zip" {
+			t.Fatalf("Unexpected download response: %d %s", recorder.Code, recorder.Body.String())
+		}
+		archive, err := zip.NewReader(bytes.NewReader(recorder.Body.Bytes()), int64(recorder.Body.Len()))
+		if err != nil {
+			t.Fatalf("read archive: %v", err)
+		}
+		var names []string
+		for _, file := range archive.File {
+			names = append(names, file.Name)
+		}
+		if want := []string{"1.png", "2.png"}; !reflect.DeepEqual(names, want) {
+			t.Errorf("Archive entries = %v, want %v", names, want)
+		}
+
+		recorder = request(`{"action": "download", "image_ids": [3, 4]}`)
+		archive, err = zip.NewReader(bytes.NewReader(recorder.Body.Bytes()), int64(recorder.Body.Len()))
+		if err != nil {
+			t.Fatalf("read archive: %v", err)
+		}
+		if len(archive.File) != 2 || archive.File[0].Name != "4.png" || archive.File[1].Name != "skipped.txt" {
+			t.Errorf("Expected the missing file to be listed as skipped, got %d entries", len(archive.File))
+		}
+	})
+
+	t.Run("SetCategory", func(t *testing.T) {
+		response := decode(request(`{"action": "set_category", "category": "nsfw", "image_ids": [1, 4, 9]}`))
+		if !response.Success || response.Succeeded != 2 || response.Failed != 1 || response.Results[2].Error != errImageNotFound.Error() {
+			t.Fatalf("Unexpected response: %+v", response)
+		}
+		if _, err := os.Stat("images_nsfw/1.png"); err != nil {
+			t.Errorf("Expected the file to move: %v", err)
+		}
+		var isNSFW bool
+		if err := app.db.QueryRow("SELECT is_nsfw FROM images WHERE id = 1").Scan(&isNSFW); err != nil || !isNSFW {
+			t.Errorf("Expected image 1 to be NSFW, got %v (%v)", isNSFW, err)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		// The query snapshot defaults to SFW, so only images 2 and 3 match
+		response := decode(request(`{"action": "delete", "query": "sort=rating"}`))
+		if !response.Success || response.Succeeded != 2 || response.Failed != 0 {
+			t.Fatalf("Unexpected response: %+v", response)
+		}
+		if ids := listIDs("SELECT id FROM images WHERE trashed_at IS NULL ORDER BY id"); !reflect.DeepEqual(ids, []int{1, 4}) {
+			t.Errorf("Remaining images = %v, want [1 4]", ids)
+		}
+		if _, err := os.Stat("images/.trash/2-2.png"); err != nil {
+			t.Errorf("Expected the file of image 2 in the trash: %v", err)
+		}
+
+		// Trashed images are no longer part of the library
+		response = decode(request(`{"action": "set_category", "category": "nsfw", "image_ids": [2]}`))
+		if response.Failed != 1 || response.Results[0].Error != errImageNotFound.Error() {
+			t.Errorf("Expected trashed images to be skipped, got %+v", response)
+		}
+	})
+
+	t.Run("Restore", func(t *testing.T) {
+		response := decode(request(`{"action": "restore", "image_ids": [2, 1]}`))
+		if response.Succeeded != 1 || response.Failed != 1 || response.Results[1].Error != errImageNotInTrash.Error() {
+			t.Fatalf("Unexpected response: %+v", response)
+		}
+		if _, err := os.Stat("images/2.png"); err != nil {
+			t.Errorf("Expected the file of image 2 back in the library: %v", err)
+		}
+	})
+
+	t.Run("Purge", func(t *testing.T) {
+		// Image 3 is still in the trash; the query snapshot lists the trash
+		response := decode(request(`{"action": "purge", "query": "trash=1"}`))
+		if !response.Success || response.Succeeded != 1 || response.Results[0].ID != 3 {
+			t.Fatalf("Unexpected response: %+v", response)
+		}
+		if ids := listIDs("SELECT id FROM images ORDER BY id"); !reflect.DeepEqual(ids, []int{1, 2, 4}) {
+			t.Errorf("Remaining images = %v, want [1 2 4]", ids)
+		}
+		if entries, _ := filepath.Glob("images/.trash/*.deleting-*"); len(entries) != 0 {
+			t.Errorf("Expected no staged files, got %v", entries)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, body := range []string{
+			`{"action": "delete"}`,
+			`{"action": "delete", "image_ids": [1], "query": "q=x"}`,
+			`{"action": "explode", "image_ids": [1]}`,
+			`{"action": "set_category", "category": "maybe", "image_ids": [1]}`,
+			`{"action": "delete", "query": "q=nothing-matches"}`,
+			`{"action": "delete", "image_ids": [0]}`,
+		} {
+			if recorder := request(body); recorder.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected 400, got %d", body, recorder.Code)
+			}
+		}
+	})
+}
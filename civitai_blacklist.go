@@ -0,0 +1,217 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	errNotBlacklisted      = errors.New("image is not blacklisted")
+	errBlacklistedInTrash  = errors.New("image is in the trash; restore it instead")
+	errCivitaiImageMissing = errors.New("image not found on Civitai")
+)
+
+// BlacklistEntry is a deleted Civitai image that imports skip.
+type BlacklistEntry struct {
+	CivitaiImageID int    `json:"civitai_image_id"`
+	Filename       string `json:"filename"`
+	DeletedAt      string `json:"deleted_at"`
+	InTrash        bool   `json:"in_trash"`
+}
+
+type BlacklistResponse struct {
+	Success   bool             `json:"success"`
+	Entries   []BlacklistEntry `json:"entries"`
+	RemovedID int              `json:"removed_id,omitempty"`
+	Error     string           `json:"error,omitempty"`
+}
+
+type BlacklistPageData struct {
+	Title   string
+	Entries []BlacklistEntry
+}
+
+// listBlacklistedCivitaiImages returns the blacklist, latest deletion first.
+// Images still in the trash are flagged, as restoring them lifts their entry.
+func (app *App) listBlacklistedCivitaiImages() ([]BlacklistEntry, error) {
+	rows, err := app.db.Query(`
+		SELECT b.civitai_image_id, b.filename, COALESCE(b.deleted_at, ''),
+		       EXISTS(SELECT 1 FROM images i WHERE i.civitai_image_id = b.civitai_image_id AND i.trashed_at IS NOT NULL)
+		FROM deleted_civitai_images b
+		ORDER BY b.deleted_at DESC, b.civitai_image_id DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]BlacklistEntry, 0)
+	for rows.Next() {
+		var entry BlacklistEntry
+		if err := rows.Scan(&entry.CivitaiImageID, &entry.Filename, &entry.DeletedAt, &entry.InTrash); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// unblacklistCivitaiImage removes the blacklist entry of a Civitai image, so
+// the next import downloads it again. An image still in the trash keeps its
+// entry until it is restored.
+func (app *App) unblacklistCivitaiImage(civitaiID int) error {
+	var filename string
+	var inTrash bool
+	err := app.db.QueryRow(`
+		SELECT b.filename,
+		       EXISTS(SELECT 1 FROM images i WHERE i.civitai_image_id = b.civitai_image_id AND i.trashed_at IS NOT NULL)
+		FROM deleted_civitai_images b
+		WHERE b.civitai_image_id = ?
+	`, civitaiID).Scan(&filename, &inTrash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errNotBlacklisted
+		}
+		return fmt.Errorf("find blacklist entry: %w", err)
+	}
+	if inTrash {
+		return errBlacklistedInTrash
+	}
+
+	if _, err := app.db.Exec("DELETE FROM deleted_civitai_images WHERE civitai_image_id = ?", civitaiID); err != nil {
+		return fmt.Errorf("remove blacklist entry: %w", err)
+	}
+	return nil
+}
+
+// fetchCivitaiImage looks up a single image on Civitai by ID.
+func (app *App) fetchCivitaiImage(config *ImportConfig, civitaiID int) (CivitaiImage, error) {
+	params := url.Values{}
+	params.Set("imageId", strconv.Itoa(civitaiID))
+	params.Set("nsfw", "X")
+
+	images, _, err := app.fetchCivitaiImages(config, civitaiImagesEndpoint+"?"+params.Encode())
+	if err != nil {
+		return CivitaiImage{}, err
+	}
+	for _, img := range images {
+		if img.ID == civitaiID {
+			return img, nil
+		}
+	}
+	return CivitaiImage{}, errCivitaiImageMissing
+}
+
+// unblacklistAndDownload lifts the blacklist entries of the given Civitai
+// images and downloads them again, for -unblacklist. The images are indexed
+// by the next server start, like imported ones.
+func (app *App) unblacklistAndDownload(civitaiIDs []int) (int, error) {
+	config := getImportConfig()
+
+	timestampMapping, err := LoadTimestampMapping()
+	if err != nil {
+		return 0, fmt.Errorf("failed to load timestamp mapping: %v", err)
+	}
+
+	downloadedCount := 0
+	for _, civitaiID := range civitaiIDs {
+		if err := app.unblacklistCivitaiImage(civitaiID); err != nil {
+			fmt.Printf("Error: Image %d: %v\n", civitaiID, err)
+			continue
+		}
+		fmt.Printf("Removed image %d from the blacklist\n", civitaiID)
+
+		img, err := app.fetchCivitaiImage(config, civitaiID)
+		if err != nil {
+			fmt.Printf("Error: Failed to fetch image %d: %v\n", civitaiID, err)
+			continue
+		}
+		updateTimestampMapping(timestampMapping, img)
+
+		downloaded, err := app.downloadImage(img)
+		if err != nil {
+			fmt.Printf("Error: Failed to download image %d: %v\n", civitaiID, err)
+			continue
+		}
+		if downloaded {
+			downloadedCount++
+			fmt.Printf("  Downloaded image %d\n", civitaiID)
+		} else {
+			fmt.Printf("  Skipped image %d (already exists)\n", civitaiID)
+		}
+	}
+
+	if err := saveTimestampMapping(timestampMapping); err != nil {
+		fmt.Printf("Warning: Failed to save timestamp mapping: %v\n", err)
+	}
+	return downloadedCount, nil
+}
+
+func (app *App) handleListBlacklist(w http.ResponseWriter, r *http.Request) {
+	entries, err := app.listBlacklistedCivitaiImages()
+	if err != nil {
+		log.Printf("Failed to list the Civitai blacklist: %v", err)
+		writeBlacklistError(w, http.StatusInternalServerError, "Failed to list the blacklist")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(BlacklistResponse{Success: true, Entries: entries})
+}
+
+func (app *App) handleRemoveBlacklistEntry(w http.ResponseWriter, r *http.Request) {
+	civitaiID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || civitaiID <= 0 {
+		writeBlacklistError(w, http.StatusBadRequest, "Invalid Civitai image ID")
+		return
+	}
+
+	err = app.unblacklistCivitaiImage(civitaiID)
+	switch {
+	case errors.Is(err, errNotBlacklisted):
+		writeBlacklistError(w, http.StatusNotFound, "Image is not blacklisted")
+		return
+	case errors.Is(err, errBlacklistedInTrash):
+		writeBlacklistError(w, http.StatusConflict, "Image is in the trash; restore it instead")
+		return
+	case err != nil:
+		log.Printf("Failed to remove Civitai image %d from the blacklist: %v", civitaiID, err)
+		writeBlacklistError(w, http.StatusInternalServerError, "Failed to remove the blacklist entry")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(BlacklistResponse{Success: true, Entries: []BlacklistEntry{}, RemovedID: civitaiID})
+}
+
+func (app *App) handleBlacklistPage(w http.ResponseWriter, r *http.Request) {
+	entries, err := app.listBlacklistedCivitaiImages()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	data := BlacklistPageData{Title: "Civitai blacklist", Entries: entries}
+	if err := app.templates.ExecuteTemplate(w, "blacklist.html", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writeBlacklistError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(BlacklistResponse{
+		Success: false,
+		Entries: []BlacklistEntry{},
+		Error:   message,
+	})
+}
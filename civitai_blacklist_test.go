@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestCivitaiBlacklist(t *testing.T) {
+	t.Chdir(t.TempDir())
+	db := openImageDeletionTestDB(t)
+	app := &App{db: db}
+
+	if _, err := db.Exec(`
+		INSERT INTO images (id, filename, civitai_image_id, trashed_at) VALUES (2, 'renamed.png', 200, CURRENT_TIMESTAMP);
+		INSERT INTO deleted_civitai_images (civitai_image_id, filename, deleted_at) VALUES
+			(100, '100.jpg', '2024-05-01 10:00:00'),
+			(200, '200.png', '2024-05-02 10:00:00');
+	`); err != nil {
+		t.Fatalf("insert blacklist entries: %v", err)
+	}
+
+	entries, err := app.listBlacklistedCivitaiImages()
+	if err != nil {
+		t.Fatalf("list blacklist: %v", err)
+	}
+	if len(entries) != 2 || entries[0].CivitaiImageID != 200 || !entries[0].InTrash || entries[1].InTrash {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+
+	if err := app.unblacklistCivitaiImage(200); !errors.Is(err, errBlacklistedInTrash) {
+		t.Fatalf("expected an image in the trash to keep its entry, got %v", err)
+	}
+
+	remove := func(id string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodDelete, "/api/blacklist/"+id, nil)
+		request = mux.SetURLVars(request, map[string]string{"id": id})
+		recorder := httptest.NewRecorder()
+		app.handleRemoveBlacklistEntry(recorder, request)
+		return recorder
+	}
+
+	recorder := remove("100")
+	var response BlacklistResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if recorder.Code != http.StatusOK || !response.Success || response.RemovedID != 100 {
+		t.Fatalf("unexpected response %d: %s", recorder.Code, recorder.Body.String())
+	}
+	blacklisted, err := app.isCivitaiImageBlacklisted(100)
+	if err != nil || blacklisted {
+		t.Fatalf("expected image 100 to leave the blacklist, got %v (%v)", blacklisted, err)
+	}
+
+	for id, status := range map[string]int{"100": http.StatusNotFound, "200": http.StatusConflict, "x": http.StatusBadRequest} {
+		if recorder := remove(id); recorder.Code != status {
+			t.Errorf("remove %s: expected %d, got %d", id, status, recorder.Code)
+		}
+	}
+}
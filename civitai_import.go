@@ -1,7 +1,9 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -160,11 +162,8 @@ func (app *App) importFromCivitai() error {
 	fmt.Println()
 
 	// Create directories
-	if err := os.MkdirAll("images", 0755); err != nil {
-		return fmt.Errorf("failed to create images directory: %v", err)
-	}
-	if err := os.MkdirAll("images_nsfw", 0755); err != nil {
-		return fmt.Errorf("failed to create images_nsfw directory: %v", err)
+	if err := createDownloadDirs(); err != nil {
+		return err
 	}
 
 	// Load excluded words
@@ -261,7 +260,10 @@ func (app *App) importFromCivitai() error {
 	return nil
 }
 
-// fetchCivitaiImages fetches images from the Civitai API
+const civitaiImagesEndpoint = "https://civitai.com/api/v1/images"
+
+// fetchCivitaiImages fetches images from the Civitai API. nextPage is a full
+// request URL, such as the next page link of a previous response.
 func (app *App) fetchCivitaiImages(config *ImportConfig, nextPage string) ([]CivitaiImage, string, error) {
 	var requestURL string
 	if nextPage != "" {
@@ -274,7 +276,7 @@ func (app *App) fetchCivitaiImages(config *ImportConfig, nextPage string) ([]Civ
 		params.Set("nsfw", "X")
 		params.Set("period", "AllTime")
 		params.Set("limit", "100")
-		requestURL = "https://civitai.com/api/v1/images?" + params.Encode()
+		requestURL = civitaiImagesEndpoint + "?" + params.Encode()
 	}
 
 	// Create request
@@ -327,27 +329,31 @@ func (app *App) downloadImage(img CivitaiImage) (bool, error) {
 		ext = ".jpg" // Default extension
 	}
 
+	filename := fmt.Sprintf("%d%s", img.ID, ext)
+
+	// Remember Civitai's level even for files we already have, so existing
+	// images are graded by the next import
+	if err := app.recordCivitaiContentLevel(img); err != nil {
+		return false, fmt.Errorf("record content level: %v", err)
+	}
+
 	// Determine directory based on NSFW level.
 	// Civitai's `nsfw` boolean is true for anything above "None" (i.e. Soft/
-	// PG-13 too), which over-classifies. Match the historical behaviour: only
-	// the hardest "X" level goes to images_nsfw; None/Soft/Mature stay SFW.
-	dir := "images"
-	if img.NSFWLevel == "X" {
-		dir = "images_nsfw"
+	// PG-13 too), which over-classifies. The level itself decides, against
+	// NSFW_FOLDER_LEVEL (X by default, so None/Soft/Mature stay SFW).
+	level, err := parseContentLevel(img.NSFWLevel)
+	root, err := destinationRoot(err == nil && contentLevelIsNSFW(level))
+	if err != nil {
+		return false, err
 	}
 
-	filename := fmt.Sprintf("%d%s", img.ID, ext)
-	filePath := filepath.Join(dir, filename)
-
-	// Check if file already exists in either SFW or NSFW directory
-	sfwPath := filepath.Join("images", filename)
-	nsfwPath := filepath.Join("images_nsfw", filename)
+	filePath := filepath.Join(root.Path, filename)
 
-	if _, err := os.Stat(sfwPath); err == nil {
-		return false, nil // File already exists in SFW directory
-	}
-	if _, err := os.Stat(nsfwPath); err == nil {
-		return false, nil // File already exists in NSFW directory
+	// Check if the image is already in the library
+	if category, err := app.civitaiDownloadExists(img.ID, filename); err != nil {
+		return false, err
+	} else if category != "" {
+		return false, nil
 	}
 
 	// Download the image (use a client with a timeout; the default client has none)
@@ -416,11 +422,8 @@ func (app *App) checkForNewCivitaiImages() error {
 	fmt.Printf("Checking for new Civitai images for user: %s\n", config.Username)
 
 	// Create directories if they don't exist
-	if err := os.MkdirAll("images", 0755); err != nil {
-		return fmt.Errorf("failed to create images directory: %v", err)
-	}
-	if err := os.MkdirAll("images_nsfw", 0755); err != nil {
-		return fmt.Errorf("failed to create images_nsfw directory: %v", err)
+	if err := createDownloadDirs(); err != nil {
+		return err
 	}
 
 	// Load excluded words
@@ -475,17 +478,13 @@ func (app *App) checkForNewCivitaiImages() error {
 			continue
 		}
 
-		// If file exists in either directory, we've reached already-imported content
-		sfwPath := filepath.Join("images", filename)
-		nsfwPath := filepath.Join("images_nsfw", filename)
-
-		if _, err := os.Stat(sfwPath); err == nil {
-			fmt.Printf("Reached already-imported image %d (in SFW), capturing timestamps for remaining images on this page\n", img.ID)
-			foundExisting = true
-			continue
+		// If the image is in the library, we've reached already-imported content
+		category, err := app.civitaiDownloadExists(img.ID, filename)
+		if err != nil {
+			return fmt.Errorf("check library for image %d: %v", img.ID, err)
 		}
-		if _, err := os.Stat(nsfwPath); err == nil {
-			fmt.Printf("Reached already-imported image %d (in NSFW), capturing timestamps for remaining images on this page\n", img.ID)
+		if category != "" {
+			fmt.Printf("Reached already-imported image %d (in %s), capturing timestamps for remaining images on this page\n", img.ID, category)
 			foundExisting = true
 			continue
 		}
@@ -569,3 +568,49 @@ func updateTimestampMapping(mapping TimestampMapping, img CivitaiImage) {
 	filename := fmt.Sprintf("%d%s", img.ID, ext)
 	mapping[filename] = img.CreatedAt
 }
+
+// createDownloadDirs creates the library roots Civitai downloads go to.
+func createDownloadDirs() error {
+	for _, nsfw := range []bool{false, true} {
+		root, err := destinationRoot(nsfw)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(root.Path, 0755); err != nil {
+			return fmt.Errorf("failed to create %s directory: %v", root.Path, err)
+		}
+	}
+	return nil
+}
+
+// civitaiDownloadExists returns the category of a Civitai image that is
+// indexed anywhere in the library under any name, or downloaded to a download
+// root but not yet indexed, and "" when it is not found.
+func (app *App) civitaiDownloadExists(civitaiID int, filename string) (string, error) {
+	var isNSFW bool
+	err := app.db.QueryRow("SELECT is_nsfw FROM images WHERE civitai_image_id = ? LIMIT 1", civitaiID).Scan(&isNSFW)
+	if err == nil {
+		return categoryName(isNSFW), nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+
+	for _, nsfw := range []bool{false, true} {
+		root, err := destinationRoot(nsfw)
+		if err != nil {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(root.Path, filename)); err == nil {
+			return categoryName(nsfw), nil
+		}
+	}
+	return "", nil
+}
+
+func categoryName(nsfw bool) string {
+	if nsfw {
+		return "NSFW"
+	}
+	return "SFW"
+}
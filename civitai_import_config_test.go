@@ -1,6 +1,9 @@
 package main
 
-import "testing"
+import (
+	"path/filepath"
+	"testing"
+)
 
 func TestResolveImportConfigUsesFileValuesAsBaseline(t *testing.T) {
 	fileConfig := &ImportConfig{
@@ -62,3 +65,36 @@ func mapEnvironment(values map[string]string) func(string) (string, bool) {
 		return value, ok
 	}
 }
+
+func TestCivitaiDownloadExistsMatchesCivitaiImageID(t *testing.T) {
+	t.Chdir(t.TempDir())
+	app := &App{}
+	setupTestDB(t, app).Close()
+	t.Cleanup(func() { app.db.Close() })
+
+	// A renamed download, and a local file that happens to use a Civitai name
+	if _, err := app.db.Exec(`
+		INSERT INTO images (id, filename, width, height, prompt, neg_prompt, steps, cfg_scale, sampler, scheduler, seed, thumbnail_path, is_nsfw, library_root, relative_path, civitai_image_id) VALUES
+			(1, 'fox.png', 1, 1, '', '', 20, 7, '', '', 1, '', 1, 'images_nsfw', 'best/fox.png', 555),
+			(2, '777.png', 1, 1, '', '', 20, 7, '', '', 2, '', 0, 'images', 'other/777.png', NULL);
+	`); err != nil {
+		t.Fatalf("insert test images: %v", err)
+	}
+	writeDeletionTestFile(t, filepath.Join("images", "888.jpeg"))
+
+	for _, tc := range []struct {
+		civitaiID int
+		filename  string
+		want      string
+	}{
+		{555, "555.png", "NSFW"},
+		{777, "777.png", ""},
+		// Downloaded but not indexed yet
+		{888, "888.jpeg", "SFW"},
+	} {
+		category, err := app.civitaiDownloadExists(tc.civitaiID, tc.filename)
+		if err != nil || category != tc.want {
+			t.Errorf("civitaiDownloadExists(%d, %q) = %q, %v; want %q", tc.civitaiID, tc.filename, category, err, tc.want)
+		}
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+const maxCollectionNameLength = 100
+
+var (
+	errCollectionNotFound = errors.New("collection not found")
+	errInvalidCollection  = errors.New("invalid collection request")
+)
+
+type Collection struct {
+	ID         int    `json:"id"`
+	Name       string `json:"name"`
+	ImageCount int    `json:"image_count"`
+	CreatedAt  string `json:"created_at"`
+}
+
+type CollectionsResponse struct {
+	Collections []Collection `json:"collections"`
+	Error       string       `json:"error,omitempty"`
+}
+
+// CollectionRequest creates or renames a collection.
+type CollectionRequest struct {
+	Name string `json:"name"`
+}
+
+// CollectionItemsRequest lists the images to add, remove or reorder. For a
+// reorder the listed images swap into the positions they already occupy, so
+// a partially loaded grid can be reordered without knowing the rest.
+type CollectionItemsRequest struct {
+	ImageIDs []int `json:"image_ids"`
+}
+
+type CollectionResponse struct {
+	Success    bool        `json:"success"`
+	Collection *Collection `json:"collection,omitempty"`
+	Changed    int         `json:"changed"`
+	Error      string      `json:"error,omitempty"`
+}
+
+func normalizeCollectionName(name string) (string, error) {
+	name = strings.Join(strings.Fields(name), " ")
+	if name == "" || utf8.RuneCountInString(name) > maxCollectionNameLength {
+		return "", fmt.Errorf("%w: name must be 1 to %d characters", errInvalidCollection, maxCollectionNameLength)
+	}
+	return name, nil
+}
+
+// parseCollectionFilter returns the collection ID of a filter value, or 0.
+func parseCollectionFilter(filter string) int {
+	if id, err := strconv.Atoi(filter); err == nil && id > 0 {
+		return id
+	}
+	return 0
+}
+
+func collectionFilterCondition(filter string) string {
+	if id := parseCollectionFilter(filter); id > 0 {
+		return fmt.Sprintf("i.id IN (SELECT ci.image_id FROM collection_items ci WHERE ci.collection_id = %d)", id)
+	}
+	return ""
+}
+
+// collectionPositionOrder sorts images by their manual position in a collection.
+func collectionPositionOrder(filter string) string {
+	if id := parseCollectionFilter(filter); id > 0 {
+		return fmt.Sprintf("(SELECT ci.position FROM collection_items ci WHERE ci.collection_id = %d AND ci.image_id = i.id) ASC", id)
+	}
+	return ""
+}
+
+// listCollections returns every collection with its image count, by name.
+// Images in the trash are not counted.
+func (app *App) listCollections() ([]Collection, error) {
+	rows, err := app.db.Query(`
+		SELECT c.id, c.name, COUNT(i.id), COALESCE(c.created_at, '')
+		FROM collections c
+		LEFT JOIN collection_items ci ON ci.collection_id = c.id
+		LEFT JOIN images i ON i.id = ci.image_id AND i.trashed_at IS NULL
+		GROUP BY c.id, c.name, c.created_at
+		ORDER BY c.name COLLATE NOCASE ASC, c.id ASC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	collections := make([]Collection, 0)
+	for rows.Next() {
+		var collection Collection
+		if err := rows.Scan(&collection.ID, &collection.Name, &collection.ImageCount, &collection.CreatedAt); err != nil {
+			return nil, err
+		}
+		collections = append(collections, collection)
+	}
+	return collections, rows.Err()
+}
+
+func (app *App) getCollection(id int) (*Collection, error) {
+	var collection Collection
+	err := app.db.QueryRow(`
+		SELECT c.id, c.name, COALESCE(c.created_at, ''),
+		       (SELECT COUNT(*) FROM collection_items ci
+		        INNER JOIN images i ON i.id = ci.image_id AND i.trashed_at IS NULL
+		        WHERE ci.collection_id = c.id)
+		FROM collections c
+		WHERE c.id = ?
+	`, id).Scan(&collection.ID, &collection.Name, &collection.CreatedAt, &collection.ImageCount)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errCollectionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("find collection: %w", err)
+	}
+	return &collection, nil
+}
+
+func (app *App) createCollection(name string) (*Collection, error) {
+	name, err := normalizeCollectionName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := app.db.Exec("INSERT INTO collections (name) VALUES (?)", name)
+	if err != nil {
+		return nil, fmt.Errorf("create collection: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("create collection: %w", err)
+	}
+	return app.getCollection(int(id))
+}
+
+func (app *App) renameCollection(id int, name string) (*Collection, error) {
+	name, err := normalizeCollectionName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := app.db.Exec("UPDATE collections SET name = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", name, id)
+	if err != nil {
+		return nil, fmt.Errorf("rename collection: %w", err)
+	}
+	if updated, err := result.RowsAffected(); err == nil && updated == 0 {
+		return nil, errCollectionNotFound
+	}
+	return app.getCollection(id)
+}
+
+// deleteCollection removes a collection; its images stay in the library.
+func (app *App) deleteCollection(id int) error {
+	result, err := app.db.Exec("DELETE FROM collections WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("delete collection: %w", err)
+	}
+	if deleted, err := result.RowsAffected(); err == nil && deleted == 0 {
+		return errCollectionNotFound
+	}
+	return nil
+}
+
+func validateCollectionItems(req CollectionItemsRequest) error {
+	if len(req.ImageIDs) == 0 || len(req.ImageIDs) > maxBulkImageIDs {
+		return fmt.Errorf("%w: image_ids must list between 1 and %d images", errInvalidCollection, maxBulkImageIDs)
+	}
+	return nil
+}
+
+// addCollectionItems appends images to the end of a collection in the given
+// order. Images already in the collection keep their position.
+func (app *App) addCollectionItems(id int, req CollectionItemsRequest) (int, error) {
+	if err := validateCollectionItems(req); err != nil {
+		return 0, err
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("begin collection update: %w", err)
+	}
+	defer tx.Rollback()
+
+	var position int
+	err = tx.QueryRow(`
+		SELECT COALESCE((SELECT MAX(position) FROM collection_items WHERE collection_id = c.id), 0)
+		FROM collections c
+		WHERE c.id = ?
+	`, id).Scan(&position)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, errCollectionNotFound
+	}
+	if err != nil {
+		return 0, fmt.Errorf("find collection: %w", err)
+	}
+
+	stmt, err := tx.Prepare(`
+		INSERT OR IGNORE INTO collection_items (collection_id, image_id, position)
+		SELECT ?, id, ? FROM images WHERE id = ?
+	`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	changed := 0
+	for _, imageID := range req.ImageIDs {
+		result, err := stmt.Exec(id, position+1, imageID)
+		if err != nil {
+			return 0, fmt.Errorf("add image %d: %w", imageID, err)
+		}
+		if rows, err := result.RowsAffected(); err == nil && rows > 0 {
+			position++
+			changed++
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE collections SET updated_at = CURRENT_TIMESTAMP WHERE id = ?", id); err != nil {
+		return 0, fmt.Errorf("touch collection: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit collection update: %w", err)
+	}
+	return changed, nil
+}
+
+func (app *App) removeCollectionItems(id int, req CollectionItemsRequest) (int, error) {
+	if err := validateCollectionItems(req); err != nil {
+		return 0, err
+	}
+	if _, err := app.getCollection(id); err != nil {
+		return 0, err
+	}
+
+	placeholders := make([]string, len(req.ImageIDs))
+	args := []any{id}
+	for i, imageID := range req.ImageIDs {
+		placeholders[i] = "?"
+		args = append(args, imageID)
+	}
+
+	result, err := app.db.Exec(`
+		DELETE FROM collection_items
+		WHERE collection_id = ? AND image_id IN (`+strings.Join(placeholders, ",")+`)
+	`, args...)
+	if err != nil {
+		return 0, fmt.Errorf("remove collection items: %w", err)
+	}
+	removed, _ := result.RowsAffected()
+	return int(removed), nil
+}
+
+// reorderCollectionItems hands the positions held by the listed images back
+// out in the listed order. Every image must already be in the collection.
+func (app *App) reorderCollectionItems(id int, req CollectionItemsRequest) (int, error) {
+	if err := validateCollectionItems(req); err != nil {
+		return 0, err
+	}
+	if _, err := app.getCollection(id); err != nil {
+		return 0, err
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("begin reorder: %w", err)
+	}
+	defer tx.Rollback()
+
+	positions := make([]int, 0, len(req.ImageIDs))
+	seen := make(map[int]bool, len(req.ImageIDs))
+	for _, imageID := range req.ImageIDs {
+		if seen[imageID] {
+			return 0, fmt.Errorf("%w: image %d is listed twice", errInvalidCollection, imageID)
+		}
+		seen[imageID] = true
+
+		var position int
+		err := tx.QueryRow("SELECT position FROM collection_items WHERE collection_id = ? AND image_id = ?", id, imageID).Scan(&position)
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, fmt.Errorf("%w: image %d is not in the collection", errInvalidCollection, imageID)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("read position: %w", err)
+		}
+		positions = append(positions, position)
+	}
+	sort.Ints(positions)
+
+	stmt, err := tx.Prepare("UPDATE collection_items SET position = ? WHERE collection_id = ? AND image_id = ?")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	for i, imageID := range req.ImageIDs {
+		if _, err := stmt.Exec(positions[i], id, imageID); err != nil {
+			return 0, fmt.Errorf("move image %d: %w", imageID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit reorder: %w", err)
+	}
+	return len(req.ImageIDs), nil
+}
+
+func (app *App) handleListCollections(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	collections, err := app.listCollections()
+	if err != nil {
+		log.Printf("Error listing collections: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(CollectionsResponse{Collections: []Collection{}, Error: "Failed to load collections"})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(CollectionsResponse{Collections: collections})
+}
+
+func (app *App) handleCreateCollection(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req CollectionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeCollectionError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	collection, err := app.createCollection(req.Name)
+	if err != nil {
+		writeCollectionResult(w, "create collection", err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(CollectionResponse{Success: true, Collection: collection})
+}
+
+func (app *App) handleRenameCollection(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || id <= 0 {
+		writeCollectionError(w, http.StatusBadRequest, "Invalid collection ID")
+		return
+	}
+
+	var req CollectionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeCollectionError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	collection, err := app.renameCollection(id, req.Name)
+	if err != nil {
+		writeCollectionResult(w, "rename collection", err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(CollectionResponse{Success: true, Collection: collection})
+}
+
+func (app *App) handleDeleteCollection(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || id <= 0 {
+		writeCollectionError(w, http.StatusBadRequest, "Invalid collection ID")
+		return
+	}
+
+	if err := app.deleteCollection(id); err != nil {
+		writeCollectionResult(w, "delete collection", err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(CollectionResponse{Success: true})
+}
+
+func (app *App) handleAddCollectionItems(w http.ResponseWriter, r *http.Request) {
+	app.handleCollectionItems(w, r, "add images", app.addCollectionItems)
+}
+
+func (app *App) handleRemoveCollectionItems(w http.ResponseWriter, r *http.Request) {
+	app.handleCollectionItems(w, r, "remove images", app.removeCollectionItems)
+}
+
+func (app *App) handleReorderCollectionItems(w http.ResponseWriter, r *http.Request) {
+	app.handleCollectionItems(w, r, "reorder images", app.reorderCollectionItems)
+}
+
+func (app *App) handleCollectionItems(w http.ResponseWriter, r *http.Request, action string, update func(int, CollectionItemsRequest) (int, error)) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || id <= 0 {
+		writeCollectionError(w, http.StatusBadRequest, "Invalid collection ID")
+		return
+	}
+
+	var req CollectionItemsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeCollectionError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	changed, err := update(id, req)
+	if err != nil {
+		writeCollectionResult(w, action, err)
+		return
+	}
+
+	collection, err := app.getCollection(id)
+	if err != nil {
+		writeCollectionResult(w, action, err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(CollectionResponse{Success: true, Collection: collection, Changed: changed})
+}
+
+// handleCollectionPage shows the library filtered to one collection, in its
+// manual order.
+func (app *App) handleCollectionPage(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || id <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if _, err := app.getCollection(id); err != nil {
+		if errors.Is(err, errCollectionNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	query.Set("collection", strconv.Itoa(id))
+	r.URL.RawQuery = query.Encode()
+	app.handleIndex(w, r)
+}
+
+func writeCollectionResult(w http.ResponseWriter, action string, err error) {
+	switch {
+	case errors.Is(err, errInvalidCollection):
+		writeCollectionError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, errCollectionNotFound):
+		writeCollectionError(w, http.StatusNotFound, "Collection not found")
+	default:
+		log.Printf("Failed to %s: %v", action, err)
+		writeCollectionError(w, http.StatusInternalServerError, "Failed to "+action)
+	}
+}
+
+func writeCollectionError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(CollectionResponse{
+		Success: false,
+		Error:   message,
+	})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestCollections(t *testing.T) {
+	t.Chdir(t.TempDir())
+	app := &App{}
+	setupTestDB(t, app).Close()
+	t.Cleanup(func() { app.db.Close() })
+
+	if _, err := app.db.Exec(`
+		INSERT INTO images (id, filename, width, height, prompt, neg_prompt, steps, cfg_scale, sampler, scheduler, seed, thumbnail_path, is_nsfw, display_timestamp, rating) VALUES
+			(1, '1.png', 1, 1, 'one', '', 20, 7, '', '', 1, '', 0, '2024-05-04 00:00:00', 1),
+			(2, '2.png', 1, 1, 'two', '', 20, 7, '', '', 2, '', 0, '2024-05-03 00:00:00', 2),
+			(3, '3.png', 1, 1, 'three', '', 20, 7, '', '', 3, '', 0, '2024-05-02 00:00:00', 3),
+			(4, '4.png', 1, 1, 'four', '', 20, 7, '', '', 4, '', 0, '2024-05-01 00:00:00', 4);
+	`); err != nil {
+		t.Fatalf("insert test images: %v", err)
+	}
+
+	collection, err := app.createCollection("  Client   moodboard ")
+	if err != nil {
+		t.Fatalf("create collection: %v", err)
+	}
+	if collection.Name != "Client moodboard" || collection.ImageCount != 0 {
+		t.Errorf("Unexpected collection: %+v", collection)
+	}
+
+	// Image 9 does not exist and the repeated image 3 keeps its place
+	added, err := app.addCollectionItems(collection.ID, CollectionItemsRequest{ImageIDs: []int{3, 1, 9, 3, 4}})
+	if err != nil {
+		t.Fatalf("add images: %v", err)
+	}
+	if added != 3 {
+		t.Errorf("Expected 3 added images, got %d", added)
+	}
+
+	ids := func(params ImageSearchParams) []int {
+		params.Page, params.Limit = 1, 10
+		params.CollectionFilter = "1"
+		images, _, err := app.queryImages(params)
+		if err != nil {
+			t.Fatalf("queryImages: %v", err)
+		}
+		var ids []int
+		for _, img := range images {
+			ids = append(ids, img.ID)
+		}
+		return ids
+	}
+
+	if got := ids(ImageSearchParams{}); !reflect.DeepEqual(got, []int{3, 1, 4}) {
+		t.Errorf("Expected the order images were added, got %v", got)
+	}
+	if got := ids(ImageSearchParams{SortOrder: sortByRating}); !reflect.DeepEqual(got, []int{4, 3, 1}) {
+		t.Errorf("Expected a sort order to override the collection order, got %v", got)
+	}
+
+	// Reordering part of the collection only moves the listed images
+	if _, err := app.reorderCollectionItems(collection.ID, CollectionItemsRequest{ImageIDs: []int{4, 3}}); err != nil {
+		t.Fatalf("reorder: %v", err)
+	}
+	if got := ids(ImageSearchParams{}); !reflect.DeepEqual(got, []int{4, 1, 3}) {
+		t.Errorf("Unexpected order after reorder: %v", got)
+	}
+
+	if _, err := app.reorderCollectionItems(collection.ID, CollectionItemsRequest{ImageIDs: []int{2}}); !errors.Is(err, errInvalidCollection) {
+		t.Errorf("Expected reordering an image outside the collection to fail, got %v", err)
+	}
+
+	removed, err := app.removeCollectionItems(collection.ID, CollectionItemsRequest{ImageIDs: []int{1, 2}})
+	if err != nil || removed != 1 {
+		t.Errorf("Expected 1 removed image, got %d (%v)", removed, err)
+	}
+
+	// Deleting an image drops it from its collections
+	if _, err := app.db.Exec("DELETE FROM images WHERE id = 4"); err != nil {
+		t.Fatalf("delete image: %v", err)
+	}
+	collections, err := app.listCollections()
+	if err != nil {
+		t.Fatalf("list collections: %v", err)
+	}
+	if len(collections) != 1 || collections[0].ImageCount != 1 {
+		t.Errorf("Unexpected collections: %+v", collections)
+	}
+
+	t.Run("Handlers", func(t *testing.T) {
+		request := func(handler http.HandlerFunc, method, id, body string) (*httptest.ResponseRecorder, CollectionResponse) {
+			recorder := httptest.NewRecorder()
+			req := mux.SetURLVars(httptest.NewRequest(method, "/api/collections/"+id, strings.NewReader(body)), map[string]string{"id": id})
+			handler(recorder, req)
+
+			var response CollectionResponse
+			if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+				t.Fatalf("decode response: %v", err)
+			}
+			return recorder, response
+		}
+
+		recorder, response := request(app.handleRenameCollection, http.MethodPut, "1", `{"name": "Spring campaign"}`)
+		if recorder.Code != http.StatusOK || response.Collection == nil || response.Collection.Name != "Spring campaign" {
+			t.Errorf("Unexpected rename response: %d %+v", recorder.Code, response)
+		}
+
+		recorder, response = request(app.handleAddCollectionItems, http.MethodPost, "1", `{"image_ids": [2]}`)
+		if recorder.Code != http.StatusOK || response.Changed != 1 || response.Collection.ImageCount != 2 {
+			t.Errorf("Unexpected add response: %d %+v", recorder.Code, response)
+		}
+
+		for _, tc := range []struct {
+			handler http.HandlerFunc
+			id      string
+			body    string
+			code    int
+		}{
+			{app.handleRenameCollection, "1", `{"name": "  "}`, http.StatusBadRequest},
+			{app.handleRenameCollection, "7", `{"name": "x"}`, http.StatusNotFound},
+			{app.handleAddCollectionItems, "1", `{"image_ids": []}`, http.StatusBadRequest},
+			{app.handleAddCollectionItems, "7", `{"image_ids": [1]}`, http.StatusNotFound},
+			{app.handleReorderCollectionItems, "1", `{"image_ids": [3, 3]}`, http.StatusBadRequest},
+			{app.handleDeleteCollection, "abc", ``, http.StatusBadRequest},
+			{app.handleDeleteCollection, "1", ``, http.StatusOK},
+			{app.handleDeleteCollection, "1", ``, http.StatusNotFound},
+		} {
+			if recorder, _ := request(tc.handler, http.MethodPost, tc.id, tc.body); recorder.Code != tc.code {
+				t.Errorf("Collection %s %s: expected %d, got %d", tc.id, tc.body, tc.code, recorder.Code)
+			}
+		}
+
+		// The images of a deleted collection stay in the library
+		var count int
+		if err := app.db.QueryRow("SELECT COUNT(*) FROM images").Scan(&count); err != nil || count != 3 {
+			t.Errorf("Expected 3 images to remain, got %d (%v)", count, err)
+		}
+	})
+}
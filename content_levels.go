@@ -0,0 +1,390 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Content levels follow Civitai's NSFW levels, from safe to explicit.
+const (
+	contentLevelNone = iota
+	contentLevelSoft
+	contentLevelMature
+	contentLevelX
+)
+
+var contentLevelNames = []string{"none", "soft", "mature", "x"}
+
+// Where an image's content level came from. User grades are never replaced.
+const (
+	contentLevelSourceFlag    = "flag"
+	contentLevelSourceCivitai = "civitai"
+	contentLevelSourceUser    = "user"
+)
+
+const defaultNSFWFolderLevel = contentLevelX
+
+// nsfwFolderLevel is the lowest content level stored in NSFW library roots;
+// lower levels are stored in SFW roots. Set from NSFW_FOLDER_LEVEL at startup.
+var nsfwFolderLevel = defaultNSFWFolderLevel
+
+var errInvalidContentLevel = errors.New("invalid content level")
+
+// parseContentLevel accepts a level name, as used by Civitai and the level
+// filter, or its number.
+func parseContentLevel(value string) (int, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	for level, name := range contentLevelNames {
+		if value == name {
+			return level, nil
+		}
+	}
+	if level, err := strconv.Atoi(value); err == nil && level >= contentLevelNone && level <= contentLevelX {
+		return level, nil
+	}
+	return 0, fmt.Errorf("%w: %q", errInvalidContentLevel, value)
+}
+
+func contentLevelName(level int) string {
+	if level < contentLevelNone || level > contentLevelX {
+		return ""
+	}
+	return contentLevelNames[level]
+}
+
+// contentLevelIsNSFW reports whether images of a level are stored in NSFW
+// library roots.
+func contentLevelIsNSFW(level int) bool {
+	return level >= nsfwFolderLevel
+}
+
+// contentLevelForCategory keeps a level when it already belongs to the
+// category and otherwise moves it to the nearest level that does, for images
+// moved between folders by hand.
+func contentLevelForCategory(level int, toNSFW bool) int {
+	if toNSFW {
+		return max(level, nsfwFolderLevel)
+	}
+	return min(level, nsfwFolderLevel-1)
+}
+
+// nsfwFolderLevelFromEnv reads NSFW_FOLDER_LEVEL. The None level cannot be
+// NSFW, as images would then never be stored in SFW roots.
+func nsfwFolderLevelFromEnv() int {
+	value := getEnvOrDefault("NSFW_FOLDER_LEVEL", contentLevelName(defaultNSFWFolderLevel))
+	level, err := parseContentLevel(value)
+	if err != nil || level == contentLevelNone {
+		log.Printf("Warning: Invalid NSFW_FOLDER_LEVEL %q, using %s", value, contentLevelName(defaultNSFWFolderLevel))
+		return defaultNSFWFolderLevel
+	}
+	return level
+}
+
+// contentLevelsForFilter resolves the level filter of a search: "sfw" and
+// "nsfw" select the levels stored in each folder, other values are a comma
+// separated list of level names. All levels match when the filter is empty,
+// "all" or not valid.
+func contentLevelsForFilter(filter string) []int {
+	switch filter {
+	case "", "all":
+		return nil
+	case "sfw":
+		levels := make([]int, 0, len(contentLevelNames))
+		for level := contentLevelNone; level < nsfwFolderLevel; level++ {
+			levels = append(levels, level)
+		}
+		return levels
+	case "nsfw":
+		levels := make([]int, 0, len(contentLevelNames))
+		for level := nsfwFolderLevel; level <= contentLevelX; level++ {
+			levels = append(levels, level)
+		}
+		return levels
+	}
+
+	selected := make(map[int]bool)
+	for _, name := range strings.Split(filter, ",") {
+		level, err := parseContentLevel(name)
+		if err != nil {
+			return nil
+		}
+		selected[level] = true
+	}
+	levels := make([]int, 0, len(selected))
+	for level := contentLevelNone; level <= contentLevelX; level++ {
+		if selected[level] {
+			levels = append(levels, level)
+		}
+	}
+	return levels
+}
+
+func contentLevelConditionForAlias(filter, alias string) string {
+	levels := contentLevelsForFilter(filter)
+	if levels == nil || len(levels) == len(contentLevelNames) {
+		return ""
+	}
+	values := make([]string, len(levels))
+	for i, level := range levels {
+		values[i] = strconv.Itoa(level)
+	}
+	return alias + ".content_level IN (" + strings.Join(values, ", ") + ")"
+}
+
+func contentLevelCondition(filter string) string {
+	return contentLevelConditionForAlias(filter, "i")
+}
+
+// migrateContentLevelColumns adds the graded content level of images, NULL
+// until gradeContentLevels has run, and the Civitai levels of downloads.
+func (app *App) migrateContentLevelColumns() error {
+	columns := []struct{ name, definition string }{
+		{"content_level", "INTEGER"},
+		{"content_level_source", "TEXT"},
+	}
+	for _, column := range columns {
+		if err := app.addColumnIfMissing("images", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+
+	if app.columnExists("civitai_content_levels", "filename") {
+		if err := app.migrateCivitaiContentLevelKeys(); err != nil {
+			return err
+		}
+	}
+
+	_, err := app.db.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_images_content_level ON images(content_level);
+		CREATE TABLE IF NOT EXISTS civitai_content_levels (
+			civitai_image_id INTEGER PRIMARY KEY,
+			level INTEGER NOT NULL
+		);
+	`)
+	return err
+}
+
+// migrateCivitaiContentLevelKeys keys the Civitai levels recorded by filename
+// by the Civitai image ID the filename was made of, which survives renames.
+func (app *App) migrateCivitaiContentLevelKeys() error {
+	rows, err := app.db.Query("SELECT filename, level FROM civitai_content_levels")
+	if err != nil {
+		return err
+	}
+	levels := make(map[int]int)
+	for rows.Next() {
+		var filename string
+		var level int
+		if err := rows.Scan(&filename, &level); err != nil {
+			rows.Close()
+			return err
+		}
+		if civitaiID, ok := civitaiImageIDFromFilename(filename); ok {
+			levels[civitaiID] = level
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		DROP TABLE civitai_content_levels;
+		CREATE TABLE civitai_content_levels (
+			civitai_image_id INTEGER PRIMARY KEY,
+			level INTEGER NOT NULL
+		);
+	`); err != nil {
+		return err
+	}
+	for civitaiID, level := range levels {
+		if _, err := tx.Exec("INSERT INTO civitai_content_levels (civitai_image_id, level) VALUES (?, ?)", civitaiID, level); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// gradeContentLevels sets the content level of images without a user grade.
+// Civitai's level is used when known, kept within the image's folder so the
+// level filter and the folders agree; other images are graded from their
+// folder, as None or X.
+func (app *App) gradeContentLevels() error {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		UPDATE images
+		SET content_level = (
+				SELECT CASE WHEN images.is_nsfw THEN MAX(c.level, ?) ELSE MIN(c.level, ?) END
+				FROM civitai_content_levels c
+				WHERE c.civitai_image_id = images.civitai_image_id
+			),
+			content_level_source = ?
+		WHERE (content_level_source IS NULL OR content_level_source = ?)
+		  AND civitai_image_id IN (SELECT civitai_image_id FROM civitai_content_levels)
+	`, nsfwFolderLevel, nsfwFolderLevel-1, contentLevelSourceCivitai, contentLevelSourceFlag); err != nil {
+		return fmt.Errorf("grade from Civitai levels: %w", err)
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE images
+		SET content_level = CASE WHEN is_nsfw THEN ? ELSE ? END,
+			content_level_source = ?
+		WHERE content_level IS NULL
+	`, contentLevelX, contentLevelNone, contentLevelSourceFlag); err != nil {
+		return fmt.Errorf("grade from NSFW flag: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// recordCivitaiContentLevel remembers the level Civitai gives a downloaded
+// image, for gradeContentLevels.
+func (app *App) recordCivitaiContentLevel(img CivitaiImage) error {
+	level, err := parseContentLevel(img.NSFWLevel)
+	if err != nil {
+		return nil // Civitai did not grade the image
+	}
+	_, err = app.db.Exec(`
+		INSERT INTO civitai_content_levels (civitai_image_id, level) VALUES (?, ?)
+		ON CONFLICT(civitai_image_id) DO UPDATE SET level = excluded.level
+	`, img.ID, level)
+	return err
+}
+
+// setContentLevel grades an image by hand. An image whose new level belongs
+// to the other category is moved to it.
+func (app *App) setContentLevel(imageID, level int) (bool, error) {
+	file, trashed, err := app.loadImageFile(imageID)
+	if err != nil {
+		return false, err
+	}
+	if trashed {
+		return false, errImageNotFound
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	undo, err := setContentLevelTx(tx, file, level)
+	if err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		if undo != nil {
+			undo()
+		}
+		return false, fmt.Errorf("commit content level: %w", err)
+	}
+	return contentLevelIsNSFW(level), nil
+}
+
+// setContentLevelTx stores a user grade and moves the image file when the
+// grade changes the image's category. The returned function moves it back.
+func setContentLevelTx(tx *sql.Tx, file imageFile, level int) (func(), error) {
+	toNSFW := contentLevelIsNSFW(level)
+	destination := file.Location
+	if toNSFW != file.IsNSFW {
+		var err error
+		if destination, err = categoryLocation(file.Location, toNSFW); err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := tx.Exec(`
+		UPDATE images SET content_level = ?, content_level_source = ?, is_nsfw = ?, library_root = ?, relative_path = ?
+		WHERE id = ? AND is_nsfw = ?
+	`, level, contentLevelSourceUser, toNSFW, destination.Root, destination.RelativePath, file.ID, file.IsNSFW)
+	if err != nil {
+		return nil, fmt.Errorf("update content level: %w", err)
+	}
+	if updated, err := result.RowsAffected(); err == nil && updated == 0 {
+		return nil, errImageNotFound
+	}
+
+	if err := moveImageFile(file.Location, destination); err != nil {
+		return nil, err
+	}
+	if destination == file.Location {
+		return nil, nil
+	}
+	return func() {
+		if err := moveImageFile(destination, file.Location); err != nil {
+			log.Printf("Failed to move %s back: %v", file.Filename, err)
+		}
+	}, nil
+}
+
+type ContentLevelRequest struct {
+	Level string `json:"level"`
+}
+
+type ContentLevelResponse struct {
+	Success bool   `json:"success"`
+	Level   string `json:"level,omitempty"`
+	IsNSFW  bool   `json:"is_nsfw"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (app *App) handleSetContentLevel(w http.ResponseWriter, r *http.Request) {
+	imageID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || imageID <= 0 {
+		writeContentLevelError(w, http.StatusBadRequest, "Invalid image ID")
+		return
+	}
+
+	var req ContentLevelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeContentLevelError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	level, err := parseContentLevel(req.Level)
+	if err != nil {
+		writeContentLevelError(w, http.StatusBadRequest, "Level must be none, soft, mature or x")
+		return
+	}
+
+	isNSFW, err := app.setContentLevel(imageID, level)
+	switch {
+	case errors.Is(err, errImageNotFound):
+		writeContentLevelError(w, http.StatusNotFound, "Image not found")
+		return
+	case errors.Is(err, errLibraryRootReadOnly), errors.Is(err, errImageFileExists):
+		writeContentLevelError(w, http.StatusConflict, err.Error())
+		return
+	case err != nil:
+		log.Printf("Failed to set the content level of image %d: %v", imageID, err)
+		writeContentLevelError(w, http.StatusInternalServerError, "Failed to set the content level")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(ContentLevelResponse{Success: true, Level: contentLevelName(level), IsNSFW: isNSFW})
+}
+
+func writeContentLevelError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(ContentLevelResponse{Success: false, Error: message})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestContentLevelCondition(t *testing.T) {
+	tests := []struct {
+		filter    string
+		threshold int
+		want      string
+	}{
+		{"all", contentLevelX, ""},
+		{"sfw", contentLevelX, "i.content_level IN (0, 1, 2)"},
+		{"nsfw", contentLevelX, "i.content_level IN (3)"},
+		{"sfw", contentLevelMature, "i.content_level IN (0, 1)"},
+		{"nsfw", contentLevelMature, "i.content_level IN (2, 3)"},
+		{"x,Soft", contentLevelX, "i.content_level IN (1, 3)"},
+		{"none,soft,mature,x", contentLevelX, ""},
+		{"extreme", contentLevelX, ""},
+	}
+
+	t.Cleanup(func() { nsfwFolderLevel = defaultNSFWFolderLevel })
+	for _, tt := range tests {
+		nsfwFolderLevel = tt.threshold
+		if got := contentLevelCondition(tt.filter); got != tt.want {
+			t.Errorf("contentLevelCondition(%q) at %s = %q, want %q", tt.filter, contentLevelName(tt.threshold), got, tt.want)
+		}
+	}
+}
+
+func TestGradeContentLevels(t *testing.T) {
+	t.Chdir(t.TempDir())
+	app := &App{}
+	setupTestDB(t, app).Close()
+	t.Cleanup(func() { app.db.Close() })
+
+	if _, err := app.db.Exec(`
+		INSERT INTO images (id, filename, civitai_image_id, width, height, prompt, neg_prompt, steps, cfg_scale, sampler, scheduler, seed, thumbnail_path, is_nsfw) VALUES
+			(1, '1.png', 1, 1, 1, '', '', 20, 7, '', '', 1, '', 0),
+			(2, '2.png', 2, 1, 1, '', '', 20, 7, '', '', 2, '', 1),
+			(3, '3.png', 3, 1, 1, '', '', 20, 7, '', '', 3, '', 0),
+			(4, 'renamed.png', 4, 1, 1, '', '', 20, 7, '', '', 4, '', 0),
+			(5, '5.png', 5, 1, 1, '', '', 20, 7, '', '', 5, '', 1);
+		UPDATE images SET content_level = 1, content_level_source = 'user' WHERE id = 5;
+		INSERT INTO civitai_content_levels (civitai_image_id, level) VALUES
+			(3, 2),
+			(4, 3),
+			(5, 3);
+	`); err != nil {
+		t.Fatalf("insert test images: %v", err)
+	}
+	if err := app.gradeContentLevels(); err != nil {
+		t.Fatalf("grade content levels: %v", err)
+	}
+
+	// Image 4 was moved to images and renamed by hand, so Civitai's X is kept
+	// out of the NSFW levels; the user grade of image 5 is left alone
+	want := map[int]int{1: contentLevelNone, 2: contentLevelX, 3: contentLevelMature, 4: contentLevelMature, 5: contentLevelSoft}
+	for id, level := range want {
+		var got int
+		if err := app.db.QueryRow("SELECT content_level FROM images WHERE id = ?", id).Scan(&got); err != nil {
+			t.Fatalf("read level of image %d: %v", id, err)
+		}
+		if got != level {
+			t.Errorf("image %d level = %s, want %s", id, contentLevelName(got), contentLevelName(level))
+		}
+	}
+
+	// A later import refines levels graded from the folder
+	if _, err := app.db.Exec("INSERT INTO civitai_content_levels (civitai_image_id, level) VALUES (1, 1)"); err != nil {
+		t.Fatalf("insert Civitai level: %v", err)
+	}
+	if err := app.gradeContentLevels(); err != nil {
+		t.Fatalf("grade content levels again: %v", err)
+	}
+	var level int
+	var source string
+	if err := app.db.QueryRow("SELECT content_level, content_level_source FROM images WHERE id = 1").Scan(&level, &source); err != nil {
+		t.Fatalf("read level of image 1: %v", err)
+	}
+	if level != contentLevelSoft || source != contentLevelSourceCivitai {
+		t.Errorf("image 1 graded %s from %s, want soft from civitai", contentLevelName(level), source)
+	}
+}
+
+func TestMigrateCivitaiContentLevelsToImageIDs(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	legacy, err := sql.Open("sqlite3", "./images.db")
+	if err != nil {
+		t.Fatalf("open legacy database: %v", err)
+	}
+	if _, err := legacy.Exec(`
+		CREATE TABLE civitai_content_levels (filename TEXT PRIMARY KEY, level INTEGER NOT NULL);
+		INSERT INTO civitai_content_levels (filename, level) VALUES ('107670305.png', 2), ('local.png', 1);
+	`); err != nil {
+		t.Fatalf("create legacy levels: %v", err)
+	}
+	legacy.Close()
+
+	app := &App{}
+	if err := app.initDB(); err != nil {
+		t.Fatalf("init database: %v", err)
+	}
+	t.Cleanup(func() { app.db.Close() })
+
+	var civitaiID, level, count int
+	if err := app.db.QueryRow("SELECT civitai_image_id, level, (SELECT COUNT(*) FROM civitai_content_levels) FROM civitai_content_levels").Scan(&civitaiID, &level, &count); err != nil {
+		t.Fatalf("read migrated levels: %v", err)
+	}
+	if civitaiID != 107670305 || level != 2 || count != 1 {
+		t.Errorf("unexpected migrated levels: id=%d level=%d count=%d", civitaiID, level, count)
+	}
+}
+
+func TestSetContentLevelMovesFilesAcrossFolders(t *testing.T) {
+	t.Chdir(t.TempDir())
+	app := &App{}
+	setupTestDB(t, app).Close()
+	t.Cleanup(func() { app.db.Close() })
+	t.Cleanup(func() { nsfwFolderLevel = defaultNSFWFolderLevel })
+	nsfwFolderLevel = contentLevelMature
+
+	if _, err := app.db.Exec(`
+		INSERT INTO images (id, filename, width, height, prompt, neg_prompt, steps, cfg_scale, sampler, scheduler, seed, thumbnail_path, is_nsfw, content_level) VALUES
+			(1, '1.png', 1, 1, '', '', 20, 7, '', '', 1, '', 0, 0);
+	`); err != nil {
+		t.Fatalf("insert test image: %v", err)
+	}
+	writeDeletionTestFile(t, filepath.Join("images", "1.png"))
+
+	isNSFW, err := app.setContentLevel(1, contentLevelSoft)
+	if err != nil || isNSFW {
+		t.Fatalf("set soft: nsfw=%v err=%v", isNSFW, err)
+	}
+	if _, err := os.Stat(filepath.Join("images", "1.png")); err != nil {
+		t.Fatalf("expected a soft image to stay in images: %v", err)
+	}
+
+	isNSFW, err = app.setContentLevel(1, contentLevelMature)
+	if err != nil || !isNSFW {
+		t.Fatalf("set mature: nsfw=%v err=%v", isNSFW, err)
+	}
+	if _, err := os.Stat(filepath.Join("images_nsfw", "1.png")); err != nil {
+		t.Fatalf("expected a mature image in images_nsfw: %v", err)
+	}
+
+	var level int
+	var storedNSFW bool
+	var source string
+	if err := app.db.QueryRow("SELECT content_level, is_nsfw, content_level_source FROM images WHERE id = 1").Scan(&level, &storedNSFW, &source); err != nil {
+		t.Fatalf("read image: %v", err)
+	}
+	if level != contentLevelMature || !storedNSFW || source != contentLevelSourceUser {
+		t.Errorf("unexpected image state: level=%d nsfw=%v source=%s", level, storedNSFW, source)
+	}
+
+	if _, err := app.setContentLevel(9, contentLevelX); !errors.Is(err, errImageNotFound) {
+		t.Errorf("expected a missing image to be reported, got %v", err)
+	}
+}
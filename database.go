@@ -44,8 +44,8 @@ func (app *App) initDB() error {
 	// Create images table
 	createImagesTable := `
 	CREATE TABLE IF NOT EXISTS images (
-		id INTEGER PRIMARY KEY,
-		filename TEXT UNIQUE NOT NULL,
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		filename TEXT NOT NULL,
 		width INTEGER,
 		height INTEGER,
 		model_id INTEGER,
@@ -85,6 +85,95 @@ func (app *App) initDB() error {
 	CREATE INDEX IF NOT EXISTS idx_lora_name ON loras(name);
 	`
 
+	// Every key/value of an A1111 parameters line, in the order it was written,
+	// so settings without a dedicated column are not lost
+	createImageParamsTable := `
+	CREATE TABLE IF NOT EXISTS image_params (
+		image_id INTEGER NOT NULL,
+		position INTEGER NOT NULL,
+		key TEXT NOT NULL,
+		value TEXT,
+		PRIMARY KEY (image_id, key),
+		FOREIGN KEY (image_id) REFERENCES images(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_image_params_key ON image_params(key, value);
+	`
+
+	// User tags, independent of the prompt text. Names are unique regardless
+	// of case; the first spelling used is kept.
+	createTagsTables := `
+	CREATE TABLE IF NOT EXISTS tags (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE COLLATE NOCASE,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS image_tags (
+		image_id INTEGER NOT NULL,
+		tag_id INTEGER NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (image_id, tag_id),
+		FOREIGN KEY (image_id) REFERENCES images(id) ON DELETE CASCADE,
+		FOREIGN KEY (tag_id) REFERENCES tags(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_image_tags_tag_id ON image_tags(tag_id);
+	`
+
+	// Curated collections keep images in a manual order. Positions only need
+	// to sort; gaps left by removed images are harmless.
+	createCollectionsTables := `
+	CREATE TABLE IF NOT EXISTS collections (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS collection_items (
+		collection_id INTEGER NOT NULL,
+		image_id INTEGER NOT NULL,
+		position INTEGER NOT NULL,
+		added_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (collection_id, image_id),
+		FOREIGN KEY (collection_id) REFERENCES collections(id) ON DELETE CASCADE,
+		FOREIGN KEY (image_id) REFERENCES images(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_collection_items_position ON collection_items(collection_id, position);
+	CREATE INDEX IF NOT EXISTS idx_collection_items_image_id ON collection_items(image_id);
+	`
+
+	// Saved searches store the grid's URL query, see SavedSearch
+	createSavedSearchesTable := `
+	CREATE TABLE IF NOT EXISTS saved_searches (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		query TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+
+	// Hand corrections and notes are keyed by the location of the image file
+	// rather than its ID, so they survive -clear-images, re-ingestion and
+	// -fix-metadata. A NULL field keeps the parsed value.
+	createImageEditsTable := `
+	CREATE TABLE IF NOT EXISTS image_edits (
+		library_root TEXT NOT NULL,
+		relative_path TEXT NOT NULL,
+		prompt TEXT,
+		neg_prompt TEXT,
+		model TEXT,
+		sampler TEXT,
+		seed INTEGER,
+		notes TEXT NOT NULL DEFAULT '',
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (library_root, relative_path)
+	);
+	`
+
 	// Keep tombstones for deleted Civitai images so imports do not download
 	// them again after their files and active database rows are removed.
 	createDeletedCivitaiImagesTable := `
@@ -113,6 +202,31 @@ func (app *App) initDB() error {
 		return err
 	}
 
+	_, err = app.db.Exec(createImageParamsTable)
+	if err != nil {
+		return err
+	}
+
+	_, err = app.db.Exec(createTagsTables)
+	if err != nil {
+		return err
+	}
+
+	_, err = app.db.Exec(createCollectionsTables)
+	if err != nil {
+		return err
+	}
+
+	_, err = app.db.Exec(createSavedSearchesTable)
+	if err != nil {
+		return err
+	}
+
+	_, err = app.db.Exec(createImageEditsTable)
+	if err != nil {
+		return err
+	}
+
 	_, err = app.db.Exec(createDeletedCivitaiImagesTable)
 	if err != nil {
 		return err
@@ -149,6 +263,75 @@ func (app *App) initDB() error {
 		}
 	}
 
+	if err := app.migrateLocalModelColumns(); err != nil {
+		return fmt.Errorf("migrate local model columns: %v", err)
+	}
+
+	if err := app.migrateGenerationParamColumns(); err != nil {
+		return fmt.Errorf("migrate generation parameter columns: %v", err)
+	}
+
+	if err := app.migrateRatingColumns(); err != nil {
+		return fmt.Errorf("migrate rating columns: %v", err)
+	}
+
+	if err := app.migrateTrashColumns(); err != nil {
+		return fmt.Errorf("migrate trash columns: %v", err)
+	}
+
+	if err := app.migrateContentLevelColumns(); err != nil {
+		return fmt.Errorf("migrate content level columns: %v", err)
+	}
+
+	if err := app.migrateLibraryColumns(); err != nil {
+		return fmt.Errorf("migrate library columns: %v", err)
+	}
+
+	if err := migrateLegacyTrash(); err != nil {
+		log.Printf("Warning: Failed to move the trash into the library roots: %v", err)
+	}
+
+	if err := app.migrateTrashFileNames(); err != nil {
+		log.Printf("Warning: Failed to rename the files in the trash: %v", err)
+	}
+
+	if err := app.migrateFolderColumn(); err != nil {
+		return fmt.Errorf("migrate folder column: %v", err)
+	}
+
+	if err := app.migrateImageIdentityColumns(); err != nil {
+		return fmt.Errorf("migrate image identity columns: %v", err)
+	}
+
+	if err := app.migrateImageIDAutoincrement(); err != nil {
+		return fmt.Errorf("migrate image IDs: %v", err)
+	}
+
+	if err := app.migrateImageLocationKey(); err != nil {
+		return fmt.Errorf("migrate image location key: %v", err)
+	}
+
+	if err := app.migrateImageEditsLocationKey(); err != nil {
+		return fmt.Errorf("migrate image edits key: %v", err)
+	}
+
+	// Civitai levels are matched by the Civitai image ID
+	if err := app.gradeContentLevels(); err != nil {
+		return fmt.Errorf("grade content levels: %v", err)
+	}
+
+	if err := app.migratePlaceholderColumns(); err != nil {
+		return fmt.Errorf("migrate placeholder columns: %v", err)
+	}
+
+	if err := app.migratePaletteTable(); err != nil {
+		return fmt.Errorf("migrate palette table: %v", err)
+	}
+
+	if err := app.migrateMediaColumns(); err != nil {
+		return fmt.Errorf("migrate media columns: %v", err)
+	}
+
 	if err := app.sanitizeStoredImagePrompts(); err != nil {
 		log.Printf("Warning: Failed to sanitize stored prompts: %v", err)
 	}
@@ -168,6 +351,112 @@ func (app *App) columnExists(tableName, columnName string) bool {
 	return count > 0
 }
 
+// addColumnIfMissing applies an additive ALTER TABLE migration once; SQLite
+// has no ADD COLUMN IF NOT EXISTS.
+func (app *App) addColumnIfMissing(tableName, columnName, definition string) error {
+	if app.columnExists(tableName, columnName) {
+		return nil
+	}
+	_, err := app.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", tableName, columnName, definition))
+	if err != nil && !strings.Contains(err.Error(), "duplicate column name") {
+		return fmt.Errorf("add %s.%s: %w", tableName, columnName, err)
+	}
+	return nil
+}
+
+// migrateLocalModelColumns adds the hash formats and file details recorded by
+// -scan-models, so model hashes can be resolved from files on disk.
+func (app *App) migrateLocalModelColumns() error {
+	columns := []struct{ name, definition string }{
+		{"sha256", "TEXT"},
+		{"autov1", "TEXT"},
+		{"autov2", "TEXT"},
+		{"local_path", "TEXT"},
+		{"local_filename", "TEXT"},
+		{"local_file_size", "INTEGER"},
+		{"local_modified_at", "TEXT"},
+		{"local_metadata", "TEXT"},
+	}
+	for _, column := range columns {
+		if err := app.addColumnIfMissing("models", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+
+	for _, index := range []string{
+		"CREATE INDEX IF NOT EXISTS idx_model_sha256 ON models(sha256 COLLATE NOCASE)",
+		"CREATE INDEX IF NOT EXISTS idx_model_autov1 ON models(autov1 COLLATE NOCASE)",
+		"CREATE INDEX IF NOT EXISTS idx_model_autov2 ON models(autov2 COLLATE NOCASE)",
+		"CREATE INDEX IF NOT EXISTS idx_model_local_path ON models(local_path)",
+	} {
+		if _, err := app.db.Exec(index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateGenerationParamColumns adds columns for the A1111 settings that are
+// commonly filtered or displayed; the rest only live in image_params. The
+// parser name and raw text blocks keep a record of what the file contained,
+// and the XMP rating and label are kept as set by photo tools.
+func (app *App) migrateGenerationParamColumns() error {
+	columns := []struct{ name, definition string }{
+		{"clip_skip", "INTEGER"},
+		{"vae", "TEXT"},
+		{"vae_hash", "TEXT"},
+		{"denoising_strength", "REAL"},
+		{"hires_upscale", "REAL"},
+		{"hires_upscaler", "TEXT"},
+		{"hires_steps", "INTEGER"},
+		{"adetailer_model", "TEXT"},
+		{"variation_seed", "INTEGER"},
+		{"generator_version", "TEXT"},
+		{"lora_hashes", "TEXT"},
+		{"metadata_parser", "TEXT"},
+		{"raw_metadata", "TEXT"},
+		{"xmp_rating", "INTEGER"},
+		{"xmp_label", "TEXT"},
+	}
+	for _, column := range columns {
+		if err := app.addColumnIfMissing("images", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateRatingColumns adds the star rating (0 unrated, 1-5) and favorite
+// flag set in the viewer.
+func (app *App) migrateRatingColumns() error {
+	columns := []struct{ name, definition string }{
+		{"rating", "INTEGER NOT NULL DEFAULT 0"},
+		{"favorite", "INTEGER NOT NULL DEFAULT 0"},
+	}
+	for _, column := range columns {
+		if err := app.addColumnIfMissing("images", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+
+	_, err := app.db.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_images_rating ON images(rating);
+		CREATE INDEX IF NOT EXISTS idx_images_favorite ON images(favorite);
+	`)
+	return err
+}
+
+// migrateTrashColumns adds the time an image was moved to the trash; images
+// without it are in the library.
+func (app *App) migrateTrashColumns() error {
+	if err := app.addColumnIfMissing("images", "trashed_at", "DATETIME"); err != nil {
+		return err
+	}
+
+	_, err := app.db.Exec("CREATE INDEX IF NOT EXISTS idx_images_trashed_at ON images(trashed_at)")
+	return err
+}
+
 func (app *App) clearImagesTables() error {
 	// Clear loras table first (foreign key constraint)
 	_, err := app.db.Exec("DELETE FROM loras")
@@ -175,6 +464,32 @@ func (app *App) clearImagesTables() error {
 		return fmt.Errorf("failed to clear loras table: %v", err)
 	}
 
+	_, err = app.db.Exec("DELETE FROM image_params")
+	if err != nil {
+		return fmt.Errorf("failed to clear image_params table: %v", err)
+	}
+
+	_, err = app.db.Exec("DELETE FROM image_palette")
+	if err != nil {
+		return fmt.Errorf("failed to clear image_palette table: %v", err)
+	}
+
+	_, err = app.db.Exec("DELETE FROM image_tags")
+	if err != nil {
+		return fmt.Errorf("failed to clear image_tags table: %v", err)
+	}
+
+	_, err = app.db.Exec("DELETE FROM tags")
+	if err != nil {
+		return fmt.Errorf("failed to clear tags table: %v", err)
+	}
+
+	// Collections are kept, but image IDs are not stable across a rebuild
+	_, err = app.db.Exec("DELETE FROM collection_items")
+	if err != nil {
+		return fmt.Errorf("failed to clear collection_items table: %v", err)
+	}
+
 	// Clear images table
 	_, err = app.db.Exec("DELETE FROM images")
 	if err != nil {
@@ -182,7 +497,7 @@ func (app *App) clearImagesTables() error {
 	}
 
 	// Reset auto-increment sequences
-	_, err = app.db.Exec("DELETE FROM sqlite_sequence WHERE name IN ('loras')")
+	_, err = app.db.Exec("DELETE FROM sqlite_sequence WHERE name IN ('loras', 'tags')")
 	if err != nil {
 		return fmt.Errorf("failed to reset sequences: %v", err)
 	}
@@ -364,13 +679,10 @@ func (app *App) getOrCreateModel(hash string) (*Model, error) {
 	}
 
 	// First, check if model already exists in database
-	var model Model
-	err := app.db.QueryRow("SELECT id, hash, name, version_name, type, nsfw, description, base_model, created_at FROM models WHERE hash = ?", cleanHash).Scan(
-		&model.ID, &model.Hash, &model.Name, &model.VersionName, &model.Type, &model.NSFW, &model.Description, &model.BaseModel, &model.CreatedAt)
-
+	model, err := app.getModel("hash = ?", cleanHash)
 	if err == nil {
 		// Model found in database
-		return &model, nil
+		return model, nil
 	}
 
 	if err != sql.ErrNoRows {
@@ -378,6 +690,16 @@ func (app *App) getOrCreateModel(hash string) (*Model, error) {
 		return nil, fmt.Errorf("database error: %v", err)
 	}
 
+	// Files registered by -scan-models are known under every hash format,
+	// including private models Civitai has never heard of
+	localID, _, err := app.findModelByAnyHash(cleanHash)
+	if err != nil {
+		return nil, err
+	}
+	if localID != 0 {
+		return app.getModel("id = ?", localID)
+	}
+
 	// Model not found, fetch from Civitai API
 	log.Printf("Fetching model from Civitai API for hash: %s", cleanHash)
 	apiModel, err := app.fetchModelFromCivitai(cleanHash)
@@ -409,38 +731,37 @@ func (app *App) getOrCreateModel(hash string) (*Model, error) {
 	return apiModel, nil
 }
 
+func (app *App) getModel(condition string, args ...any) (*Model, error) {
+	var model Model
+	err := app.db.QueryRow(`
+		SELECT id, hash, name, version_name, type, nsfw, description, base_model, created_at,
+		       COALESCE(local_filename, '')
+		FROM models WHERE `+condition, args...).Scan(
+		&model.ID, &model.Hash, &model.Name, &model.VersionName, &model.Type, &model.NSFW, &model.Description, &model.BaseModel, &model.CreatedAt,
+		&model.LocalFilename)
+	if err != nil {
+		return nil, err
+	}
+	return &model, nil
+}
+
 func (app *App) insertImageMetadata(metadata *ImageMetadata) error {
 	metadata.Prompt = sanitizePromptForStorage(metadata.Prompt)
 	metadata.NegPrompt = sanitizePromptForStorage(metadata.NegPrompt)
 
-	// Check if ID already exists and increment if needed
-	originalID := metadata.ID
-	for {
-		var exists int
-		err := app.db.QueryRow("SELECT COUNT(*) FROM images WHERE id = ?", metadata.ID).Scan(&exists)
-		if err != nil {
-			return err
-		}
-
-		if exists == 0 {
-			break // ID is available
-		}
-
-		// ID exists, increment and try again
-		metadata.ID++
-		if metadata.ID != originalID && metadata.ID%1000 == 0 {
-			log.Printf("ID collision for %s, trying ID: %d", metadata.Filename, metadata.ID)
-		}
-	}
-
 	query := `
-	INSERT INTO images (id, filename, width, height, model_id, model_hash, prompt, neg_prompt, steps, cfg_scale, sampler, scheduler, seed, thumbnail_path, is_nsfw, display_timestamp)
-	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	INSERT INTO images (filename, civitai_image_id, content_hash, width, height, model_id, model_hash, prompt, neg_prompt, steps, cfg_scale, sampler, scheduler, seed, thumbnail_path, is_nsfw, display_timestamp,
+		clip_skip, vae, vae_hash, denoising_strength, hires_upscale, hires_upscaler, hires_steps, adetailer_model, variation_seed, generator_version, lora_hashes,
+		metadata_parser, raw_metadata, xmp_rating, xmp_label, rating, favorite, library_root, relative_path, folder, blurhash, dominant_color,
+		media_type, frame_count, duration_ms)
+	VALUES (?, NULLIF(?, 0), NULLIF(?, ''), ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''), ?, ?, ?,
+		?, NULLIF(?, 0), NULLIF(?, 0))
 	`
 
-	_, err := app.db.Exec(query,
-		metadata.ID,
+	result, err := app.db.Exec(query,
 		metadata.Filename,
+		metadata.CivitaiImageID,
+		metadata.ContentHash,
 		metadata.Width,
 		metadata.Height,
 		metadata.ModelID,
@@ -455,12 +776,44 @@ func (app *App) insertImageMetadata(metadata *ImageMetadata) error {
 		metadata.ThumbnailPath,
 		metadata.IsNSFW,
 		metadata.DisplayTimestamp,
+		metadata.ClipSkip,
+		metadata.VAE,
+		metadata.VAEHash,
+		metadata.DenoisingStrength,
+		metadata.HiresUpscale,
+		metadata.HiresUpscaler,
+		metadata.HiresSteps,
+		metadata.ADetailerModel,
+		metadata.VariationSeed,
+		metadata.GeneratorVersion,
+		metadata.LoraHashes,
+		metadata.MetadataParser,
+		metadata.RawMetadataJSON(),
+		metadata.XMPRating,
+		metadata.XMPLabel,
+		metadata.Rating,
+		metadata.Favorite,
+		metadata.LibraryRoot,
+		metadata.RelativePath,
+		imageFolder(metadata.RelativePath),
+		metadata.BlurHash,
+		metadata.DominantColor,
+		metadata.mediaType(),
+		metadata.FrameCount,
+		metadata.DurationMS,
 	)
 
 	if err != nil {
 		return err
 	}
 
+	// The ID is assigned on insert
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	metadata.ID = int(id)
+
 	// Append prompt to appropriate file
 	excludedWords := loadExcludedWords()
 	if err := appendPromptToFile(metadata.Prompt, metadata.NegPrompt, metadata.IsNSFW, excludedWords); err != nil {
@@ -476,13 +829,24 @@ type LoraData struct {
 	Weight float64
 }
 
+// dbExecutor is implemented by both *sql.DB and *sql.Tx, so record updates
+// can run inside a caller's transaction.
+type dbExecutor interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Prepare(query string) (*sql.Stmt, error)
+}
+
 func (app *App) insertLoraData(imageID int, loras []LoraData) error {
+	return insertLoraRows(app.db, imageID, loras)
+}
+
+func insertLoraRows(db dbExecutor, imageID int, loras []LoraData) error {
 	if len(loras) == 0 {
 		return nil
 	}
 
 	// Prepare statement for bulk insert
-	stmt, err := app.db.Prepare("INSERT INTO loras (image_id, name, weight) VALUES (?, ?, ?)")
+	stmt, err := db.Prepare("INSERT INTO loras (image_id, name, weight) VALUES (?, ?, ?)")
 	if err != nil {
 		return err
 	}
@@ -499,10 +863,70 @@ func (app *App) insertLoraData(imageID int, loras []LoraData) error {
 	return nil
 }
 
+// insertImageParams stores the full parameters line of an image; keys are
+// unique per image, so re-inserting replaces the previous values.
+func (app *App) insertImageParams(imageID int, params []GenerationParam) error {
+	return insertImageParamRows(app.db, imageID, params)
+}
+
+func insertImageParamRows(db dbExecutor, imageID int, params []GenerationParam) error {
+	if len(params) == 0 {
+		return nil
+	}
+
+	stmt, err := db.Prepare("INSERT OR REPLACE INTO image_params (image_id, position, key, value) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for i, param := range params {
+		if _, err := stmt.Exec(imageID, i, param.Key, param.Value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadImageParams fetches the parameters of a page of images in one query.
+func (app *App) loadImageParams(imageIDs []int) (map[int][]GenerationParam, error) {
+	params := make(map[int][]GenerationParam)
+	if len(imageIDs) == 0 {
+		return params, nil
+	}
+
+	placeholders := make([]string, len(imageIDs))
+	args := make([]interface{}, len(imageIDs))
+	for i, id := range imageIDs {
+		placeholders[i] = "?"
+		args[i] = id
+	}
+
+	rows, err := app.db.Query(fmt.Sprintf(
+		"SELECT image_id, key, COALESCE(value, '') FROM image_params WHERE image_id IN (%s) ORDER BY image_id, position",
+		strings.Join(placeholders, ","),
+	), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var imageID int
+		var param GenerationParam
+		if err := rows.Scan(&imageID, &param.Key, &param.Value); err != nil {
+			return nil, err
+		}
+		params[imageID] = append(params[imageID], param)
+	}
+	return params, rows.Err()
+}
+
 func (app *App) getModelStats(nsfwFilter string) ([]ModelStat, int, error) {
-	whereClause := ""
-	if condition := nsfwFilterCondition(nsfwFilter); condition != "" {
-		whereClause = "WHERE " + condition
+	whereClause := "WHERE i.trashed_at IS NULL"
+	if condition := contentLevelCondition(nsfwFilter); condition != "" {
+		whereClause += " AND " + condition
 	}
 
 	query := `
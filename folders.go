@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// FolderStat is a folder of the library with the number of images in it and
+// its subfolders. Folders are paths inside a library root, so folders of the
+// same name in different roots are browsed together.
+type FolderStat struct {
+	Path       string       `json:"path"`
+	Name       string       `json:"name"`
+	ImageCount int          `json:"image_count"`
+	Children   []FolderStat `json:"children,omitempty"`
+}
+
+type FolderTreeResponse struct {
+	Folders []FolderStat `json:"folders"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// FolderOption is a folder listed in the folder filter, indented by depth.
+type FolderOption struct {
+	Path       string
+	Label      string
+	ImageCount int
+}
+
+// imageFolder returns the folder of a slash-separated path inside a library
+// root, "" for its top level.
+func imageFolder(relativePath string) string {
+	folder := path.Dir(relativePath)
+	if folder == "." || folder == "/" {
+		return ""
+	}
+	return folder
+}
+
+// cleanFolderFilter normalizes a folder filter such as "2025-05-14/portraits/",
+// returning "" for the whole library.
+func cleanFolderFilter(filter string) string {
+	folder := strings.Trim(path.Clean("/"+strings.ReplaceAll(filter, `\`, "/")), "/")
+	if folder == "." {
+		return ""
+	}
+	return folder
+}
+
+// folderFilterCondition restricts results to a folder and its subfolders.
+func folderFilterCondition(filter string) (string, []any) {
+	folder := cleanFolderFilter(filter)
+	if folder == "" {
+		return "", nil
+	}
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(folder)
+	return `(i.folder = ? OR i.folder LIKE ? ESCAPE '\')`, []any{folder, escaped + "/%"}
+}
+
+// migrateFolderColumn adds the folder of images, filled from the paths of
+// images indexed before it existed.
+func (app *App) migrateFolderColumn() error {
+	if err := app.addColumnIfMissing("images", "folder", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if _, err := app.db.Exec("CREATE INDEX IF NOT EXISTS idx_images_folder ON images(folder)"); err != nil {
+		return err
+	}
+
+	rows, err := app.db.Query("SELECT id, relative_path FROM images WHERE folder = '' AND relative_path LIKE '%/%'")
+	if err != nil {
+		return err
+	}
+	folders := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var relativePath string
+		if err := rows.Scan(&id, &relativePath); err != nil {
+			rows.Close()
+			return err
+		}
+		folders[id] = imageFolder(relativePath)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, folder := range folders {
+		if _, err := app.db.Exec("UPDATE images SET folder = ? WHERE id = ?", folder, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getFolderTree counts the images of each folder, subfolders included, for the
+// current content level filter. Images at the top level of a root are only
+// counted in the library total.
+func (app *App) getFolderTree(nsfwFilter string) ([]FolderStat, error) {
+	conditions := []string{"i.trashed_at IS NULL", "i.folder != ''"}
+	if condition := contentLevelCondition(nsfwFilter); condition != "" {
+		conditions = append(conditions, condition)
+	}
+
+	rows, err := app.db.Query(`
+		SELECT i.folder, COUNT(*)
+		FROM images i
+		WHERE ` + strings.Join(conditions, " AND ") + `
+		GROUP BY i.folder
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var folder string
+		var count int
+		if err := rows.Scan(&folder, &count); err != nil {
+			return nil, err
+		}
+		// Every parent folder counts the images of its subfolders
+		for ; folder != ""; folder = imageFolder(folder) {
+			counts[folder] += count
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return folderChildren(counts, ""), nil
+}
+
+// folderChildren builds the subtree of a folder from the counts of all
+// folders, sorted by name.
+func folderChildren(counts map[string]int, parent string) []FolderStat {
+	children := make([]FolderStat, 0)
+	for folder, count := range counts {
+		if imageFolder(folder) != parent {
+			continue
+		}
+		children = append(children, FolderStat{
+			Path:       folder,
+			Name:       path.Base(folder),
+			ImageCount: count,
+			Children:   folderChildren(counts, folder),
+		})
+	}
+	sort.Slice(children, func(a, b int) bool {
+		return children[a].Name < children[b].Name
+	})
+	return children
+}
+
+// folderOptions lists a folder tree depth first for the folder filter.
+func folderOptions(folders []FolderStat, depth int) []FolderOption {
+	var options []FolderOption
+	for _, folder := range folders {
+		options = append(options, FolderOption{
+			Path:       folder.Path,
+			Label:      strings.Repeat("  ", depth) + folder.Name,
+			ImageCount: folder.ImageCount,
+		})
+		options = append(options, folderOptions(folder.Children, depth+1)...)
+	}
+	return options
+}
+
+func (app *App) handleFolderTree(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	folders, err := app.getFolderTree(r.URL.Query().Get("nsfw"))
+	if err != nil {
+		log.Printf("Error getting folder tree: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(FolderTreeResponse{Folders: []FolderStat{}, Error: "Failed to load folders"})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(FolderTreeResponse{Folders: folders})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCleanFolderFilter(t *testing.T) {
+	tests := map[string]string{
+		"":                       "",
+		"/":                      "",
+		"2025-05-14/portraits/":  "2025-05-14/portraits",
+		`2025-05-14\portraits`:   "2025-05-14/portraits",
+		"../2025-05-14/./a":      "2025-05-14/a",
+		"2025-05-14//portraits/": "2025-05-14/portraits",
+	}
+	for filter, want := range tests {
+		if got := cleanFolderFilter(filter); got != want {
+			t.Errorf("cleanFolderFilter(%q) = %q, want %q", filter, got, want)
+		}
+	}
+}
+
+func TestFolderTreeAndFilter(t *testing.T) {
+	t.Chdir(t.TempDir())
+	app := &App{}
+	setupTestDB(t, app).Close()
+	t.Cleanup(func() { app.db.Close() })
+
+	if _, err := app.db.Exec(`
+		INSERT INTO images (id, filename, width, height, prompt, neg_prompt, steps, cfg_scale, sampler, scheduler, seed, thumbnail_path, is_nsfw, library_root, relative_path, folder) VALUES
+			(1, '1.png', 1, 1, '', '', 20, 7, '', '', 1, '', 0, 'images', '1.png', ''),
+			(2, '2.png', 1, 1, '', '', 20, 7, '', '', 2, '', 0, 'images', '2025-05-14/2.png', '2025-05-14'),
+			(3, '3.png', 1, 1, '', '', 20, 7, '', '', 3, '', 0, 'images', '2025-05-14/portraits/3.png', '2025-05-14/portraits'),
+			(4, '4.png', 1, 1, '', '', 20, 7, '', '', 4, '', 1, 'images_nsfw', '2025-05-14/portraits/4.png', '2025-05-14/portraits'),
+			(5, '5.png', 1, 1, '', '', 20, 7, '', '', 5, '', 0, 'images', '2025-05-14_old/5.png', '2025-05-14_old');
+	`); err != nil {
+		t.Fatalf("insert test images: %v", err)
+	}
+	if err := app.gradeContentLevels(); err != nil {
+		t.Fatalf("grade content levels: %v", err)
+	}
+
+	folders, err := app.getFolderTree("all")
+	if err != nil {
+		t.Fatalf("get folder tree: %v", err)
+	}
+	want := []FolderStat{
+		{Path: "2025-05-14", Name: "2025-05-14", ImageCount: 3, Children: []FolderStat{
+			{Path: "2025-05-14/portraits", Name: "portraits", ImageCount: 2, Children: []FolderStat{}},
+		}},
+		{Path: "2025-05-14_old", Name: "2025-05-14_old", ImageCount: 1, Children: []FolderStat{}},
+	}
+	if !reflect.DeepEqual(folders, want) {
+		t.Errorf("getFolderTree = %+v, want %+v", folders, want)
+	}
+
+	sfwFolders, err := app.getFolderTree("sfw")
+	if err != nil {
+		t.Fatalf("get SFW folder tree: %v", err)
+	}
+	if sfwFolders[0].ImageCount != 2 || sfwFolders[0].Children[0].ImageCount != 1 {
+		t.Errorf("expected the NSFW image to be left out of the counts, got %+v", sfwFolders)
+	}
+
+	ids := func(params ImageSearchParams) []int {
+		t.Helper()
+		params.Page, params.Limit = 1, 10
+		images, _, err := app.queryImages(params)
+		if err != nil {
+			t.Fatalf("query images: %v", err)
+		}
+		var got []int
+		for _, img := range images {
+			got = append(got, img.ID)
+		}
+		return got
+	}
+	if got := ids(ImageSearchParams{FolderFilter: "2025-05-14"}); len(got) != 3 {
+		t.Errorf("expected a folder to include its subfolders but not its siblings, got %v", got)
+	}
+	if got := ids(ImageSearchParams{FolderFilter: "2025-05-14/portraits", NSFWFilter: "sfw"}); !reflect.DeepEqual(got, []int{3}) {
+		t.Errorf("expected image 3 in SFW portraits, got %v", got)
+	}
+	if got := imageSearchParamsFromQuery(map[string][]string{"folder": {"/2025-05-14/portraits/"}}); got.FolderFilter != "2025-05-14/portraits" {
+		t.Errorf("unexpected folder filter %q", got.FolderFilter)
+	}
+}
@@ -22,6 +22,7 @@ type DeleteImageResponse struct {
 	Success     bool   `json:"success"`
 	DeletedID   int    `json:"deleted_id,omitempty"`
 	Blacklisted bool   `json:"blacklisted,omitempty"`
+	Trashed     bool   `json:"trashed,omitempty"`
 	Error       string `json:"error,omitempty"`
 }
 
@@ -95,75 +96,83 @@ func removeStagedDeletionFiles(files []stagedDeletionFile) {
 	}
 }
 
-func (app *App) deleteImage(imageID int) (bool, error) {
+// isBlacklistedFile reports whether a file found in the library is a deleted
+// Civitai image, by the Civitai ID its download was named after or by its
+// content, which also finds a renamed file.
+func (app *App) isBlacklistedFile(filename, hash string) (bool, error) {
+	civitaiID, _ := civitaiImageIDFromFilename(filename)
+	var exists int
+	err := app.db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM deleted_civitai_images WHERE civitai_image_id = ? OR content_hash = ?)",
+		civitaiID, hash,
+	).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+	return exists == 1, nil
+}
+
+// blacklistCivitaiImage records a deleted Civitai image inside tx, by the
+// Civitai image ID stored with it, so imports do not download it again.
+// Images without a Civitai image ID are not recorded.
+func blacklistCivitaiImage(tx *sql.Tx, imageID int) (bool, error) {
+	var civitaiID sql.NullInt64
 	var filename string
-	err := app.db.QueryRow("SELECT filename FROM images WHERE id = ?", imageID).Scan(&filename)
+	var hash sql.NullString
+	err := tx.QueryRow("SELECT civitai_image_id, filename, content_hash FROM images WHERE id = ?", imageID).Scan(&civitaiID, &filename, &hash)
 	if errors.Is(err, sql.ErrNoRows) {
-		return false, errImageNotFound
+		return false, nil
 	}
 	if err != nil {
-		return false, fmt.Errorf("find image: %w", err)
-	}
-	if filename == "" || filepath.Base(filename) != filename {
-		return false, errors.New("image has an invalid filename")
+		return false, fmt.Errorf("find Civitai image ID: %w", err)
+	}
+	if !civitaiID.Valid {
+		return false, nil
+	}
+	_, err = tx.Exec(`
+		INSERT INTO deleted_civitai_images (civitai_image_id, filename, content_hash)
+		VALUES (?, ?, ?)
+		ON CONFLICT(civitai_image_id) DO UPDATE SET
+			filename = excluded.filename,
+			content_hash = excluded.content_hash,
+			deleted_at = CURRENT_TIMESTAMP
+	`, civitaiID.Int64, filename, hash)
+	if err != nil {
+		return false, fmt.Errorf("blacklist Civitai image: %w", err)
 	}
+	return true, nil
+}
 
-	paths := []string{
-		filepath.Join("images", filename),
-		filepath.Join("images_nsfw", filename),
-		filepath.Join("thumbnails", filename),
-	}
-	stagedFiles, err := stageFilesForDeletion(paths)
+// deleteImageRecord removes an image row inside tx, and blacklists Civitai
+// images so imports do not download them again.
+func deleteImageRecord(tx *sql.Tx, imageID int) (bool, error) {
+	blacklisted, err := blacklistCivitaiImage(tx, imageID)
 	if err != nil {
 		return false, err
 	}
 
-	tx, err := app.db.Begin()
-	if err != nil {
-		restoreStagedDeletionFiles(stagedFiles)
-		return false, fmt.Errorf("begin image deletion: %w", err)
-	}
-
-	rollback := func() {
-		_ = tx.Rollback()
-		restoreStagedDeletionFiles(stagedFiles)
-	}
-
-	civitaiID, blacklisted := civitaiImageIDFromFilename(filename)
-	if blacklisted {
-		_, err = tx.Exec(`
-			INSERT INTO deleted_civitai_images (civitai_image_id, filename)
-			VALUES (?, ?)
-			ON CONFLICT(civitai_image_id) DO UPDATE SET
-				filename = excluded.filename,
-				deleted_at = CURRENT_TIMESTAMP
-		`, civitaiID, filename)
-		if err != nil {
-			rollback()
-			return false, fmt.Errorf("blacklist Civitai image: %w", err)
-		}
+	// Hand edits are keyed by location, so they would otherwise outlive the image
+	if _, err := tx.Exec(`
+		DELETE FROM image_edits
+		WHERE EXISTS (
+			SELECT 1 FROM images i
+			WHERE i.id = ? AND i.library_root = image_edits.library_root AND i.relative_path = image_edits.relative_path
+		)
+	`, imageID); err != nil {
+		return false, fmt.Errorf("delete image edits: %w", err)
 	}
 
 	result, err := tx.Exec("DELETE FROM images WHERE id = ?", imageID)
 	if err != nil {
-		rollback()
 		return false, fmt.Errorf("delete image record: %w", err)
 	}
 	deletedRows, err := result.RowsAffected()
-	if err != nil || deletedRows != 1 {
-		rollback()
-		if err != nil {
-			return false, fmt.Errorf("verify image deletion: %w", err)
-		}
-		return false, errImageNotFound
+	if err != nil {
+		return false, fmt.Errorf("verify image deletion: %w", err)
 	}
-
-	if err := tx.Commit(); err != nil {
-		restoreStagedDeletionFiles(stagedFiles)
-		return false, fmt.Errorf("commit image deletion: %w", err)
+	if deletedRows != 1 {
+		return false, errImageNotFound
 	}
-
-	removeStagedDeletionFiles(stagedFiles)
 	return blacklisted, nil
 }
 
@@ -180,7 +189,7 @@ func (app *App) handleDeleteImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	blacklisted, err := app.deleteImage(imageID)
+	blacklisted, err := app.trashImage(imageID)
 	if errors.Is(err, errImageNotFound) {
 		w.WriteHeader(http.StatusNotFound)
 		_ = json.NewEncoder(w).Encode(DeleteImageResponse{
@@ -189,6 +198,14 @@ func (app *App) handleDeleteImage(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
+	if errors.Is(err, errLibraryRootReadOnly) {
+		w.WriteHeader(http.StatusConflict)
+		_ = json.NewEncoder(w).Encode(DeleteImageResponse{
+			Success: false,
+			Error:   "The image is in a read-only library root",
+		})
+		return
+	}
 	if err != nil {
 		log.Printf("Failed to delete image %d: %v", imageID, err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -203,5 +220,6 @@ func (app *App) handleDeleteImage(w http.ResponseWriter, r *http.Request) {
 		Success:     true,
 		DeletedID:   imageID,
 		Blacklisted: blacklisted,
+		Trashed:     true,
 	})
 }
@@ -26,7 +26,14 @@ func openImageDeletionTestDB(t *testing.T) *sql.DB {
 		PRAGMA foreign_keys = ON;
 		CREATE TABLE images (
 			id INTEGER PRIMARY KEY,
-			filename TEXT UNIQUE NOT NULL
+			filename TEXT NOT NULL,
+			civitai_image_id INTEGER,
+			content_hash TEXT,
+			is_nsfw INTEGER NOT NULL DEFAULT 0,
+			library_root TEXT,
+			relative_path TEXT,
+			thumbnail_path TEXT,
+			trashed_at DATETIME
 		);
 		CREATE TABLE loras (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -38,8 +45,14 @@ func openImageDeletionTestDB(t *testing.T) *sql.DB {
 		CREATE TABLE deleted_civitai_images (
 			civitai_image_id INTEGER PRIMARY KEY,
 			filename TEXT NOT NULL,
+			content_hash TEXT,
 			deleted_at DATETIME DEFAULT CURRENT_TIMESTAMP
 		);
+		CREATE TABLE image_edits (
+			library_root TEXT NOT NULL,
+			relative_path TEXT NOT NULL,
+			PRIMARY KEY (library_root, relative_path)
+		);
 	`); err != nil {
 		t.Fatalf("create test schema: %v", err)
 	}
@@ -57,12 +70,12 @@ func writeDeletionTestFile(t *testing.T, path string) {
 	}
 }
 
-func TestHandleDeleteImageRemovesFilesAndBlacklistsCivitaiImage(t *testing.T) {
+func TestHandleDeleteImageMovesFilesToTrashAndBlacklistsCivitaiImage(t *testing.T) {
 	t.Chdir(t.TempDir())
 	db := openImageDeletionTestDB(t)
 	app := &App{db: db}
 
-	if _, err := db.Exec("INSERT INTO images (id, filename) VALUES (123, '123.jpg')"); err != nil {
+	if _, err := db.Exec("INSERT INTO images (id, filename, civitai_image_id) VALUES (123, '123.jpg', 123)"); err != nil {
 		t.Fatalf("insert image: %v", err)
 	}
 	if _, err := db.Exec("INSERT INTO loras (image_id, name, weight) VALUES (123, 'detail', 0.8)"); err != nil {
@@ -80,17 +93,20 @@ func TestHandleDeleteImageRemovesFilesAndBlacklistsCivitaiImage(t *testing.T) {
 	if recorder.Code != http.StatusOK {
 		t.Fatalf("unexpected status %d: %s", recorder.Code, recorder.Body.String())
 	}
+	if _, err := os.Stat(filepath.Join("images", "123.jpg")); !os.IsNotExist(err) {
+		t.Fatalf("expected the image to leave the library, stat error: %v", err)
+	}
 	for _, path := range []string{
-		filepath.Join("images", "123.jpg"),
+		filepath.Join("images", libraryTrashDir, "123-123.jpg"),
 		filepath.Join("thumbnails", "123.jpg"),
 	} {
-		if _, err := os.Stat(path); !os.IsNotExist(err) {
-			t.Fatalf("expected %s to be deleted, stat error: %v", path, err)
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("expected %s to be kept: %v", path, err)
 		}
 	}
 
-	var imageCount, loraCount, blacklistCount int
-	if err := db.QueryRow("SELECT COUNT(*) FROM images WHERE id = 123").Scan(&imageCount); err != nil {
+	var trashedCount, loraCount, blacklistCount int
+	if err := db.QueryRow("SELECT COUNT(*) FROM images WHERE id = 123 AND trashed_at IS NOT NULL").Scan(&trashedCount); err != nil {
 		t.Fatalf("count images: %v", err)
 	}
 	if err := db.QueryRow("SELECT COUNT(*) FROM loras WHERE image_id = 123").Scan(&loraCount); err != nil {
@@ -99,33 +115,36 @@ func TestHandleDeleteImageRemovesFilesAndBlacklistsCivitaiImage(t *testing.T) {
 	if err := db.QueryRow("SELECT COUNT(*) FROM deleted_civitai_images WHERE civitai_image_id = 123").Scan(&blacklistCount); err != nil {
 		t.Fatalf("count blacklist entries: %v", err)
 	}
-	if imageCount != 0 || loraCount != 0 || blacklistCount != 1 {
+	if trashedCount != 1 || loraCount != 1 || blacklistCount != 1 {
 		t.Fatalf(
-			"unexpected database state: images=%d loras=%d blacklist=%d",
-			imageCount,
+			"unexpected database state: trashed=%d loras=%d blacklist=%d",
+			trashedCount,
 			loraCount,
 			blacklistCount,
 		)
 	}
 }
 
-func TestDeleteImageDoesNotBlacklistLocalFilename(t *testing.T) {
+func TestTrashImageDoesNotBlacklistLocalFilename(t *testing.T) {
 	t.Chdir(t.TempDir())
 	db := openImageDeletionTestDB(t)
 	app := &App{db: db}
 
-	if _, err := db.Exec("INSERT INTO images (id, filename) VALUES (456, 'local-image.png')"); err != nil {
+	if _, err := db.Exec("INSERT INTO images (id, filename, is_nsfw) VALUES (456, 'local-image.png', 1)"); err != nil {
 		t.Fatalf("insert image: %v", err)
 	}
 	writeDeletionTestFile(t, filepath.Join("images_nsfw", "local-image.png"))
 
-	blacklisted, err := app.deleteImage(456)
+	blacklisted, err := app.trashImage(456)
 	if err != nil {
 		t.Fatalf("delete local image: %v", err)
 	}
 	if blacklisted {
 		t.Fatal("local image should not be added to the Civitai blacklist")
 	}
+	if _, err := os.Stat(filepath.Join("images_nsfw", libraryTrashDir, "456-local-image.png")); err != nil {
+		t.Fatalf("expected the image in the NSFW trash folder: %v", err)
+	}
 
 	var count int
 	if err := db.QueryRow("SELECT COUNT(*) FROM deleted_civitai_images").Scan(&count); err != nil {
@@ -136,17 +155,17 @@ func TestDeleteImageDoesNotBlacklistLocalFilename(t *testing.T) {
 	}
 }
 
-func TestDeleteImageRestoresFilesWhenDatabaseDeletionFails(t *testing.T) {
+func TestTrashImageRestoresFilesWhenDatabaseUpdateFails(t *testing.T) {
 	t.Chdir(t.TempDir())
 	db := openImageDeletionTestDB(t)
 	app := &App{db: db}
 
 	if _, err := db.Exec(`
-		INSERT INTO images (id, filename) VALUES (789, '789.png');
-		CREATE TRIGGER reject_image_deletion
-		BEFORE DELETE ON images
+		INSERT INTO images (id, filename, civitai_image_id) VALUES (789, '789.png', 789);
+		CREATE TRIGGER reject_image_trash
+		BEFORE UPDATE OF trashed_at ON images
 		BEGIN
-			SELECT RAISE(ABORT, 'deletion rejected');
+			SELECT RAISE(ABORT, 'trash rejected');
 		END;
 	`); err != nil {
 		t.Fatalf("prepare failing deletion: %v", err)
@@ -154,22 +173,22 @@ func TestDeleteImageRestoresFilesWhenDatabaseDeletionFails(t *testing.T) {
 	imagePath := filepath.Join("images", "789.png")
 	writeDeletionTestFile(t, imagePath)
 
-	if _, err := app.deleteImage(789); err == nil {
+	if _, err := app.trashImage(789); err == nil {
 		t.Fatal("expected image deletion to fail")
 	}
 	if _, err := os.Stat(imagePath); err != nil {
 		t.Fatalf("expected original image file to be restored: %v", err)
 	}
 
-	var imageCount, blacklistCount int
-	if err := db.QueryRow("SELECT COUNT(*) FROM images WHERE id = 789").Scan(&imageCount); err != nil {
+	var trashedCount, blacklistCount int
+	if err := db.QueryRow("SELECT COUNT(*) FROM images WHERE id = 789 AND trashed_at IS NOT NULL").Scan(&trashedCount); err != nil {
 		t.Fatalf("count images: %v", err)
 	}
 	if err := db.QueryRow("SELECT COUNT(*) FROM deleted_civitai_images WHERE civitai_image_id = 789").Scan(&blacklistCount); err != nil {
 		t.Fatalf("count blacklist entries: %v", err)
 	}
-	if imageCount != 1 || blacklistCount != 0 {
-		t.Fatalf("expected rollback, got images=%d blacklist=%d", imageCount, blacklistCount)
+	if trashedCount != 0 || blacklistCount != 0 {
+		t.Fatalf("expected rollback, got trashed=%d blacklist=%d", trashedCount, blacklistCount)
 	}
 }
 
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+const maxImageNotesLength = 10000
+
+// Fields that can be corrected by hand, by image_edits column
+var imageEditFields = []string{"prompt", "neg_prompt", "model", "sampler", "seed"}
+
+var errInvalidImageEdit = errors.New("invalid image edit")
+
+// ImageEditRequest corrects parsed fields of an image or sets its notes.
+// Omitted fields are left unchanged; fields listed in Revert go back to the
+// parsed value.
+type ImageEditRequest struct {
+	Prompt    *string  `json:"prompt"`
+	NegPrompt *string  `json:"neg_prompt"`
+	Model     *string  `json:"model"`
+	Sampler   *string  `json:"sampler"`
+	Seed      *int64   `json:"seed"`
+	Notes     *string  `json:"notes"`
+	Revert    []string `json:"revert"`
+}
+
+type ImageEditResponse struct {
+	Success      bool     `json:"success"`
+	ID           int      `json:"id,omitempty"`
+	Prompt       string   `json:"prompt"`
+	NegPrompt    string   `json:"neg_prompt"`
+	Model        string   `json:"model"`
+	Sampler      string   `json:"sampler"`
+	Seed         int64    `json:"seed"`
+	Notes        string   `json:"notes"`
+	EditedFields []string `json:"edited_fields"`
+	Error        string   `json:"error,omitempty"`
+}
+
+// imageEditColumns scans the image_edits columns selected by
+// imageEditSelectColumns. NULL means the parsed value is kept.
+type imageEditColumns struct {
+	Prompt    sql.NullString
+	NegPrompt sql.NullString
+	Model     sql.NullString
+	Sampler   sql.NullString
+	Seed      sql.NullInt64
+	Notes     sql.NullString
+}
+
+// imageEditSelectColumns reads the overlay of an image joined as "e".
+const imageEditSelectColumns = "e.prompt, e.neg_prompt, e.model, e.sampler, e.seed, e.notes"
+
+func (c *imageEditColumns) scanTargets() []any {
+	return []any{&c.Prompt, &c.NegPrompt, &c.Model, &c.Sampler, &c.Seed, &c.Notes}
+}
+
+// apply replaces parsed values with hand-edited ones and records which
+// fields were edited.
+func (c *imageEditColumns) apply(img *ImageMetadata) {
+	img.EditedFields = nil
+	if c.Prompt.Valid {
+		img.Prompt = c.Prompt.String
+		img.EditedFields = append(img.EditedFields, "prompt")
+	}
+	if c.NegPrompt.Valid {
+		img.NegPrompt = c.NegPrompt.String
+		img.EditedFields = append(img.EditedFields, "neg_prompt")
+	}
+	if c.Model.Valid {
+		img.Model = c.Model.String
+		img.EditedFields = append(img.EditedFields, "model")
+	}
+	if c.Sampler.Valid {
+		img.Sampler = c.Sampler.String
+		img.EditedFields = append(img.EditedFields, "sampler")
+	}
+	if c.Seed.Valid {
+		img.Seed = c.Seed.Int64
+		img.EditedFields = append(img.EditedFields, "seed")
+	}
+	img.Notes = c.Notes.String
+}
+
+// imageEditsJoin joins the overlay of an image as "e".
+const imageEditsJoin = "LEFT JOIN image_edits e ON e.library_root = i.library_root AND e.relative_path = i.relative_path"
+
+// effectivePromptColumn is the prompt shown for an image, for searches.
+const effectivePromptColumn = "COALESCE((SELECT e.prompt FROM image_edits e WHERE e.library_root = i.library_root AND e.relative_path = i.relative_path), i.prompt)"
+
+// loadEditedImage returns the parsed values of an image with its overlay.
+func (app *App) loadEditedImage(imageID int) (ImageMetadata, error) {
+	var img ImageMetadata
+	var edits imageEditColumns
+	err := app.db.QueryRow(`
+		SELECT i.id, i.filename, COALESCE(i.prompt, ''), COALESCE(i.neg_prompt, ''),
+		       CASE
+		           WHEN m.name IS NOT NULL AND m.version_name IS NOT NULL THEN m.name || ' - ' || m.version_name
+		           WHEN m.name IS NOT NULL THEN m.name
+		           ELSE 'Unknown Model'
+		       END,
+		       COALESCE(i.sampler, ''), COALESCE(i.seed, 0), `+imageEditSelectColumns+`
+		FROM images i
+		LEFT JOIN models m ON i.model_id = m.id
+		`+imageEditsJoin+`
+		WHERE i.id = ?
+	`, imageID).Scan(append([]any{&img.ID, &img.Filename, &img.Prompt, &img.NegPrompt, &img.Model, &img.Sampler, &img.Seed}, edits.scanTargets()...)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return img, errImageNotFound
+	}
+	if err != nil {
+		return img, fmt.Errorf("load image edits: %w", err)
+	}
+	edits.apply(&img)
+	return img, nil
+}
+
+// saveImageEdits stores corrections in the image_edits overlay, keyed by the
+// location of the file so that re-ingestion and -fix-metadata keep them. A
+// value equal to the parsed one clears the edit.
+func (app *App) saveImageEdits(imageID int, req ImageEditRequest) (ImageMetadata, error) {
+	for _, field := range req.Revert {
+		if !containsString(imageEditFields, field) {
+			return ImageMetadata{}, fmt.Errorf("%w: unknown field %q", errInvalidImageEdit, field)
+		}
+	}
+	if req.Notes != nil && utf8.RuneCountInString(*req.Notes) > maxImageNotesLength {
+		return ImageMetadata{}, fmt.Errorf("%w: notes are limited to %d characters", errInvalidImageEdit, maxImageNotesLength)
+	}
+
+	// The parsed values, without the overlay
+	var parsed ImageMetadata
+	var location imageLocation
+	err := app.db.QueryRow(`
+		SELECT i.library_root, i.relative_path, COALESCE(i.prompt, ''), COALESCE(i.neg_prompt, ''),
+		       CASE
+		           WHEN m.name IS NOT NULL AND m.version_name IS NOT NULL THEN m.name || ' - ' || m.version_name
+		           WHEN m.name IS NOT NULL THEN m.name
+		           ELSE 'Unknown Model'
+		       END,
+		       COALESCE(i.sampler, ''), COALESCE(i.seed, 0)
+		FROM images i
+		LEFT JOIN models m ON i.model_id = m.id
+		WHERE i.id = ?
+	`, imageID).Scan(&location.Root, &location.RelativePath, &parsed.Prompt, &parsed.NegPrompt, &parsed.Model, &parsed.Sampler, &parsed.Seed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ImageMetadata{}, errImageNotFound
+	}
+	if err != nil {
+		return ImageMetadata{}, fmt.Errorf("load image: %w", err)
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		return ImageMetadata{}, fmt.Errorf("begin image edit: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("INSERT INTO image_edits (library_root, relative_path) VALUES (?, ?) ON CONFLICT DO NOTHING", location.Root, location.RelativePath); err != nil {
+		return ImageMetadata{}, fmt.Errorf("create image edit: %w", err)
+	}
+
+	// Column names are fixed here or checked against imageEditFields above
+	var updateErr error
+	update := func(column string, value any) {
+		if updateErr != nil {
+			return
+		}
+		if _, err := tx.Exec("UPDATE image_edits SET "+column+" = ?, updated_at = CURRENT_TIMESTAMP WHERE library_root = ? AND relative_path = ?",
+			value, location.Root, location.RelativePath); err != nil {
+			updateErr = fmt.Errorf("update %s: %w", column, err)
+		}
+	}
+	// A value equal to the parsed one is stored as NULL
+	updateText := func(column, value, parsedValue string) {
+		if value == parsedValue {
+			update(column, nil)
+		} else {
+			update(column, value)
+		}
+	}
+
+	if req.Prompt != nil {
+		updateText("prompt", sanitizePromptForStorage(*req.Prompt), parsed.Prompt)
+	}
+	if req.NegPrompt != nil {
+		updateText("neg_prompt", sanitizePromptForStorage(*req.NegPrompt), parsed.NegPrompt)
+	}
+	if req.Model != nil {
+		updateText("model", strings.TrimSpace(*req.Model), parsed.Model)
+	}
+	if req.Sampler != nil {
+		updateText("sampler", strings.TrimSpace(*req.Sampler), parsed.Sampler)
+	}
+	if req.Seed != nil {
+		if *req.Seed == parsed.Seed {
+			update("seed", nil)
+		} else {
+			update("seed", *req.Seed)
+		}
+	}
+	for _, field := range req.Revert {
+		update(field, nil)
+	}
+	if req.Notes != nil {
+		update("notes", strings.TrimSpace(*req.Notes))
+	}
+	if updateErr != nil {
+		return ImageMetadata{}, updateErr
+	}
+
+	// An overlay without edits or notes is not kept
+	if _, err := tx.Exec(`
+		DELETE FROM image_edits
+		WHERE library_root = ? AND relative_path = ? AND prompt IS NULL AND neg_prompt IS NULL AND model IS NULL
+		  AND sampler IS NULL AND seed IS NULL AND notes = ''
+	`, location.Root, location.RelativePath); err != nil {
+		return ImageMetadata{}, fmt.Errorf("remove empty image edit: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return ImageMetadata{}, fmt.Errorf("commit image edit: %w", err)
+	}
+	return app.loadEditedImage(imageID)
+}
+
+// migrateImageEditsLocationKey keys the edits recorded by filename by the
+// location of the image, since the same filename may now be found in several
+// folders. The edits of a filename go to every image of that name, which all
+// showed them until now. Edits of images that are not indexed keep their
+// filename as the path in the SFW folder, where such files used to be.
+func (app *App) migrateImageEditsLocationKey() error {
+	if !app.columnExists("image_edits", "filename") {
+		return nil
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	const (
+		editColumns         = "prompt, neg_prompt, model, sampler, seed, notes, updated_at"
+		selectedEditColumns = "e.prompt, e.neg_prompt, e.model, e.sampler, e.seed, e.notes, e.updated_at"
+	)
+	if _, err := tx.Exec(`
+		ALTER TABLE image_edits RENAME TO image_edits_by_filename;
+		CREATE TABLE image_edits (
+			library_root TEXT NOT NULL,
+			relative_path TEXT NOT NULL,
+			prompt TEXT,
+			neg_prompt TEXT,
+			model TEXT,
+			sampler TEXT,
+			seed INTEGER,
+			notes TEXT NOT NULL DEFAULT '',
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (library_root, relative_path)
+		);
+		INSERT OR IGNORE INTO image_edits (library_root, relative_path, ` + editColumns + `)
+		SELECT i.library_root, i.relative_path, ` + selectedEditColumns + `
+		FROM image_edits_by_filename e
+		JOIN images i ON i.filename = e.filename
+		WHERE i.library_root IS NOT NULL AND i.relative_path IS NOT NULL;
+		INSERT OR IGNORE INTO image_edits (library_root, relative_path, ` + editColumns + `)
+		SELECT 'images', e.filename, ` + selectedEditColumns + `
+		FROM image_edits_by_filename e
+		WHERE NOT EXISTS (SELECT 1 FROM images i WHERE i.filename = e.filename);
+		DROP TABLE image_edits_by_filename;
+	`); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Println("Image edits keyed by image location")
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (app *App) handleImageEdits(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	imageID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || imageID <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(ImageEditResponse{
+			Success: false,
+			Error:   "Invalid image ID",
+		})
+		return
+	}
+
+	var req ImageEditRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(ImageEditResponse{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+
+	img, err := app.saveImageEdits(imageID, req)
+	switch {
+	case errors.Is(err, errInvalidImageEdit):
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(ImageEditResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	case errors.Is(err, errImageNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(ImageEditResponse{
+			Success: false,
+			Error:   "Image not found",
+		})
+		return
+	case err != nil:
+		log.Printf("Failed to edit image %d: %v", imageID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(ImageEditResponse{
+			Success: false,
+			Error:   "Failed to save the changes",
+		})
+		return
+	}
+
+	editedFields := img.EditedFields
+	if editedFields == nil {
+		editedFields = []string{}
+	}
+	_ = json.NewEncoder(w).Encode(ImageEditResponse{
+		Success:      true,
+		ID:           img.ID,
+		Prompt:       img.Prompt,
+		NegPrompt:    img.NegPrompt,
+		Model:        img.Model,
+		Sampler:      img.Sampler,
+		Seed:         img.Seed,
+		Notes:        img.Notes,
+		EditedFields: editedFields,
+	})
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestImageEdits(t *testing.T) {
+	t.Chdir(t.TempDir())
+	app := &App{}
+	setupTestDB(t, app).Close()
+	t.Cleanup(func() { app.db.Close() })
+
+	if _, err := app.db.Exec(`
+		INSERT INTO models (id, hash, name, version_name) VALUES (1, 'abc123', 'Pony', 'v6');
+		INSERT INTO images (id, filename, width, height, model_id, prompt, neg_prompt, steps, cfg_scale, sampler, scheduler, seed, thumbnail_path, is_nsfw, library_root, relative_path) VALUES
+			(1, '1.png', 1, 1, 1, 'garbled {"prompt"', 'blurry', 20, 7, 'Euler', '', 11, '', 0, 'images', '1.png'),
+			(2, '2.png', 1, 1, NULL, 'grey wolf', '', 20, 7, 'DPM++ 2M', '', 22, '', 0, 'images', '2.png');
+	`); err != nil {
+		t.Fatalf("insert test images: %v", err)
+	}
+
+	prompt, model, notes := "red fox in snow", "Illustrious - v1", "  Reference for the winter set "
+	unchangedSampler := "Euler"
+	img, err := app.saveImageEdits(1, ImageEditRequest{Prompt: &prompt, Model: &model, Sampler: &unchangedSampler, Notes: &notes})
+	if err != nil {
+		t.Fatalf("save edits: %v", err)
+	}
+	if img.Prompt != prompt || img.Model != model || img.NegPrompt != "blurry" || img.Notes != "Reference for the winter set" {
+		t.Errorf("Unexpected edited image: %+v", img)
+	}
+	// A value equal to the parsed one is not an edit
+	if want := []string{"prompt", "model"}; !reflect.DeepEqual(img.EditedFields, want) {
+		t.Errorf("EditedFields = %v, want %v", img.EditedFields, want)
+	}
+
+	search := func(query string) []ImageMetadata {
+		images, _, err := app.queryImages(ImageSearchParams{PromptQuery: query, Page: 1, Limit: 10})
+		if err != nil {
+			t.Fatalf("queryImages: %v", err)
+		}
+		return images
+	}
+
+	// Searches and the grid use the corrected prompt
+	images := search("fox")
+	if len(images) != 1 || images[0].ID != 1 || images[0].Model != model || images[0].Notes == "" {
+		t.Fatalf("Unexpected search results: %+v", images)
+	}
+	if len(search("garbled")) != 0 {
+		t.Error("Expected the replaced prompt not to match")
+	}
+
+	// Re-ingestion replaces the images row, the overlay stays with the file
+	if _, err := app.db.Exec("DELETE FROM images WHERE id = 1"); err != nil {
+		t.Fatalf("delete image row: %v", err)
+	}
+	if _, err := app.db.Exec(`
+		INSERT INTO images (id, filename, width, height, prompt, neg_prompt, steps, cfg_scale, sampler, scheduler, seed, thumbnail_path, is_nsfw, library_root, relative_path)
+		VALUES (3, '1.png', 1, 1, 'garbled again', 'blurry', 20, 7, 'Euler', '', 11, '', 0, 'images', '1.png')
+	`); err != nil {
+		t.Fatalf("reinsert image: %v", err)
+	}
+	if images := search("fox"); len(images) != 1 || images[0].ID != 3 {
+		t.Errorf("Expected the edit to survive re-ingestion, got %+v", images)
+	}
+
+	written, err := app.loadImageForMetadataWrite(3)
+	if err != nil {
+		t.Fatalf("load for metadata write: %v", err)
+	}
+	if written.Prompt != prompt || written.ModelFile != model {
+		t.Errorf("Expected corrected values to be written, got prompt %q model %q", written.Prompt, written.ModelFile)
+	}
+
+	// Reverting every field and clearing the notes drops the overlay
+	empty := ""
+	img, err = app.saveImageEdits(3, ImageEditRequest{Notes: &empty, Revert: []string{"prompt", "model"}})
+	if err != nil {
+		t.Fatalf("revert edits: %v", err)
+	}
+	if img.Prompt != "garbled again" || len(img.EditedFields) != 0 {
+		t.Errorf("Unexpected reverted image: %+v", img)
+	}
+	var count int
+	if err := app.db.QueryRow("SELECT COUNT(*) FROM image_edits").Scan(&count); err != nil || count != 0 {
+		t.Errorf("Expected no overlay rows, got %d (%v)", count, err)
+	}
+
+	if _, err := app.saveImageEdits(2, ImageEditRequest{Revert: []string{"steps"}}); !errors.Is(err, errInvalidImageEdit) {
+		t.Errorf("Expected an unknown field to be rejected, got %v", err)
+	}
+
+	t.Run("Handler", func(t *testing.T) {
+		request := func(id, body string) (*httptest.ResponseRecorder, ImageEditResponse) {
+			recorder := httptest.NewRecorder()
+			req := mux.SetURLVars(httptest.NewRequest(http.MethodPut, "/api/images/"+id+"/edits", strings.NewReader(body)), map[string]string{"id": id})
+			app.handleImageEdits(recorder, req)
+
+			var response ImageEditResponse
+			if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+				t.Fatalf("decode response: %v", err)
+			}
+			return recorder, response
+		}
+
+		recorder, response := request("2", `{"seed": 42}`)
+		if recorder.Code != http.StatusOK || response.Seed != 42 || !reflect.DeepEqual(response.EditedFields, []string{"seed"}) {
+			t.Errorf("Unexpected edit response: %d %+v", recorder.Code, response)
+		}
+
+		for _, tc := range []struct {
+			id   string
+			body string
+			code int
+		}{
+			{"abc", `{}`, http.StatusBadRequest},
+			{"2", `{"seed": "x"}`, http.StatusBadRequest},
+			{"2", `{"revert": ["filename"]}`, http.StatusBadRequest},
+			{"9", `{"notes": "x"}`, http.StatusNotFound},
+		} {
+			if recorder, _ := request(tc.id, tc.body); recorder.Code != tc.code {
+				t.Errorf("Edit %s %s: expected %d, got %d", tc.id, tc.body, tc.code, recorder.Code)
+			}
+		}
+	})
+}
+
+func TestImageEditsAreKeptPerLocation(t *testing.T) {
+	t.Chdir(t.TempDir())
+	app := &App{}
+	setupTestDB(t, app).Close()
+	t.Cleanup(func() { app.db.Close() })
+
+	// ComfyUI restarts its numbering in each dated output folder
+	if _, err := app.db.Exec(`
+		INSERT INTO images (id, filename, width, height, prompt, neg_prompt, steps, cfg_scale, sampler, scheduler, seed, thumbnail_path, is_nsfw, library_root, relative_path) VALUES
+			(1, '00001_.png', 1, 1, 'red fox', '', 20, 7, 'Euler', '', 11, '', 0, 'images', '2024-05-01/00001_.png'),
+			(2, '00001_.png', 1, 1, 'grey wolf', '', 20, 7, 'Euler', '', 22, '', 0, 'images', '2024-05-02/00001_.png');
+	`); err != nil {
+		t.Fatalf("insert test images: %v", err)
+	}
+
+	prompt, notes := "arctic fox", "keeper"
+	if _, err := app.saveImageEdits(1, ImageEditRequest{Prompt: &prompt, Notes: &notes}); err != nil {
+		t.Fatalf("save edits: %v", err)
+	}
+	other, err := app.loadEditedImage(2)
+	if err != nil {
+		t.Fatalf("load other image: %v", err)
+	}
+	if other.Prompt != "grey wolf" || other.Notes != "" || len(other.EditedFields) != 0 {
+		t.Errorf("Expected the image of the same name to keep its own values, got %+v", other)
+	}
+
+	// Deleting the other image leaves the edits of the first one
+	tx, err := app.db.Begin()
+	if err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	if _, err := deleteImageRecord(tx, 2); err != nil {
+		t.Fatalf("delete image: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	edited, err := app.loadEditedImage(1)
+	if err != nil {
+		t.Fatalf("load edited image: %v", err)
+	}
+	if edited.Prompt != prompt || edited.Notes != notes {
+		t.Errorf("Expected the edits to survive deleting another image of the same name, got %+v", edited)
+	}
+}
+
+func TestMigrateImageEditsToLocations(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	legacy, err := sql.Open("sqlite3", "./images.db")
+	if err != nil {
+		t.Fatalf("open legacy database: %v", err)
+	}
+	if _, err := legacy.Exec(`
+		CREATE TABLE images (
+			id INTEGER PRIMARY KEY,
+			filename TEXT UNIQUE NOT NULL,
+			width INTEGER,
+			height INTEGER,
+			model_id INTEGER,
+			model_hash TEXT,
+			prompt TEXT,
+			neg_prompt TEXT,
+			steps INTEGER,
+			cfg_scale REAL,
+			sampler TEXT,
+			scheduler TEXT,
+			seed INTEGER,
+			thumbnail_path TEXT,
+			is_nsfw BOOLEAN DEFAULT FALSE,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		INSERT INTO images (id, filename, prompt, is_nsfw) VALUES (1, 'fox.png', 'fox', 0), (2, 'wolf.png', 'wolf', 1);
+		CREATE TABLE image_edits (
+			filename TEXT PRIMARY KEY,
+			prompt TEXT, neg_prompt TEXT, model TEXT, sampler TEXT, seed INTEGER,
+			notes TEXT NOT NULL DEFAULT '',
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		INSERT INTO image_edits (filename, prompt, notes) VALUES
+			('fox.png', 'arctic fox', ''), ('wolf.png', NULL, 'pack'), ('gone.png', NULL, 'orphan');
+	`); err != nil {
+		t.Fatalf("create legacy tables: %v", err)
+	}
+	legacy.Close()
+
+	app := &App{}
+	if err := app.initDB(); err != nil {
+		t.Fatalf("init database: %v", err)
+	}
+	t.Cleanup(func() { app.db.Close() })
+
+	rows, err := app.db.Query("SELECT library_root, relative_path, COALESCE(prompt, ''), notes FROM image_edits ORDER BY relative_path")
+	if err != nil {
+		t.Fatalf("read migrated edits: %v", err)
+	}
+	defer rows.Close()
+	var got []string
+	for rows.Next() {
+		var root, relativePath, prompt, notes string
+		if err := rows.Scan(&root, &relativePath, &prompt, &notes); err != nil {
+			t.Fatalf("scan migrated edit: %v", err)
+		}
+		got = append(got, root+"/"+relativePath+":"+prompt+":"+notes)
+	}
+	want := []string{"images/fox.png:arctic fox:", "images/gone.png::orphan", "images_nsfw/wolf.png::pack"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("migrated edits = %v, want %v", got, want)
+	}
+
+	img, err := app.loadEditedImage(1)
+	if err != nil || img.Prompt != "arctic fox" {
+		t.Errorf("Expected the migrated edit to apply, got %+v (%v)", img, err)
+	}
+}
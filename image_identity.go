@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// Images are identified by an internal ID assigned on insert, which never
+// changes with the file name. Civitai downloads also record the Civitai image
+// ID, and every image the SHA-256 of its file, which finds renamed files.
+
+// contentHash returns the SHA-256 of a file's bytes, as hex.
+func contentHash(r io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func fileContentHash(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	return contentHash(file)
+}
+
+// migrateImageIdentityColumns adds the Civitai image ID and content hash of
+// images, and the content hash of blacklisted Civitai images so a renamed
+// file is still skipped. The Civitai ID of existing images comes from their
+// filename, as the image ID used to.
+func (app *App) migrateImageIdentityColumns() error {
+	columns := []struct{ name, definition string }{
+		{"civitai_image_id", "INTEGER"},
+		{"content_hash", "TEXT"},
+	}
+	for _, column := range columns {
+		if err := app.addColumnIfMissing("images", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+	if err := app.addColumnIfMissing("deleted_civitai_images", "content_hash", "TEXT"); err != nil {
+		return err
+	}
+
+	if _, err := app.db.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_images_civitai_image_id ON images(civitai_image_id);
+		CREATE INDEX IF NOT EXISTS idx_images_content_hash ON images(content_hash);
+		CREATE INDEX IF NOT EXISTS idx_deleted_civitai_images_content_hash ON deleted_civitai_images(content_hash);
+	`); err != nil {
+		return err
+	}
+
+	rows, err := app.db.Query("SELECT id, filename FROM images WHERE civitai_image_id IS NULL")
+	if err != nil {
+		return err
+	}
+	civitaiIDs := make(map[int]int)
+	for rows.Next() {
+		var id int
+		var filename string
+		if err := rows.Scan(&id, &filename); err != nil {
+			rows.Close()
+			return err
+		}
+		if civitaiID, ok := civitaiImageIDFromFilename(filename); ok {
+			civitaiIDs[id] = civitaiID
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, civitaiID := range civitaiIDs {
+		if _, err := app.db.Exec("UPDATE images SET civitai_image_id = ? WHERE id = ?", civitaiID, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateImageIDAutoincrement rebuilds an images table created before IDs
+// were assigned on insert, so that the ID of a purged image is never handed
+// out again. Existing IDs are kept, so links to images keep working.
+func (app *App) migrateImageIDAutoincrement() error {
+	return app.rebuildImagesTable("autoincrement IDs", func(tableSQL string) (string, error) {
+		if strings.Contains(strings.ToUpper(tableSQL), "AUTOINCREMENT") {
+			return "", nil
+		}
+		const primaryKey = "id INTEGER PRIMARY KEY,"
+		if !strings.Contains(tableSQL, primaryKey) {
+			return "", fmt.Errorf("unexpected images table definition: %s", tableSQL)
+		}
+		return strings.Replace(tableSQL, primaryKey, "id INTEGER PRIMARY KEY AUTOINCREMENT,", 1), nil
+	})
+}
+
+// migrateImageLocationKey rebuilds an images table with unique filenames.
+// Images are keyed by their location, so files of the same name in different
+// folders, such as ComfyUI's dated output folders, are different images.
+func (app *App) migrateImageLocationKey() error {
+	err := app.rebuildImagesTable("filenames that are not unique", func(tableSQL string) (string, error) {
+		const uniqueFilename = "filename TEXT UNIQUE NOT NULL,"
+		if !strings.Contains(tableSQL, uniqueFilename) {
+			return "", nil
+		}
+		return strings.Replace(tableSQL, uniqueFilename, "filename TEXT NOT NULL,", 1), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = app.db.Exec("CREATE INDEX IF NOT EXISTS idx_images_filename ON images(filename)")
+	return err
+}
+
+// rebuildImagesTable recreates the images table from the definition returned
+// by rewrite, keeping its rows, indexes and triggers. An empty definition
+// leaves the table as it is.
+func (app *App) rebuildImagesTable(change string, rewrite func(tableSQL string) (string, error)) error {
+	var tableSQL string
+	if err := app.db.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'images'").Scan(&tableSQL); err != nil {
+		return err
+	}
+	rebuiltSQL, err := rewrite(tableSQL)
+	if err != nil || rebuiltSQL == "" {
+		return err
+	}
+
+	// A table that was rebuilt before has its name quoted
+	var columns string
+	for _, tablePrefix := range []string{"CREATE TABLE images", `CREATE TABLE "images"`} {
+		if strings.HasPrefix(rebuiltSQL, tablePrefix) {
+			columns = strings.TrimPrefix(rebuiltSQL, tablePrefix)
+		}
+	}
+	if columns == "" {
+		return fmt.Errorf("unexpected images table definition: %s", tableSQL)
+	}
+	rebuiltSQL = "CREATE TABLE images_rebuilt" + columns
+
+	ctx := context.Background()
+	conn, err := app.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Dropping the old table must not cascade to the LoRAs, tags and
+	// collections of its images
+	if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "PRAGMA foreign_keys = ON")
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Indexes are dropped with the table and created again afterwards
+	rows, err := tx.Query("SELECT sql FROM sqlite_master WHERE tbl_name = 'images' AND type IN ('index', 'trigger') AND sql IS NOT NULL")
+	if err != nil {
+		return err
+	}
+	var schemaSQL []string
+	for rows.Next() {
+		var statement string
+		if err := rows.Scan(&statement); err != nil {
+			rows.Close()
+			return err
+		}
+		schemaSQL = append(schemaSQL, statement)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	statements := append([]string{
+		rebuiltSQL,
+		"INSERT INTO images_rebuilt SELECT * FROM images",
+		"DROP TABLE images",
+		"ALTER TABLE images_rebuilt RENAME TO images",
+	}, schemaSQL...)
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return fmt.Errorf("rebuild images table: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("Images table rebuilt with %s", change)
+	return nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"database/sql"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrateImageIDsKeepsExistingIDs(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	// An images table from before autoincrement IDs, with IDs taken from
+	// filenames
+	legacy, err := sql.Open("sqlite3", "./images.db")
+	if err != nil {
+		t.Fatalf("open legacy database: %v", err)
+	}
+	if _, err := legacy.Exec(`
+		CREATE TABLE images (
+			id INTEGER PRIMARY KEY,
+			filename TEXT UNIQUE NOT NULL,
+			width INTEGER,
+			height INTEGER,
+			model_id INTEGER,
+			model_hash TEXT,
+			prompt TEXT,
+			neg_prompt TEXT,
+			steps INTEGER,
+			cfg_scale REAL,
+			sampler TEXT,
+			scheduler TEXT,
+			seed INTEGER,
+			thumbnail_path TEXT,
+			is_nsfw BOOLEAN DEFAULT FALSE,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX idx_nsfw ON images(is_nsfw);
+		CREATE TABLE loras (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			image_id INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			weight REAL NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (image_id) REFERENCES images(id) ON DELETE CASCADE
+		);
+		INSERT INTO images (id, filename, prompt, neg_prompt, is_nsfw) VALUES
+			(107670305, '107670305.png', 'fox', '', 0),
+			(1000012345, '00042_.png', 'owl', '', 0);
+		INSERT INTO loras (image_id, name, weight) VALUES (107670305, 'detail', 0.8);
+	`); err != nil {
+		t.Fatalf("create legacy database: %v", err)
+	}
+	legacy.Close()
+
+	app := &App{}
+	if err := app.initDB(); err != nil {
+		t.Fatalf("init database: %v", err)
+	}
+	t.Cleanup(func() { app.db.Close() })
+
+	var tableSQL string
+	if err := app.db.QueryRow("SELECT sql FROM sqlite_master WHERE name = 'images'").Scan(&tableSQL); err != nil {
+		t.Fatalf("read images table: %v", err)
+	}
+	if !strings.Contains(tableSQL, "AUTOINCREMENT") {
+		t.Errorf("expected autoincrement IDs, got %s", tableSQL)
+	}
+	if strings.Contains(tableSQL, "UNIQUE") {
+		t.Errorf("expected filenames that are not unique, got %s", tableSQL)
+	}
+
+	// Images from before library roots get their location in the original
+	// layout
+	var root, relativePath string
+	if err := app.db.QueryRow("SELECT library_root, relative_path FROM images WHERE id = 107670305").Scan(&root, &relativePath); err != nil {
+		t.Fatalf("read migrated location: %v", err)
+	}
+	if root != "images" || relativePath != "107670305.png" {
+		t.Errorf("unexpected migrated location %s/%s", root, relativePath)
+	}
+
+	var civitaiID sql.NullInt64
+	if err := app.db.QueryRow("SELECT civitai_image_id FROM images WHERE id = 107670305").Scan(&civitaiID); err != nil {
+		t.Fatalf("read migrated Civitai image: %v", err)
+	}
+	if civitaiID.Int64 != 107670305 {
+		t.Errorf("expected the Civitai ID from the filename, got %v", civitaiID)
+	}
+	if err := app.db.QueryRow("SELECT civitai_image_id FROM images WHERE id = 1000012345").Scan(&civitaiID); err != nil {
+		t.Fatalf("read migrated local image: %v", err)
+	}
+	if civitaiID.Valid {
+		t.Errorf("expected no Civitai ID for a local image, got %d", civitaiID.Int64)
+	}
+
+	var loraCount int
+	if err := app.db.QueryRow("SELECT COUNT(*) FROM loras WHERE image_id = 107670305").Scan(&loraCount); err != nil || loraCount != 1 {
+		t.Errorf("expected the LoRAs to survive the rebuild, got %d (%v)", loraCount, err)
+	}
+
+	// A purged ID is not handed out again
+	if _, err := app.db.Exec("DELETE FROM images WHERE id = 1000012345"); err != nil {
+		t.Fatalf("delete image: %v", err)
+	}
+	metadata := &ImageMetadata{Filename: "new.png", LibraryRoot: "images", RelativePath: "new.png"}
+	if err := app.insertImageMetadata(metadata); err != nil {
+		t.Fatalf("insert image: %v", err)
+	}
+	if metadata.ID <= 1000012345 {
+		t.Errorf("expected a new ID above every ID used, got %d", metadata.ID)
+	}
+}
+
+func writeTestPNG(t *testing.T, path string, width int) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("create test directory: %v", err)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("create test image: %v", err)
+	}
+	defer file.Close()
+	if err := png.Encode(file, image.NewGray(image.Rect(0, 0, width, 1))); err != nil {
+		t.Fatalf("encode test image: %v", err)
+	}
+}
+
+func TestProcessImagesKeepsIDOfRenamedFile(t *testing.T) {
+	t.Chdir(t.TempDir())
+	app := &App{}
+	setupTestDB(t, app).Close()
+	t.Cleanup(func() { app.db.Close() })
+
+	writeTestPNG(t, filepath.Join("images", "00042_.png"), 2)
+	writeTestPNG(t, filepath.Join("images", "00043_.png"), 3)
+	if err := app.processImages(); err != nil {
+		t.Fatalf("process images: %v", err)
+	}
+
+	var id int
+	var hash string
+	if err := app.db.QueryRow("SELECT id, content_hash FROM images WHERE filename = '00042_.png'").Scan(&id, &hash); err != nil {
+		t.Fatalf("read image: %v", err)
+	}
+	if want, err := fileContentHash(filepath.Join("images", "00042_.png")); err != nil || hash != want {
+		t.Errorf("expected the SHA-256 of the file %q, got %q (%v)", want, hash, err)
+	}
+	if _, err := app.db.Exec("INSERT INTO image_edits (library_root, relative_path, notes) VALUES ('images', '00042_.png', 'keeper'), ('images', 'best/fox.png', 'stale')"); err != nil {
+		t.Fatalf("insert edit: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Join("images", "best"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join("images", "00042_.png"), filepath.Join("images", "best", "fox.png")); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.processImages(); err != nil {
+		t.Fatalf("process images again: %v", err)
+	}
+
+	var count int
+	if err := app.db.QueryRow("SELECT COUNT(*) FROM images").Scan(&count); err != nil || count != 2 {
+		t.Fatalf("expected the renamed file to keep its row, got %d images (%v)", count, err)
+	}
+	var filename, relativePath, notes string
+	if err := app.db.QueryRow(`
+		SELECT i.filename, i.relative_path, COALESCE(e.notes, '')
+		FROM images i `+imageEditsJoin+`
+		WHERE i.id = ?
+	`, id).Scan(&filename, &relativePath, &notes); err != nil {
+		t.Fatalf("read renamed image: %v", err)
+	}
+	if filename != "fox.png" || relativePath != "best/fox.png" || notes != "keeper" {
+		t.Errorf("unexpected renamed image: filename=%s path=%s notes=%q", filename, relativePath, notes)
+	}
+	// Edits left at the new location by an image no longer indexed give way
+	var edits int
+	if err := app.db.QueryRow("SELECT COUNT(*) FROM image_edits").Scan(&edits); err != nil || edits != 1 {
+		t.Errorf("expected the stale edits to be replaced, got %d rows (%v)", edits, err)
+	}
+}
+
+func TestProcessImagesIndexesFilesOfTheSameName(t *testing.T) {
+	t.Chdir(t.TempDir())
+	app := &App{}
+	setupTestDB(t, app).Close()
+	t.Cleanup(func() { app.db.Close() })
+
+	// ComfyUI restarts its numbering in each dated output folder
+	writeTestPNG(t, filepath.Join("images", "2025-05-14", "ComfyUI_00001_.png"), 2)
+	writeTestPNG(t, filepath.Join("images", "2025-05-15", "ComfyUI_00001_.png"), 3)
+	for i := 0; i < 2; i++ {
+		if err := app.processImages(); err != nil {
+			t.Fatalf("process images: %v", err)
+		}
+	}
+
+	paths := func() map[string]int {
+		t.Helper()
+		rows, err := app.db.Query("SELECT id, relative_path FROM images WHERE filename = 'ComfyUI_00001_.png'")
+		if err != nil {
+			t.Fatalf("list images: %v", err)
+		}
+		defer rows.Close()
+		ids := make(map[string]int)
+		for rows.Next() {
+			var id int
+			var relativePath string
+			if err := rows.Scan(&id, &relativePath); err != nil {
+				t.Fatalf("read image: %v", err)
+			}
+			ids[relativePath] = id
+		}
+		return ids
+	}
+	ids := paths()
+	if len(ids) != 2 || ids["2025-05-14/ComfyUI_00001_.png"] == 0 || ids["2025-05-15/ComfyUI_00001_.png"] == 0 {
+		t.Fatalf("expected both files to be indexed, got %v", ids)
+	}
+
+	// A moved file is found by its content, not by a file of the same name
+	if err := os.MkdirAll(filepath.Join("images", "best"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join("images", "2025-05-15", "ComfyUI_00001_.png"), filepath.Join("images", "best", "ComfyUI_00001_.png")); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.processImages(); err != nil {
+		t.Fatalf("process images again: %v", err)
+	}
+	moved := paths()
+	if len(moved) != 2 || moved["best/ComfyUI_00001_.png"] != ids["2025-05-15/ComfyUI_00001_.png"] ||
+		moved["2025-05-14/ComfyUI_00001_.png"] != ids["2025-05-14/ComfyUI_00001_.png"] {
+		t.Errorf("expected the moved file to keep its ID, got %v (was %v)", moved, ids)
+	}
+}
+
+func TestProcessImagesSkipsRenamedBlacklistedFile(t *testing.T) {
+	t.Chdir(t.TempDir())
+	app := &App{}
+	setupTestDB(t, app).Close()
+	t.Cleanup(func() { app.db.Close() })
+
+	writeTestPNG(t, filepath.Join("images", "kept-as-fox.png"), 4)
+	hash, err := fileContentHash(filepath.Join("images", "kept-as-fox.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.db.Exec("INSERT INTO deleted_civitai_images (civitai_image_id, filename, content_hash) VALUES (999, '999.png', ?)", hash); err != nil {
+		t.Fatalf("insert blacklist entry: %v", err)
+	}
+	if err := app.processImages(); err != nil {
+		t.Fatalf("process images: %v", err)
+	}
+
+	var count int
+	if err := app.db.QueryRow("SELECT COUNT(*) FROM images").Scan(&count); err != nil || count != 0 {
+		t.Errorf("expected the deleted Civitai image to be skipped, got %d images (%v)", count, err)
+	}
+}
@@ -3,107 +3,101 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"image"
-	"image/jpeg"
-	"image/png"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/nfnt/resize"
 	"github.com/rwcarlsen/goexif/exif"
 )
 
 func (app *App) processImages() error {
-	// Create thumbnails directory
-	os.MkdirAll("thumbnails", 0755)
-
-	// Function to get files from a directory
-	getFilesFromDir := func(dir string) []string {
-		patterns := []string{
-			fmt.Sprintf("%s/*.jpg", dir),
-			fmt.Sprintf("%s/*.jpeg", dir),
-			fmt.Sprintf("%s/*.png", dir),
-			fmt.Sprintf("%s/*.JPG", dir),
-			fmt.Sprintf("%s/*.JPEG", dir),
-			fmt.Sprintf("%s/*.PNG", dir),
+	// Get files from every library root, including subfolders
+	var locations []imageLocation
+	for _, root := range libraryRoots {
+		files, err := scanLibraryRoot(root)
+		if err != nil {
+			log.Printf("Error scanning library root %s: %v", root.Path, err)
+			continue
 		}
 
-		var allFiles []string
-		for _, pattern := range patterns {
-			files, _ := filepath.Glob(pattern)
-			allFiles = append(allFiles, files...)
+		category := "SFW"
+		if root.NSFW {
+			category = "NSFW"
 		}
-		return allFiles
-	}
-
-	// Get files from both directories
-	sfwFiles := getFilesFromDir("images")
-	nsfwFiles := getFilesFromDir("images_nsfw")
-
-	// Combine all files
-	allFiles := append(sfwFiles, nsfwFiles...)
-
-	// Remove duplicates
-	fileMap := make(map[string]bool)
-	var uniqueFiles []string
-	for _, file := range allFiles {
-		if !fileMap[file] {
-			fileMap[file] = true
-			uniqueFiles = append(uniqueFiles, file)
+		fmt.Printf("Found %d %s image files in %s\n", len(files), category, root.Path)
+		for _, file := range files {
+			locations = append(locations, imageLocation{Root: root.Path, RelativePath: file})
 		}
 	}
+	fmt.Printf("Total: %d image files\n", len(locations))
 
-	fmt.Printf("Found %d SFW image files\n", len(sfwFiles))
-	fmt.Printf("Found %d NSFW image files\n", len(nsfwFiles))
-	fmt.Printf("Total: %d unique image files\n", len(uniqueFiles))
+	for i, location := range locations {
+		imagePath := location.path()
+		filename := path.Base(location.RelativePath)
 
-	for i, imagePath := range uniqueFiles {
-		filename := filepath.Base(imagePath)
+		// Check if already processed
+		indexed, err := app.isIndexedLocation(location)
+		if err != nil {
+			log.Printf("Error checking database for %s: %v", filename, err)
+			continue
+		}
 
-		if civitaiID, ok := civitaiImageIDFromFilename(filename); ok {
-			blacklisted, err := app.isCivitaiImageBlacklisted(civitaiID)
-			if err != nil {
-				log.Printf("Error checking deletion blacklist for %s: %v", filename, err)
-				continue
-			}
-			if blacklisted {
-				fmt.Printf("Skipping %s (previously deleted)\n", filename)
-				continue
-			}
+		if indexed {
+			fmt.Printf("Skipping %s (already in database)\n", location.RelativePath)
+			continue
 		}
 
-		// Check if already processed
-		var count int
-		err := app.db.QueryRow("SELECT COUNT(*) FROM images WHERE filename = ?", filename).Scan(&count)
+		// Other files are hashed once: the hash finds moved images and deleted
+		// Civitai images, and is stored with new ones
+		hash, err := fileContentHash(imagePath)
+		if err != nil {
+			log.Printf("Error hashing %s: %v", filename, err)
+			continue
+		}
+		moved, err := app.relocateIndexedImage(location, hash)
 		if err != nil {
 			log.Printf("Error checking database for %s: %v", filename, err)
 			continue
 		}
+		if moved {
+			fmt.Printf("Skipping %s (already in database)\n", location.RelativePath)
+			continue
+		}
 
-		if count > 0 {
-			fmt.Printf("Skipping %s (already in database)\n", filename)
+		// New files have no Civitai image ID stored yet, so deleted Civitai
+		// images are recognized by their download filename or their content
+		blacklisted, err := app.isBlacklistedFile(filename, hash)
+		if err != nil {
+			log.Printf("Error checking deletion blacklist for %s: %v", filename, err)
+			continue
+		}
+		if blacklisted {
+			fmt.Printf("Skipping %s (previously deleted)\n", filename)
 			continue
 		}
 
-		// Determine if NSFW based on directory
-		isNSFW := strings.Contains(imagePath, "images_nsfw")
+		// The category comes from the library root
+		root, _ := findLibraryRoot(location.Root)
+		isNSFW := root.NSFW
 		nsfwStatus := "SFW"
 		if isNSFW {
 			nsfwStatus = "NSFW"
 		}
 
-		fmt.Printf("Processing %d/%d: %s (%s)\n", i+1, len(uniqueFiles), filename, nsfwStatus)
+		fmt.Printf("Processing %d/%d: %s (%s)\n", i+1, len(locations), location.RelativePath, nsfwStatus)
 
-		// Extract metadata and create thumbnail
-		metadata, err := app.extractImageMetadata(imagePath, isNSFW)
+		// Extract metadata
+		metadata, err := app.extractImageMetadata(imagePath, isNSFW, hash)
 		if err != nil {
 			log.Printf("Error extracting metadata for %s: %v", filename, err)
 			continue
 		}
+		metadata.LibraryRoot = location.Root
+		metadata.RelativePath = location.RelativePath
 
 		// Insert into database
 		err = app.insertImageMetadata(metadata)
@@ -119,31 +113,37 @@ func (app *App) processImages() error {
 				log.Printf("Error inserting LoRA data for %s: %v", filename, err)
 			}
 		}
+
+		if err := app.insertImageParams(metadata.ID, metadata.Params); err != nil {
+			log.Printf("Error inserting generation parameters for %s: %v", filename, err)
+		}
+
+		if err := app.storeImagePalette(metadata.ID, metadata.Palette); err != nil {
+			log.Printf("Error storing palette for %s: %v", filename, err)
+		}
+	}
+
+	// New images are graded from their folder or the Civitai import
+	if err := app.gradeContentLevels(); err != nil {
+		return fmt.Errorf("grade content levels: %v", err)
+	}
+
+	filledCount, err := app.fillMissingImageColors()
+	if err != nil {
+		return fmt.Errorf("compute image colors: %v", err)
+	}
+	if filledCount > 0 {
+		fmt.Printf("Computed placeholders and palettes for %d images\n", filledCount)
 	}
 
 	return nil
 }
 
-func (app *App) extractImageMetadata(imagePath string, isNSFW bool) (*ImageMetadata, error) {
+// extractImageMetadata reads an image file. The content hash is computed
+// unless the caller already has it.
+func (app *App) extractImageMetadata(imagePath string, isNSFW bool, hash string) (*ImageMetadata, error) {
 	filename := filepath.Base(imagePath)
 
-	// Parse ID from filename (assuming format: {id}.{ext})
-	idStr := strings.Split(filename, ".")[0]
-	id, err := strconv.Atoi(idStr)
-	if err != nil {
-		// Generate a unique ID based on filename hash for non-standard filenames
-		hash := 0
-		for _, c := range filename {
-			hash = hash*31 + int(c)
-		}
-		// Ensure positive ID and avoid collision with real IDs (use high numbers)
-		id = 1000000000 + (hash % 1000000000)
-		if id < 0 {
-			id = -id
-		}
-		log.Printf("Could not parse ID from filename %s, generated ID: %d", filename, id)
-	}
-
 	// Open image file
 	file, err := os.Open(imagePath)
 	if err != nil {
@@ -151,20 +151,15 @@ func (app *App) extractImageMetadata(imagePath string, isNSFW bool) (*ImageMetad
 	}
 	defer file.Close()
 
-	// Detect actual file type by reading magic bytes to skip video files
+	// Detect actual file type by reading magic bytes to skip the videos that
+	// cannot be read
 	fileMagicBytes := make([]byte, 12)
 	file.Read(fileMagicBytes)
 	file.Seek(0, 0) // Reset file pointer
 
-	// Check for video files (MP4, WebM, AVI, MOV)
-	// MP4: starts with "ftyp" at offset 4, or ftypiso at offset 4
 	// WebM: starts with 0x1A 0x45 0xDF 0xA3
 	// AVI: starts with "RIFF" and contains "AVI "
 	if len(fileMagicBytes) >= 8 {
-		// MP4 detection
-		if string(fileMagicBytes[4:8]) == "ftyp" {
-			return nil, fmt.Errorf("skipping video file (MP4): %s", filename)
-		}
 		// WebM detection
 		if fileMagicBytes[0] == 0x1A && fileMagicBytes[1] == 0x45 && fileMagicBytes[2] == 0xDF && fileMagicBytes[3] == 0xA3 {
 			return nil, fmt.Errorf("skipping video file (WebM): %s", filename)
@@ -173,28 +168,53 @@ func (app *App) extractImageMetadata(imagePath string, isNSFW bool) (*ImageMetad
 		if string(fileMagicBytes[0:4]) == "RIFF" && len(fileMagicBytes) >= 12 && string(fileMagicBytes[8:12]) == "AVI " {
 			return nil, fmt.Errorf("skipping video file (AVI): %s", filename)
 		}
-		// MOV/QuickTime detection
-		if string(fileMagicBytes[4:8]) == "moov" || string(fileMagicBytes[4:8]) == "mdat" {
-			return nil, fmt.Errorf("skipping video file (MOV): %s", filename)
-		}
 	}
 
-	// Get image dimensions
-	img, _, err := image.DecodeConfig(file)
+	// Get dimensions, and the frames of animations and videos
+	media, err := probeMedia(file)
 	if err != nil {
 		return nil, err
 	}
 
 	metadata := &ImageMetadata{
-		ID:       id,
-		Filename: filename,
-		Width:    img.Width,
-		Height:   img.Height,
-		IsNSFW:   isNSFW,
+		Filename:   filename,
+		Width:      media.Width,
+		Height:     media.Height,
+		IsNSFW:     isNSFW,
+		MediaType:  media.Type,
+		FrameCount: media.FrameCount,
+		DurationMS: media.DurationMS,
+	}
+
+	// Civitai downloads are named after their Civitai image ID
+	if civitaiID, ok := civitaiImageIDFromFilename(filename); ok {
+		metadata.CivitaiImageID = civitaiID
+	}
+
+	// Hash the file to recognize it when renamed
+	metadata.ContentHash = hash
+	if metadata.ContentHash == "" {
+		file.Seek(0, 0)
+		if metadata.ContentHash, err = contentHash(file); err != nil {
+			return nil, err
+		}
+	}
+
+	// Placeholder shown in the grid while the thumbnail loads, and palette.
+	// Videos have neither, being shown by the browser.
+	if media.Type != mediaTypeVideo {
+		file.Seek(0, 0)
+		placeholder, palette, err := analyzeImageColors(file)
+		if err != nil {
+			log.Printf("Error computing colors of %s: %v", filename, err)
+		}
+		metadata.BlurHash = placeholder.BlurHash
+		metadata.DominantColor = placeholder.DominantColor
+		metadata.Palette = palette
 	}
 
 	// Calculate display timestamp for chronological ordering
-	metadata.DisplayTimestamp = calculateDisplayTimestamp(imagePath, id, filename)
+	metadata.DisplayTimestamp = calculateDisplayTimestamp(imagePath, filename)
 
 	// Detect actual file type by magic bytes instead of relying on extension
 	file.Seek(0, 0) // Reset file pointer
@@ -202,14 +222,23 @@ func (app *App) extractImageMetadata(imagePath string, isNSFW bool) (*ImageMetad
 	file.Read(signature)
 	file.Seek(0, 0) // Reset again for subsequent reads
 
-	pngSignature := []byte{137, 80, 78, 71, 13, 10, 26, 10}
 	jpegSignature := []byte{0xFF, 0xD8, 0xFF}
-	isPNG := len(signature) >= 8 && string(signature[:8]) == string(pngSignature)
+	isPNG := len(signature) >= 8 && string(signature[:8]) == pngSignature
 	isJPEG := len(signature) >= 3 && string(signature[:3]) == string(jpegSignature)
 
+	// Metadata tags of videos, such as the ComfyUI prompt and workflow
+	if len(media.Sources) > 0 {
+		app.parseMetadataSources(media.Sources, metadata)
+	}
+
 	// Try PNG metadata first if it's a PNG file (regardless of extension)
 	if isPNG {
 		app.extractPNGMetadata(imagePath, metadata)
+
+		// Hosting sites strip text chunks but keep the pixels
+		if metadata.Prompt == "" {
+			app.extractStealthPNGInfo(imagePath, metadata)
+		}
 	}
 
 	// If still no metadata found, try EXIF (works for JPEG and some PNGs)
@@ -217,41 +246,23 @@ func (app *App) extractImageMetadata(imagePath string, isNSFW bool) (*ImageMetad
 		exifData, err := exif.Decode(file)
 		if err == nil {
 			// Try to extract common AI generation parameters from various EXIF fields
-			if userComment, err := exifData.Get(exif.UserComment); err == nil {
-				if comment := string(userComment.Val); comment != "" {
-					app.parseGenerationParams(comment, metadata)
-				}
-			}
-
-			if imageDescription, err := exifData.Get(exif.ImageDescription); err == nil {
-				if desc := string(imageDescription.Val); desc != "" {
-					app.parseGenerationParams(desc, metadata)
-				}
-			}
-
-			// Try other common EXIF fields that might contain AI metadata
-			if software, err := exifData.Get(exif.Software); err == nil {
-				if sw := string(software.Val); sw != "" {
-					app.parseGenerationParams(sw, metadata)
-				}
-			}
-
-			// Try Artist field
-			if artist, err := exifData.Get(exif.Artist); err == nil {
-				if art := string(artist.Val); art != "" {
-					app.parseGenerationParams(art, metadata)
-				}
-			}
-
-			// Try Copyright field
-			if copyright, err := exifData.Get(exif.Copyright); err == nil {
-				if cp := string(copyright.Val); cp != "" {
-					app.parseGenerationParams(cp, metadata)
+			var sources []MetadataSource
+			for _, field := range []exif.FieldName{exif.UserComment, exif.ImageDescription, exif.Software, exif.Artist, exif.Copyright} {
+				if tag, err := exifData.Get(field); err == nil {
+					if text := string(tag.Val); text != "" {
+						sources = append(sources, MetadataSource{Container: "exif", Key: string(field), Text: text})
+					}
 				}
 			}
+			app.parseMetadataSources(sources, metadata)
 		}
 	}
 
+	// XMP and IPTC segments are not covered by the EXIF decoder
+	if isJPEG {
+		app.extractJPEGXMPAndIPTC(imagePath, metadata)
+	}
+
 	// Process model information
 	if metadata.ModelHash != "" {
 		model, err := app.getOrCreateModel(metadata.ModelHash)
@@ -270,75 +281,17 @@ func (app *App) extractImageMetadata(imagePath string, isNSFW bool) (*ImageMetad
 		}
 	}
 
-	// Create thumbnail
-	thumbnailPath, err := app.createThumbnail(imagePath, filename)
-	if err != nil {
-		log.Printf("Error creating thumbnail for %s: %v", filename, err)
-	} else {
-		metadata.ThumbnailPath = thumbnailPath
-	}
-
 	return metadata, nil
 }
 
-func (app *App) createThumbnail(imagePath, filename string) (string, error) {
-	thumbnailPath := filepath.Join("thumbnails", filename)
-
-	// Check if thumbnail already exists
-	if _, err := os.Stat(thumbnailPath); err == nil {
-		return thumbnailPath, nil
-	}
-
-	// Open original image
-	file, err := os.Open(imagePath)
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
-
-	// Decode image
-	img, format, err := image.Decode(file)
-	if err != nil {
-		return "", err
-	}
-
-	// Create thumbnail (400x600 max, maintain aspect ratio)
-	// Higher resolution for masonry layout
-	thumbnail := resize.Thumbnail(400, 600, img, resize.Lanczos3)
-
-	// Create thumbnail file
-	thumbnailFile, err := os.Create(thumbnailPath)
-	if err != nil {
-		return "", err
-	}
-	defer thumbnailFile.Close()
-
-	// Encode thumbnail
-	switch format {
-	case "png":
-		err = png.Encode(thumbnailFile, thumbnail)
-	default:
-		err = jpeg.Encode(thumbnailFile, thumbnail, &jpeg.Options{Quality: 80})
-	}
-
-	if err != nil {
-		return "", err
-	}
-
-	return thumbnailPath, nil
-}
-
-// Helper function to set the correct image URL based on NSFW flag
+// SetImageURL sets the URL of the image file, served by ID wherever the file
+// is stored.
 func (img *ImageMetadata) SetImageURL() {
-	if img.IsNSFW {
-		img.ImageURL = "/images_nsfw/" + img.Filename
-	} else {
-		img.ImageURL = "/images/" + img.Filename
-	}
+	img.ImageURL = fmt.Sprintf("/media/%d", img.ID)
 }
 
 // calculateDisplayTimestamp computes a chronological timestamp for the image
-func calculateDisplayTimestamp(imagePath string, imageID int, filename string) *time.Time {
+func calculateDisplayTimestamp(imagePath string, filename string) *time.Time {
 	// Method 1: Check if we have real timestamp from Civitai API
 	civitaiTimestamps := loadCivitaiTimestamps()
 	if createdAtStr, exists := civitaiTimestamps[filename]; exists {
@@ -31,7 +31,7 @@ func TestPNGWithWrongExtension(t *testing.T) {
 	}
 
 	// Extract metadata
-	metadata, err := app.extractImageMetadata(imagePath, false)
+	metadata, err := app.extractImageMetadata(imagePath, false, "")
 	if err != nil {
 		t.Fatalf("Failed to extract metadata from %s: %v", imagePath, err)
 	}
@@ -136,7 +136,7 @@ func TestRealPNGFile(t *testing.T) {
 
 	// Test the first PNG file found
 	imagePath := pngFiles[0]
-	metadata, err := app.extractImageMetadata(imagePath, false)
+	metadata, err := app.extractImageMetadata(imagePath, false, "")
 	if err != nil {
 		t.Fatalf("Failed to extract metadata from %s: %v", imagePath, err)
 	}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+const maxImageRating = 5
+
+var errInvalidRating = errors.New("rating must be between 0 and 5")
+
+// ImageRatingRequest updates the rating, the favorite flag, or both; omitted
+// fields are left unchanged.
+type ImageRatingRequest struct {
+	Rating   *int  `json:"rating"`
+	Favorite *bool `json:"favorite"`
+}
+
+type ImageRatingResponse struct {
+	Success  bool   `json:"success"`
+	ID       int    `json:"id,omitempty"`
+	Rating   int    `json:"rating"`
+	Favorite bool   `json:"favorite"`
+	Error    string `json:"error,omitempty"`
+}
+
+// setImageRating applies a rating request and returns the stored values.
+func (app *App) setImageRating(imageID int, req ImageRatingRequest) (int, bool, error) {
+	if req.Rating != nil && (*req.Rating < 0 || *req.Rating > maxImageRating) {
+		return 0, false, errInvalidRating
+	}
+
+	result, err := app.db.Exec(`
+		UPDATE images SET
+			rating = COALESCE(?, rating),
+			favorite = COALESCE(?, favorite)
+		WHERE id = ?
+	`, req.Rating, req.Favorite, imageID)
+	if err != nil {
+		return 0, false, fmt.Errorf("update rating: %w", err)
+	}
+	if updated, err := result.RowsAffected(); err == nil && updated == 0 {
+		return 0, false, errImageNotFound
+	}
+
+	var rating int
+	var favorite bool
+	err = app.db.QueryRow("SELECT rating, favorite FROM images WHERE id = ?", imageID).Scan(&rating, &favorite)
+	if err != nil {
+		return 0, false, fmt.Errorf("read rating: %w", err)
+	}
+	return rating, favorite, nil
+}
+
+func (app *App) handleImageRating(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	imageID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || imageID <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(ImageRatingResponse{
+			Success: false,
+			Error:   "Invalid image ID",
+		})
+		return
+	}
+
+	var req ImageRatingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Rating == nil && req.Favorite == nil) {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(ImageRatingResponse{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+
+	rating, favorite, err := app.setImageRating(imageID, req)
+	switch {
+	case errors.Is(err, errInvalidRating):
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(ImageRatingResponse{
+			Success: false,
+			Error:   "Rating must be between 0 and 5",
+		})
+		return
+	case errors.Is(err, errImageNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(ImageRatingResponse{
+			Success: false,
+			Error:   "Image not found",
+		})
+		return
+	case err != nil:
+		log.Printf("Failed to rate image %d: %v", imageID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(ImageRatingResponse{
+			Success: false,
+			Error:   "Failed to update rating",
+		})
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(ImageRatingResponse{
+		Success:  true,
+		ID:       imageID,
+		Rating:   rating,
+		Favorite: favorite,
+	})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestHandleImageRating(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("open test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(`
+		CREATE TABLE images (
+			id INTEGER PRIMARY KEY,
+			filename TEXT NOT NULL,
+			rating INTEGER NOT NULL DEFAULT 0,
+			favorite INTEGER NOT NULL DEFAULT 0
+		);
+		INSERT INTO images (id, filename, rating, favorite) VALUES (7, '7.png', 2, 0);
+	`); err != nil {
+		t.Fatalf("create test schema: %v", err)
+	}
+	app := &App{db: db}
+
+	request := func(id, body string) (*httptest.ResponseRecorder, ImageRatingResponse) {
+		recorder := httptest.NewRecorder()
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodPost, "/api/images/"+id+"/rating", strings.NewReader(body)), map[string]string{"id": id})
+		app.handleImageRating(recorder, req)
+
+		var response ImageRatingResponse
+		if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+		return recorder, response
+	}
+
+	recorder, response := request("7", `{"rating": 5}`)
+	if recorder.Code != http.StatusOK || !response.Success || response.Rating != 5 || response.Favorite {
+		t.Errorf("Unexpected response to a rating: %d %+v", recorder.Code, response)
+	}
+
+	// Updating only the favorite flag keeps the rating
+	recorder, response = request("7", `{"favorite": true}`)
+	if recorder.Code != http.StatusOK || response.Rating != 5 || !response.Favorite {
+		t.Errorf("Unexpected response to a favorite: %d %+v", recorder.Code, response)
+	}
+
+	var rating int
+	var favorite bool
+	if err := db.QueryRow("SELECT rating, favorite FROM images WHERE id = 7").Scan(&rating, &favorite); err != nil {
+		t.Fatalf("read rating: %v", err)
+	}
+	if rating != 5 || !favorite {
+		t.Errorf("Stored rating = %d, favorite = %t", rating, favorite)
+	}
+
+	for _, tc := range []struct {
+		id, body string
+		code     int
+	}{
+		{"7", `{"rating": 6}`, http.StatusBadRequest},
+		{"7", `{"rating": -1}`, http.StatusBadRequest},
+		{"7", `{}`, http.StatusBadRequest},
+		{"abc", `{"rating": 1}`, http.StatusBadRequest},
+		{"9", `{"rating": 1}`, http.StatusNotFound},
+	} {
+		if recorder, _ := request(tc.id, tc.body); recorder.Code != tc.code {
+			t.Errorf("POST %s %s: expected %d, got %d", tc.id, tc.body, tc.code, recorder.Code)
+		}
+	}
+}
+
+func TestQueryImagesFiltersAndSortsByRating(t *testing.T) {
+	t.Chdir(t.TempDir())
+	app := &App{}
+	setupTestDB(t, app).Close()
+	t.Cleanup(func() { app.db.Close() })
+
+	if _, err := app.db.Exec(`
+		INSERT INTO images (id, filename, width, height, prompt, neg_prompt, steps, cfg_scale, sampler, scheduler, seed, thumbnail_path, is_nsfw, display_timestamp, rating, favorite) VALUES
+			(1, '1.png', 1, 1, 'newest, unrated', '', 20, 7, '', '', 1, '', 0, '2024-05-04 00:00:00', 0, 0),
+			(2, '2.png', 1, 1, 'three stars', '', 20, 7, '', '', 2, '', 0, '2024-05-03 00:00:00', 3, 0),
+			(3, '3.png', 1, 1, 'five stars', '', 20, 7, '', '', 3, '', 0, '2024-05-02 00:00:00', 5, 0),
+			(4, '4.png', 1, 1, 'favorite', '', 20, 7, '', '', 4, '', 0, '2024-05-01 00:00:00', 3, 1);
+	`); err != nil {
+		t.Fatalf("insert test images: %v", err)
+	}
+
+	ids := func(params ImageSearchParams) []int {
+		params.Page, params.Limit = 1, 10
+		images, _, err := app.queryImages(params)
+		if err != nil {
+			t.Fatalf("queryImages: %v", err)
+		}
+		var ids []int
+		for _, img := range images {
+			ids = append(ids, img.ID)
+		}
+		return ids
+	}
+
+	for _, tc := range []struct {
+		name   string
+		params ImageSearchParams
+		want   []int
+	}{
+		{"Newest", ImageSearchParams{}, []int{1, 2, 3, 4}},
+		{"TopRated", ImageSearchParams{SortOrder: sortByRating}, []int{3, 4, 2, 1}},
+		{"MinimumRating", ImageSearchParams{RatingFilter: "3"}, []int{2, 3, 4}},
+		{"Favorites", ImageSearchParams{RatingFilter: "favorites"}, []int{4}},
+		{"InvalidFilterIgnored", ImageSearchParams{RatingFilter: "9"}, []int{1, 2, 3, 4}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := ids(tc.params)
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Fatalf("got %v, want %v", got, tc.want)
+				}
+			}
+		})
+	}
+}
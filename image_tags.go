@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxTagLength = 64
+
+	// Upper bound for the image IDs of one bulk request, to keep
+	// transactions short
+	maxBulkImageIDs = 5000
+
+	tagAutocompleteLimit = 20
+)
+
+var errInvalidTag = errors.New("invalid tag")
+
+type TagStat struct {
+	ID         int    `json:"id"`
+	Name       string `json:"name"`
+	ImageCount int    `json:"image_count"`
+}
+
+type TagStatsResponse struct {
+	Tags  []TagStat `json:"tags"`
+	Error string    `json:"error,omitempty"`
+}
+
+// TagUpdateRequest adds or removes tags on any number of images at once.
+type TagUpdateRequest struct {
+	ImageIDs []int    `json:"image_ids"`
+	Tags     []string `json:"tags"`
+}
+
+type TagUpdateResponse struct {
+	Success bool     `json:"success"`
+	Tags    []string `json:"tags,omitempty"`
+	Changed int      `json:"changed"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// normalizeTagName collapses whitespace in a tag name. Commas separate tags in
+// filter URLs, so they are not allowed inside one.
+func normalizeTagName(name string) (string, error) {
+	name = strings.Join(strings.Fields(name), " ")
+	if name == "" || strings.Contains(name, ",") || utf8.RuneCountInString(name) > maxTagLength {
+		return "", fmt.Errorf("%w: %q", errInvalidTag, name)
+	}
+	return name, nil
+}
+
+// parseTagList reads a comma-separated tag filter, dropping invalid entries
+// and duplicates.
+func parseTagList(value string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(value, ",") {
+		name, err := normalizeTagName(part)
+		if err != nil || seen[strings.ToLower(name)] {
+			continue
+		}
+		seen[strings.ToLower(name)] = true
+		tags = append(tags, name)
+	}
+	return tags
+}
+
+// tagFilterConditions requires every included tag and none of the excluded
+// ones. Tag names compare without case, like the tags table.
+func tagFilterConditions(includeTags, excludeTags []string) ([]string, []any) {
+	const taggedImages = `SELECT it.image_id FROM image_tags it JOIN tags t ON t.id = it.tag_id WHERE t.name = ?`
+
+	var conditions []string
+	var args []any
+	for _, tag := range includeTags {
+		conditions = append(conditions, "i.id IN ("+taggedImages+")")
+		args = append(args, tag)
+	}
+	for _, tag := range excludeTags {
+		conditions = append(conditions, "i.id NOT IN ("+taggedImages+")")
+		args = append(args, tag)
+	}
+	return conditions, args
+}
+
+// getTagStats counts the images of each tag within an NSFW filter, most used
+// first. A prefix narrows the list for autocompletion.
+func (app *App) getTagStats(nsfwFilter, prefix string, limit int) ([]TagStat, error) {
+	conditions := []string{"i.trashed_at IS NULL"}
+	var args []any
+	if condition := contentLevelCondition(nsfwFilter); condition != "" {
+		conditions = append(conditions, condition)
+	}
+	if prefix != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix)
+		conditions = append(conditions, `t.name LIKE ? ESCAPE '\'`)
+		args = append(args, escaped+"%")
+	}
+
+	whereClause := "WHERE " + strings.Join(conditions, " AND ")
+	limitClause := ""
+	if limit > 0 {
+		limitClause = "LIMIT " + strconv.Itoa(limit)
+	}
+
+	rows, err := app.db.Query(`
+		SELECT t.id, t.name, COUNT(i.id) AS image_count
+		FROM tags t
+		INNER JOIN image_tags it ON it.tag_id = t.id
+		INNER JOIN images i ON i.id = it.image_id
+		`+whereClause+`
+		GROUP BY t.id, t.name
+		ORDER BY image_count DESC, t.name COLLATE NOCASE ASC
+		`+limitClause, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := make([]TagStat, 0)
+	for rows.Next() {
+		var tag TagStat
+		if err := rows.Scan(&tag.ID, &tag.Name, &tag.ImageCount); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// loadImageTags returns the tag names of each image, alphabetically.
+func (app *App) loadImageTags(imageIDs []int) (map[int][]string, error) {
+	tags := make(map[int][]string)
+	if len(imageIDs) == 0 {
+		return tags, nil
+	}
+
+	placeholders := make([]string, len(imageIDs))
+	args := make([]interface{}, len(imageIDs))
+	for i, id := range imageIDs {
+		placeholders[i] = "?"
+		args[i] = id
+	}
+
+	rows, err := app.db.Query(fmt.Sprintf(`
+		SELECT it.image_id, t.name
+		FROM image_tags it
+		JOIN tags t ON t.id = it.tag_id
+		WHERE it.image_id IN (%s)
+		ORDER BY it.image_id, t.name COLLATE NOCASE`,
+		strings.Join(placeholders, ","),
+	), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var imageID int
+		var name string
+		if err := rows.Scan(&imageID, &name); err != nil {
+			return nil, err
+		}
+		tags[imageID] = append(tags[imageID], name)
+	}
+	return tags, rows.Err()
+}
+
+func normalizeTagUpdate(req TagUpdateRequest) ([]string, error) {
+	if len(req.ImageIDs) == 0 || len(req.ImageIDs) > maxBulkImageIDs {
+		return nil, fmt.Errorf("%w: image_ids must list between 1 and %d images", errInvalidTag, maxBulkImageIDs)
+	}
+	if len(req.Tags) == 0 {
+		return nil, fmt.Errorf("%w: no tags given", errInvalidTag)
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, tag := range req.Tags {
+		name, err := normalizeTagName(tag)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[strings.ToLower(name)] {
+			seen[strings.ToLower(name)] = true
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// addImageTags tags every existing image of the request, creating tags as
+// needed. It returns the stored tag names and how many links were added.
+func (app *App) addImageTags(req TagUpdateRequest) ([]string, int, error) {
+	names, err := normalizeTagUpdate(req)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		return nil, 0, fmt.Errorf("begin tagging: %w", err)
+	}
+	defer tx.Rollback()
+
+	tagIDs := make([]int, len(names))
+	for i, name := range names {
+		if _, err := tx.Exec("INSERT INTO tags (name) VALUES (?) ON CONFLICT(name) DO NOTHING", name); err != nil {
+			return nil, 0, fmt.Errorf("create tag %q: %w", name, err)
+		}
+		// An existing tag keeps its spelling
+		if err := tx.QueryRow("SELECT id, name FROM tags WHERE name = ?", name).Scan(&tagIDs[i], &names[i]); err != nil {
+			return nil, 0, fmt.Errorf("find tag %q: %w", name, err)
+		}
+	}
+
+	stmt, err := tx.Prepare(`
+		INSERT OR IGNORE INTO image_tags (image_id, tag_id)
+		SELECT id, ? FROM images WHERE id = ?
+	`)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer stmt.Close()
+
+	changed := 0
+	for _, imageID := range req.ImageIDs {
+		for _, tagID := range tagIDs {
+			result, err := stmt.Exec(tagID, imageID)
+			if err != nil {
+				return nil, 0, fmt.Errorf("tag image %d: %w", imageID, err)
+			}
+			if rows, err := result.RowsAffected(); err == nil {
+				changed += int(rows)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, 0, fmt.Errorf("commit tagging: %w", err)
+	}
+	return names, changed, nil
+}
+
+// removeImageTags untags the images of the request and drops tags that no
+// longer have any image.
+func (app *App) removeImageTags(req TagUpdateRequest) ([]string, int, error) {
+	names, err := normalizeTagUpdate(req)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		return nil, 0, fmt.Errorf("begin untagging: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+		DELETE FROM image_tags
+		WHERE image_id = ? AND tag_id = (SELECT id FROM tags WHERE name = ?)
+	`)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer stmt.Close()
+
+	changed := 0
+	for _, imageID := range req.ImageIDs {
+		for _, name := range names {
+			result, err := stmt.Exec(imageID, name)
+			if err != nil {
+				return nil, 0, fmt.Errorf("untag image %d: %w", imageID, err)
+			}
+			if rows, err := result.RowsAffected(); err == nil {
+				changed += int(rows)
+			}
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM tags WHERE id NOT IN (SELECT tag_id FROM image_tags)"); err != nil {
+		return nil, 0, fmt.Errorf("remove unused tags: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, 0, fmt.Errorf("commit untagging: %w", err)
+	}
+	return names, changed, nil
+}
+
+func (app *App) handleTagStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	tags, err := app.getTagStats(r.URL.Query().Get("nsfw"), "", 0)
+	if err != nil {
+		log.Printf("Error getting tag stats: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(TagStatsResponse{Tags: []TagStat{}, Error: "Failed to load tags"})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(TagStatsResponse{Tags: tags})
+}
+
+func (app *App) handleTagAutocomplete(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	prefix := strings.Join(strings.Fields(r.URL.Query().Get("q")), " ")
+	tags, err := app.getTagStats("all", prefix, tagAutocompleteLimit)
+	if err != nil {
+		log.Printf("Error completing tags: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(TagStatsResponse{Tags: []TagStat{}, Error: "Failed to load tags"})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(TagStatsResponse{Tags: tags})
+}
+
+func (app *App) handleAddImageTags(w http.ResponseWriter, r *http.Request) {
+	app.handleTagUpdate(w, r, app.addImageTags)
+}
+
+func (app *App) handleRemoveImageTags(w http.ResponseWriter, r *http.Request) {
+	app.handleTagUpdate(w, r, app.removeImageTags)
+}
+
+func (app *App) handleTagUpdate(w http.ResponseWriter, r *http.Request, update func(TagUpdateRequest) ([]string, int, error)) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req TagUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(TagUpdateResponse{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+
+	names, changed, err := update(req)
+	switch {
+	case errors.Is(err, errInvalidTag):
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(TagUpdateResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	case err != nil:
+		log.Printf("Failed to update tags: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(TagUpdateResponse{
+			Success: false,
+			Error:   "Failed to update tags",
+		})
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(TagUpdateResponse{
+		Success: true,
+		Tags:    names,
+		Changed: changed,
+	})
+}
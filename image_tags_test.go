@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTagList(t *testing.T) {
+	got := parseTagList(" Portrait ,,landscape,  night   sky ,portrait")
+	want := []string{"Portrait", "landscape", "night sky"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseTagList = %q, want %q", got, want)
+	}
+
+	if _, err := normalizeTagName(strings.Repeat("a", maxTagLength+1)); err == nil {
+		t.Error("Expected an overlong tag to be rejected")
+	}
+}
+
+func TestImageTags(t *testing.T) {
+	t.Chdir(t.TempDir())
+	app := &App{}
+	setupTestDB(t, app).Close()
+	t.Cleanup(func() { app.db.Close() })
+
+	if _, err := app.db.Exec(`
+		INSERT INTO images (id, filename, width, height, prompt, neg_prompt, steps, cfg_scale, sampler, scheduler, seed, thumbnail_path, is_nsfw, display_timestamp) VALUES
+			(1, '1.png', 1, 1, 'one', '', 20, 7, '', '', 1, '', 0, '2024-05-04 00:00:00'),
+			(2, '2.png', 1, 1, 'two', '', 20, 7, '', '', 2, '', 0, '2024-05-03 00:00:00'),
+			(3, '3.png', 1, 1, 'three', '', 20, 7, '', '', 3, '', 1, '2024-05-02 00:00:00');
+	`); err != nil {
+		t.Fatalf("insert test images: %v", err)
+	}
+	if err := app.gradeContentLevels(); err != nil {
+		t.Fatalf("grade test images: %v", err)
+	}
+
+	// Image 9 does not exist and is skipped
+	names, changed, err := app.addImageTags(TagUpdateRequest{ImageIDs: []int{1, 2, 3, 9}, Tags: []string{"Portrait", " portrait "}})
+	if err != nil {
+		t.Fatalf("add tags: %v", err)
+	}
+	if !reflect.DeepEqual(names, []string{"Portrait"}) || changed != 3 {
+		t.Errorf("Unexpected add result: %q, %d", names, changed)
+	}
+
+	// An existing tag keeps its original spelling
+	names, changed, err = app.addImageTags(TagUpdateRequest{ImageIDs: []int{1, 3}, Tags: []string{"PORTRAIT", "night"}})
+	if err != nil {
+		t.Fatalf("add tags: %v", err)
+	}
+	if !reflect.DeepEqual(names, []string{"Portrait", "night"}) || changed != 2 {
+		t.Errorf("Unexpected add result: %q, %d", names, changed)
+	}
+
+	t.Run("Stats", func(t *testing.T) {
+		stats, err := app.getTagStats("sfw", "", 0)
+		if err != nil {
+			t.Fatalf("getTagStats: %v", err)
+		}
+		if len(stats) != 2 || stats[0].Name != "Portrait" || stats[0].ImageCount != 2 || stats[1].Name != "night" || stats[1].ImageCount != 1 {
+			t.Errorf("Unexpected SFW tag stats: %+v", stats)
+		}
+
+		completed, err := app.getTagStats("all", "NI", tagAutocompleteLimit)
+		if err != nil {
+			t.Fatalf("getTagStats: %v", err)
+		}
+		if len(completed) != 1 || completed[0].Name != "night" || completed[0].ImageCount != 2 {
+			t.Errorf("Unexpected completion: %+v", completed)
+		}
+	})
+
+	t.Run("Filters", func(t *testing.T) {
+		for _, tc := range []struct {
+			name    string
+			params  ImageSearchParams
+			want    []int
+			wantTag []string
+		}{
+			{"Include", ImageSearchParams{IncludeTags: []string{"portrait"}}, []int{1, 2, 3}, []string{"night", "Portrait"}},
+			{"IncludeAll", ImageSearchParams{IncludeTags: []string{"portrait", "night"}}, []int{1, 3}, []string{"night", "Portrait"}},
+			{"Exclude", ImageSearchParams{ExcludeTags: []string{"night"}}, []int{2}, []string{"Portrait"}},
+			{"WithNSFWFilter", ImageSearchParams{NSFWFilter: "sfw", IncludeTags: []string{"night"}}, []int{1}, []string{"night", "Portrait"}},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				tc.params.Page, tc.params.Limit = 1, 10
+				images, total, err := app.queryImages(tc.params)
+				if err != nil {
+					t.Fatalf("queryImages: %v", err)
+				}
+				var ids []int
+				for _, img := range images {
+					ids = append(ids, img.ID)
+				}
+				if !reflect.DeepEqual(ids, tc.want) || total != len(tc.want) {
+					t.Fatalf("got %v (total %d), want %v", ids, total, tc.want)
+				}
+				if !reflect.DeepEqual(images[0].Tags, tc.wantTag) {
+					t.Errorf("Unexpected tags of image %d: %q", images[0].ID, images[0].Tags)
+				}
+			})
+		}
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		_, changed, err := app.removeImageTags(TagUpdateRequest{ImageIDs: []int{1, 3}, Tags: []string{"night"}})
+		if err != nil {
+			t.Fatalf("remove tags: %v", err)
+		}
+		if changed != 2 {
+			t.Errorf("Expected 2 removed links, got %d", changed)
+		}
+
+		// The unused tag is dropped
+		var count int
+		if err := app.db.QueryRow("SELECT COUNT(*) FROM tags WHERE name = 'night'").Scan(&count); err != nil {
+			t.Fatalf("count tags: %v", err)
+		}
+		if count != 0 {
+			t.Errorf("Expected the unused tag to be removed")
+		}
+	})
+
+	t.Run("Handler", func(t *testing.T) {
+		request := func(body string) (*httptest.ResponseRecorder, TagUpdateResponse) {
+			recorder := httptest.NewRecorder()
+			app.handleAddImageTags(recorder, httptest.NewRequest(http.MethodPost, "/api/tags/add", strings.NewReader(body)))
+
+			var response TagUpdateResponse
+			if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+				t.Fatalf("decode response: %v", err)
+			}
+			return recorder, response
+		}
+
+		recorder, response := request(`{"image_ids": [2], "tags": ["landscape"]}`)
+		if recorder.Code != http.StatusOK || !response.Success || response.Changed != 1 {
+			t.Errorf("Unexpected response: %d %+v", recorder.Code, response)
+		}
+
+		for _, body := range []string{
+			`{"image_ids": [], "tags": ["x"]}`,
+			`{"image_ids": [1], "tags": []}`,
+			`{"image_ids": [1], "tags": ["a,b"]}`,
+			`not json`,
+		} {
+			if recorder, _ := request(body); recorder.Code != http.StatusBadRequest {
+				t.Errorf("POST %s: expected 400, got %d", body, recorder.Code)
+			}
+		}
+	})
+}
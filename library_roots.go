@@ -0,0 +1,669 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/gorilla/mux"
+)
+
+// LibraryRoot is a directory scanned for images, recursively. Images found in
+// it get its default category; read-only roots are indexed and served, but
+// their files are never moved, deleted or rewritten.
+type LibraryRoot struct {
+	Path     string `json:"path"`
+	NSFW     bool   `json:"nsfw"`
+	ReadOnly bool   `json:"read_only"`
+}
+
+// libraryTrashDir holds the trashed files of a library root, inside the root
+// so that trashing never copies across disks.
+const libraryTrashDir = ".trash"
+
+// legacyTrashDir is where trashed files were kept before library roots.
+const legacyTrashDir = "trash"
+
+var (
+	errLibraryRootReadOnly = errors.New("image is in a read-only library root")
+	errNoLibraryRoot       = errors.New("no writable library root for the category")
+	errInvalidImagePath    = errors.New("image has an invalid path")
+	errAmbiguousImage      = errors.New("several images match")
+)
+
+// libraryRoots and thumbnailDir are set from LIBRARY_ROOTS and THUMBNAILS_DIR
+// at startup. The defaults are the original layout.
+var (
+	libraryRoots = defaultLibraryRoots()
+	thumbnailDir = "thumbnails"
+)
+
+func defaultLibraryRoots() []LibraryRoot {
+	return []LibraryRoot{
+		{Path: "images"},
+		{Path: "images_nsfw", NSFW: true},
+	}
+}
+
+// parseLibraryRoots reads a list of roots separated like PATH (":" or ";" on
+// Windows). Options follow the last "=" of an entry, separated by commas:
+// "sfw" (the default) or "nsfw", and "ro" or "rw" (the default). For example
+// "images:images_nsfw=nsfw:/mnt/archive=sfw,ro".
+func parseLibraryRoots(value string) ([]LibraryRoot, error) {
+	var roots []LibraryRoot
+	seen := make(map[string]bool)
+	for _, entry := range filepath.SplitList(value) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		var root LibraryRoot
+		dir, options, hasOptions := cutLast(entry, "=")
+		if hasOptions {
+			for _, option := range strings.Split(options, ",") {
+				switch strings.ToLower(strings.TrimSpace(option)) {
+				case "sfw":
+					root.NSFW = false
+				case "nsfw":
+					root.NSFW = true
+				case "ro":
+					root.ReadOnly = true
+				case "rw":
+					root.ReadOnly = false
+				default:
+					return nil, fmt.Errorf("library root %q: unknown option %q", dir, option)
+				}
+			}
+		}
+		root.Path = filepath.Clean(strings.TrimSpace(dir))
+		if root.Path == "." && strings.TrimSpace(dir) == "" {
+			return nil, fmt.Errorf("library root entry %q has no directory", entry)
+		}
+		if seen[root.Path] {
+			return nil, fmt.Errorf("library root %q is listed twice", root.Path)
+		}
+		seen[root.Path] = true
+		roots = append(roots, root)
+	}
+	if len(roots) == 0 {
+		return nil, errors.New("no library roots configured")
+	}
+	return roots, nil
+}
+
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// libraryRootsFromEnv reads LIBRARY_ROOTS, keeping the default roots when it
+// is not set.
+func libraryRootsFromEnv() ([]LibraryRoot, error) {
+	value := strings.TrimSpace(os.Getenv("LIBRARY_ROOTS"))
+	if value == "" {
+		return defaultLibraryRoots(), nil
+	}
+	return parseLibraryRoots(value)
+}
+
+// findLibraryRoot returns the configured root at a directory. Roots of images
+// indexed under an earlier configuration are not found.
+func findLibraryRoot(dir string) (LibraryRoot, bool) {
+	dir = filepath.Clean(dir)
+	for _, root := range libraryRoots {
+		if root.Path == dir {
+			return root, true
+		}
+	}
+	return LibraryRoot{}, false
+}
+
+// destinationRoot returns the first writable root of a category, where
+// downloads and images moved to the category go.
+func destinationRoot(nsfw bool) (LibraryRoot, error) {
+	for _, root := range libraryRoots {
+		if root.NSFW == nsfw && !root.ReadOnly {
+			return root, nil
+		}
+	}
+	category := "SFW"
+	if nsfw {
+		category = "NSFW"
+	}
+	return LibraryRoot{}, fmt.Errorf("%w: %s", errNoLibraryRoot, category)
+}
+
+// imageLocation is where an image file is stored: a library root and a
+// slash-separated path inside it.
+type imageLocation struct {
+	Root         string
+	RelativePath string
+}
+
+func (loc imageLocation) path() string {
+	return filepath.Join(loc.Root, filepath.FromSlash(loc.RelativePath))
+}
+
+func (loc imageLocation) check() error {
+	if loc.Root == "" || !filepath.IsLocal(filepath.FromSlash(loc.RelativePath)) {
+		return errInvalidImagePath
+	}
+	if first, _, _ := strings.Cut(loc.RelativePath, "/"); first == libraryTrashDir {
+		return errInvalidImagePath
+	}
+	return nil
+}
+
+func (loc imageLocation) readOnly() bool {
+	root, ok := findLibraryRoot(loc.Root)
+	return ok && root.ReadOnly
+}
+
+// imageFile is a stored image with the location of its file.
+type imageFile struct {
+	ID            int
+	Filename      string
+	IsNSFW        bool
+	Location      imageLocation
+	ThumbnailPath string
+}
+
+// imageFileColumns selects an imageFile from images aliased "i", for
+// scanImageFile.
+const imageFileColumns = "i.id, i.filename, i.is_nsfw, i.library_root, i.relative_path, COALESCE(i.thumbnail_path, '')"
+
+// scanImageFile reads imageFileColumns followed by extra columns. Images
+// indexed before library roots have no location and are found in the
+// category folders of the original layout.
+func scanImageFile(row interface{ Scan(...any) error }, extra ...any) (imageFile, error) {
+	var file imageFile
+	var root, relativePath sql.NullString
+	targets := append([]any{&file.ID, &file.Filename, &file.IsNSFW, &root, &relativePath, &file.ThumbnailPath}, extra...)
+	if err := row.Scan(targets...); err != nil {
+		return file, err
+	}
+
+	file.Location = imageLocation{Root: root.String, RelativePath: relativePath.String}
+	if !root.Valid {
+		file.Location.Root = "images"
+		if file.IsNSFW {
+			file.Location.Root = "images_nsfw"
+		}
+	}
+	if !relativePath.Valid {
+		file.Location.RelativePath = file.Filename
+	}
+	return file, nil
+}
+
+// loadImageFile looks up an image in the library or the trash.
+func (app *App) loadImageFile(imageID int) (imageFile, bool, error) {
+	var trashed bool
+	file, err := scanImageFile(app.db.QueryRow("SELECT "+imageFileColumns+", i.trashed_at IS NOT NULL FROM images i WHERE i.id = ?", imageID), &trashed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return file, false, errImageNotFound
+	}
+	if err != nil {
+		return file, false, fmt.Errorf("find image: %w", err)
+	}
+	return file, trashed, nil
+}
+
+// findImageByName looks up an image outside the trash named on the command
+// line: by its ID, its path in a library root with or without the root, or its
+// filename when no other image has the same one.
+func (app *App) findImageByName(name string) (imageFile, error) {
+	if imageID, err := strconv.Atoi(name); err == nil && imageID > 0 {
+		file, trashed, err := app.loadImageFile(imageID)
+		if err == nil && trashed {
+			return file, errImageNotFound
+		}
+		return file, err
+	}
+
+	slashPath := filepath.ToSlash(name)
+	files, err := app.loadImageFiles("i.trashed_at IS NULL AND (i.filename = ? OR i.relative_path = ? OR i.library_root || '/' || i.relative_path = ?)",
+		name, slashPath, slashPath)
+	if err != nil {
+		return imageFile{}, fmt.Errorf("find image: %w", err)
+	}
+	switch len(files) {
+	case 0:
+		return imageFile{}, errImageNotFound
+	case 1:
+		return files[0].imageFile, nil
+	}
+	paths := make([]string, len(files))
+	for i, file := range files {
+		paths[i] = fmt.Sprintf("%s (ID %d)", file.Location.path(), file.ID)
+	}
+	return imageFile{}, fmt.Errorf("%w: %s; name one by its path or ID", errAmbiguousImage, strings.Join(paths, ", "))
+}
+
+// trashPath is where the file of a trashed image is kept: in the trash of its
+// root at the same path, with the image ID prefixed to its name so that files
+// trashed in turn from one path don't collide.
+func (file imageFile) trashPath() string {
+	dir, name := path.Split(file.Location.RelativePath)
+	return filepath.Join(file.Location.Root, libraryTrashDir, filepath.FromSlash(dir), strconv.Itoa(file.ID)+"-"+name)
+}
+
+// storedImageFile is an image file and whether it is in the trash.
+type storedImageFile struct {
+	imageFile
+	Trashed bool
+}
+
+// loadImageFiles lists the files of the images matching a condition, in ID
+// order.
+func (app *App) loadImageFiles(condition string, args ...any) ([]storedImageFile, error) {
+	rows, err := app.db.Query("SELECT "+imageFileColumns+", i.trashed_at IS NOT NULL FROM images i WHERE "+condition+" ORDER BY i.id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []storedImageFile
+	for rows.Next() {
+		var file storedImageFile
+		if file.imageFile, err = scanImageFile(rows, &file.Trashed); err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, rows.Err()
+}
+
+// categoryLocation is where an image goes when moved to a category: it stays
+// in a root of that category, and otherwise moves to the category's
+// destination root at the same path.
+func categoryLocation(loc imageLocation, toNSFW bool) (imageLocation, error) {
+	if root, ok := findLibraryRoot(loc.Root); ok {
+		if root.NSFW == toNSFW {
+			return loc, nil
+		}
+		if root.ReadOnly {
+			return loc, errLibraryRootReadOnly
+		}
+	}
+	destination, err := destinationRoot(toNSFW)
+	if err != nil {
+		return loc, err
+	}
+	return imageLocation{Root: destination.Path, RelativePath: loc.RelativePath}, nil
+}
+
+// moveImageFile moves an image file between locations, possibly on different
+// disks, without overwriting. A missing file is left alone.
+func moveImageFile(from, to imageLocation) error {
+	if from == to {
+		return nil
+	}
+	if err := from.check(); err != nil {
+		return err
+	}
+	if err := to.check(); err != nil {
+		return err
+	}
+	if from.readOnly() || to.readOnly() {
+		return errLibraryRootReadOnly
+	}
+
+	if _, err := os.Lstat(from.path()); os.IsNotExist(err) {
+		return nil
+	}
+	if _, err := os.Lstat(to.path()); err == nil {
+		return fmt.Errorf("%w: %s", errImageFileExists, to.path())
+	}
+	if err := os.MkdirAll(filepath.Dir(to.path()), 0755); err != nil {
+		return fmt.Errorf("failed to create destination directory: %v", err)
+	}
+	if err := renameFile(from.path(), to.path()); err != nil {
+		return fmt.Errorf("failed to move image file: %v", err)
+	}
+
+	log.Printf("Moved image %s from %s to %s", from.RelativePath, from.Root, to.Root)
+	return nil
+}
+
+// renameFile renames a file, copying it when the target is on another disk.
+func renameFile(from, to string) error {
+	err := os.Rename(from, to)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	source, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	info, err := source.Stat()
+	if err != nil {
+		return err
+	}
+
+	target, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, copyErr := io.Copy(target, source)
+	if copyErr == nil {
+		copyErr = target.Sync()
+	}
+	if closeErr := target.Close(); copyErr == nil {
+		copyErr = closeErr
+	}
+	if copyErr != nil {
+		os.Remove(to)
+		return copyErr
+	}
+	_ = os.Chtimes(to, info.ModTime(), info.ModTime())
+
+	source.Close()
+	return os.Remove(from)
+}
+
+func isLibraryImageFile(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".webp", ".mp4", ".m4v", ".mov":
+		return true
+	}
+	return false
+}
+
+// scanLibraryRoot lists the image files of a root and its subfolders, as
+// slash-separated paths inside the root. Hidden folders, such as the trash,
+// are skipped. A missing root has no images.
+func scanLibraryRoot(root LibraryRoot) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(root.Path, func(walkPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if walkPath == root.Path && errors.Is(err, fs.ErrNotExist) {
+				return filepath.SkipDir
+			}
+			log.Printf("Warning: Skipping %s: %v", walkPath, err)
+			if entry != nil && entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			if walkPath != root.Path && strings.HasPrefix(entry.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() || !isLibraryImageFile(entry.Name()) {
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(root.Path, walkPath)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(relativePath))
+		return nil
+	})
+	return files, err
+}
+
+// isIndexedLocation reports whether the image file found at a location is
+// already indexed there.
+func (app *App) isIndexedLocation(found imageLocation) (bool, error) {
+	var storedHash sql.NullString
+	file, err := scanImageFile(app.db.QueryRow("SELECT "+imageFileColumns+", i.content_hash FROM images i WHERE i.library_root = ? AND i.relative_path = ?",
+		found.Root, found.RelativePath), &storedHash)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+	if err == nil {
+		// Images indexed before content hashes get one on the next scan
+		if !storedHash.Valid {
+			hash, err := fileContentHash(found.path())
+			if err != nil {
+				return true, err
+			}
+			_, err = app.db.Exec("UPDATE images SET content_hash = ? WHERE id = ?", hash, file.ID)
+			return true, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// relocateIndexedImage reports whether a file that is not indexed at its
+// location is an indexed image, by its content hash: an image whose file has
+// gone from its stored location was moved or renamed within the library, and
+// its location and filename are updated to the ones found. Files of the same
+// name elsewhere are different images.
+func (app *App) relocateIndexedImage(found imageLocation, hash string) (bool, error) {
+	rows, err := app.db.Query("SELECT "+imageFileColumns+" FROM images i WHERE i.content_hash = ?", hash)
+	if err != nil {
+		return false, err
+	}
+	var candidates []imageFile
+	for rows.Next() {
+		candidate, err := scanImageFile(rows)
+		if err != nil {
+			rows.Close()
+			return false, err
+		}
+		candidates = append(candidates, candidate)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	for _, candidate := range candidates {
+		if !imageFileExists(candidate) {
+			return true, app.moveImageRecord(candidate, found)
+		}
+	}
+	return false, nil
+}
+
+func imageFileExists(file imageFile) bool {
+	for _, filePath := range []string{file.Location.path(), file.trashPath()} {
+		if _, err := os.Stat(filePath); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// moveImageRecord points an image at the file found at a new location, keeping
+// its ID. Hand edits, keyed by location, follow a moved file.
+func (app *App) moveImageRecord(file imageFile, found imageLocation) error {
+	filename := path.Base(found.RelativePath)
+	tx, err := app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE images SET filename = ?, library_root = ?, relative_path = ?, folder = ? WHERE id = ?",
+		filename, found.Root, found.RelativePath, imageFolder(found.RelativePath), file.ID); err != nil {
+		return err
+	}
+	if err := moveImageEdits(tx, file, found); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("Image %d moved from %s to %s", file.ID, file.Location.path(), found.path())
+	return nil
+}
+
+// moveImageEdits moves the hand edits of an image to its new location. Edits
+// found there were left by an image that is no longer indexed: they give way
+// to the moved image's own, or are taken over when it has none, and either
+// case is reported.
+func moveImageEdits(tx *sql.Tx, file imageFile, found imageLocation) error {
+	var hasEdits, foundHasEdits bool
+	err := tx.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM image_edits WHERE library_root = ? AND relative_path = ?),
+		       EXISTS (SELECT 1 FROM image_edits WHERE library_root = ? AND relative_path = ?)
+	`, file.Location.Root, file.Location.RelativePath, found.Root, found.RelativePath).Scan(&hasEdits, &foundHasEdits)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case foundHasEdits && hasEdits:
+		log.Printf("Warning: replacing the edits left at %s with those of image %d", found.path(), file.ID)
+		if _, err := tx.Exec("DELETE FROM image_edits WHERE library_root = ? AND relative_path = ?", found.Root, found.RelativePath); err != nil {
+			return err
+		}
+	case foundHasEdits:
+		log.Printf("Warning: image %d takes over the edits left at %s", file.ID, found.path())
+		return nil
+	case !hasEdits:
+		return nil
+	}
+
+	_, err = tx.Exec("UPDATE image_edits SET library_root = ?, relative_path = ? WHERE library_root = ? AND relative_path = ?",
+		found.Root, found.RelativePath, file.Location.Root, file.Location.RelativePath)
+	return err
+}
+
+// migrateLibraryColumns adds the location of image files, which identifies
+// an image. Images indexed before library roots get the location they have
+// in the category folders of the original layout.
+func (app *App) migrateLibraryColumns() error {
+	columns := []struct{ name, definition string }{
+		{"library_root", "TEXT"},
+		{"relative_path", "TEXT"},
+	}
+	for _, column := range columns {
+		if err := app.addColumnIfMissing("images", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+
+	_, err := app.db.Exec(`
+		UPDATE images SET
+			library_root = COALESCE(library_root, CASE WHEN is_nsfw THEN 'images_nsfw' ELSE 'images' END),
+			relative_path = COALESCE(relative_path, filename)
+		WHERE library_root IS NULL OR relative_path IS NULL;
+		DROP INDEX IF EXISTS idx_images_library_path;
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_images_location ON images(library_root, relative_path);
+	`)
+	return err
+}
+
+// migrateLegacyTrash moves files trashed before library roots, kept under
+// trash/images and trash/images_nsfw, into the trash of their root.
+func migrateLegacyTrash() error {
+	for _, dir := range []string{"images", "images_nsfw"} {
+		legacyDir := filepath.Join(legacyTrashDir, dir)
+		entries, err := os.ReadDir(legacyDir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		moves := make([]fileMove, 0, len(entries))
+		for _, entry := range entries {
+			if entry.Type().IsRegular() {
+				moves = append(moves, fileMove{
+					from: filepath.Join(legacyDir, entry.Name()),
+					to:   filepath.Join(dir, libraryTrashDir, entry.Name()),
+				})
+			}
+		}
+		if _, err := moveFiles(moves); err != nil {
+			return err
+		}
+		_ = os.Remove(legacyDir)
+	}
+	_ = os.Remove(legacyTrashDir)
+	return nil
+}
+
+// migrateTrashFileNames prefixes the image ID to the names of files trashed
+// before the prefix was added, which kept their plain name.
+func (app *App) migrateTrashFileNames() error {
+	files, err := app.loadImageFiles("i.trashed_at IS NOT NULL")
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if file.Location.check() != nil {
+			continue
+		}
+		// Files already renamed are skipped, and moveFiles skips missing ones
+		if _, err := os.Lstat(file.trashPath()); err == nil {
+			continue
+		}
+		plain := filepath.Join(file.Location.Root, libraryTrashDir, filepath.FromSlash(file.Location.RelativePath))
+		if _, err := moveFiles([]fileMove{{from: plain, to: file.trashPath()}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleImageFile serves the original file of an image by ID, from the
+// library or the trash.
+func (app *App) handleImageFile(w http.ResponseWriter, r *http.Request) {
+	imageID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || imageID <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	file, trashed, err := app.loadImageFile(imageID)
+	if err != nil {
+		if !errors.Is(err, errImageNotFound) {
+			log.Printf("Failed to serve image %d: %v", imageID, err)
+		}
+		http.NotFound(w, r)
+		return
+	}
+	if err := file.Location.check(); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	imagePath := file.Location.path()
+	if trashed {
+		imagePath = file.trashPath()
+	}
+	http.ServeFile(w, r, app.libraryPath(imagePath))
+}
+
+// libraryPath resolves a relative library path against libraryBaseDir, the
+// working directory unless a test sets it.
+func (app *App) libraryPath(filePath string) string {
+	if app.libraryBaseDir == "" || filepath.IsAbs(filePath) {
+		return filePath
+	}
+	return filepath.Join(app.libraryBaseDir, filePath)
+}
+
+// imageFilePath returns the path of an image file in the library.
+func (app *App) imageFilePath(loc imageLocation) (string, error) {
+	if err := loc.check(); err != nil {
+		return "", err
+	}
+	return app.libraryPath(loc.path()), nil
+}
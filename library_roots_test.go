@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestParseLibraryRoots(t *testing.T) {
+	sep := string(filepath.ListSeparator)
+	roots, err := parseLibraryRoots("images" + sep + "images_nsfw=nsfw" + sep + " archive/ =NSFW, ro ")
+	if err != nil {
+		t.Fatalf("parse library roots: %v", err)
+	}
+	want := []LibraryRoot{
+		{Path: "images"},
+		{Path: "images_nsfw", NSFW: true},
+		{Path: "archive", NSFW: true, ReadOnly: true},
+	}
+	if !reflect.DeepEqual(roots, want) {
+		t.Errorf("parseLibraryRoots = %+v, want %+v", roots, want)
+	}
+
+	for _, value := range []string{"", "images=sfw,fast", "images" + sep + "images/", "=nsfw"} {
+		if _, err := parseLibraryRoots(value); err == nil {
+			t.Errorf("expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestScanLibraryRootIsRecursive(t *testing.T) {
+	t.Chdir(t.TempDir())
+	for _, name := range []string{
+		"top.png",
+		"2025-05-14/portraits/a.JPG",
+		"2025-05-14/notes.txt",
+		".trash/deleted.png",
+		".cache/b.png",
+	} {
+		writeDeletionTestFile(t, filepath.Join("library", filepath.FromSlash(name)))
+	}
+
+	files, err := scanLibraryRoot(LibraryRoot{Path: "library"})
+	if err != nil {
+		t.Fatalf("scan library root: %v", err)
+	}
+	want := []string{"2025-05-14/portraits/a.JPG", "top.png"}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("scanLibraryRoot = %v, want %v", files, want)
+	}
+
+	if files, err := scanLibraryRoot(LibraryRoot{Path: "missing"}); err != nil || len(files) != 0 {
+		t.Errorf("expected a missing root to be empty, got %v, %v", files, err)
+	}
+}
+
+func TestCategoryMoveKeepsPathAndRespectsReadOnlyRoots(t *testing.T) {
+	t.Chdir(t.TempDir())
+	app := &App{}
+	setupTestDB(t, app).Close()
+	t.Cleanup(func() { app.db.Close() })
+	t.Cleanup(func() { libraryRoots = defaultLibraryRoots() })
+	libraryRoots = []LibraryRoot{
+		{Path: "comfy"},
+		{Path: "nsfw", NSFW: true},
+		{Path: "archive", ReadOnly: true},
+	}
+
+	if _, err := app.db.Exec(`
+		INSERT INTO images (id, filename, width, height, prompt, neg_prompt, steps, cfg_scale, sampler, scheduler, seed, thumbnail_path, is_nsfw, content_level, library_root, relative_path) VALUES
+			(1, 'a.png', 1, 1, '', '', 20, 7, '', '', 1, '', 0, 0, 'comfy', '2025-05-14/a.png'),
+			(2, 'b.png', 1, 1, '', '', 20, 7, '', '', 2, '', 0, 0, 'archive', 'b.png');
+	`); err != nil {
+		t.Fatalf("insert test images: %v", err)
+	}
+	writeDeletionTestFile(t, filepath.Join("comfy", "2025-05-14", "a.png"))
+	writeDeletionTestFile(t, filepath.Join("archive", "b.png"))
+
+	if _, err := app.setContentLevel(1, contentLevelX); err != nil {
+		t.Fatalf("set level of image 1: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join("nsfw", "2025-05-14", "a.png")); err != nil {
+		t.Fatalf("expected the file in the NSFW root at the same path: %v", err)
+	}
+	file, _, err := app.loadImageFile(1)
+	if err != nil {
+		t.Fatalf("load image 1: %v", err)
+	}
+	if file.Location != (imageLocation{Root: "nsfw", RelativePath: "2025-05-14/a.png"}) {
+		t.Errorf("unexpected location %+v", file.Location)
+	}
+
+	if _, err := app.setContentLevel(2, contentLevelX); !errors.Is(err, errLibraryRootReadOnly) {
+		t.Errorf("expected a read-only root to be refused, got %v", err)
+	}
+	if _, err := app.trashImage(2); !errors.Is(err, errLibraryRootReadOnly) {
+		t.Errorf("expected trashing from a read-only root to be refused, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join("archive", "b.png")); err != nil {
+		t.Errorf("expected the read-only file to stay: %v", err)
+	}
+}
+
+func TestHandleImageFileServesByID(t *testing.T) {
+	t.Chdir(t.TempDir())
+	app := &App{}
+	setupTestDB(t, app).Close()
+	t.Cleanup(func() { app.db.Close() })
+
+	if _, err := app.db.Exec(`
+		INSERT INTO images (id, filename, width, height, prompt, neg_prompt, steps, cfg_scale, sampler, scheduler, seed, thumbnail_path, is_nsfw, library_root, relative_path) VALUES
+			(1, 'a.png', 1, 1, '', '', 20, 7, '', '', 1, '', 0, 'images', 'nested/a.png'),
+			(2, 'b.png', 1, 1, '', '', 20, 7, '', '', 2, '', 1, NULL, NULL);
+	`); err != nil {
+		t.Fatalf("insert test images: %v", err)
+	}
+	// Image 2 was indexed before library roots and has no stored location
+	writeDeletionTestFile(t, filepath.Join("images", "nested", "a.png"))
+	writeDeletionTestFile(t, filepath.Join("images_nsfw", "b.png"))
+
+	router := mux.NewRouter()
+	router.HandleFunc("/media/{id}", app.handleImageFile)
+	for _, url := range []string{"/media/1", "/media/2"} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, url, nil))
+		if recorder.Code != http.StatusOK || recorder.Body.String() != "image" {
+			t.Errorf("GET %s = %d %q", url, recorder.Code, recorder.Body.String())
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/media/3", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("expected a missing image to be 404, got %d", recorder.Code)
+	}
+}
+
+func TestFindImageByName(t *testing.T) {
+	t.Chdir(t.TempDir())
+	app := &App{}
+	setupTestDB(t, app).Close()
+	t.Cleanup(func() { app.db.Close() })
+
+	if _, err := app.db.Exec(`
+		INSERT INTO images (id, filename, width, height, prompt, neg_prompt, steps, cfg_scale, sampler, scheduler, seed, thumbnail_path, is_nsfw, library_root, relative_path, trashed_at) VALUES
+			(1, '00001_.png', 1, 1, '', '', 20, 7, '', '', 1, '', 0, 'images', '2024-05-01/00001_.png', NULL),
+			(2, '00001_.png', 1, 1, '', '', 20, 7, '', '', 2, '', 1, 'images_nsfw', '2024-05-02/00001_.png', NULL),
+			(3, 'fox.png', 1, 1, '', '', 20, 7, '', '', 3, '', 0, 'images', 'fox.png', NULL),
+			(4, 'old.png', 1, 1, '', '', 20, 7, '', '', 4, '', 0, 'images', 'old.png', CURRENT_TIMESTAMP);
+	`); err != nil {
+		t.Fatalf("insert test images: %v", err)
+	}
+
+	for name, want := range map[string]int{
+		"fox.png":                      3,
+		"3":                            3,
+		"2024-05-02/00001_.png":        2,
+		"images/2024-05-01/00001_.png": 1,
+		filepath.Join("2024-05-01", "00001_.png"): 1,
+	} {
+		file, err := app.findImageByName(name)
+		if err != nil || file.ID != want {
+			t.Errorf("findImageByName(%q) = %d, %v; want %d", name, file.ID, err, want)
+		}
+	}
+
+	if _, err := app.findImageByName("00001_.png"); !errors.Is(err, errAmbiguousImage) {
+		t.Errorf("expected a shared filename to be ambiguous, got %v", err)
+	}
+	for _, name := range []string{"old.png", "4", "missing.png"} {
+		if _, err := app.findImageByName(name); !errors.Is(err, errImageNotFound) {
+			t.Errorf("findImageByName(%q): expected not found, got %v", name, err)
+		}
+	}
+}
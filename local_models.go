@@ -0,0 +1,369 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// A safetensors header is a JSON document; anything larger than this is
+	// not a real header and would only waste memory.
+	maxSafetensorsHeaderBytes = 100 << 20
+
+	// AutoV1 is the legacy A1111 model hash: SHA256 of a 64KiB window read
+	// 1MiB into the file, truncated to 8 hex characters.
+	autoV1Offset = 0x100000
+	autoV1Length = 0x10000
+)
+
+var localModelExtensions = map[string]bool{
+	".safetensors": true,
+	".ckpt":        true,
+}
+
+// modelFileHashes holds the hash formats generators write into image
+// metadata, so an image hash can be matched against a file on disk.
+type modelFileHashes struct {
+	SHA256 string
+	AutoV1 string
+	AutoV2 string
+}
+
+// LocalModelFile describes a checkpoint or LoRA found by -scan-models.
+type LocalModelFile struct {
+	Path        string
+	Filename    string
+	Size        int64
+	ModifiedAt  time.Time
+	Hashes      modelFileHashes
+	Metadata    map[string]string
+	Name        string
+	VersionName string
+	Type        string
+	BaseModel   string
+	Description string
+}
+
+// computeModelFileHashes reads the whole file once and derives the SHA256,
+// AutoV2 (first 10 characters of the SHA256) and legacy AutoV1 hashes.
+func computeModelFileHashes(path string) (modelFileHashes, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return modelFileHashes{}, err
+	}
+	defer file.Close()
+
+	fullHash := sha256.New()
+	if _, err := io.Copy(fullHash, file); err != nil {
+		return modelFileHashes{}, fmt.Errorf("hash %s: %w", path, err)
+	}
+	sum := hex.EncodeToString(fullHash.Sum(nil))
+
+	hashes := modelFileHashes{
+		SHA256: strings.ToUpper(sum),
+		AutoV2: strings.ToUpper(sum[:10]),
+	}
+
+	window := make([]byte, autoV1Length)
+	n, err := file.ReadAt(window, autoV1Offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return modelFileHashes{}, fmt.Errorf("hash %s: %w", path, err)
+	}
+	if n > 0 {
+		legacy := sha256.Sum256(window[:n])
+		hashes.AutoV1 = strings.ToUpper(hex.EncodeToString(legacy[:])[:8])
+	}
+
+	return hashes, nil
+}
+
+// readSafetensorsMetadata returns the "__metadata__" object of a safetensors
+// header. Training tools (kohya ss_* keys) and the modelspec convention store
+// everything as strings there.
+func readSafetensorsMetadata(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var headerLength uint64
+	if err := binary.Read(file, binary.LittleEndian, &headerLength); err != nil {
+		return nil, fmt.Errorf("read safetensors header length: %w", err)
+	}
+	if headerLength == 0 || headerLength > maxSafetensorsHeaderBytes {
+		return nil, fmt.Errorf("invalid safetensors header length %d", headerLength)
+	}
+
+	header := make([]byte, headerLength)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return nil, fmt.Errorf("read safetensors header: %w", err)
+	}
+
+	var parsed struct {
+		Metadata map[string]string `json:"__metadata__"`
+	}
+	if err := json.Unmarshal(header, &parsed); err != nil {
+		return nil, fmt.Errorf("decode safetensors header: %w", err)
+	}
+	if parsed.Metadata == nil {
+		return map[string]string{}, nil
+	}
+	return parsed.Metadata, nil
+}
+
+// describeLocalModel fills the display fields of a scanned file from its
+// header metadata, falling back to the filename for untagged checkpoints.
+func describeLocalModel(model *LocalModelFile) {
+	metadata := model.Metadata
+	stem := strings.TrimSuffix(model.Filename, filepath.Ext(model.Filename))
+
+	model.Name = firstNonEmpty(metadata["modelspec.title"], metadata["ss_output_name"], stem)
+	model.VersionName = metadata["modelspec.version"]
+	model.Description = metadata["modelspec.description"]
+	model.BaseModel = firstNonEmpty(metadata["ss_base_model_version"], metadata["modelspec.architecture"])
+
+	switch {
+	case metadata["ss_network_module"] != "" || strings.Contains(strings.ToLower(metadata["modelspec.architecture"]), "lora"):
+		model.Type = "LORA"
+	case pathHasSegment(model.Path, "lora", "loras"):
+		model.Type = "LORA"
+	default:
+		model.Type = "Checkpoint"
+	}
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func pathHasSegment(path string, segments ...string) bool {
+	for _, part := range strings.Split(filepath.ToSlash(filepath.Dir(path)), "/") {
+		for _, segment := range segments {
+			if strings.EqualFold(part, segment) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// localModelMetadataJSON keeps the training and modelspec keys of a header
+// so they can be inspected later without opening the model file again.
+func localModelMetadataJSON(metadata map[string]string) string {
+	kept := make(map[string]string)
+	for key, value := range metadata {
+		if strings.HasPrefix(key, "ss_") || strings.HasPrefix(key, "modelspec.") {
+			kept[key] = value
+		}
+	}
+	if len(kept) == 0 {
+		return ""
+	}
+	encoded, err := json.Marshal(kept)
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
+
+func findLocalModelFiles(root string) ([]string, error) {
+	var paths []string
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			log.Printf("Skipping %s: %v", path, err)
+			if entry != nil && entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		if localModelExtensions[strings.ToLower(filepath.Ext(path))] {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	sort.Strings(paths)
+	return paths, err
+}
+
+// scanLocalModels walks a models directory and registers every checkpoint
+// and LoRA in the models table, so image hashes resolve without Civitai.
+func (app *App) scanLocalModels(root string) (int, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return 0, fmt.Errorf("open models directory: %v", err)
+	}
+	if !info.IsDir() {
+		return 0, fmt.Errorf("%s is not a directory", root)
+	}
+
+	fmt.Printf("Scanning %s for model files...\n", root)
+	paths, err := findLocalModelFiles(root)
+	if err != nil {
+		return 0, fmt.Errorf("walk models directory: %v", err)
+	}
+	fmt.Printf("Found %d model files\n", len(paths))
+
+	registered := 0
+	for i, path := range paths {
+		fileInfo, err := os.Stat(path)
+		if err != nil {
+			fmt.Printf("Warning: Cannot read %s: %v\n", path, err)
+			continue
+		}
+
+		unchanged, err := app.localModelUnchanged(path, fileInfo)
+		if err != nil {
+			return registered, err
+		}
+		if unchanged {
+			fmt.Printf("Skipping %d/%d: %s (already registered)\n", i+1, len(paths), filepath.Base(path))
+			continue
+		}
+
+		fmt.Printf("Hashing %d/%d: %s\n", i+1, len(paths), filepath.Base(path))
+		model := &LocalModelFile{
+			Path:       path,
+			Filename:   filepath.Base(path),
+			Size:       fileInfo.Size(),
+			ModifiedAt: fileInfo.ModTime(),
+			Metadata:   map[string]string{},
+		}
+
+		model.Hashes, err = computeModelFileHashes(path)
+		if err != nil {
+			fmt.Printf("Warning: %v\n", err)
+			continue
+		}
+
+		if strings.EqualFold(filepath.Ext(path), ".safetensors") {
+			metadata, err := readSafetensorsMetadata(path)
+			if err != nil {
+				fmt.Printf("Warning: Cannot read header of %s: %v\n", model.Filename, err)
+			} else {
+				model.Metadata = metadata
+			}
+		}
+		describeLocalModel(model)
+
+		if err := app.registerLocalModel(model); err != nil {
+			return registered, fmt.Errorf("register %s: %v", model.Filename, err)
+		}
+		registered++
+		fmt.Printf("  %s (%s, AutoV2 %s)\n", model.Name, model.Type, model.Hashes.AutoV2)
+	}
+
+	return registered, nil
+}
+
+// localModelUnchanged avoids re-hashing multi-gigabyte files that were
+// already registered with the same size and modification time.
+func (app *App) localModelUnchanged(path string, info os.FileInfo) (bool, error) {
+	var size sql.NullInt64
+	var modifiedAt sql.NullString
+	err := app.db.QueryRow(
+		"SELECT local_file_size, local_modified_at FROM models WHERE local_path = ?",
+		path,
+	).Scan(&size, &modifiedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("check registered model %s: %v", path, err)
+	}
+	return size.Int64 == info.Size() && modifiedAt.String == info.ModTime().UTC().Format(time.RFC3339Nano), nil
+}
+
+// registerLocalModel attaches a scanned file to the model row matching any of
+// its hashes, or creates one. Rows created from a failed Civitai lookup only
+// carry a placeholder name, so those get the local description instead.
+func (app *App) registerLocalModel(model *LocalModelFile) error {
+	existingID, existingName, err := app.findModelByAnyHash(model.Hashes.AutoV2, model.Hashes.AutoV1, model.Hashes.SHA256)
+	if err != nil {
+		return err
+	}
+
+	metadataJSON := localModelMetadataJSON(model.Metadata)
+	modifiedAt := model.ModifiedAt.UTC().Format(time.RFC3339Nano)
+
+	if existingID == 0 {
+		_, err := app.db.Exec(`
+			INSERT INTO models (hash, name, version_name, type, nsfw, description, base_model,
+				sha256, autov1, autov2, local_path, local_filename, local_file_size, local_modified_at, local_metadata)
+			VALUES (?, ?, ?, ?, FALSE, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			model.Hashes.AutoV2, model.Name, model.VersionName, model.Type, model.Description, model.BaseModel,
+			model.Hashes.SHA256, model.Hashes.AutoV1, model.Hashes.AutoV2,
+			model.Path, model.Filename, model.Size, modifiedAt, metadataJSON)
+		return err
+	}
+
+	_, err = app.db.Exec(`
+		UPDATE models SET
+			sha256 = ?, autov1 = ?, autov2 = ?,
+			local_path = ?, local_filename = ?, local_file_size = ?, local_modified_at = ?, local_metadata = ?
+		WHERE id = ?`,
+		model.Hashes.SHA256, model.Hashes.AutoV1, model.Hashes.AutoV2,
+		model.Path, model.Filename, model.Size, modifiedAt, metadataJSON, existingID)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(existingName, "Unknown Model") {
+		_, err = app.db.Exec(
+			"UPDATE models SET name = ?, version_name = ?, type = ?, description = ?, base_model = ? WHERE id = ?",
+			model.Name, model.VersionName, model.Type, model.Description, model.BaseModel, existingID)
+	}
+	return err
+}
+
+// findModelByAnyHash matches the short and full hash forms case-insensitively:
+// A1111 writes lowercase hashes while Civitai reports them uppercase.
+func (app *App) findModelByAnyHash(hashes ...string) (int, string, error) {
+	for _, hash := range hashes {
+		if hash == "" {
+			continue
+		}
+
+		var id int
+		var name sql.NullString
+		err := app.db.QueryRow(`
+			SELECT id, name FROM models
+			WHERE hash = ? COLLATE NOCASE
+			   OR autov2 = ? COLLATE NOCASE
+			   OR autov1 = ? COLLATE NOCASE
+			   OR sha256 = ? COLLATE NOCASE
+			ORDER BY local_path IS NULL, id
+			LIMIT 1`,
+			hash, hash, hash, hash,
+		).Scan(&id, &name)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return 0, "", fmt.Errorf("find model by hash: %v", err)
+		}
+		return id, name.String, nil
+	}
+	return 0, "", nil
+}
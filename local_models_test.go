@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func writeSafetensorsTestFile(t *testing.T, path, header string, payload []byte) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("create model directory: %v", err)
+	}
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, uint64(len(header)))
+	data = append(data, header...)
+	data = append(data, payload...)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("write safetensors file: %v", err)
+	}
+}
+
+func openLocalModelsTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("open test database: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = db.Close() })
+
+	if _, err := db.Exec(`
+		CREATE TABLE models (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			hash TEXT UNIQUE NOT NULL,
+			name TEXT,
+			version_name TEXT,
+			type TEXT,
+			nsfw BOOLEAN DEFAULT FALSE,
+			description TEXT,
+			base_model TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+	`); err != nil {
+		t.Fatalf("create test schema: %v", err)
+	}
+	app := &App{db: db}
+	if err := app.migrateLocalModelColumns(); err != nil {
+		t.Fatalf("migrate local model columns: %v", err)
+	}
+
+	return db
+}
+
+func TestReadSafetensorsMetadata(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "detail.safetensors")
+	writeSafetensorsTestFile(t, path,
+		`{"__metadata__":{"ss_output_name":"detail_slider","ss_network_module":"networks.lora","modelspec.title":"Detail Slider"},"w":{"dtype":"F16","shape":[1],"data_offsets":[0,2]}}`,
+		[]byte{0, 0},
+	)
+
+	metadata, err := readSafetensorsMetadata(path)
+	if err != nil {
+		t.Fatalf("read metadata: %v", err)
+	}
+	if metadata["ss_output_name"] != "detail_slider" || metadata["modelspec.title"] != "Detail Slider" {
+		t.Fatalf("unexpected metadata: %#v", metadata)
+	}
+
+	model := &LocalModelFile{Path: path, Filename: filepath.Base(path), Metadata: metadata}
+	describeLocalModel(model)
+	if model.Name != "Detail Slider" || model.Type != "LORA" {
+		t.Fatalf("unexpected description: name=%q type=%q", model.Name, model.Type)
+	}
+}
+
+func TestReadSafetensorsMetadataRejectsGarbage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broken.safetensors")
+	if err := os.WriteFile(path, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, '{'}, 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+	if _, err := readSafetensorsMetadata(path); err == nil {
+		t.Fatal("expected an invalid header length error")
+	}
+}
+
+func TestComputeModelFileHashes(t *testing.T) {
+	data := make([]byte, autoV1Offset+autoV1Length+100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	path := filepath.Join(t.TempDir(), "model.ckpt")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	hashes, err := computeModelFileHashes(path)
+	if err != nil {
+		t.Fatalf("compute hashes: %v", err)
+	}
+
+	full := sha256.Sum256(data)
+	wantSHA := strings.ToUpper(hex.EncodeToString(full[:]))
+	legacy := sha256.Sum256(data[autoV1Offset : autoV1Offset+autoV1Length])
+	wantAutoV1 := strings.ToUpper(hex.EncodeToString(legacy[:])[:8])
+
+	if hashes.SHA256 != wantSHA {
+		t.Errorf("SHA256 = %s, want %s", hashes.SHA256, wantSHA)
+	}
+	if hashes.AutoV2 != wantSHA[:10] {
+		t.Errorf("AutoV2 = %s, want %s", hashes.AutoV2, wantSHA[:10])
+	}
+	if hashes.AutoV1 != wantAutoV1 {
+		t.Errorf("AutoV1 = %s, want %s", hashes.AutoV1, wantAutoV1)
+	}
+}
+
+func TestScanLocalModelsResolvesImageHashesWithoutCivitai(t *testing.T) {
+	db := openLocalModelsTestDB(t)
+	app := &App{db: db}
+
+	root := t.TempDir()
+	checkpoint := filepath.Join(root, "checkpoints", "privateMix_v2.safetensors")
+	writeSafetensorsTestFile(t, checkpoint,
+		`{"__metadata__":{"modelspec.title":"Private Mix","modelspec.architecture":"stable-diffusion-xl-v1-base"}}`,
+		[]byte("weights"),
+	)
+
+	// A failed Civitai lookup left a placeholder row for a LoRA on disk
+	lora := filepath.Join(root, "Lora", "style.safetensors")
+	writeSafetensorsTestFile(t, lora, `{"__metadata__":{"ss_output_name":"style"}}`, []byte("lora"))
+	loraHashes, err := computeModelFileHashes(lora)
+	if err != nil {
+		t.Fatalf("hash LoRA: %v", err)
+	}
+	placeholderHash := strings.ToLower(loraHashes.AutoV2)
+	if _, err := db.Exec(
+		"INSERT INTO models (hash, name, version_name, type, description, base_model) VALUES (?, ?, '', 'Unknown', '', '')",
+		placeholderHash, "Unknown Model ("+placeholderHash[:8]+")",
+	); err != nil {
+		t.Fatalf("insert placeholder model: %v", err)
+	}
+
+	registered, err := app.scanLocalModels(root)
+	if err != nil {
+		t.Fatalf("scan models: %v", err)
+	}
+	if registered != 2 {
+		t.Fatalf("registered %d models, want 2", registered)
+	}
+
+	checkpointHashes, err := computeModelFileHashes(checkpoint)
+	if err != nil {
+		t.Fatalf("hash checkpoint: %v", err)
+	}
+
+	// Images written by A1111 carry the lowercase short hash
+	model, err := app.getOrCreateModel(strings.ToLower(checkpointHashes.AutoV2))
+	if err != nil {
+		t.Fatalf("resolve checkpoint: %v", err)
+	}
+	if model.Name != "Private Mix" || model.LocalFilename != "privateMix_v2.safetensors" || model.Type != "Checkpoint" {
+		t.Fatalf("unexpected checkpoint model: %#v", model)
+	}
+
+	model, err = app.getOrCreateModel(checkpointHashes.SHA256)
+	if err != nil {
+		t.Fatalf("resolve checkpoint by SHA256: %v", err)
+	}
+	if model.LocalFilename != "privateMix_v2.safetensors" {
+		t.Fatalf("SHA256 lookup returned %#v", model)
+	}
+
+	model, err = app.getOrCreateModel(placeholderHash)
+	if err != nil {
+		t.Fatalf("resolve LoRA: %v", err)
+	}
+	if model.Name != "style" || model.Type != "LORA" || model.LocalFilename != "style.safetensors" {
+		t.Fatalf("placeholder was not replaced by local details: %#v", model)
+	}
+
+	var modelCount int
+	if err := db.QueryRow("SELECT COUNT(*) FROM models").Scan(&modelCount); err != nil {
+		t.Fatalf("count models: %v", err)
+	}
+	if modelCount != 2 {
+		t.Fatalf("expected the placeholder row to be reused, got %d models", modelCount)
+	}
+
+	registered, err = app.scanLocalModels(root)
+	if err != nil {
+		t.Fatalf("rescan models: %v", err)
+	}
+	if registered != 0 {
+		t.Fatalf("unchanged files were hashed again: %d registered", registered)
+	}
+}
@@ -29,6 +29,8 @@ type Model struct {
 	Description string `json:"description"`
 	BaseModel   string `json:"base_model"`
 	CreatedAt   string `json:"created_at"`
+	// LocalFilename is set for models registered from disk by -scan-models
+	LocalFilename string `json:"local_filename,omitempty"`
 }
 
 type CivitaiModelResponse struct {
@@ -70,11 +72,14 @@ type CivitaiVersionResponse struct {
 
 type ImageMetadata struct {
 	ID               int        `json:"id"`
+	CivitaiImageID   int        `json:"civitai_image_id,omitempty"`
+	ContentHash      string     `json:"content_hash,omitempty"`
 	Filename         string     `json:"filename"`
 	Width            int        `json:"width"`
 	Height           int        `json:"height"`
 	ModelID          *int       `json:"model_id"`
-	Model            string     `json:"model"` // For display purposes
+	Model            string     `json:"model"`      // For display purposes
+	ModelFile        string     `json:"model_file"` // Local checkpoint filename from -scan-models
 	ModelHash        string     `json:"model_hash"`
 	Prompt           string     `json:"prompt"`
 	NegPrompt        string     `json:"neg_prompt"`
@@ -89,6 +94,134 @@ type ImageMetadata struct {
 	DisplayTimestamp *time.Time `json:"display_timestamp"` // Computed chronological timestamp
 	TruncatedPrompt  string     `json:"-"`
 	LoRAs            []LoraData `json:"loras"` // LoRA data for JSON and template display
+
+	// Extended A1111 settings promoted from the image_params table
+	ClipSkip          int               `json:"clip_skip,omitempty"`
+	VAE               string            `json:"vae,omitempty"`
+	VAEHash           string            `json:"vae_hash,omitempty"`
+	DenoisingStrength float64           `json:"denoising_strength,omitempty"`
+	HiresUpscale      float64           `json:"hires_upscale,omitempty"`
+	HiresUpscaler     string            `json:"hires_upscaler,omitempty"`
+	HiresSteps        int               `json:"hires_steps,omitempty"`
+	ADetailerModel    string            `json:"adetailer_model,omitempty"`
+	VariationSeed     int64             `json:"variation_seed,omitempty"`
+	GeneratorVersion  string            `json:"generator_version,omitempty"`
+	LoraHashes        string            `json:"lora_hashes,omitempty"`
+	Params            []GenerationParam `json:"params,omitempty"` // Every key of the parameters line
+
+	// Which parser recognized the file, and the text blocks it contained
+	MetadataParser  string           `json:"metadata_parser,omitempty"`
+	MetadataSources []MetadataSource `json:"-"`
+
+	// Rating (-1 rejected, 0 unrated, 1-5) and color label from XMP
+	XMPRating int    `json:"xmp_rating,omitempty"`
+	XMPLabel  string `json:"xmp_label,omitempty"`
+
+	// The file's parameters were written back from the viewer's record
+	ParametersWritten bool `json:"-"`
+
+	// Star rating (0 unrated, 1-5) and favorite flag set in the viewer
+	Rating   int  `json:"rating"`
+	Favorite bool `json:"favorite"`
+
+	// User tags from the image_tags table
+	Tags []string `json:"tags,omitempty"`
+
+	// Placeholder shown in the grid while the thumbnail loads
+	BlurHash      string `json:"blurhash,omitempty"`
+	DominantColor string `json:"dominant_color,omitempty"`
+
+	// Palette computed when indexing, stored in the image_palette table
+	Palette imagePalette `json:"-"`
+
+	// Still image, animated GIF or WebP, or video, with the frames of
+	// animations and videos
+	MediaType  string `json:"media_type"`
+	FrameCount int    `json:"frame_count,omitempty"`
+	DurationMS int    `json:"duration_ms,omitempty"`
+
+	// Free-form notes and the fields corrected by hand, from image_edits
+	Notes        string   `json:"notes,omitempty"`
+	EditedFields []string `json:"edited_fields,omitempty"`
+
+	// In the trash; the original file is in the trash folder of its library
+	// root until restored or purged
+	Trashed bool `json:"trashed,omitempty"`
+
+	// Where the file is stored: a library root and the path inside it
+	LibraryRoot  string `json:"-"`
+	RelativePath string `json:"relative_path,omitempty"`
+
+	// Graded content level (contentLevelNone to contentLevelX)
+	ContentLevel int `json:"content_level"`
+}
+
+// ContentLevelName names the content level for templates and the level filter.
+func (img ImageMetadata) ContentLevelName() string {
+	return contentLevelName(img.ContentLevel)
+}
+
+// IsVideo reports whether the grid and the lightbox play the original file
+// instead of showing thumbnails.
+func (img ImageMetadata) IsVideo() bool {
+	return img.MediaType == mediaTypeVideo
+}
+
+// IsMoving reports whether the grid shows a play badge.
+func (img ImageMetadata) IsMoving() bool {
+	return img.MediaType == mediaTypeAnimation || img.MediaType == mediaTypeVideo
+}
+
+// DurationLabel formats the duration for the play badge, as 0:04.
+func (img ImageMetadata) DurationLabel() string {
+	if img.DurationMS <= 0 {
+		return ""
+	}
+	seconds := (img.DurationMS + 500) / 1000
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
+
+func (img ImageMetadata) mediaType() string {
+	if img.MediaType == "" {
+		return mediaTypeImage
+	}
+	return img.MediaType
+}
+
+// ParamsJSON encodes the generic parameters for the lightbox data attribute.
+func (img ImageMetadata) ParamsJSON() string {
+	if len(img.Params) == 0 {
+		return "[]"
+	}
+	encoded, err := json.Marshal(img.Params)
+	if err != nil {
+		return "[]"
+	}
+	return string(encoded)
+}
+
+// TagsJSON encodes the user tags for the lightbox data attribute.
+func (img ImageMetadata) TagsJSON() string {
+	if len(img.Tags) == 0 {
+		return "[]"
+	}
+	encoded, err := json.Marshal(img.Tags)
+	if err != nil {
+		return "[]"
+	}
+	return string(encoded)
+}
+
+// EditedFieldsJSON encodes the hand-edited fields for the lightbox data attribute.
+func (img ImageMetadata) EditedFieldsJSON() string {
+	if len(img.EditedFields) == 0 {
+		return "[]"
+	}
+	encoded, err := json.Marshal(img.EditedFields)
+	if err != nil {
+		return "[]"
+	}
+	return string(encoded)
 }
 
 type ModelStat struct {
@@ -108,6 +241,27 @@ type PageData struct {
 	InitialURL      string
 	SelectedModelID int
 	OthersSelected  bool
+	RatingFilter    string
+	SortOrder       string
+	Tags            []TagStat
+	IncludeTags     string
+	ExcludeTags     string
+	Collections     []Collection
+	Collection      *Collection
+	Folders         []FolderOption
+	FolderFilter    string
+	ColorFamilies   []string
+	ColorFilter     string
+	ToneFilter      string
+	AspectBuckets   []AspectStat
+	AspectFilter    string
+	MinMegapixels   string
+	MaxMegapixels   string
+	SavedSearches   []SavedSearch
+	SavedSearch     *SavedSearch
+	Trash           bool
+	TrashCount      int
+	TrashRetention  int // days before trashed images are purged, 0 to keep them
 }
 
 type ImageGridData struct {
@@ -132,7 +286,8 @@ type App struct {
 	db                 *sql.DB
 	templates          *template.Template
 	promptGenerator    PromptGenerator
-	promptImageBaseDir string
+	libraryBaseDir     string
+	trashRetentionDays int
 }
 
 type ModelStatsResponse struct {
@@ -142,11 +297,15 @@ type ModelStatsResponse struct {
 
 func main() {
 	// Parse command line flags
-	clearImages := flag.Bool("clear-images", false, "Clear images and loras tables (preserves models)")
+	clearImages := flag.Bool("clear-images", false, "Clear images, loras and tags tables (preserves models)")
 	importImages := flag.Bool("import-civitai", false, "Import images and prompts from Civitai API")
 	cleanDuplicates := flag.Bool("clean-duplicates", false, "Move duplicate images from images_nsfw to temp folder")
 	fixTimestamps := flag.Bool("fix-timestamps", false, "Fix display timestamps for existing Civitai images using real creation dates")
-	fixMetadata := flag.String("fix-metadata", "", "Re-process metadata for specific images (comma-separated filenames)")
+	fixMetadata := flag.String("fix-metadata", "", "Re-process metadata for specific images (comma-separated filenames, paths or image IDs)")
+	writeMetadata := flag.String("write-metadata", "", "Write stored prompts and parameters back into image files (comma-separated filenames, paths or image IDs, or \"all\")")
+	scanModels := flag.String("scan-models", "", "Register local checkpoint and LoRA files from a models directory")
+	unblacklist := flag.String("unblacklist", "", "Remove deleted Civitai images from the blacklist and download them again (comma-separated Civitai image IDs)")
+	rebuildThumbnails := flag.Bool("rebuild-thumbnails", false, "Create the thumbnails of every image again, in every size")
 	help := flag.Bool("help", false, "Show usage information")
 	flag.Parse()
 
@@ -154,17 +313,25 @@ func main() {
 		fmt.Println("AI Generated Image Viewer")
 		fmt.Println("Usage:")
 		fmt.Println("  ./ai-generated-image-viewer                   # Run the web server")
-		fmt.Println("  ./ai-generated-image-viewer -clear-images     # Clear images and LoRAs tables")
+		fmt.Println("  ./ai-generated-image-viewer -clear-images     # Clear images, LoRAs and tags tables")
 		fmt.Println("  ./ai-generated-image-viewer -import-civitai   # Import images from Civitai API")
 		fmt.Println("  ./ai-generated-image-viewer -clean-duplicates # Move duplicate NSFW images to temp folder")
 		fmt.Println("  ./ai-generated-image-viewer -fix-timestamps   # Fix display timestamps using real Civitai creation dates")
-		fmt.Println("  ./ai-generated-image-viewer -fix-metadata=\"img1.jpeg,img2.jpeg\" # Re-process metadata for specific images")
+		fmt.Println("  ./ai-generated-image-viewer -fix-metadata=\"img1.jpeg,2024-05-01/00001_.png,42\" # Re-process metadata for specific images (filenames, paths or IDs)")
+		fmt.Println("  ./ai-generated-image-viewer -write-metadata=\"img1.png\" # Embed stored metadata into image files (or \"all\")")
+		fmt.Println("  ./ai-generated-image-viewer -scan-models=/path/to/models # Register local checkpoints and LoRAs by hash")
+		fmt.Println("  ./ai-generated-image-viewer -unblacklist=\"123,456\" # Re-download deleted Civitai images")
+		fmt.Println("  ./ai-generated-image-viewer -rebuild-thumbnails # Recreate the grid thumbnails of every image")
 		fmt.Println("  ./ai-generated-image-viewer -help             # Show this help")
 		fmt.Println("")
 		fmt.Println("Server Configuration:")
 		fmt.Println("  HOST=0.0.0.0                                  # Bind to all network interfaces (default)")
 		fmt.Println("  HOST=127.0.0.1                               # Bind to localhost only (more secure)")
 		fmt.Println("  PORT=8081                                     # Port to listen on (default: 8081)")
+		fmt.Println("  TRASH_RETENTION_DAYS=30                       # Days before deleted images are purged (0 keeps them)")
+		fmt.Println("  NSFW_FOLDER_LEVEL=x                           # Lowest content level of the NSFW category (soft, mature or x)")
+		fmt.Println("  LIBRARY_ROOTS=images:images_nsfw=nsfw         # Image folders, scanned recursively; options: sfw, nsfw, ro, rw")
+		fmt.Println("  THUMBNAILS_DIR=thumbnails                     # Where thumbnails are cached (one folder per size)")
 		fmt.Println("")
 		fmt.Println("Prompt Generation Configuration:")
 		fmt.Println("  PROMPT_LLM_API_KEY                           # Provider API key (falls back to XAI_API_KEY)")
@@ -195,8 +362,16 @@ func main() {
 		os.Exit(0)
 	}
 
+	nsfwFolderLevel = nsfwFolderLevelFromEnv()
+
+	var err error
+	if libraryRoots, err = libraryRootsFromEnv(); err != nil {
+		log.Fatal("Invalid LIBRARY_ROOTS: ", err)
+	}
+	thumbnailDir = getEnvOrDefault("THUMBNAILS_DIR", "thumbnails")
+
 	promptGenerator, promptGeneratorDescription := newPromptGeneratorFromEnv()
-	app := &App{promptGenerator: promptGenerator}
+	app := &App{promptGenerator: promptGenerator, trashRetentionDays: trashRetentionDaysFromEnv()}
 	if promptGenerator == nil {
 		log.Println("Prompt generation disabled: configure PROMPT_LLM_API_KEY or XAI_API_KEY to enable it")
 	} else {
@@ -268,12 +443,66 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Handle write-metadata flag
+	if *writeMetadata != "" {
+		filenames := strings.Split(*writeMetadata, ",")
+		for i := range filenames {
+			filenames[i] = strings.TrimSpace(filenames[i])
+		}
+
+		writtenCount, err := app.writeMetadataToFiles(filenames)
+		if err != nil {
+			log.Fatal("Failed to write metadata:", err)
+		}
+		fmt.Printf("Metadata write completed. %d image files updated.\n", writtenCount)
+		os.Exit(0)
+	}
+
+	// Handle scan-models flag
+	if *scanModels != "" {
+		registeredCount, err := app.scanLocalModels(*scanModels)
+		if err != nil {
+			log.Fatal("Failed to scan models:", err)
+		}
+		fmt.Printf("Model scan completed. %d model files registered.\n", registeredCount)
+		os.Exit(0)
+	}
+
+	// Handle unblacklist flag
+	if *unblacklist != "" {
+		var civitaiIDs []int
+		for _, value := range strings.Split(*unblacklist, ",") {
+			civitaiID, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil || civitaiID <= 0 {
+				log.Fatalf("Invalid Civitai image ID %q", value)
+			}
+			civitaiIDs = append(civitaiIDs, civitaiID)
+		}
+
+		downloadedCount, err := app.unblacklistAndDownload(civitaiIDs)
+		if err != nil {
+			log.Fatal("Failed to unblacklist images:", err)
+		}
+		fmt.Printf("Unblacklist completed. %d images downloaded.\n", downloadedCount)
+		os.Exit(0)
+	}
+
+	// Handle rebuild-thumbnails flag
+	if *rebuildThumbnails {
+		rebuiltCount, err := app.rebuildThumbnails()
+		if err != nil {
+			log.Fatal("Failed to rebuild thumbnails:", err)
+		}
+		fmt.Printf("Thumbnail rebuild completed. %d images updated.\n", rebuiltCount)
+		os.Exit(0)
+	}
+
 	// Check for new Civitai images on startup if auto-import is enabled
 	if err := app.checkForNewCivitaiImages(); err != nil {
 		log.Printf("Warning: Auto-import failed: %v", err)
 	}
 
-	// Process images and create thumbnails
+	// Index new and moved images; thumbnails are created when first requested
 	if err := app.processImages(); err != nil {
 		log.Fatal("Failed to process images:", err)
 	}
@@ -283,6 +512,9 @@ func main() {
 		log.Printf("Warning: Failed to deduplicate prompt files: %v", err)
 	}
 
+	// Purge images that have been in the trash longer than the retention
+	go app.runTrashPurge()
+
 	// Start HTTP server
 	router := mux.NewRouter()
 	app.setupRoutes(router)
@@ -306,10 +538,9 @@ func (app *App) initTemplates() error {
 }
 
 func (app *App) setupRoutes(router *mux.Router) {
-	// Serve static files
-	router.PathPrefix("/images/").Handler(http.StripPrefix("/images/", http.FileServer(http.Dir("./images/"))))
-	router.PathPrefix("/images_nsfw/").Handler(http.StripPrefix("/images_nsfw/", http.FileServer(http.Dir("./images_nsfw/"))))
-	router.PathPrefix("/thumbnails/").Handler(http.StripPrefix("/thumbnails/", http.FileServer(http.Dir("./thumbnails/"))))
+	// Serve static files; image files are served by ID from their library root
+	router.HandleFunc("/media/{id}", app.handleImageFile).Methods("GET")
+	router.HandleFunc("/media/{id}/thumbnail", app.handleImageThumbnail).Methods("GET")
 	router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("./static/"))))
 
 	// API routes
@@ -317,7 +548,39 @@ func (app *App) setupRoutes(router *mux.Router) {
 	router.HandleFunc("/api/images", app.handleAPIImages).Methods("GET")
 	router.HandleFunc("/api/models", app.handleModelStats).Methods("GET")
 	router.HandleFunc("/search", app.handleSearch).Methods("GET")
+	router.HandleFunc("/api/images/bulk", app.handleBulkOperation).Methods("POST")
 	router.HandleFunc("/api/images/{id}", app.handleDeleteImage).Methods("DELETE")
+	router.HandleFunc("/api/images/{id}/restore", app.handleRestoreImage).Methods("POST")
+	router.HandleFunc("/api/images/{id}/purge", app.handlePurgeImage).Methods("POST")
+	router.HandleFunc("/api/images/{id}/preview", app.handleImagePreview).Methods("GET")
+	router.HandleFunc("/api/images/{id}/raw-metadata", app.handleRawMetadata).Methods("GET")
+	router.HandleFunc("/api/images/{id}/write-metadata", app.handleWriteImageMetadata).Methods("POST")
+	router.HandleFunc("/api/images/{id}/rating", app.handleImageRating).Methods("POST")
+	router.HandleFunc("/api/images/{id}/content-level", app.handleSetContentLevel).Methods("POST")
+	router.HandleFunc("/api/images/{id}/edits", app.handleImageEdits).Methods("PUT")
+	router.HandleFunc("/api/tags", app.handleTagStats).Methods("GET")
+	router.HandleFunc("/api/tags/autocomplete", app.handleTagAutocomplete).Methods("GET")
+	router.HandleFunc("/api/tags/add", app.handleAddImageTags).Methods("POST")
+	router.HandleFunc("/api/tags/remove", app.handleRemoveImageTags).Methods("POST")
+	router.HandleFunc("/api/folders", app.handleFolderTree).Methods("GET")
+	router.HandleFunc("/api/aspect-ratios", app.handleAspectStats).Methods("GET")
+	router.HandleFunc("/api/collections", app.handleListCollections).Methods("GET")
+	router.HandleFunc("/api/collections", app.handleCreateCollection).Methods("POST")
+	router.HandleFunc("/api/collections/{id}", app.handleRenameCollection).Methods("PUT")
+	router.HandleFunc("/api/collections/{id}", app.handleDeleteCollection).Methods("DELETE")
+	router.HandleFunc("/api/collections/{id}/add", app.handleAddCollectionItems).Methods("POST")
+	router.HandleFunc("/api/collections/{id}/remove", app.handleRemoveCollectionItems).Methods("POST")
+	router.HandleFunc("/api/collections/{id}/reorder", app.handleReorderCollectionItems).Methods("POST")
+	router.HandleFunc("/collections/{id}", app.handleCollectionPage).Methods("GET")
+	router.HandleFunc("/api/saved-searches", app.handleListSavedSearches).Methods("GET")
+	router.HandleFunc("/api/saved-searches", app.handleCreateSavedSearch).Methods("POST")
+	router.HandleFunc("/api/saved-searches/{id}", app.handleUpdateSavedSearch).Methods("PUT")
+	router.HandleFunc("/api/saved-searches/{id}", app.handleDeleteSavedSearch).Methods("DELETE")
+	router.HandleFunc("/saved/{id}", app.handleSavedSearchPage).Methods("GET")
+	router.HandleFunc("/trash", app.handleTrashPage).Methods("GET")
+	router.HandleFunc("/api/blacklist", app.handleListBlacklist).Methods("GET")
+	router.HandleFunc("/api/blacklist/{id}", app.handleRemoveBlacklistEntry).Methods("DELETE")
+	router.HandleFunc("/blacklist", app.handleBlacklistPage).Methods("GET")
 	router.HandleFunc("/api/toggle-category", app.handleToggleCategory).Methods("POST")
 	router.HandleFunc("/api/generate-prompt", app.handleGeneratePrompt).Methods("POST")
 	router.HandleFunc("/api/comfy/generate-prompt", app.handleComfyGeneratePrompt).Methods("POST")
@@ -328,6 +591,11 @@ func (app *App) handleIndex(w http.ResponseWriter, r *http.Request) {
 	promptQuery := r.URL.Query().Get("q")
 	modelFilter := r.URL.Query().Get("model")
 	nsfwFilter := r.URL.Query().Get("nsfw")
+	ratingFilter := r.URL.Query().Get("rating")
+	sortOrder := r.URL.Query().Get("sort")
+	includeTags := parseTagList(r.URL.Query().Get("tags"))
+	excludeTags := parseTagList(r.URL.Query().Get("exclude_tags"))
+	collectionFilter := r.URL.Query().Get("collection")
 
 	// Parse selected model ID
 	var selectedModelID int
@@ -344,66 +612,124 @@ func (app *App) handleIndex(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get total count based on current filters
-	var totalCount int
-	var countQuery string
-	var args []any
+	params := imageSearchParamsFromQuery(r.URL.Query())
+	params.NSFWFilter = nsfwFilter
+	totalCount, err := app.countImages(params)
+	if err != nil {
+		log.Printf("Error getting total count: %v", err)
+		totalCount = 0
+	}
 
-	// Build count query with filters
-	whereClause := "WHERE 1=1"
-	if condition := nsfwFilterCondition(nsfwFilter); condition != "" {
-		whereClause += " AND " + condition
+	// Get model statistics
+	models, othersCount, err := app.getModelStats(nsfwFilter)
+	if err != nil {
+		log.Printf("Error getting model stats: %v", err)
+		models = []ModelStat{}
+		othersCount = 0
 	}
 
-	if condition, modelArgs := modelFilterCondition(modelFilter, nsfwFilter); condition != "" {
-		whereClause += " AND " + condition
-		args = append(args, modelArgs...)
+	// Get tag statistics
+	tags, err := app.getTagStats(nsfwFilter, "", 0)
+	if err != nil {
+		log.Printf("Error getting tag stats: %v", err)
+		tags = []TagStat{}
 	}
 
-	if promptQuery != "" {
-		whereClause += " AND i.prompt LIKE ?"
-		searchTerm := "%" + promptQuery + "%"
-		args = append(args, searchTerm)
+	// Get folder statistics
+	folders, err := app.getFolderTree(nsfwFilter)
+	if err != nil {
+		log.Printf("Error getting folder tree: %v", err)
+		folders = []FolderStat{}
 	}
 
-	countQuery = "SELECT COUNT(*) FROM images i LEFT JOIN models m ON i.model_id = m.id " + whereClause
+	// Get aspect ratio statistics
+	aspectStats, err := app.getAspectStats(nsfwFilter)
+	if err != nil {
+		log.Printf("Error getting aspect ratio stats: %v", err)
+		aspectStats = []AspectStat{}
+	}
 
-	if len(args) > 0 {
-		err := app.db.QueryRow(countQuery, args...).Scan(&totalCount)
-		if err != nil {
-			log.Printf("Error getting total count: %v", err)
-			totalCount = 0
+	collections, err := app.listCollections()
+	if err != nil {
+		log.Printf("Error listing collections: %v", err)
+		collections = []Collection{}
+	}
+	var selectedCollection *Collection
+	for i := range collections {
+		if collections[i].ID == parseCollectionFilter(collectionFilter) {
+			selectedCollection = &collections[i]
 		}
-	} else {
-		err := app.db.QueryRow(countQuery).Scan(&totalCount)
-		if err != nil {
-			log.Printf("Error getting total count: %v", err)
-			totalCount = 0
+	}
+
+	savedSearches, err := app.listSavedSearches()
+	if err != nil {
+		log.Printf("Error listing saved searches: %v", err)
+		savedSearches = []SavedSearch{}
+	}
+	var activeSavedSearch *SavedSearch
+	for i := range savedSearches {
+		if strconv.Itoa(savedSearches[i].ID) == r.URL.Query().Get("saved") {
+			activeSavedSearch = &savedSearches[i]
 		}
 	}
 
-	// Get model statistics
-	models, othersCount, err := app.getModelStats(nsfwFilter)
+	trashCount, err := app.countImages(ImageSearchParams{Trash: true})
 	if err != nil {
-		log.Printf("Error getting model stats: %v", err)
-		models = []ModelStat{}
-		othersCount = 0
+		log.Printf("Error counting trashed images: %v", err)
+		trashCount = 0
 	}
 
 	// Build initial URL for HTMX request
 	var initialURL string
+	listParams := url.Values{}
+	listParams.Set("page", "1")
+	listParams.Set("nsfw", nsfwFilter)
+	if ratingFilterCondition(ratingFilter) != "" {
+		listParams.Set("rating", ratingFilter)
+	}
+	if sortOrder == sortByRating || sortOrder == sortByMegapixels {
+		listParams.Set("sort", sortOrder)
+	}
+	if len(includeTags) > 0 {
+		listParams.Set("tags", strings.Join(includeTags, ","))
+	}
+	if len(excludeTags) > 0 {
+		listParams.Set("exclude_tags", strings.Join(excludeTags, ","))
+	}
+	if selectedCollection != nil {
+		listParams.Set("collection", strconv.Itoa(selectedCollection.ID))
+	}
+	if params.FolderFilter != "" {
+		listParams.Set("folder", params.FolderFilter)
+	}
+	if params.ColorFilter != "" {
+		listParams.Set("color", params.ColorFilter)
+	}
+	if params.ToneFilter != "" {
+		listParams.Set("tone", params.ToneFilter)
+	}
+	if params.AspectFilter != "" {
+		listParams.Set("aspect", params.AspectFilter)
+	}
+	if params.MinMegapixels > 0 {
+		listParams.Set("min_mp", formatMegapixels(params.MinMegapixels))
+	}
+	if params.MaxMegapixels > 0 {
+		listParams.Set("max_mp", formatMegapixels(params.MaxMegapixels))
+	}
+	if params.Trash {
+		listParams.Set("trash", "1")
+	}
 	if promptQuery != "" || modelFilter != "" {
-		params := url.Values{}
 		if promptQuery != "" {
-			params.Set("q", promptQuery)
+			listParams.Set("q", promptQuery)
 		}
 		if modelFilter != "" && modelFilter != "all" {
-			params.Set("model", modelFilter)
+			listParams.Set("model", modelFilter)
 		}
-		params.Set("nsfw", nsfwFilter)
-		params.Set("page", "1")
-		initialURL = "/search?" + params.Encode()
+		initialURL = "/search?" + listParams.Encode()
 	} else {
-		initialURL = "/api/images?page=1&nsfw=" + nsfwFilter
+		initialURL = "/api/images?" + listParams.Encode()
 	}
 
 	data := PageData{
@@ -416,6 +742,27 @@ func (app *App) handleIndex(w http.ResponseWriter, r *http.Request) {
 		InitialURL:      initialURL,
 		SelectedModelID: selectedModelID,
 		OthersSelected:  othersSelected,
+		RatingFilter:    ratingFilter,
+		SortOrder:       sortOrder,
+		Tags:            tags,
+		IncludeTags:     strings.Join(includeTags, ","),
+		ExcludeTags:     strings.Join(excludeTags, ","),
+		Collections:     collections,
+		Collection:      selectedCollection,
+		Folders:         folderOptions(folders, 0),
+		FolderFilter:    params.FolderFilter,
+		ColorFamilies:   colorFamilies,
+		ColorFilter:     params.ColorFilter,
+		ToneFilter:      params.ToneFilter,
+		AspectBuckets:   aspectStats,
+		AspectFilter:    params.AspectFilter,
+		MinMegapixels:   formatMegapixels(params.MinMegapixels),
+		MaxMegapixels:   formatMegapixels(params.MaxMegapixels),
+		SavedSearches:   savedSearches,
+		SavedSearch:     activeSavedSearch,
+		Trash:           params.Trash,
+		TrashCount:      trashCount,
+		TrashRetention:  app.trashRetentionDays,
 	}
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -427,24 +774,66 @@ func (app *App) handleIndex(w http.ResponseWriter, r *http.Request) {
 
 // ImageSearchParams holds the parameters for searching images
 type ImageSearchParams struct {
-	Page        int
-	Limit       int
-	NSFWFilter  string
-	ModelFilter string
-	PromptQuery string
+	Page         int
+	Limit        int
+	NSFWFilter   string
+	ModelFilter  string
+	PromptQuery  string
+	RatingFilter string // "favorites", or a minimum star rating "1"-"5"
+	SortOrder    string // "rating", "megapixels", or empty for newest first
+	IncludeTags  []string
+	ExcludeTags  []string
+
+	// Collection ID; without a sort order the collection's manual order applies
+	CollectionFilter string
+
+	// Folder inside the library roots, subfolders included
+	FolderFilter string
+
+	// Color family covering a good part of the image, and overall tone
+	// (dark, bright or desaturated)
+	ColorFilter string
+	ToneFilter  string
+
+	// Aspect bucket (a shape or an SDXL bucket such as "832x1216"), and
+	// resolution bounds in megapixels, 0 for none
+	AspectFilter  string
+	MinMegapixels float64
+	MaxMegapixels float64
+
+	// Lists the trash instead of the library
+	Trash bool
 }
 
 // parseImageSearchParams extracts search parameters from HTTP request
 func parseImageSearchParams(r *http.Request) ImageSearchParams {
+	return imageSearchParamsFromQuery(r.URL.Query())
+}
+
+// imageSearchParamsFromQuery reads search parameters from URL query values,
+// which is also how saved searches are stored.
+func imageSearchParamsFromQuery(query url.Values) ImageSearchParams {
 	params := ImageSearchParams{
 		Page:        1,
 		Limit:       300,
-		NSFWFilter:  r.URL.Query().Get("nsfw"),
-		ModelFilter: r.URL.Query().Get("model"),
-		PromptQuery: r.URL.Query().Get("q"),
-	}
-
-	if p := r.URL.Query().Get("page"); p != "" {
+		NSFWFilter:  query.Get("nsfw"),
+		ModelFilter: query.Get("model"),
+		PromptQuery: query.Get("q"),
+	}
+	params.RatingFilter = query.Get("rating")
+	params.SortOrder = query.Get("sort")
+	params.IncludeTags = parseTagList(query.Get("tags"))
+	params.ExcludeTags = parseTagList(query.Get("exclude_tags"))
+	params.CollectionFilter = query.Get("collection")
+	params.FolderFilter = cleanFolderFilter(query.Get("folder"))
+	params.ColorFilter = cleanColorFilter(query.Get("color"))
+	params.ToneFilter = cleanToneFilter(query.Get("tone"))
+	params.AspectFilter = cleanAspectFilter(query.Get("aspect"))
+	params.MinMegapixels = cleanMegapixels(query.Get("min_mp"))
+	params.MaxMegapixels = cleanMegapixels(query.Get("max_mp"))
+	params.Trash = query.Get("trash") == "1"
+
+	if p := query.Get("page"); p != "" {
 		if parsed, err := strconv.Atoi(p); err == nil && parsed > 0 {
 			params.Page = parsed
 		}
@@ -453,19 +842,54 @@ func parseImageSearchParams(r *http.Request) ImageSearchParams {
 	return params
 }
 
-func nsfwFilterConditionForAlias(filter, alias string) string {
-	switch filter {
-	case "sfw":
-		return alias + ".is_nsfw = 0"
-	case "nsfw":
-		return alias + ".is_nsfw = 1"
-	default:
-		return ""
+// imageSearchParamsFromSnapshot reads a stored grid query, such as a saved
+// search, with the same SFW default as the index page.
+func imageSearchParamsFromSnapshot(query string) (ImageSearchParams, error) {
+	values, err := url.ParseQuery(strings.TrimPrefix(query, "?"))
+	if err != nil {
+		return ImageSearchParams{}, err
+	}
+
+	params := imageSearchParamsFromQuery(values)
+	if params.NSFWFilter == "" {
+		params.NSFWFilter = "sfw"
+	}
+	return params, nil
+}
+
+const sortByRating = "rating"
+
+// ratingFilterCondition restricts results to favorites, or to images rated at
+// least the given number of stars.
+func ratingFilterCondition(filter string) string {
+	if filter == "favorites" {
+		return "i.favorite = 1"
+	}
+	if minimum, err := strconv.Atoi(filter); err == nil && minimum >= 1 && minimum <= maxImageRating {
+		return fmt.Sprintf("i.rating >= %d", minimum)
 	}
+	return ""
 }
 
-func nsfwFilterCondition(filter string) string {
-	return nsfwFilterConditionForAlias(filter, "i")
+// imageOrderByClause puts the highest rated images first when sorting by
+// rating, keeping the chronological order within each rating, and the largest
+// images first when sorting by megapixels. A collection
+// without a sort order is shown in its manual order, and the trash lists the
+// latest deletions first.
+func (app *App) imageOrderByClause(params ImageSearchParams) string {
+	if params.SortOrder == sortByRating {
+		return "i.rating DESC, i.favorite DESC, " + app.getOrderByClause()
+	}
+	if params.SortOrder == sortByMegapixels {
+		return "i.width * i.height DESC, " + app.getOrderByClause()
+	}
+	if params.Trash {
+		return "i.trashed_at DESC, " + app.getOrderByClause()
+	}
+	if order := collectionPositionOrder(params.CollectionFilter); order != "" {
+		return order + ", " + app.getOrderByClause()
+	}
+	return app.getOrderByClause()
 }
 
 func modelFilterCondition(modelFilter, nsfwFilter string) (string, []any) {
@@ -474,8 +898,8 @@ func modelFilterCondition(modelFilter, nsfwFilter string) (string, []any) {
 	}
 
 	if strings.EqualFold(modelFilter, "OTHERS") {
-		statsConditions := []string{"model_stats.model_id IS NOT NULL"}
-		if condition := nsfwFilterConditionForAlias(nsfwFilter, "model_stats"); condition != "" {
+		statsConditions := []string{"model_stats.model_id IS NOT NULL", "model_stats.trashed_at IS NULL"}
+		if condition := contentLevelConditionForAlias(nsfwFilter, "model_stats"); condition != "" {
 			statsConditions = append(statsConditions, condition)
 		}
 
@@ -491,16 +915,22 @@ func modelFilterCondition(modelFilter, nsfwFilter string) (string, []any) {
 	return "i.model_id = ?", []any{modelFilter}
 }
 
-// queryImages performs the unified image search with given parameters
-func (app *App) queryImages(params ImageSearchParams) ([]ImageMetadata, int, error) {
-	offset := (params.Page - 1) * params.Limit
-
-	// Build WHERE clause components
+// imageSearchWhereClause builds the filters of a search. Every filter of
+// ImageSearchParams belongs here, so the grid, page counts and saved search
+// counts agree.
+func imageSearchWhereClause(params ImageSearchParams) (string, []any) {
 	var whereConditions []string
-	var args []interface{}
+	var args []any
+
+	// Trashed images are only listed in the trash
+	if params.Trash {
+		whereConditions = append(whereConditions, "i.trashed_at IS NOT NULL")
+	} else {
+		whereConditions = append(whereConditions, "i.trashed_at IS NULL")
+	}
 
-	// NSFW filter
-	if condition := nsfwFilterCondition(params.NSFWFilter); condition != "" {
+	// Content level filter
+	if condition := contentLevelCondition(params.NSFWFilter); condition != "" {
 		whereConditions = append(whereConditions, condition)
 	}
 
@@ -512,29 +942,69 @@ func (app *App) queryImages(params ImageSearchParams) ([]ImageMetadata, int, err
 
 	// Prompt search (only positive prompts)
 	if params.PromptQuery != "" {
-		whereConditions = append(whereConditions, "i.prompt LIKE ?")
+		whereConditions = append(whereConditions, effectivePromptColumn+" LIKE ?")
 		args = append(args, "%"+params.PromptQuery+"%")
 	}
 
-	// Build complete WHERE clause
-	whereClause := ""
-	if len(whereConditions) > 0 {
-		whereClause = "WHERE " + strings.Join(whereConditions, " AND ")
+	// Rating filter
+	if condition := ratingFilterCondition(params.RatingFilter); condition != "" {
+		whereConditions = append(whereConditions, condition)
+	}
+
+	// Tag filters
+	tagConditions, tagArgs := tagFilterConditions(params.IncludeTags, params.ExcludeTags)
+	whereConditions = append(whereConditions, tagConditions...)
+	args = append(args, tagArgs...)
+
+	// Collection filter
+	if condition := collectionFilterCondition(params.CollectionFilter); condition != "" {
+		whereConditions = append(whereConditions, condition)
 	}
 
-	// Count query
-	countQuery := "SELECT COUNT(*) FROM images i LEFT JOIN models m ON i.model_id = m.id " + whereClause
+	// Folder filter
+	if condition, folderArgs := folderFilterCondition(params.FolderFilter); condition != "" {
+		whereConditions = append(whereConditions, condition)
+		args = append(args, folderArgs...)
+	}
+
+	// Color and tone filters
+	if condition, colorArgs := colorFilterCondition(params.ColorFilter); condition != "" {
+		whereConditions = append(whereConditions, condition)
+		args = append(args, colorArgs...)
+	}
+	if condition := toneFilterCondition(params.ToneFilter); condition != "" {
+		whereConditions = append(whereConditions, condition)
+	}
+
+	// Aspect ratio and resolution filters
+	if condition := aspectFilterCondition(params.AspectFilter); condition != "" {
+		whereConditions = append(whereConditions, condition)
+	}
+	resolutionConditions, resolutionArgs := resolutionFilterConditions(params.MinMegapixels, params.MaxMegapixels)
+	whereConditions = append(whereConditions, resolutionConditions...)
+	args = append(args, resolutionArgs...)
+
+	return "WHERE " + strings.Join(whereConditions, " AND "), args
+}
+
+// countImages returns how many images match a search.
+func (app *App) countImages(params ImageSearchParams) (int, error) {
+	whereClause, args := imageSearchWhereClause(params)
+
 	var total int
-	if len(args) > 0 {
-		err := app.db.QueryRow(countQuery, args...).Scan(&total)
-		if err != nil {
-			return nil, 0, err
-		}
-	} else {
-		err := app.db.QueryRow(countQuery).Scan(&total)
-		if err != nil {
-			return nil, 0, err
-		}
+	err := app.db.QueryRow("SELECT COUNT(*) FROM images i LEFT JOIN models m ON i.model_id = m.id "+whereClause, args...).Scan(&total)
+	return total, err
+}
+
+// queryImages performs the unified image search with given parameters
+func (app *App) queryImages(params ImageSearchParams) ([]ImageMetadata, int, error) {
+	offset := (params.Page - 1) * params.Limit
+
+	whereClause, args := imageSearchWhereClause(params)
+
+	total, err := app.countImages(params)
+	if err != nil {
+		return nil, 0, err
 	}
 
 	// Select query with LEFT JOIN to loras table
@@ -545,15 +1015,25 @@ func (app *App) queryImages(params ImageSearchParams) ([]ImageMetadata, int, err
 		           WHEN m.name IS NOT NULL THEN m.name
 		           ELSE 'Unknown Model'
 		       END as model_display,
+		       COALESCE(m.local_filename, '') as model_file,
 		       i.prompt, i.neg_prompt, i.steps, i.cfg_scale, i.sampler, i.scheduler, i.seed, i.thumbnail_path, i.is_nsfw,
+		       COALESCE(i.clip_skip, 0), COALESCE(i.vae, ''), COALESCE(i.vae_hash, ''), COALESCE(i.denoising_strength, 0),
+		       COALESCE(i.hires_upscale, 0), COALESCE(i.hires_upscaler, ''), COALESCE(i.hires_steps, 0),
+		       COALESCE(i.adetailer_model, ''), COALESCE(i.variation_seed, 0), COALESCE(i.generator_version, ''),
+		       COALESCE(i.lora_hashes, ''), COALESCE(i.rating, 0), COALESCE(i.favorite, 0),
+		       i.trashed_at IS NOT NULL, COALESCE(i.content_level, CASE WHEN i.is_nsfw THEN 3 ELSE 0 END),
+		       COALESCE(i.blurhash, ''), COALESCE(i.dominant_color, ''),
+		       i.media_type, COALESCE(i.frame_count, 0), COALESCE(i.duration_ms, 0),
+		       ` + imageEditSelectColumns + `,
 		       l.name as lora_name, l.weight as lora_weight
 		FROM images i
 		LEFT JOIN models m ON i.model_id = m.id
+		` + imageEditsJoin + `
 		LEFT JOIN (
 			SELECT DISTINCT image_id, name, weight
 			FROM loras
 		) l ON i.id = l.image_id ` + whereClause + `
-		ORDER BY ` + app.getOrderByClause() + `, l.name ASC
+		ORDER BY ` + app.imageOrderByClause(params) + `, l.name ASC
 		LIMIT ? OFFSET ?
 	`
 
@@ -571,16 +1051,25 @@ func (app *App) queryImages(params ImageSearchParams) ([]ImageMetadata, int, err
 
 	for rows.Next() {
 		var img ImageMetadata
+		var edits imageEditColumns
 		var loraName, loraWeight sql.NullString
 
 		err := rows.Scan(&img.ID, &img.Filename, &img.Width, &img.Height,
-			&img.Model, &img.Prompt, &img.NegPrompt, &img.Steps, &img.CFGScale,
+			&img.Model, &img.ModelFile, &img.Prompt, &img.NegPrompt, &img.Steps, &img.CFGScale,
 			&img.Sampler, &img.Scheduler, &img.Seed, &img.ThumbnailPath, &img.IsNSFW,
+			&img.ClipSkip, &img.VAE, &img.VAEHash, &img.DenoisingStrength,
+			&img.HiresUpscale, &img.HiresUpscaler, &img.HiresSteps,
+			&img.ADetailerModel, &img.VariationSeed, &img.GeneratorVersion,
+			&img.LoraHashes, &img.Rating, &img.Favorite, &img.Trashed, &img.ContentLevel,
+			&img.BlurHash, &img.DominantColor,
+			&img.MediaType, &img.FrameCount, &img.DurationMS,
+			&edits.Prompt, &edits.NegPrompt, &edits.Model, &edits.Sampler, &edits.Seed, &edits.Notes,
 			&loraName, &loraWeight)
 		if err != nil {
 			log.Printf("Error scanning row: %v", err)
 			continue
 		}
+		edits.apply(&img)
 
 		// Check if we already have this image
 		if existingImg, exists := imageMap[img.ID]; exists {
@@ -610,9 +1099,21 @@ func (app *App) queryImages(params ImageSearchParams) ([]ImageMetadata, int, err
 		}
 	}
 
+	generationParams, err := app.loadImageParams(orderedIDs)
+	if err != nil {
+		log.Printf("Error loading generation parameters: %v", err)
+	}
+
+	imageTags, err := app.loadImageTags(orderedIDs)
+	if err != nil {
+		log.Printf("Error loading image tags: %v", err)
+	}
+
 	// Convert map back to ordered slice
 	for _, id := range orderedIDs {
 		if img, exists := imageMap[id]; exists {
+			img.Params = generationParams[id]
+			img.Tags = imageTags[id]
 			images = append(images, *img)
 		}
 	}
@@ -726,9 +1227,10 @@ type ToggleCategoryRequest struct {
 }
 
 type ToggleCategoryResponse struct {
-	Success     bool   `json:"success"`
-	NewCategory string `json:"new_category,omitempty"`
-	Error       string `json:"error,omitempty"`
+	Success      bool   `json:"success"`
+	NewCategory  string `json:"new_category,omitempty"`
+	ContentLevel string `json:"content_level,omitempty"`
+	Error        string `json:"error,omitempty"`
 }
 
 func (app *App) handleToggleCategory(w http.ResponseWriter, r *http.Request) {
@@ -748,9 +1250,9 @@ func (app *App) handleToggleCategory(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get current image info from database
-	var filename string
-	var currentNSFW bool
-	err := app.db.QueryRow("SELECT filename, is_nsfw FROM images WHERE id = ?", req.ImageID).Scan(&filename, &currentNSFW)
+	var currentLevel int
+	var currentLevelSource sql.NullString
+	file, err := scanImageFile(app.db.QueryRow("SELECT "+imageFileColumns+", COALESCE(i.content_level, 0), i.content_level_source FROM images i WHERE i.id = ? AND i.trashed_at IS NULL", req.ImageID), &currentLevel, &currentLevelSource)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			resp := ToggleCategoryResponse{Success: false, Error: "Image not found"}
@@ -764,14 +1266,26 @@ func (app *App) handleToggleCategory(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Toggle NSFW status
+	currentNSFW := file.IsNSFW
 	newNSFW := !currentNSFW
 	newCategory := "sfw"
 	if newNSFW {
 		newCategory = "nsfw"
 	}
+	newLevel := contentLevelForCategory(currentLevel, newNSFW)
+
+	// The file moves to a library root of the new category
+	destination, err := categoryLocation(file.Location, newNSFW)
+	if err != nil {
+		log.Printf("Cannot move image %d: %v", req.ImageID, err)
+		resp := ToggleCategoryResponse{Success: false, Error: err.Error()}
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
 
 	// Update database
-	_, err = app.db.Exec("UPDATE images SET is_nsfw = ? WHERE id = ?", newNSFW, req.ImageID)
+	_, err = app.db.Exec("UPDATE images SET is_nsfw = ?, content_level = ?, content_level_source = ?, library_root = ?, relative_path = ? WHERE id = ?",
+		newNSFW, newLevel, contentLevelSourceUser, destination.Root, destination.RelativePath, req.ImageID)
 	if err != nil {
 		log.Printf("Failed to update database: %v", err)
 		resp := ToggleCategoryResponse{Success: false, Error: "Failed to update database"}
@@ -779,60 +1293,34 @@ func (app *App) handleToggleCategory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Move files between directories
-	err = app.moveImageFiles(filename, currentNSFW, newNSFW)
+	// Move the file between library roots
+	err = moveImageFile(file.Location, destination)
 	if err != nil {
 		log.Printf("Failed to move files: %v", err)
 		// Rollback database change
-		app.db.Exec("UPDATE images SET is_nsfw = ? WHERE id = ?", currentNSFW, req.ImageID)
+		app.db.Exec("UPDATE images SET is_nsfw = ?, content_level = ?, content_level_source = ?, library_root = ?, relative_path = ? WHERE id = ?",
+			currentNSFW, currentLevel, currentLevelSource, file.Location.Root, file.Location.RelativePath, req.ImageID)
 		resp := ToggleCategoryResponse{Success: false, Error: "Failed to move image files"}
 		json.NewEncoder(w).Encode(resp)
 		return
 	}
 
-	resp := ToggleCategoryResponse{Success: true, NewCategory: newCategory}
+	resp := ToggleCategoryResponse{Success: true, NewCategory: newCategory, ContentLevel: contentLevelName(newLevel)}
 	json.NewEncoder(w).Encode(resp)
 }
 
-func (app *App) moveImageFiles(filename string, fromNSFW, toNSFW bool) error {
-	// Determine source and destination directories
-	var sourceDir, destDir string
-	if fromNSFW {
-		sourceDir = "images_nsfw"
-		destDir = "images"
-	} else {
-		sourceDir = "images"
-		destDir = "images_nsfw"
-	}
-
-	// Ensure destination directory exists
-	if err := os.MkdirAll(destDir, 0755); err != nil {
-		return fmt.Errorf("failed to create destination directory: %v", err)
+func (app *App) cleanDuplicateImages() (int, error) {
+	sfwRoot, err := destinationRoot(false)
+	if err != nil {
+		return 0, err
 	}
-
-	// Move main image file
-	sourcePath := filepath.Join(sourceDir, filename)
-	destPath := filepath.Join(destDir, filename)
-
-	if _, err := os.Stat(sourcePath); err == nil {
-		if err := os.Rename(sourcePath, destPath); err != nil {
-			return fmt.Errorf("failed to move image file: %v", err)
-		}
+	nsfwRoot, err := destinationRoot(true)
+	if err != nil {
+		return 0, err
 	}
 
-	// For thumbnails, we don't need separate directories, but we need to ensure consistency
-	// The thumbnail path in database stays the same, just the main image moves
-
-	log.Printf("Moved image %s from %s to %s category", filename,
-		map[bool]string{false: "SFW", true: "NSFW"}[fromNSFW],
-		map[bool]string{false: "SFW", true: "NSFW"}[toNSFW])
-
-	return nil
-}
-
-func (app *App) cleanDuplicateImages() (int, error) {
 	fmt.Println("Starting duplicate image cleanup...")
-	fmt.Println("Scanning for images that exist in both images/ and images_nsfw/ directories...")
+	fmt.Printf("Scanning for images that exist in both %s/ and %s/ directories...\n", sfwRoot.Path, nsfwRoot.Path)
 
 	// Create temp directory if it doesn't exist
 	tempDir := "temp"
@@ -840,26 +1328,26 @@ func (app *App) cleanDuplicateImages() (int, error) {
 		return 0, fmt.Errorf("failed to create temp directory: %v", err)
 	}
 
-	// Read all files from images_nsfw directory
-	nsfwFiles, err := os.ReadDir("images_nsfw")
+	// Read all files from the NSFW directory
+	nsfwFiles, err := os.ReadDir(nsfwRoot.Path)
 	if err != nil {
-		return 0, fmt.Errorf("failed to read images_nsfw directory: %v", err)
+		return 0, fmt.Errorf("failed to read %s directory: %v", nsfwRoot.Path, err)
 	}
 
 	duplicatesFound := 0
 	movedFiles := []string{}
 
-	// Check each file in images_nsfw to see if it exists in images
+	// Check each NSFW file to see if it exists in the SFW directory
 	for _, file := range nsfwFiles {
 		if file.IsDir() {
 			continue
 		}
 
 		filename := file.Name()
-		nsfwPath := filepath.Join("images_nsfw", filename)
-		sfwPath := filepath.Join("images", filename)
+		nsfwPath := filepath.Join(nsfwRoot.Path, filename)
+		sfwPath := filepath.Join(sfwRoot.Path, filename)
 
-		// Check if the same file exists in images directory
+		// Check if the same file exists in the SFW directory
 		if _, err := os.Stat(sfwPath); err == nil {
 			// File exists in both directories - this is a duplicate
 			duplicatesFound++
@@ -876,14 +1364,12 @@ func (app *App) cleanDuplicateImages() (int, error) {
 
 			movedFiles = append(movedFiles, filename)
 
-			// Update database to set is_nsfw = false for this image
-			// Extract image ID from filename (assuming format: ID.extension)
-			filenameWithoutExt := strings.TrimSuffix(filename, filepath.Ext(filename))
-			if imageID, err := strconv.Atoi(filenameWithoutExt); err == nil {
-				_, dbErr := app.db.Exec("UPDATE images SET is_nsfw = false WHERE id = ?", imageID)
-				if dbErr != nil {
-					fmt.Printf("Warning: Failed to update database for image %d: %v\n", imageID, dbErr)
-				}
+			// Update database to set is_nsfw = false for this image, with a
+			// content level and a file that belong in the SFW directory
+			_, dbErr := app.db.Exec("UPDATE images SET is_nsfw = false, content_level = MIN(COALESCE(content_level, 0), ?), library_root = ?, relative_path = ?, folder = '' WHERE library_root = ? AND relative_path = ?",
+				nsfwFolderLevel-1, sfwRoot.Path, filename, nsfwRoot.Path, filename)
+			if dbErr != nil {
+				fmt.Printf("Warning: Failed to update database for image %s: %v\n", filename, dbErr)
 			}
 		}
 	}
@@ -987,6 +1473,46 @@ func (app *App) fixCivitaiTimestamps() (int, error) {
 	return updatedCount, nil
 }
 
+// updateImageMetadataRecord replaces the parsed metadata of an image, its
+// LoRAs and its generation parameters with freshly extracted values.
+func updateImageMetadataRecord(db dbExecutor, imageID int, metadata *ImageMetadata) error {
+	updateQuery := `UPDATE images SET
+		prompt = ?, neg_prompt = ?, steps = ?, cfg_scale = ?,
+		sampler = ?, scheduler = ?, seed = ?, model_hash = ?,
+		clip_skip = ?, vae = ?, vae_hash = ?, denoising_strength = ?,
+		hires_upscale = ?, hires_upscaler = ?, hires_steps = ?, adetailer_model = ?,
+		variation_seed = ?, generator_version = ?, lora_hashes = ?,
+		metadata_parser = ?, raw_metadata = ?, xmp_rating = ?, xmp_label = ?
+		WHERE id = ?`
+
+	_, err := db.Exec(updateQuery,
+		metadata.Prompt, metadata.NegPrompt, metadata.Steps, metadata.CFGScale,
+		metadata.Sampler, metadata.Scheduler, metadata.Seed, metadata.ModelHash,
+		metadata.ClipSkip, metadata.VAE, metadata.VAEHash, metadata.DenoisingStrength,
+		metadata.HiresUpscale, metadata.HiresUpscaler, metadata.HiresSteps, metadata.ADetailerModel,
+		metadata.VariationSeed, metadata.GeneratorVersion, metadata.LoraHashes,
+		metadata.MetadataParser, metadata.RawMetadataJSON(), metadata.XMPRating, metadata.XMPLabel,
+		imageID)
+	if err != nil {
+		return fmt.Errorf("update image: %w", err)
+	}
+
+	if _, err := db.Exec("DELETE FROM loras WHERE image_id = ?", imageID); err != nil {
+		return fmt.Errorf("clear LoRA data: %w", err)
+	}
+	if err := insertLoraRows(db, imageID, metadata.LoRAs); err != nil {
+		return fmt.Errorf("insert LoRA data: %w", err)
+	}
+
+	if _, err := db.Exec("DELETE FROM image_params WHERE image_id = ?", imageID); err != nil {
+		return fmt.Errorf("clear generation parameters: %w", err)
+	}
+	if err := insertImageParamRows(db, imageID, metadata.Params); err != nil {
+		return fmt.Errorf("insert generation parameters: %w", err)
+	}
+	return nil
+}
+
 // fixImageMetadata re-processes metadata for specific images
 func (app *App) fixImageMetadata(filenames []string) (int, error) {
 	fmt.Printf("Starting metadata fix for %d images...\n", len(filenames))
@@ -997,60 +1523,37 @@ func (app *App) fixImageMetadata(filenames []string) (int, error) {
 		fmt.Printf("Processing %s...\n", filename)
 
 		// Find the image in the database to get its ID and path info
-		var imageID int
-		var isNSFW bool
-		err := app.db.QueryRow("SELECT id, is_nsfw FROM images WHERE filename = ?", filename).Scan(&imageID, &isNSFW)
+		file, err := app.findImageByName(filename)
 		if err != nil {
-			fmt.Printf("Error: Image %s not found in database: %v\n", filename, err)
+			fmt.Printf("Error: Image %s: %v\n", filename, err)
 			continue
 		}
+		imageID := file.ID
 
 		// Determine the image path
-		var imagePath string
-		if isNSFW {
-			imagePath = "images_nsfw/" + filename
-		} else {
-			imagePath = "images/" + filename
+		imagePath, err := app.imageFilePath(file.Location)
+		if err != nil {
+			fmt.Printf("Error: Image %s: %v\n", filename, err)
+			continue
 		}
 
 		// Re-extract metadata
-		metadata, err := app.extractImageMetadata(imagePath, isNSFW)
+		metadata, err := app.extractImageMetadata(imagePath, file.IsNSFW, "")
 		if err != nil {
 			fmt.Printf("Error: Failed to extract metadata for %s: %v\n", filename, err)
 			continue
 		}
 
-		// Update the database with new metadata
-		updateQuery := `UPDATE images SET
-			prompt = ?, neg_prompt = ?, steps = ?, cfg_scale = ?,
-			sampler = ?, scheduler = ?, seed = ?, model_hash = ?
-			WHERE id = ?`
-
-		_, err = app.db.Exec(updateQuery,
-			metadata.Prompt, metadata.NegPrompt, metadata.Steps, metadata.CFGScale,
-			metadata.Sampler, metadata.Scheduler, metadata.Seed, metadata.ModelHash,
-			imageID)
-		if err != nil {
+		if err := updateImageMetadataRecord(app.db, imageID, metadata); err != nil {
 			fmt.Printf("Error: Failed to update database for %s: %v\n", filename, err)
 			continue
 		}
 
-		// Clear existing LoRA data for this image
-		_, err = app.db.Exec("DELETE FROM loras WHERE image_id = ?", imageID)
-		if err != nil {
-			fmt.Printf("Warning: Failed to clear LoRA data for %s: %v\n", filename, err)
-		}
-
-		// Insert new LoRA data
-		if len(metadata.LoRAs) > 0 {
-			err = app.insertLoraData(imageID, metadata.LoRAs)
-			if err != nil {
-				fmt.Printf("Warning: Failed to insert LoRA data for %s: %v\n", filename, err)
-			}
-		}
-
 		updatedCount++
-		fmt.Printf("Successfully updated metadata for %s\n", filename)
+		fmt.Printf("Successfully updated metadata for %s (parser: %s)\n", filename, metadataParserLabel(metadata.MetadataParser))
+		if unparsed := unparsedMetadataSources(metadata.MetadataSources); len(unparsed) > 0 {
+			fmt.Printf("  Not recognized by any parser: %s\n", strings.Join(unparsed, ", "))
+		}
 	}
 
 	return updatedCount, nil
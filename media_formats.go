@@ -0,0 +1,557 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+	"sort"
+	"strings"
+
+	"golang.org/x/image/riff"
+	"golang.org/x/image/webp"
+)
+
+// Besides still images, the library holds animated GIF and WebP files and
+// MP4 or QuickTime videos. Animations are indexed with their frame count and
+// duration and shown by their first frame. Videos are read from their
+// container: dimensions, duration, frame count and the metadata tags ComfyUI
+// video nodes write, such as the prompt and workflow. Videos have no
+// thumbnails or poster frames, as decoding them would need ffmpeg; the grid
+// loads the original file and the browser draws its first frame.
+
+const (
+	mediaTypeImage     = "image"
+	mediaTypeAnimation = "animation"
+	mediaTypeVideo     = "video"
+
+	// The movie box holds the sample tables, a few megabytes for long videos
+	maxMovieBoxBytes = 64 << 20
+)
+
+var (
+	errNoStillImage = errors.New("videos have no still image")
+	errNoMovieBox   = errors.New("no movie box in video file")
+)
+
+type mediaInfo struct {
+	Type          string
+	Width, Height int
+	FrameCount    int
+	DurationMS    int
+	Sources       []MetadataSource // Metadata tags of videos
+}
+
+// isVideoHeader reports whether a file starts like an ISO base media file
+// (MP4, M4V) or a QuickTime movie.
+func isVideoHeader(header []byte) bool {
+	if len(header) < 8 {
+		return false
+	}
+	switch string(header[4:8]) {
+	case "ftyp", "moov", "mdat", "wide":
+		return true
+	}
+	return false
+}
+
+func isWebPHeader(header []byte) bool {
+	return len(header) >= 12 && string(header[:4]) == "RIFF" && string(header[8:12]) == "WEBP"
+}
+
+// isAnimatedWebPHeader checks the animation flag of the extended format
+// header, which follows the RIFF header.
+func isAnimatedWebPHeader(header []byte) bool {
+	return isWebPHeader(header) && len(header) >= 21 && string(header[12:16]) == "VP8X" && header[20]&0x02 != 0
+}
+
+func isGIFHeader(header []byte) bool {
+	return len(header) >= 6 && (string(header[:6]) == "GIF87a" || string(header[:6]) == "GIF89a")
+}
+
+// probeMedia reads the dimensions of an image, animation or video, and the
+// frames of animations and videos.
+func probeMedia(file io.ReadSeeker) (mediaInfo, error) {
+	header := make([]byte, 21)
+	n, err := io.ReadFull(file, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return mediaInfo{}, err
+	}
+	header = header[:n]
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return mediaInfo{}, err
+	}
+
+	if isVideoHeader(header) {
+		return probeVideo(file)
+	}
+
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return mediaInfo{}, err
+	}
+	info := mediaInfo{Type: mediaTypeImage, Width: config.Width, Height: config.Height}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return mediaInfo{}, err
+	}
+
+	var frameCount, durationMS int
+	switch {
+	case isGIFHeader(header):
+		frameCount, durationMS, err = gifAnimation(file)
+	case isAnimatedWebPHeader(header):
+		frameCount, durationMS, err = webpAnimation(file)
+	}
+	if err != nil {
+		return mediaInfo{}, err
+	}
+	// A GIF or WebP of a single frame is a still image
+	if frameCount > 1 {
+		info.Type = mediaTypeAnimation
+		info.FrameCount = frameCount
+		info.DurationMS = durationMS
+	}
+	return info, nil
+}
+
+// gifAnimation counts the frames of a GIF and adds up their delays, given in
+// hundredths of a second.
+func gifAnimation(source io.Reader) (int, int, error) {
+	animation, err := gif.DecodeAll(source)
+	if err != nil {
+		return 0, 0, fmt.Errorf("decode GIF frames: %w", err)
+	}
+	durationMS := 0
+	for _, delay := range animation.Delay {
+		durationMS += delay * 10
+	}
+	return len(animation.Image), durationMS, nil
+}
+
+// webpAnimation counts the ANMF chunks of an animated WebP and adds up their
+// durations, given in milliseconds.
+func webpAnimation(source io.Reader) (int, int, error) {
+	_, chunks, err := riff.NewReader(source)
+	if err != nil {
+		return 0, 0, err
+	}
+	frameCount, durationMS := 0, 0
+	for {
+		chunkID, _, chunkData, err := chunks.Next()
+		if err == io.EOF {
+			return frameCount, durationMS, nil
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("read WebP chunks: %w", err)
+		}
+		if chunkID != (riff.FourCC{'A', 'N', 'M', 'F'}) {
+			continue
+		}
+		var frameHeader [16]byte
+		if _, err := io.ReadFull(chunkData, frameHeader[:]); err != nil {
+			return 0, 0, fmt.Errorf("read WebP frame: %w", err)
+		}
+		frameCount++
+		durationMS += int(uint24(frameHeader[12:15]))
+	}
+}
+
+// decodeImage decodes a still image, or the first frame of an animation.
+func decodeImage(source io.Reader) (image.Image, error) {
+	buffered := bufio.NewReader(source)
+	header, _ := buffered.Peek(21)
+	switch {
+	case isVideoHeader(header):
+		return nil, errNoStillImage
+	case isAnimatedWebPHeader(header):
+		return firstWebPFrame(buffered)
+	}
+	// The first frame of a GIF is the image decoded
+	decoded, _, err := image.Decode(buffered)
+	return decoded, err
+}
+
+// firstWebPFrame decodes the first frame of an animated WebP, which the WebP
+// decoder does not support, by rewrapping its bitstream as a still WebP. The
+// frame is drawn at its offset on a transparent canvas.
+func firstWebPFrame(source io.Reader) (image.Image, error) {
+	_, chunks, err := riff.NewReader(source)
+	if err != nil {
+		return nil, err
+	}
+
+	var canvasWidth, canvasHeight int
+	for {
+		chunkID, _, chunkData, err := chunks.Next()
+		if err == io.EOF {
+			return nil, errors.New("animated WebP has no frames")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read WebP chunks: %w", err)
+		}
+
+		switch chunkID {
+		case riff.FourCC{'V', 'P', '8', 'X'}:
+			var extendedHeader [10]byte
+			if _, err := io.ReadFull(chunkData, extendedHeader[:]); err != nil {
+				return nil, err
+			}
+			canvasWidth = int(uint24(extendedHeader[4:7])) + 1
+			canvasHeight = int(uint24(extendedHeader[7:10])) + 1
+
+		case riff.FourCC{'A', 'N', 'M', 'F'}:
+			frame, err := io.ReadAll(chunkData)
+			if err != nil {
+				return nil, err
+			}
+			if len(frame) < 16 {
+				return nil, errors.New("invalid WebP frame")
+			}
+			x, y := 2*int(uint24(frame[0:3])), 2*int(uint24(frame[3:6]))
+			width, height := int(uint24(frame[6:9]))+1, int(uint24(frame[9:12]))+1
+
+			decoded, err := webp.Decode(bytes.NewReader(stillWebP(frame[16:], width, height)))
+			if err != nil {
+				return nil, fmt.Errorf("decode first WebP frame: %w", err)
+			}
+			canvas := image.NewNRGBA(image.Rect(0, 0, max(canvasWidth, x+width), max(canvasHeight, y+height)))
+			draw.Draw(canvas, image.Rect(x, y, x+width, y+height), decoded, decoded.Bounds().Min, draw.Src)
+			return canvas, nil
+		}
+	}
+}
+
+// stillWebP wraps the chunks of an animation frame (an optional ALPH chunk,
+// then VP8 or VP8L) in a WebP file. Alpha needs the extended header.
+func stillWebP(frameChunks []byte, width, height int) []byte {
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+	if len(frameChunks) >= 4 && string(frameChunks[:4]) == "ALPH" {
+		body.WriteString("VP8X")
+		binary.Write(&body, binary.LittleEndian, uint32(10))
+		body.Write([]byte{0x10, 0, 0, 0})
+		body.Write(putUint24(uint32(width - 1)))
+		body.Write(putUint24(uint32(height - 1)))
+	}
+	body.Write(frameChunks)
+
+	var file bytes.Buffer
+	file.WriteString("RIFF")
+	binary.Write(&file, binary.LittleEndian, uint32(body.Len()))
+	file.Write(body.Bytes())
+	return file.Bytes()
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+func putUint24(value uint32) []byte {
+	return []byte{byte(value), byte(value >> 8), byte(value >> 16)}
+}
+
+// probeVideo reads the movie box of an MP4 or QuickTime file: the duration
+// from its header, the dimensions and frame count of the first video track,
+// and the metadata tags of its user data.
+func probeVideo(file io.ReadSeeker) (mediaInfo, error) {
+	movie, err := readMovieBox(file)
+	if err != nil {
+		return mediaInfo{}, err
+	}
+	info := mediaInfo{Type: mediaTypeVideo}
+
+	for _, box := range mp4Boxes(movie) {
+		switch box.Type {
+		case "mvhd":
+			info.DurationMS = movieDurationMS(box.Data)
+		case "trak":
+			if info.Width > 0 {
+				continue
+			}
+			width, height, frameCount, ok := videoTrack(box.Data)
+			if ok {
+				info.Width, info.Height, info.FrameCount = width, height, frameCount
+			}
+		case "udta":
+			info.Sources = append(info.Sources, userDataTags(box.Data)...)
+		case "meta":
+			info.Sources = append(info.Sources, metadataItems(box.Data)...)
+		}
+	}
+	if info.Width == 0 || info.Height == 0 {
+		return mediaInfo{}, errors.New("no video track in video file")
+	}
+	info.Sources = unwrapVideoComments(info.Sources)
+	return info, nil
+}
+
+// readMovieBox finds the moov box among the top-level boxes, skipping the
+// media data without reading it.
+func readMovieBox(file io.ReadSeeker) ([]byte, error) {
+	var offset int64
+	for {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+		var header [16]byte
+		if _, err := io.ReadFull(file, header[:8]); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, errNoMovieBox
+			}
+			return nil, err
+		}
+		size, headerSize := int64(binary.BigEndian.Uint32(header[:4])), int64(8)
+		boxType := string(header[4:8])
+		switch size {
+		case 0:
+			// The last box runs to the end of the file
+			if boxType != "moov" {
+				return nil, errNoMovieBox
+			}
+			movie, err := io.ReadAll(io.LimitReader(file, maxMovieBoxBytes+1))
+			if err != nil {
+				return nil, err
+			}
+			if len(movie) > maxMovieBoxBytes {
+				return nil, errors.New("movie box too large")
+			}
+			return movie, nil
+		case 1:
+			if _, err := io.ReadFull(file, header[8:16]); err != nil {
+				return nil, errNoMovieBox
+			}
+			size, headerSize = int64(binary.BigEndian.Uint64(header[8:16])), 16
+		}
+		if size < headerSize {
+			return nil, fmt.Errorf("invalid %q box size %d", boxType, size)
+		}
+
+		if boxType == "moov" {
+			if size-headerSize > maxMovieBoxBytes {
+				return nil, errors.New("movie box too large")
+			}
+			movie := make([]byte, size-headerSize)
+			if _, err := io.ReadFull(file, movie); err != nil {
+				return nil, fmt.Errorf("read movie box: %w", err)
+			}
+			return movie, nil
+		}
+		offset += size
+	}
+}
+
+type mp4Box struct {
+	Type string
+	Data []byte
+}
+
+// mp4Boxes splits the content of a box into its child boxes, up to the first
+// malformed one.
+func mp4Boxes(data []byte) []mp4Box {
+	var boxes []mp4Box
+	for len(data) >= 8 {
+		size, headerSize := uint64(binary.BigEndian.Uint32(data[:4])), uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return boxes
+			}
+			size, headerSize = binary.BigEndian.Uint64(data[8:16]), 16
+		}
+		if size < headerSize || size > uint64(len(data)) {
+			return boxes
+		}
+		boxes = append(boxes, mp4Box{Type: string(data[4:8]), Data: data[headerSize:size]})
+		data = data[size:]
+	}
+	return boxes
+}
+
+func findMP4Box(data []byte, path ...string) ([]byte, bool) {
+	for _, boxType := range path {
+		found := false
+		for _, box := range mp4Boxes(data) {
+			if box.Type == boxType {
+				data, found = box.Data, true
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	return data, true
+}
+
+// movieDurationMS reads the duration of the movie header, in its time scale.
+func movieDurationMS(header []byte) int {
+	var timeScale, duration uint64
+	switch {
+	case len(header) >= 32 && header[0] == 1:
+		timeScale, duration = uint64(binary.BigEndian.Uint32(header[20:24])), binary.BigEndian.Uint64(header[24:32])
+	case len(header) >= 20 && header[0] == 0:
+		timeScale, duration = uint64(binary.BigEndian.Uint32(header[12:16])), uint64(binary.BigEndian.Uint32(header[16:20]))
+	}
+	if timeScale == 0 {
+		return 0
+	}
+	return int(duration * 1000 / timeScale)
+}
+
+// videoTrack reads the display size of a video track from its header, and
+// the number of frames from its sample sizes. It reports false for audio and
+// other tracks.
+func videoTrack(track []byte) (int, int, int, bool) {
+	handler, ok := findMP4Box(track, "mdia", "hdlr")
+	if !ok || len(handler) < 12 || string(handler[8:12]) != "vide" {
+		return 0, 0, 0, false
+	}
+	header, ok := findMP4Box(track, "tkhd")
+	if !ok || len(header) < 84 {
+		return 0, 0, 0, false
+	}
+	// Width and height end the header, as 16.16 fixed-point numbers
+	width := int(binary.BigEndian.Uint32(header[len(header)-8:]) >> 16)
+	height := int(binary.BigEndian.Uint32(header[len(header)-4:]) >> 16)
+
+	frameCount := 0
+	if sampleSizes, ok := findMP4Box(track, "mdia", "minf", "stbl", "stsz"); ok && len(sampleSizes) >= 12 {
+		frameCount = int(binary.BigEndian.Uint32(sampleSizes[8:12]))
+	}
+	return width, height, frameCount, width > 0 && height > 0
+}
+
+// itunesTagNames names the iTunes-style tags ffmpeg writes for its metadata
+// keys.
+var itunesTagNames = map[string]string{
+	"\xa9cmt": "comment",
+	"\xa9nam": "title",
+	"\xa9too": "encoder",
+	"desc":    "description",
+	"ldes":    "description",
+}
+
+// videoTagName names a tag by its key, or by its box type with the leading
+// © of QuickTime tags decoded from Latin-1.
+func videoTagName(boxType string) string {
+	if name, ok := itunesTagNames[boxType]; ok {
+		return name
+	}
+	if strings.HasPrefix(boxType, "\xa9") {
+		return "©" + boxType[1:]
+	}
+	return boxType
+}
+
+// userDataTags reads the user data box: QuickTime text tags, whose box type
+// starts with ©, and an iTunes or mdta metadata box.
+func userDataTags(userData []byte) []MetadataSource {
+	var sources []MetadataSource
+	for _, box := range mp4Boxes(userData) {
+		if box.Type == "meta" {
+			sources = append(sources, metadataItems(box.Data)...)
+			continue
+		}
+		// Each text is a 16-bit length and a language code, then the text
+		if !strings.HasPrefix(box.Type, "\xa9") || len(box.Data) < 4 {
+			continue
+		}
+		length := int(binary.BigEndian.Uint16(box.Data[:2]))
+		if length > len(box.Data)-4 {
+			continue
+		}
+		sources = append(sources, MetadataSource{Container: "mp4", Key: videoTagName(box.Type), Text: string(box.Data[4 : 4+length])})
+	}
+	return sources
+}
+
+// metadataItems reads the item list of a metadata box. Items are named by an
+// iTunes box type, or by an index into the keys box when ffmpeg writes
+// arbitrary keys, as ComfyUI does.
+func metadataItems(meta []byte) []MetadataSource {
+	// The ISO metadata box has a version and flags, the QuickTime one does not
+	if len(meta) >= 8 && string(meta[4:8]) != "hdlr" {
+		meta = meta[4:]
+	}
+
+	var keys []string
+	if keyBox, ok := findMP4Box(meta, "keys"); ok && len(keyBox) >= 8 {
+		for _, key := range mp4Boxes(keyBox[8:]) {
+			keys = append(keys, string(key.Data))
+		}
+	}
+
+	items, ok := findMP4Box(meta, "ilst")
+	if !ok {
+		return nil
+	}
+	var sources []MetadataSource
+	for _, item := range mp4Boxes(items) {
+		name := videoTagName(item.Type)
+		if index := int(binary.BigEndian.Uint32([]byte(item.Type))); len(keys) > 0 && index >= 1 && index <= len(keys) {
+			name = keys[index-1]
+		}
+		for _, value := range mp4Boxes(item.Data) {
+			// UTF-8 text values, after their type and locale
+			if value.Type != "data" || len(value.Data) < 8 || binary.BigEndian.Uint32(value.Data[:4])&0xffffff != 1 {
+				continue
+			}
+			sources = append(sources, MetadataSource{Container: "mp4", Key: name, Text: string(value.Data[8:])})
+		}
+	}
+	return sources
+}
+
+// unwrapVideoComments splits the comment the ComfyUI Video Helper Suite
+// writes, a JSON object holding the prompt and the workflow, into one source
+// per key, as they are found in PNG files.
+func unwrapVideoComments(sources []MetadataSource) []MetadataSource {
+	var unwrapped []MetadataSource
+	for _, source := range sources {
+		var fields map[string]json.RawMessage
+		if !strings.EqualFold(source.Key, "comment") || json.Unmarshal([]byte(source.Text), &fields) != nil ||
+			(fields["prompt"] == nil && fields["workflow"] == nil) {
+			unwrapped = append(unwrapped, source)
+			continue
+		}
+
+		keys := make([]string, 0, len(fields))
+		for key := range fields {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			text := string(fields[key])
+			var value string
+			if json.Unmarshal(fields[key], &value) == nil {
+				text = value
+			}
+			unwrapped = append(unwrapped, MetadataSource{Container: source.Container, Key: key, Text: text})
+		}
+	}
+	return unwrapped
+}
+
+// migrateMediaColumns adds the media type of images, and the frame count and
+// duration of animations and videos.
+func (app *App) migrateMediaColumns() error {
+	columns := []struct{ name, definition string }{
+		{"media_type", "TEXT NOT NULL DEFAULT 'image'"},
+		{"frame_count", "INTEGER"},
+		{"duration_ms", "INTEGER"},
+	}
+	for _, column := range columns {
+		if err := app.addColumnIfMissing("images", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testWebPFrame is the VP8L chunk of a 1x1 transparent WebP, padding included.
+var testWebPFrame = []byte{
+	'V', 'P', '8', 'L', 0x0d, 0, 0, 0,
+	0x2f, 0, 0, 0, 0x10, 0x07, 0x10, 0x11, 0x11, 0x88, 0x88, 0xfe, 0x07, 0,
+}
+
+func riffChunk(id string, data []byte) []byte {
+	chunk := append([]byte(id), binary.LittleEndian.AppendUint32(nil, uint32(len(data)))...)
+	chunk = append(chunk, data...)
+	if len(data)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+// writeTestAnimatedWebP writes a 1x1 animation of frames of 100 ms.
+func writeTestAnimatedWebP(t *testing.T, path string, frames int) {
+	t.Helper()
+	body := []byte("WEBP")
+	body = append(body, riffChunk("VP8X", []byte{0x02 | 0x10, 0, 0, 0, 0, 0, 0, 0, 0, 0})...)
+	body = append(body, riffChunk("ANIM", []byte{0, 0, 0, 0, 0, 0})...)
+	for i := 0; i < frames; i++ {
+		frame := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 100, 0, 0, 0}
+		body = append(body, riffChunk("ANMF", append(frame, testWebPFrame...))...)
+	}
+	writeTestFile(t, path, append(append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...), body...))
+}
+
+func mp4TestBox(boxType string, children ...[]byte) []byte {
+	content := bytes.Join(children, nil)
+	return append(append(binary.BigEndian.AppendUint32(nil, uint32(8+len(content))), boxType...), content...)
+}
+
+func mp4Uint32s(values ...uint32) []byte {
+	var data []byte
+	for _, value := range values {
+		data = binary.BigEndian.AppendUint32(data, value)
+	}
+	return data
+}
+
+// writeTestMP4 writes the boxes of a 512x768 video of 96 frames lasting 4
+// seconds, with a ComfyUI Video Helper Suite comment and an A1111 parameters
+// key, and no actual media data.
+func writeTestMP4(t *testing.T, path string) {
+	t.Helper()
+	trackHeader := append(mp4Uint32s(0, 0, 0, 1, 0, 4000, 0, 0, 0, 0, 0x10000, 0, 0, 0, 0x10000, 0, 0, 0, 0x40000000), mp4Uint32s(512<<16, 768<<16)...)
+	handler := append(mp4Uint32s(0, 0), []byte("vide\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00VideoHandler\x00")...)
+	audioHandler := append(mp4Uint32s(0, 0), []byte("soun\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")...)
+	textData := func(text string) []byte { return mp4TestBox("data", mp4Uint32s(1, 0), []byte(text)) }
+
+	comment := `{"prompt": "{\"3\": {\"class_type\": \"KSampler\"}}", "workflow": {"nodes": []}}`
+	parameters := "a lighthouse at dusk\nSteps: 30, Sampler: Euler a, CFG scale: 6, Seed: 1234, Size: 512x768"
+	movie := mp4TestBox("moov",
+		mp4TestBox("mvhd", mp4Uint32s(0, 0, 0, 1000, 4000)),
+		// An audio track before the video track
+		mp4TestBox("trak",
+			mp4TestBox("tkhd", append(trackHeader[:76:76], mp4Uint32s(0, 0)...)),
+			mp4TestBox("mdia", mp4TestBox("hdlr", audioHandler))),
+		mp4TestBox("trak",
+			mp4TestBox("tkhd", trackHeader),
+			mp4TestBox("mdia",
+				mp4TestBox("hdlr", handler),
+				mp4TestBox("minf", mp4TestBox("stbl", mp4TestBox("stsz", mp4Uint32s(0, 0, 96)))))),
+		mp4TestBox("udta",
+			mp4TestBox("\xa9cmt", []byte{0, byte(len(comment)), 0x55, 0xc4}, []byte(comment)),
+			mp4TestBox("meta", mp4Uint32s(0),
+				mp4TestBox("hdlr", mp4Uint32s(0, 0), []byte("mdta"), make([]byte, 13)),
+				mp4TestBox("keys", mp4Uint32s(0, 2),
+					mp4TestBox("mdta", []byte("encoder")),
+					mp4TestBox("mdta", []byte("parameters"))),
+				mp4TestBox("ilst",
+					mp4TestBox("\x00\x00\x00\x01", textData("Lavf61.7.100")),
+					mp4TestBox("\x00\x00\x00\x02", textData(parameters))))),
+	)
+	var file []byte
+	file = append(file, mp4TestBox("ftyp", []byte("isom"), mp4Uint32s(0x200), []byte("isomiso2mp41"))...)
+	file = append(file, mp4TestBox("mdat", make([]byte, 64))...)
+	file = append(file, movie...)
+	writeTestFile(t, path, file)
+}
+
+func writeTestFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProbeMediaAnimations(t *testing.T) {
+	dir := t.TempDir()
+
+	palette := color.Palette{color.Black, color.White}
+	animation := &gif.GIF{}
+	for i := 0; i < 3; i++ {
+		animation.Image = append(animation.Image, image.NewPaletted(image.Rect(0, 0, 4, 2), palette))
+		animation.Delay = append(animation.Delay, 25)
+	}
+	var encoded bytes.Buffer
+	if err := gif.EncodeAll(&encoded, animation); err != nil {
+		t.Fatal(err)
+	}
+	gifPath := filepath.Join(dir, "loop.gif")
+	writeTestFile(t, gifPath, encoded.Bytes())
+
+	webpPath := filepath.Join(dir, "loop.webp")
+	writeTestAnimatedWebP(t, webpPath, 4)
+	stillPath := filepath.Join(dir, "still.png")
+	writeTestPNG(t, stillPath, 5)
+
+	tests := []struct {
+		path string
+		want mediaInfo
+	}{
+		{gifPath, mediaInfo{Type: mediaTypeAnimation, Width: 4, Height: 2, FrameCount: 3, DurationMS: 750}},
+		{webpPath, mediaInfo{Type: mediaTypeAnimation, Width: 1, Height: 1, FrameCount: 4, DurationMS: 400}},
+		{stillPath, mediaInfo{Type: mediaTypeImage, Width: 5, Height: 1}},
+	}
+	for _, test := range tests {
+		file, err := os.Open(test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := probeMedia(file)
+		file.Close()
+		if err != nil {
+			t.Fatalf("probe %s: %v", test.path, err)
+		}
+		if got.Type != test.want.Type || got.Width != test.want.Width || got.Height != test.want.Height ||
+			got.FrameCount != test.want.FrameCount || got.DurationMS != test.want.DurationMS {
+			t.Errorf("probe %s = %+v, want %+v", test.path, got, test.want)
+		}
+	}
+
+	// Animations are shown by their first frame
+	for _, path := range []string{gifPath, webpPath} {
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := decodeImage(file)
+		file.Close()
+		if err != nil {
+			t.Fatalf("decode first frame of %s: %v", path, err)
+		}
+		if bounds := decoded.Bounds(); bounds.Dx() == 0 || bounds.Dy() == 0 {
+			t.Errorf("unexpected first frame bounds %v for %s", bounds, path)
+		}
+	}
+}
+
+func TestVideosAreIndexedFromTheirContainer(t *testing.T) {
+	t.Chdir(t.TempDir())
+	app := &App{}
+	setupTestDB(t, app).Close()
+	t.Cleanup(func() { app.db.Close() })
+
+	writeTestMP4(t, filepath.Join("images", "wan", "clip.mp4"))
+	writeTestAnimatedWebP(t, filepath.Join("images", "loop.webp"), 2)
+	if err := app.processImages(); err != nil {
+		t.Fatalf("process images: %v", err)
+	}
+
+	images, _, err := app.queryImages(ImageSearchParams{Page: 1, Limit: 10})
+	if err != nil {
+		t.Fatalf("query images: %v", err)
+	}
+	if len(images) != 2 {
+		t.Fatalf("expected 2 images, got %d", len(images))
+	}
+	media := make(map[string]ImageMetadata)
+	for _, img := range images {
+		media[img.Filename] = img
+	}
+
+	video := media["clip.mp4"]
+	if video.MediaType != mediaTypeVideo || video.Width != 512 || video.Height != 768 || video.FrameCount != 96 || video.DurationMS != 4000 {
+		t.Errorf("unexpected video %+v", video)
+	}
+	if video.DurationLabel() != "0:04" || !video.IsVideo() || !video.IsMoving() {
+		t.Errorf("unexpected video labels %q %v %v", video.DurationLabel(), video.IsVideo(), video.IsMoving())
+	}
+	if video.Seed != 1234 || video.Steps != 30 {
+		t.Errorf("expected the parameters tag to be parsed, got seed %d steps %d", video.Seed, video.Steps)
+	}
+	if video.BlurHash != "" {
+		t.Errorf("expected no placeholder for a video, got %q", video.BlurHash)
+	}
+
+	var rawMetadata string
+	if err := app.db.QueryRow("SELECT raw_metadata FROM images WHERE filename = 'clip.mp4'").Scan(&rawMetadata); err != nil {
+		t.Fatalf("load raw metadata: %v", err)
+	}
+	for _, want := range []string{`"key":"prompt"`, `"key":"workflow"`, `"key":"encoder"`, `"container":"mp4"`} {
+		if !bytes.Contains([]byte(rawMetadata), []byte(want)) {
+			t.Errorf("expected %s in the raw metadata %s", want, rawMetadata)
+		}
+	}
+
+	animation := media["loop.webp"]
+	if animation.MediaType != mediaTypeAnimation || animation.FrameCount != 2 || animation.DurationMS != 200 || animation.BlurHash == "" {
+		t.Errorf("unexpected animation %+v", animation)
+	}
+
+	// Videos have no thumbnail, and are left out of thumbnail rebuilds
+	if _, err := app.imageThumbnail(imageFile{ID: video.ID, Location: imageLocation{Root: "images", RelativePath: "wan/clip.mp4"}}, false, thumbnailSizes[0], false); !errors.Is(err, errNoStillImage) {
+		t.Errorf("expected no thumbnail for a video, got %v", err)
+	}
+	rebuiltCount, err := app.rebuildThumbnails()
+	if err != nil || rebuiltCount != 1 {
+		t.Errorf("expected only the animation to be rebuilt, got %d (%v)", rebuiltCount, err)
+	}
+}
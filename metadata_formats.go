@@ -0,0 +1,390 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// NovelAIComment is the JSON NovelAI stores in the PNG "Comment" chunk. V4
+// models also write the prompts as structured captions.
+type NovelAIComment struct {
+	Prompt           string         `json:"prompt"`
+	UC               string         `json:"uc"`
+	Steps            int            `json:"steps"`
+	Scale            float64        `json:"scale"`
+	Seed             int64          `json:"seed"`
+	Sampler          string         `json:"sampler"`
+	NoiseSchedule    string         `json:"noise_schedule"`
+	CFGRescale       float64        `json:"cfg_rescale"`
+	Strength         float64        `json:"strength"`
+	RequestType      string         `json:"request_type"`
+	V4Prompt         *novelAIV4Text `json:"v4_prompt"`
+	V4NegativePrompt *novelAIV4Text `json:"v4_negative_prompt"`
+}
+
+type novelAIV4Text struct {
+	Caption struct {
+		BaseCaption string `json:"base_caption"`
+	} `json:"caption"`
+}
+
+// InvokeAIMetadata is the "invokeai_metadata" chunk written by InvokeAI 3 and
+// later. Models are objects whose name field changed between versions.
+type InvokeAIMetadata struct {
+	GenerationMode string              `json:"generation_mode"`
+	PositivePrompt string              `json:"positive_prompt"`
+	NegativePrompt string              `json:"negative_prompt"`
+	Seed           int64               `json:"seed"`
+	CFGScale       float64             `json:"cfg_scale"`
+	Steps          int                 `json:"steps"`
+	Scheduler      string              `json:"scheduler"`
+	ClipSkip       int                 `json:"clip_skip"`
+	Strength       float64             `json:"strength"`
+	Model          *invokeAIModelRef   `json:"model"`
+	VAE            *invokeAIModelRef   `json:"vae"`
+	LoRAs          []invokeAILoraEntry `json:"loras"`
+	AppVersion     string              `json:"app_version"`
+}
+
+type invokeAIModelRef struct {
+	Name      string `json:"name"`
+	ModelName string `json:"model_name"`
+	Base      string `json:"base"`
+	BaseModel string `json:"base_model"`
+}
+
+func (ref *invokeAIModelRef) displayName() string {
+	if ref == nil {
+		return ""
+	}
+	return firstNonEmpty(ref.Name, ref.ModelName)
+}
+
+type invokeAILoraEntry struct {
+	Model  *invokeAIModelRef `json:"model"`
+	LoRA   *invokeAIModelRef `json:"lora"`
+	Weight float64           `json:"weight"`
+}
+
+// Values of the fooocus_scheme chunk Fooocus writes after its parameters
+const (
+	fooocusSchemeKeyword = "fooocus_scheme"
+	fooocusSchemeJSON    = "fooocus"
+	fooocusSchemeA1111   = "a1111"
+)
+
+// FooocusParams is the JSON Fooocus writes to the "parameters" chunk when
+// its metadata scheme is "fooocus"; the scheme itself goes to a separate
+// "fooocus_scheme" chunk written after it.
+type FooocusParams struct {
+	Prompt         string          `json:"prompt"`
+	NegativePrompt string          `json:"negative_prompt"`
+	BaseModel      string          `json:"base_model"`
+	BaseModelHash  string          `json:"base_model_hash"`
+	RefinerModel   string          `json:"refiner_model"`
+	Steps          int             `json:"steps"`
+	GuidanceScale  float64         `json:"guidance_scale"`
+	Sampler        string          `json:"sampler"`
+	Scheduler      string          `json:"scheduler"`
+	Seed           json.RawMessage `json:"seed"`
+	ClipSkip       int             `json:"clip_skip"`
+	VAE            string          `json:"vae"`
+	LoRAs          json.RawMessage `json:"loras"`
+	Performance    string          `json:"performance"`
+	Styles         string          `json:"styles"`
+	Sharpness      float64         `json:"sharpness"`
+	Resolution     string          `json:"resolution"`
+	Version        string          `json:"version"`
+	MetadataScheme string          `json:"metadata_scheme"`
+}
+
+// parseNovelAIComment parses the NovelAI "Comment" chunk. The "Description"
+// chunk already set the prompt, but only the comment has the settings and the
+// undesired content.
+func (app *App) parseNovelAIComment(jsonText string, metadata *ImageMetadata) bool {
+	var comment NovelAIComment
+	if err := json.Unmarshal([]byte(strings.TrimSpace(jsonText)), &comment); err != nil {
+		return false
+	}
+
+	prompt := comment.Prompt
+	if prompt == "" && comment.V4Prompt != nil {
+		prompt = comment.V4Prompt.Caption.BaseCaption
+	}
+	negPrompt := comment.UC
+	if negPrompt == "" && comment.V4NegativePrompt != nil {
+		negPrompt = comment.V4NegativePrompt.Caption.BaseCaption
+	}
+	if prompt == "" || (comment.Steps == 0 && comment.Scale == 0) {
+		return false // Some other tool's comment
+	}
+
+	metadata.Prompt = prompt
+	metadata.NegPrompt = negPrompt
+	if comment.Steps > 0 {
+		metadata.Steps = comment.Steps
+	}
+	if comment.Scale > 0 {
+		metadata.CFGScale = comment.Scale
+	}
+	if comment.Sampler != "" {
+		metadata.Sampler = comment.Sampler
+	}
+	if comment.NoiseSchedule != "" {
+		metadata.Scheduler = comment.NoiseSchedule
+	}
+	if comment.Seed != 0 {
+		metadata.Seed = comment.Seed
+	}
+	if comment.Strength > 0 && comment.RequestType != "" && comment.RequestType != "PromptGenerateRequest" {
+		metadata.DenoisingStrength = comment.Strength
+	}
+
+	metadata.Params = nil
+	addGenerationParam(metadata, "Steps", formatParamInt(comment.Steps))
+	addGenerationParam(metadata, "Sampler", comment.Sampler)
+	addGenerationParam(metadata, "Schedule type", comment.NoiseSchedule)
+	addGenerationParam(metadata, "CFG scale", formatParamFloat(comment.Scale))
+	addGenerationParam(metadata, "Seed", formatParamInt64(comment.Seed))
+	addGenerationParam(metadata, "CFG rescale", formatParamFloat(comment.CFGRescale))
+	addGenerationParam(metadata, "Denoising strength", formatParamFloat(metadata.DenoisingStrength))
+
+	log.Printf("Successfully parsed NovelAI comment: prompt=%s, steps=%d",
+		metadata.Prompt[:min(50, len(metadata.Prompt))], metadata.Steps)
+	return true
+}
+
+// parseInvokeAIMetadata parses the "invokeai_metadata" chunk. InvokeAI model
+// hashes are BLAKE3 digests that Civitai cannot resolve, so only the model
+// name is kept.
+func (app *App) parseInvokeAIMetadata(jsonText string, metadata *ImageMetadata) bool {
+	var invoke InvokeAIMetadata
+	if err := json.Unmarshal([]byte(strings.TrimSpace(jsonText)), &invoke); err != nil {
+		return false
+	}
+	if invoke.PositivePrompt == "" && invoke.Steps == 0 {
+		return false
+	}
+
+	cleanedPrompt, promptLoRAs := extractLoRAs(invoke.PositivePrompt)
+	metadata.Prompt = cleanedPrompt
+	metadata.LoRAs = append(metadata.LoRAs, promptLoRAs...)
+	metadata.NegPrompt = invoke.NegativePrompt
+
+	if invoke.Steps > 0 {
+		metadata.Steps = invoke.Steps
+	}
+	if invoke.CFGScale > 0 {
+		metadata.CFGScale = invoke.CFGScale
+	}
+	if invoke.Scheduler != "" {
+		// InvokeAI names its samplers "schedulers" (euler, dpmpp_2m_k, ...)
+		metadata.Sampler = invoke.Scheduler
+	}
+	if invoke.Seed != 0 {
+		metadata.Seed = invoke.Seed
+	}
+	if name := invoke.Model.displayName(); name != "" {
+		metadata.Model = name
+	}
+	metadata.VAE = invoke.VAE.displayName()
+	metadata.ClipSkip = invoke.ClipSkip
+	metadata.GeneratorVersion = invoke.AppVersion
+	if invoke.GenerationMode != "txt2img" && invoke.Strength > 0 {
+		metadata.DenoisingStrength = invoke.Strength
+	}
+
+	for _, entry := range invoke.LoRAs {
+		ref := entry.Model
+		if ref == nil {
+			ref = entry.LoRA
+		}
+		if name := ref.displayName(); name != "" {
+			metadata.LoRAs = append(metadata.LoRAs, LoraData{Name: name, Weight: entry.Weight})
+		}
+	}
+
+	metadata.Params = nil
+	addGenerationParam(metadata, "Steps", formatParamInt(invoke.Steps))
+	addGenerationParam(metadata, "Sampler", invoke.Scheduler)
+	addGenerationParam(metadata, "CFG scale", formatParamFloat(invoke.CFGScale))
+	addGenerationParam(metadata, "Seed", formatParamInt64(invoke.Seed))
+	addGenerationParam(metadata, "Model", metadata.Model)
+	if invoke.Model != nil {
+		addGenerationParam(metadata, "Base model", firstNonEmpty(invoke.Model.Base, invoke.Model.BaseModel))
+	}
+	addGenerationParam(metadata, "VAE", metadata.VAE)
+	addGenerationParam(metadata, "Clip skip", formatParamInt(metadata.ClipSkip))
+	addGenerationParam(metadata, "Denoising strength", formatParamFloat(metadata.DenoisingStrength))
+	addGenerationParam(metadata, "Generation mode", invoke.GenerationMode)
+	addGenerationParam(metadata, "Version", metadata.GeneratorVersion)
+
+	log.Printf("Successfully parsed InvokeAI metadata: prompt=%s, model=%s, steps=%d",
+		metadata.Prompt[:min(50, len(metadata.Prompt))], metadata.Model, metadata.Steps)
+	return true
+}
+
+// parseFooocusParams parses either Fooocus scheme: JSON, or the A1111 text
+// it writes when the scheme is "a1111". Fooocus writes the AutoV2 hash of the
+// base model, so it resolves like an A1111 model hash.
+func (app *App) parseFooocusParams(text string, metadata *ImageMetadata) bool {
+	if !isJSONObject(text) {
+		return app.parseA1111Text(text, metadata)
+	}
+
+	var fooocus FooocusParams
+	if err := json.Unmarshal([]byte(text), &fooocus); err != nil {
+		return false
+	}
+	if fooocus.MetadataScheme != "fooocus" && !strings.HasPrefix(fooocus.Version, "Fooocus") {
+		return false
+	}
+
+	cleanedPrompt, promptLoRAs := extractLoRAs(fooocus.Prompt)
+	metadata.Prompt = cleanedPrompt
+	metadata.LoRAs = append(metadata.LoRAs, promptLoRAs...)
+	metadata.NegPrompt = fooocus.NegativePrompt
+
+	if fooocus.BaseModel != "" {
+		metadata.Model = strings.TrimSuffix(fooocus.BaseModel, filepath.Ext(fooocus.BaseModel))
+	}
+	if fooocus.BaseModelHash != "" {
+		metadata.ModelHash = fooocus.BaseModelHash
+	}
+	if fooocus.Steps > 0 {
+		metadata.Steps = fooocus.Steps
+	}
+	if fooocus.GuidanceScale > 0 {
+		metadata.CFGScale = fooocus.GuidanceScale
+	}
+	if fooocus.Sampler != "" {
+		metadata.Sampler = fooocus.Sampler
+	}
+	if fooocus.Scheduler != "" {
+		metadata.Scheduler = fooocus.Scheduler
+	}
+	if seed, err := strconv.ParseInt(strings.Trim(string(fooocus.Seed), `"`), 10, 64); err == nil {
+		metadata.Seed = seed
+	}
+	metadata.ClipSkip = fooocus.ClipSkip
+	metadata.VAE = fooocus.VAE
+	metadata.GeneratorVersion = fooocus.Version
+	metadata.LoRAs = append(metadata.LoRAs, parseFooocusLoRAs(fooocus.LoRAs)...)
+
+	metadata.Params = nil
+	addGenerationParam(metadata, "Steps", formatParamInt(fooocus.Steps))
+	addGenerationParam(metadata, "Sampler", fooocus.Sampler)
+	addGenerationParam(metadata, "Schedule type", fooocus.Scheduler)
+	addGenerationParam(metadata, "CFG scale", formatParamFloat(fooocus.GuidanceScale))
+	addGenerationParam(metadata, "Seed", formatParamInt64(metadata.Seed))
+	addGenerationParam(metadata, "Model", metadata.Model)
+	addGenerationParam(metadata, "Model hash", metadata.ModelHash)
+	if fooocus.RefinerModel != "None" {
+		addGenerationParam(metadata, "Refiner", fooocus.RefinerModel)
+	}
+	addGenerationParam(metadata, "VAE", fooocus.VAE)
+	addGenerationParam(metadata, "Clip skip", formatParamInt(fooocus.ClipSkip))
+	addGenerationParam(metadata, "Performance", fooocus.Performance)
+	addGenerationParam(metadata, "Styles", fooocus.Styles)
+	addGenerationParam(metadata, "Sharpness", formatParamFloat(fooocus.Sharpness))
+	addGenerationParam(metadata, "Resolution", fooocus.Resolution)
+	addGenerationParam(metadata, "Version", fooocus.Version)
+
+	log.Printf("Successfully parsed Fooocus parameters: prompt=%s, model=%s, steps=%d",
+		metadata.Prompt[:min(50, len(metadata.Prompt))], metadata.Model, metadata.Steps)
+	return true
+}
+
+// applyFooocusScheme names the scheme of the parameters chunk when Fooocus
+// wrote a fooocus_scheme chunk, which follows the parameters.
+func applyFooocusScheme(sources []MetadataSource) {
+	scheme := ""
+	for _, source := range sources {
+		if source.Container == "png" && strings.EqualFold(source.Key, fooocusSchemeKeyword) {
+			scheme = strings.ToLower(strings.TrimSpace(source.Text))
+		}
+	}
+	if scheme == "" {
+		return
+	}
+	for i := range sources {
+		if sources[i].Container == "png" && sources[i].Key == "parameters" {
+			sources[i].Scheme = scheme
+		}
+	}
+}
+
+// parseFooocusLoRAs reads the "loras" list, whose entries are either
+// ["name : weight", "hash"] or ["name", weight] depending on the version.
+func parseFooocusLoRAs(raw json.RawMessage) []LoraData {
+	if len(raw) == 0 {
+		return nil
+	}
+	var entries [][]interface{}
+	if err := json.Unmarshal(raw, &entries); err != nil {
+		return nil
+	}
+
+	var loras []LoraData
+	for _, entry := range entries {
+		if len(entry) == 0 {
+			continue
+		}
+		label, ok := entry[0].(string)
+		if !ok {
+			continue
+		}
+
+		name := label
+		weight := 1.0
+		if before, after, found := strings.Cut(label, " : "); found {
+			name = before
+			if v, err := strconv.ParseFloat(strings.TrimSpace(after), 64); err == nil {
+				weight = v
+			}
+		} else if len(entry) > 1 {
+			if v, ok := entry[1].(float64); ok {
+				weight = v
+			}
+		}
+
+		name = strings.TrimSpace(name)
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+		if name == "" || name == "None" {
+			continue
+		}
+		loras = append(loras, LoraData{Name: name, Weight: weight})
+	}
+	return loras
+}
+
+func addGenerationParam(metadata *ImageMetadata, key, value string) {
+	if value == "" {
+		return
+	}
+	metadata.Params = append(metadata.Params, GenerationParam{Key: key, Value: value})
+}
+
+func formatParamInt(value int) string {
+	if value == 0 {
+		return ""
+	}
+	return strconv.Itoa(value)
+}
+
+func formatParamInt64(value int64) string {
+	if value == 0 {
+		return ""
+	}
+	return strconv.FormatInt(value, 10)
+}
+
+func formatParamFloat(value float64) string {
+	if value == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Fixtures trimmed from real exports of each generator
+const novelAIDescriptionFixture = `1girl, silver hair, night city, rain, neon lights, best quality`
+
+const novelAICommentFixture = `{"prompt": "1girl, silver hair, night city, rain, neon lights, best quality", "steps": 28, "height": 1216, "width": 832, "scale": 5.0, "uncond_scale": 0.0, "cfg_rescale": 0.2, "seed": 2876425398, "n_samples": 1, "hide_debug_overlay": false, "noise_schedule": "karras", "legacy_v3_extend": false, "sampler": "k_euler_ancestral", "sm": false, "sm_dyn": false, "uc": "lowres, bad anatomy, bad hands, text, error", "request_type": "PromptGenerateRequest", "signed_hash": "abc"}`
+
+const novelAIV4CommentFixture = `{"steps": 23, "scale": 6.0, "seed": 17, "sampler": "k_euler_ancestral", "noise_schedule": "karras", "v4_prompt": {"caption": {"base_caption": "a fox in the snow", "char_captions": []}, "use_coords": false}, "v4_negative_prompt": {"caption": {"base_caption": "blurry", "char_captions": []}}, "request_type": "PromptGenerateRequest"}`
+
+const invokeAIMetadataFixture = `{"generation_mode": "txt2img", "positive_prompt": "a cozy cabin in a snowy forest, warm light", "negative_prompt": "blurry, watermark", "width": 1024, "height": 1024, "seed": 3822461, "rand_device": "cpu", "cfg_scale": 6.5, "cfg_rescale_multiplier": 0, "steps": 32, "scheduler": "dpmpp_2m_k", "clip_skip": 0, "model": {"key": "9c4f", "hash": "blake3:52c7aa", "name": "Juggernaut XL v9", "base": "sdxl", "type": "main"}, "vae": {"key": "1d2e", "hash": "blake3:0f0f", "name": "sdxl-vae-fp16-fix", "base": "sdxl", "type": "vae"}, "loras": [{"model": {"key": "77aa", "hash": "blake3:77aa", "name": "add-detail-xl", "base": "sdxl", "type": "lora"}, "weight": 0.75}], "app_version": "5.4.3"}`
+
+const invokeAIV3MetadataFixture = `{"generation_mode": "img2img", "positive_prompt": "portrait of an old sailor", "negative_prompt": "", "seed": 99, "cfg_scale": 7.5, "steps": 40, "scheduler": "euler", "strength": 0.55, "model": {"model_name": "dreamshaper_8", "base_model": "sd-1", "model_type": "main"}, "loras": [{"lora": {"model_name": "film_grain", "base_model": "sd-1"}, "weight": 0.4}], "app_version": "3.6.2"}`
+
+const fooocusParamsFixture = `{"adm_guidance": "(1.5, 0.8, 0.3)", "base_model": "juggernautXL_v8Rundiffusion.safetensors", "base_model_hash": "aeb7e9e689", "clip_skip": 2, "full_negative_prompt": ["(worst quality, low quality:1.4)"], "full_prompt": ["a red bicycle leaning on a brick wall"], "guidance_scale": 4.0, "loras": [["sd_xl_offset_example-lora_1.0.safetensors : 0.1", "4852686128"], ["None : 1.0", ""]], "metadata_scheme": "fooocus", "negative_prompt": "", "performance": "Speed", "prompt": "a red bicycle leaning on a brick wall", "prompt_expansion": "a red bicycle leaning on a brick wall, sharp focus", "refiner_model": "None", "refiner_switch": 0.5, "resolution": "(1152, 896)", "sampler": "dpmpp_2m_sde_gpu", "scheduler": "karras", "seed": "5872410948561325", "sharpness": 2.0, "steps": 30, "styles": "['Fooocus V2', 'Fooocus Enhance', 'Fooocus Sharp']", "vae": "Default (model)", "version": "Fooocus v2.5.5"}`
+
+func TestNovelAICommentParsing(t *testing.T) {
+	app := &App{}
+
+	t.Run("V3", func(t *testing.T) {
+		metadata := &ImageMetadata{}
+		if !app.parseNovelAIComment(novelAICommentFixture, metadata) {
+			t.Fatal("Failed to parse NovelAI comment")
+		}
+
+		if metadata.Prompt != novelAIDescriptionFixture {
+			t.Errorf("Unexpected prompt: %q", metadata.Prompt)
+		}
+		if metadata.NegPrompt != "lowres, bad anatomy, bad hands, text, error" {
+			t.Errorf("Expected uc as negative prompt, got: %q", metadata.NegPrompt)
+		}
+		if metadata.Steps != 28 || metadata.CFGScale != 5.0 || metadata.Seed != 2876425398 {
+			t.Errorf("Unexpected params: steps=%d scale=%f seed=%d", metadata.Steps, metadata.CFGScale, metadata.Seed)
+		}
+		if metadata.Sampler != "k_euler_ancestral" || metadata.Scheduler != "karras" {
+			t.Errorf("Unexpected sampler/schedule: %q/%q", metadata.Sampler, metadata.Scheduler)
+		}
+		if metadata.DenoisingStrength != 0 {
+			t.Errorf("txt2img should not record a denoising strength, got %f", metadata.DenoisingStrength)
+		}
+	})
+
+	t.Run("V4Captions", func(t *testing.T) {
+		metadata := &ImageMetadata{}
+		if !app.parseNovelAIComment(novelAIV4CommentFixture, metadata) {
+			t.Fatal("Failed to parse NovelAI V4 comment")
+		}
+		if metadata.Prompt != "a fox in the snow" || metadata.NegPrompt != "blurry" {
+			t.Errorf("Unexpected V4 prompts: %q / %q", metadata.Prompt, metadata.NegPrompt)
+		}
+	})
+
+	t.Run("OtherComment", func(t *testing.T) {
+		metadata := &ImageMetadata{Prompt: "kept"}
+		if app.parseNovelAIComment(`{"prompt": "not a generator", "author": "me"}`, metadata) {
+			t.Fatal("Expected a comment without settings to be rejected")
+		}
+		if app.parseNovelAIComment("Shot on a Sunday", metadata) {
+			t.Fatal("Expected plain text comment to be rejected")
+		}
+		if metadata.Prompt != "kept" {
+			t.Errorf("Rejected comment changed the prompt: %q", metadata.Prompt)
+		}
+	})
+}
+
+func TestInvokeAIMetadataParsing(t *testing.T) {
+	app := &App{}
+
+	t.Run("V5", func(t *testing.T) {
+		metadata := &ImageMetadata{}
+		if !app.parseInvokeAIMetadata(invokeAIMetadataFixture, metadata) {
+			t.Fatal("Failed to parse InvokeAI metadata")
+		}
+
+		if metadata.Prompt != "a cozy cabin in a snowy forest, warm light" || metadata.NegPrompt != "blurry, watermark" {
+			t.Errorf("Unexpected prompts: %q / %q", metadata.Prompt, metadata.NegPrompt)
+		}
+		if metadata.Steps != 32 || metadata.CFGScale != 6.5 || metadata.Seed != 3822461 {
+			t.Errorf("Unexpected params: steps=%d cfg=%f seed=%d", metadata.Steps, metadata.CFGScale, metadata.Seed)
+		}
+		if metadata.Sampler != "dpmpp_2m_k" {
+			t.Errorf("Expected scheduler as sampler, got: %q", metadata.Sampler)
+		}
+		if metadata.Model != "Juggernaut XL v9" || metadata.ModelHash != "" {
+			t.Errorf("Expected model name without BLAKE3 hash, got: %q (%q)", metadata.Model, metadata.ModelHash)
+		}
+		if metadata.VAE != "sdxl-vae-fp16-fix" || metadata.GeneratorVersion != "5.4.3" {
+			t.Errorf("Unexpected VAE/version: %q/%q", metadata.VAE, metadata.GeneratorVersion)
+		}
+		if len(metadata.LoRAs) != 1 || metadata.LoRAs[0] != (LoraData{Name: "add-detail-xl", Weight: 0.75}) {
+			t.Errorf("Unexpected LoRAs: %+v", metadata.LoRAs)
+		}
+	})
+
+	t.Run("V3", func(t *testing.T) {
+		metadata := &ImageMetadata{}
+		if !app.parseInvokeAIMetadata(invokeAIV3MetadataFixture, metadata) {
+			t.Fatal("Failed to parse InvokeAI 3 metadata")
+		}
+		if metadata.Model != "dreamshaper_8" {
+			t.Errorf("Expected model_name fallback, got: %q", metadata.Model)
+		}
+		if metadata.DenoisingStrength != 0.55 {
+			t.Errorf("Expected img2img strength 0.55, got: %f", metadata.DenoisingStrength)
+		}
+		if len(metadata.LoRAs) != 1 || metadata.LoRAs[0] != (LoraData{Name: "film_grain", Weight: 0.4}) {
+			t.Errorf("Unexpected LoRAs: %+v", metadata.LoRAs)
+		}
+	})
+}
+
+func TestFooocusParamsParsing(t *testing.T) {
+	app := &App{}
+	metadata := &ImageMetadata{}
+
+	// Fooocus uses the same "parameters" keyword as A1111
+	app.parseGenerationParams(fooocusParamsFixture, metadata)
+
+	if metadata.Prompt != "a red bicycle leaning on a brick wall" {
+		t.Errorf("Unexpected prompt: %q", metadata.Prompt)
+	}
+	if metadata.Model != "juggernautXL_v8Rundiffusion" || metadata.ModelHash != "aeb7e9e689" {
+		t.Errorf("Unexpected model: %q (%q)", metadata.Model, metadata.ModelHash)
+	}
+	if metadata.Steps != 30 || metadata.CFGScale != 4.0 || metadata.Seed != 5872410948561325 {
+		t.Errorf("Unexpected params: steps=%d cfg=%f seed=%d", metadata.Steps, metadata.CFGScale, metadata.Seed)
+	}
+	if metadata.Sampler != "dpmpp_2m_sde_gpu" || metadata.Scheduler != "karras" {
+		t.Errorf("Unexpected sampler/scheduler: %q/%q", metadata.Sampler, metadata.Scheduler)
+	}
+	if metadata.ClipSkip != 2 || metadata.GeneratorVersion != "Fooocus v2.5.5" {
+		t.Errorf("Unexpected clip skip/version: %d/%q", metadata.ClipSkip, metadata.GeneratorVersion)
+	}
+	if len(metadata.LoRAs) != 1 || metadata.LoRAs[0] != (LoraData{Name: "sd_xl_offset_example-lora_1.0", Weight: 0.1}) {
+		t.Errorf("Unexpected LoRAs: %+v", metadata.LoRAs)
+	}
+
+	var styles string
+	for _, param := range metadata.Params {
+		if param.Key == "Styles" {
+			styles = param.Value
+		}
+		if param.Key == "Refiner" {
+			t.Errorf("Refiner \"None\" should not be listed")
+		}
+	}
+	if styles != "['Fooocus V2', 'Fooocus Enhance', 'Fooocus Sharp']" {
+		t.Errorf("Expected styles in generic params, got: %q", styles)
+	}
+}
+
+func TestParseFooocusLoRAsLegacyPairs(t *testing.T) {
+	loras := parseFooocusLoRAs([]byte(`[["add_detail.safetensors", 0.5], ["None", 1.0]]`))
+	if len(loras) != 1 || loras[0] != (LoraData{Name: "add_detail", Weight: 0.5}) {
+		t.Errorf("Unexpected LoRAs: %+v", loras)
+	}
+}
+
+func TestExtractPNGMetadataSelectsParserByKeyword(t *testing.T) {
+	app := &App{}
+	dir := t.TempDir()
+
+	cases := []struct {
+		name   string
+		chunks [][2]string
+		prompt string
+		steps  int
+		parser string
+	}{
+		{
+			name: "NovelAI",
+			chunks: [][2]string{
+				{"Title", "NovelAI generated image"},
+				{"Description", novelAIDescriptionFixture},
+				{"Software", "NovelAI"},
+				{"Source", "Stable Diffusion XL C1E1DE52"},
+				{"Comment", novelAICommentFixture},
+			},
+			prompt: novelAIDescriptionFixture,
+			steps:  28,
+			parser: "novelai",
+		},
+		{
+			name: "InvokeAI",
+			chunks: [][2]string{
+				{"invokeai_metadata", invokeAIMetadataFixture},
+				{"invokeai_graph", `{"id": "graph", "nodes": {}}`},
+			},
+			prompt: "a cozy cabin in a snowy forest, warm light",
+			steps:  32,
+			parser: "invokeai",
+		},
+		{
+			name: "Fooocus",
+			chunks: [][2]string{
+				{"parameters", fooocusParamsFixture},
+				{"fooocus_scheme", "fooocus"},
+			},
+			prompt: "a red bicycle leaning on a brick wall",
+			steps:  30,
+			parser: "fooocus",
+		},
+		{
+			name: "FooocusA1111",
+			chunks: [][2]string{
+				{"parameters", "a lighthouse at dusk\nNegative prompt: blurry\nSteps: 24, Sampler: DPM++ 2M SDE Karras, Seed: 8675309, Size: 1152x896, " +
+					"CFG scale: 4, Sharpness: 2, Model: juggernautXL_v8Rundiffusion, Performance: Speed, Version: Fooocus v2.5.5"},
+				{"fooocus_scheme", "a1111"},
+			},
+			prompt: "a lighthouse at dusk",
+			steps:  24,
+			parser: "fooocus",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, tc.name+".png")
+			writePNGWithTextChunks(t, path, tc.chunks)
+
+			metadata := &ImageMetadata{}
+			app.extractPNGMetadata(path, metadata)
+
+			if metadata.Prompt != tc.prompt {
+				t.Errorf("Expected prompt %q, got %q", tc.prompt, metadata.Prompt)
+			}
+			if metadata.Steps != tc.steps {
+				t.Errorf("Expected steps %d, got %d", tc.steps, metadata.Steps)
+			}
+			if metadata.MetadataParser != tc.parser {
+				t.Errorf("Expected parser %q, got %q", tc.parser, metadata.MetadataParser)
+			}
+		})
+	}
+}
+
+// writePNGWithTextChunks writes a 1x1 PNG with tEXt chunks before IEND, the
+// way generators append their metadata.
+func writePNGWithTextChunks(t *testing.T, path string, chunks [][2]string) {
+	t.Helper()
+
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatalf("encode PNG: %v", err)
+	}
+	data := encoded.Bytes()
+	iend := len(data) - 12
+
+	var output bytes.Buffer
+	output.Write(data[:iend])
+	for _, chunk := range chunks {
+		payload := append([]byte(chunk[0]), 0)
+		payload = append(payload, []byte(chunk[1])...)
+
+		header := make([]byte, 8)
+		binary.BigEndian.PutUint32(header, uint32(len(payload)))
+		copy(header[4:], "tEXt")
+		output.Write(header)
+		output.Write(payload)
+
+		crc := crc32.NewIEEE()
+		crc.Write(header[4:])
+		crc.Write(payload)
+		binary.Write(&output, binary.BigEndian, crc.Sum32())
+	}
+	output.Write(data[iend:])
+
+	if err := os.WriteFile(path, output.Bytes(), 0644); err != nil {
+		t.Fatalf("write PNG: %v", err)
+	}
+}
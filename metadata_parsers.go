@@ -0,0 +1,273 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// MetadataSource is one block of text found in an image file: a PNG text
+// chunk or an EXIF field. Parser is the name of the parser that accepted it,
+// empty when nothing recognized the text.
+type MetadataSource struct {
+	Container string `json:"container"`
+	Key       string `json:"key"`
+	Text      string `json:"text"`
+	Parser    string `json:"parser,omitempty"`
+
+	// Scheme is the format named by a companion chunk, such as Fooocus's
+	// fooocus_scheme, when the generator writes one
+	Scheme string `json:"scheme,omitempty"`
+}
+
+// MetadataParser recognizes and parses one generator's metadata format.
+// Parsers are tried from the highest priority down; the first one whose
+// Parse succeeds claims the source.
+type MetadataParser interface {
+	Name() string
+	Priority() int
+	Detect(source MetadataSource) bool
+	Parse(app *App, text string, metadata *ImageMetadata) bool
+}
+
+// MetadataParserRegistry keeps the parsers ordered by priority.
+type MetadataParserRegistry struct {
+	parsers []MetadataParser
+}
+
+func (registry *MetadataParserRegistry) Register(parser MetadataParser) {
+	registry.parsers = append(registry.parsers, parser)
+	sort.SliceStable(registry.parsers, func(i, j int) bool {
+		return registry.parsers[i].Priority() > registry.parsers[j].Priority()
+	})
+}
+
+func (registry *MetadataParserRegistry) Parsers() []MetadataParser {
+	return registry.parsers
+}
+
+// detects reports whether any parser would try a source.
+func (registry *MetadataParserRegistry) detects(source MetadataSource) bool {
+	for _, parser := range registry.parsers {
+		if parser.Detect(source) {
+			return true
+		}
+	}
+	return false
+}
+
+// metadataParserFunc adapts the parse functions of the built-in formats.
+type metadataParserFunc struct {
+	name     string
+	priority int
+	detect   func(source MetadataSource) bool
+	parse    func(app *App, text string, metadata *ImageMetadata) bool
+}
+
+func (parser metadataParserFunc) Name() string  { return parser.name }
+func (parser metadataParserFunc) Priority() int { return parser.priority }
+
+func (parser metadataParserFunc) Detect(source MetadataSource) bool {
+	return parser.detect(source)
+}
+
+func (parser metadataParserFunc) Parse(app *App, text string, metadata *ImageMetadata) bool {
+	return parser.parse(app, text, metadata)
+}
+
+// supersededMetadataParser marks the generator's sources of a file whose
+// parameters were written back by the viewer.
+const supersededMetadataParser = "superseded"
+
+// metadataParsers holds every known format. A1111 text is the catch-all and
+// must stay last.
+var metadataParsers = newMetadataParserRegistry(
+	metadataParserFunc{name: "swarmui", priority: 100, detect: detectGenerationJSON, parse: (*App).parseSwarmUIParams},
+	metadataParserFunc{name: "comfyui", priority: 90, detect: detectGenerationJSON, parse: (*App).parseComfyUIWorkflow},
+	metadataParserFunc{name: "fooocus", priority: 80, detect: detectFooocusParams, parse: (*App).parseFooocusParams},
+	metadataParserFunc{name: "novelai", priority: 70, detect: detectPNGKeyword("comment"), parse: (*App).parseNovelAIComment},
+	metadataParserFunc{name: "invokeai", priority: 70, detect: detectPNGKeyword("invokeai_metadata"), parse: (*App).parseInvokeAIMetadata},
+	metadataParserFunc{name: "a1111", priority: 0, detect: isGenerationParamsSource, parse: (*App).parseA1111Text},
+)
+
+func newMetadataParserRegistry(parsers ...MetadataParser) *MetadataParserRegistry {
+	registry := &MetadataParserRegistry{}
+	for _, parser := range parsers {
+		registry.Register(parser)
+	}
+	return registry
+}
+
+// generationParamsKeywords are the PNG keywords generators use for a
+// parameters string or workflow JSON.
+var generationParamsKeywords = map[string]bool{
+	"parameters":      true,
+	"workflow":        true,
+	"prompt":          true,
+	"generation_data": true,
+	"usercomment":     true,
+	"description":     true,
+}
+
+// hasPNGKeyword reports whether a source is named by a PNG text keyword,
+// either from a chunk or from stealth metadata mirroring the chunks. Video
+// tags written by ComfyUI use the same keywords.
+func hasPNGKeyword(source MetadataSource) bool {
+	return source.Container == "png" || source.Container == "stealth" || source.Container == "mp4"
+}
+
+// isGenerationParamsSource reports whether a source may hold generation
+// parameters. Every EXIF text field is tried, as generators disagree on
+// which one to use.
+func isGenerationParamsSource(source MetadataSource) bool {
+	if !hasPNGKeyword(source) {
+		return true
+	}
+	keyword := strings.ToLower(source.Key)
+	if generationParamsKeywords[keyword] {
+		return true
+	}
+	// ComfyUI often stores params in workflow
+	return keyword == "software" && strings.Contains(strings.ToLower(source.Text), "comfyui")
+}
+
+// isJSONObject reports whether text looks like a JSON object.
+func isJSONObject(text string) bool {
+	trimmed := strings.TrimSpace(text)
+	return strings.HasPrefix(trimmed, "{") && strings.HasSuffix(trimmed, "}")
+}
+
+// detectGenerationJSON accepts JSON from generators that don't name their
+// scheme; a source with a scheme goes to the parser of that scheme.
+func detectGenerationJSON(source MetadataSource) bool {
+	return source.Scheme == "" && isGenerationParamsSource(source) && isJSONObject(source.Text)
+}
+
+// detectFooocusParams accepts the parameters of a fooocus_scheme chunk, which
+// are JSON or A1111 text, and unnamed JSON that may be Fooocus's.
+func detectFooocusParams(source MetadataSource) bool {
+	if source.Scheme != "" {
+		return source.Scheme == fooocusSchemeJSON || source.Scheme == fooocusSchemeA1111
+	}
+	return detectGenerationJSON(source)
+}
+
+func detectPNGKeyword(keyword string) func(MetadataSource) bool {
+	return func(source MetadataSource) bool {
+		return hasPNGKeyword(source) && strings.EqualFold(source.Key, keyword)
+	}
+}
+
+// parseMetadataSources hands every source to the first parser that accepts
+// it. The image is attributed to the highest-priority parser that matched
+// anything, so a NovelAI comment wins over its plain-text description.
+func (app *App) parseMetadataSources(sources []MetadataSource, metadata *ImageMetadata) {
+	bestPriority := -1
+	for i := range sources {
+		text := app.cleanUnicodeText(sources[i].Text)
+		for _, parser := range metadataParsers.Parsers() {
+			if !parser.Detect(sources[i]) || !parser.Parse(app, text, metadata) {
+				continue
+			}
+			sources[i].Parser = parser.Name()
+			if parser.Priority() >= bestPriority {
+				bestPriority = parser.Priority()
+				metadata.MetadataParser = parser.Name()
+			}
+			break
+		}
+	}
+	metadata.MetadataSources = append(metadata.MetadataSources, sources...)
+}
+
+// RawMetadataJSON encodes the text blocks read from the file, with the parser
+// that claimed each, for the raw_metadata column.
+func (img ImageMetadata) RawMetadataJSON() string {
+	if len(img.MetadataSources) == 0 {
+		return ""
+	}
+	encoded, err := json.Marshal(img.MetadataSources)
+	if err != nil {
+		log.Printf("Error encoding raw metadata for %s: %v", img.Filename, err)
+		return ""
+	}
+	return string(encoded)
+}
+
+// unparsedMetadataSources lists the sources no parser accepted, for the
+// -fix-metadata report.
+func unparsedMetadataSources(sources []MetadataSource) []string {
+	var keys []string
+	for _, source := range sources {
+		if source.Parser == "" {
+			keys = append(keys, source.Container+":"+source.Key)
+		}
+	}
+	return keys
+}
+
+func metadataParserLabel(name string) string {
+	if name == "" {
+		return "none"
+	}
+	return name
+}
+
+// RawMetadataResponse is returned by GET /api/images/{id}/raw-metadata.
+type RawMetadataResponse struct {
+	ID       int              `json:"id"`
+	Filename string           `json:"filename"`
+	Parser   string           `json:"parser"`
+	Sources  []MetadataSource `json:"sources"`
+	Error    string           `json:"error,omitempty"`
+}
+
+func (app *App) handleRawMetadata(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	imageID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || imageID <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(RawMetadataResponse{Error: "Invalid image ID"})
+		return
+	}
+
+	var filename string
+	var parser, rawMetadata sql.NullString
+	err = app.db.QueryRow(
+		"SELECT filename, metadata_parser, raw_metadata FROM images WHERE id = ?",
+		imageID,
+	).Scan(&filename, &parser, &rawMetadata)
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(RawMetadataResponse{Error: "Image not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to load raw metadata for image %d: %v", imageID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(RawMetadataResponse{Error: "Failed to load raw metadata"})
+		return
+	}
+
+	response := RawMetadataResponse{
+		ID:       imageID,
+		Filename: filename,
+		Parser:   parser.String,
+		Sources:  []MetadataSource{},
+	}
+	if rawMetadata.String != "" {
+		if err := json.Unmarshal([]byte(rawMetadata.String), &response.Sources); err != nil {
+			log.Printf("Invalid raw metadata stored for image %d: %v", imageID, err)
+		}
+	}
+
+	_ = json.NewEncoder(w).Encode(response)
+}
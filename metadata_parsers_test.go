@@ -0,0 +1,147 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestMetadataParserRegistryOrdersByPriority(t *testing.T) {
+	var calls []string
+	record := func(name string, accept bool) metadataParserFunc {
+		return metadataParserFunc{
+			name:     name,
+			priority: map[string]int{"low": 1, "high": 50, "middle": 10}[name],
+			detect:   func(MetadataSource) bool { return true },
+			parse: func(_ *App, _ string, _ *ImageMetadata) bool {
+				calls = append(calls, name)
+				return accept
+			},
+		}
+	}
+
+	registry := newMetadataParserRegistry(record("low", true), record("high", false), record("middle", true))
+
+	var names []string
+	for _, parser := range registry.Parsers() {
+		names = append(names, parser.Name())
+	}
+	if len(names) != 3 || names[0] != "high" || names[1] != "middle" || names[2] != "low" {
+		t.Fatalf("Unexpected parser order: %v", names)
+	}
+
+	metadata := &ImageMetadata{}
+	for _, parser := range registry.Parsers() {
+		if parser.Parse(nil, "", metadata) {
+			break
+		}
+	}
+	if len(calls) != 2 || calls[1] != "middle" {
+		t.Errorf("Expected the first accepting parser to stop the cascade, calls: %v", calls)
+	}
+}
+
+func TestParseMetadataSourcesRecordsParsers(t *testing.T) {
+	app := &App{}
+	path := filepath.Join(t.TempDir(), "novelai.png")
+	writePNGWithTextChunks(t, path, [][2]string{
+		{"Title", "NovelAI generated image"},
+		{"Description", novelAIDescriptionFixture},
+		{"Comment", novelAICommentFixture},
+	})
+
+	metadata := &ImageMetadata{}
+	app.extractPNGMetadata(path, metadata)
+
+	if metadata.MetadataParser != "novelai" {
+		t.Errorf("Expected the image to be attributed to novelai, got %q", metadata.MetadataParser)
+	}
+
+	want := map[string]string{"Title": "", "Description": "a1111", "Comment": "novelai"}
+	if len(metadata.MetadataSources) != len(want) {
+		t.Fatalf("Expected %d sources, got %+v", len(want), metadata.MetadataSources)
+	}
+	for _, source := range metadata.MetadataSources {
+		if source.Container != "png" || source.Parser != want[source.Key] {
+			t.Errorf("Unexpected source %s/%s parsed by %q", source.Container, source.Key, source.Parser)
+		}
+	}
+
+	unparsed := unparsedMetadataSources(metadata.MetadataSources)
+	if len(unparsed) != 1 || unparsed[0] != "png:Title" {
+		t.Errorf("Expected only the title to be unparsed, got %v", unparsed)
+	}
+
+	var stored []MetadataSource
+	if err := json.Unmarshal([]byte(metadata.RawMetadataJSON()), &stored); err != nil {
+		t.Fatalf("decode raw metadata: %v", err)
+	}
+	if len(stored) != 3 || stored[2].Text != novelAICommentFixture {
+		t.Errorf("Raw metadata did not keep the chunk text: %+v", stored)
+	}
+}
+
+func TestHandleRawMetadata(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("open test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(`
+		CREATE TABLE images (
+			id INTEGER PRIMARY KEY,
+			filename TEXT NOT NULL,
+			metadata_parser TEXT,
+			raw_metadata TEXT
+		);
+		INSERT INTO images (id, filename, metadata_parser, raw_metadata) VALUES
+			(7, '7.png', 'a1111', '[{"container":"png","key":"parameters","text":"a cat\nSteps: 20","parser":"a1111"}]'),
+			(8, '8.jpeg', NULL, NULL);
+	`); err != nil {
+		t.Fatalf("create test schema: %v", err)
+	}
+	app := &App{db: db}
+
+	request := func(id string) (*httptest.ResponseRecorder, RawMetadataResponse) {
+		recorder := httptest.NewRecorder()
+		req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/api/images/"+id+"/raw-metadata", nil), map[string]string{"id": id})
+		app.handleRawMetadata(recorder, req)
+
+		var response RawMetadataResponse
+		if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+		return recorder, response
+	}
+
+	recorder, response := request("7")
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", recorder.Code)
+	}
+	if response.Parser != "a1111" || len(response.Sources) != 1 || response.Sources[0].Text != "a cat\nSteps: 20" {
+		t.Errorf("Unexpected response: %+v", response)
+	}
+
+	recorder, response = request("8")
+	if recorder.Code != http.StatusOK || response.Sources == nil || len(response.Sources) != 0 {
+		t.Errorf("Expected an empty source list for an image without metadata, got %d %+v", recorder.Code, response)
+	}
+
+	recorder, _ = request("9")
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing image, got %d", recorder.Code)
+	}
+
+	recorder, _ = request("abc")
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid ID, got %d", recorder.Code)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"unicode/utf16"
 )
 
 // extractLoRAs extracts LoRA information from text and returns cleaned text and LoRA data
@@ -86,39 +87,23 @@ type ComfyUIExtraMetadata struct {
 	Seed           int64   `json:"seed"`
 }
 
+// parseGenerationParams parses a standalone parameters string through the
+// parser registry, as if it came from a PNG "parameters" chunk.
 func (app *App) parseGenerationParams(text string, metadata *ImageMetadata) {
-	// Clean Unicode encoding where spaces are inserted between characters
-	cleanText := app.cleanUnicodeText(text)
-
-	// First, try to detect and parse JSON formats
-	if app.tryParseJSON(cleanText, metadata) {
-		return // Successfully parsed as JSON, we're done
-	}
-
-	// Fall back to traditional text parsing for non-JSON formats
-	app.parseTraditionalParams(cleanText, metadata)
+	app.parseMetadataSources([]MetadataSource{{Container: "png", Key: "parameters", Text: text}}, metadata)
 }
 
-// tryParseJSON attempts to parse JSON workflows and returns true if successful
-func (app *App) tryParseJSON(text string, metadata *ImageMetadata) bool {
-	// Check if text looks like JSON
+// parseA1111Text is the catch-all parser: A1111-style text with a settings
+// line, or a bare prompt when nothing else recognized the source.
+func (app *App) parseA1111Text(text string, metadata *ImageMetadata) bool {
 	trimmed := strings.TrimSpace(text)
-	if !strings.HasPrefix(trimmed, "{") || !strings.HasSuffix(trimmed, "}") {
-		return false
-	}
-
-	// Try Swarm UI format first
-	if app.parseSwarmUIParams(trimmed, metadata) {
-		return true
-	}
-
-	// Try ComfyUI format
-	if app.parseComfyUIWorkflow(trimmed, metadata) {
-		return true
+	if strings.HasPrefix(trimmed, "{") && strings.HasSuffix(trimmed, "}") {
+		log.Printf("Found JSON but couldn't parse it as known format: %s", trimmed[:min(100, len(trimmed))])
 	}
 
-	log.Printf("Found JSON but couldn't parse it as known format: %s", trimmed[:min(100, len(trimmed))])
-	return false
+	hadPrompt := metadata.Prompt != ""
+	app.parseTraditionalParams(text, metadata)
+	return findA1111ParamsLine(text) != "" || (!hadPrompt && metadata.Prompt != "")
 }
 
 func (app *App) parseTraditionalParams(cleanText string, metadata *ImageMetadata) {
@@ -188,67 +173,150 @@ func (app *App) parseTraditionalParams(cleanText string, metadata *ImageMetadata
 		metadata.LoRAs = append(metadata.LoRAs, promptLoRAs...)
 	}
 
-	// Extract numeric parameters
-	if strings.Contains(cleanText, "Steps:") {
-		if steps := extractParam(cleanText, "Steps:", ","); steps != "" {
-			if s, err := strconv.Atoi(strings.TrimSpace(steps)); err == nil {
-				metadata.Steps = s
-			}
-		}
+	// Everything after the prompts is a single "Key: value, Key: value" line
+	if paramsLine := findA1111ParamsLine(cleanText); paramsLine != "" {
+		applyA1111Params(parseA1111ParamsLine(paramsLine), metadata)
 	}
+}
 
-	if strings.Contains(cleanText, "CFG scale:") {
-		if cfg := extractParam(cleanText, "CFG scale:", ","); cfg != "" {
-			if c, err := strconv.ParseFloat(strings.TrimSpace(cfg), 64); err == nil {
-				metadata.CFGScale = c
-			}
-		}
-	}
+// GenerationParam is one key/value pair of an A1111 parameters line, kept in
+// the order the generator wrote it.
+type GenerationParam struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
 
-	if strings.Contains(cleanText, "Sampler:") {
-		sampler := extractParam(cleanText, "Sampler:", ",")
-		if sampler != "" {
-			metadata.Sampler = strings.TrimSpace(sampler)
+// a1111ParamRegex mirrors the expression A1111 itself uses to read back its
+// infotext: values containing commas are written as JSON-quoted strings.
+var a1111ParamRegex = regexp.MustCompile(`\s*(\w[\w \-/]+):\s*("(?:\\.|[^\\"])+"|[^,]*)(?:,|$)`)
+
+// findA1111ParamsLine returns the last line holding generation settings. The
+// prompt and negative prompt above it may themselves span several lines.
+func findA1111ParamsLine(text string) string {
+	lines := strings.Split(text, "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		line := strings.TrimSpace(lines[i])
+		if strings.HasPrefix(line, "Steps:") {
+			return line
 		}
 	}
-
-	if strings.Contains(cleanText, "Schedule type:") {
-		scheduler := extractParam(cleanText, "Schedule type:", ",")
-		if scheduler != "" {
-			metadata.Scheduler = strings.TrimSpace(scheduler)
+	// Some tools append the settings to the prompt line itself
+	for i := len(lines) - 1; i >= 0; i-- {
+		line := strings.TrimSpace(lines[i])
+		start := -1
+		for _, marker := range []string{"Steps:", "CFG scale:", "Sampler:"} {
+			if index := strings.Index(line, marker); index != -1 && (start == -1 || index < start) {
+				start = index
+			}
 		}
-	} else if strings.Contains(cleanText, "Scheduler:") {
-		scheduler := extractParam(cleanText, "Scheduler:", ",")
-		if scheduler != "" {
-			metadata.Scheduler = strings.TrimSpace(scheduler)
+		if start != -1 {
+			return line[start:]
 		}
 	}
+	return ""
+}
 
-	if strings.Contains(cleanText, "Model:") {
-		model := extractParam(cleanText, "Model:", ",")
-		if model != "" {
-			metadata.Model = strings.TrimSpace(model)
+// parseA1111ParamsLine tokenizes an A1111 parameters line into ordered
+// key/value pairs, unquoting values such as "Lora hashes".
+func parseA1111ParamsLine(line string) []GenerationParam {
+	var params []GenerationParam
+	seen := make(map[string]int)
+
+	for _, match := range a1111ParamRegex.FindAllStringSubmatch(line, -1) {
+		key := strings.TrimSpace(match[1])
+		value := strings.TrimSpace(match[2])
+		if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+			var unquoted string
+			if err := json.Unmarshal([]byte(value), &unquoted); err == nil {
+				value = unquoted
+			} else {
+				value = value[1 : len(value)-1]
+			}
 		}
-	}
 
-	// Extract model hash if present
-	if strings.Contains(cleanText, "Model hash:") {
-		hash := extractParam(cleanText, "Model hash:", ",")
-		if hash != "" {
-			metadata.ModelHash = strings.TrimSpace(hash)
+		if index, exists := seen[key]; exists {
+			params[index].Value = value
+			continue
 		}
+		seen[key] = len(params)
+		params = append(params, GenerationParam{Key: key, Value: value})
 	}
 
-	if strings.Contains(cleanText, "Seed:") {
-		if seed := extractParam(cleanText, "Seed:", ","); seed != "" {
-			if s, err := strconv.ParseInt(strings.TrimSpace(seed), 10, 64); err == nil {
-				metadata.Seed = s
+	return params
+}
+
+// applyA1111Params copies the settings the viewer knows about onto their
+// dedicated fields and keeps the full list for the image_params table.
+func applyA1111Params(params []GenerationParam, metadata *ImageMetadata) {
+	for _, param := range params {
+		value := param.Value
+		switch param.Key {
+		case "Steps":
+			if v, err := strconv.Atoi(value); err == nil {
+				metadata.Steps = v
+			}
+		case "CFG scale":
+			if v, err := strconv.ParseFloat(value, 64); err == nil {
+				metadata.CFGScale = v
+			}
+		case "Sampler":
+			metadata.Sampler = value
+		case "Schedule type":
+			metadata.Scheduler = value
+		case "Scheduler":
+			if metadata.Scheduler == "" {
+				metadata.Scheduler = value
+			}
+		case "Model":
+			metadata.Model = value
+		case "Model hash":
+			metadata.ModelHash = value
+		case "Seed":
+			if v, err := strconv.ParseInt(value, 10, 64); err == nil {
+				metadata.Seed = v
+			}
+		case "Clip skip":
+			if v, err := strconv.Atoi(value); err == nil {
+				metadata.ClipSkip = v
+			}
+		case "VAE":
+			metadata.VAE = value
+		case "VAE hash":
+			metadata.VAEHash = value
+		case "Denoising strength":
+			if v, err := strconv.ParseFloat(value, 64); err == nil {
+				metadata.DenoisingStrength = v
+			}
+		case "Hires upscale":
+			if v, err := strconv.ParseFloat(value, 64); err == nil {
+				metadata.HiresUpscale = v
+			}
+		case "Hires upscaler":
+			metadata.HiresUpscaler = value
+		case "Hires steps":
+			if v, err := strconv.Atoi(value); err == nil {
+				metadata.HiresSteps = v
 			}
+		case "ADetailer model":
+			metadata.ADetailerModel = value
+		case "Variation seed":
+			if v, err := strconv.ParseInt(value, 10, 64); err == nil {
+				metadata.VariationSeed = v
+			}
+		case "Version":
+			metadata.GeneratorVersion = value
+		case "Lora hashes":
+			metadata.LoraHashes = value
 		}
 	}
+
+	metadata.Params = params
 }
 
 func (app *App) cleanUnicodeText(text string) string {
+	if comment, ok := decodeEXIFUnicodeComment(text); ok {
+		return strings.TrimSpace(sanitizeUTF8(comment))
+	}
 	text = sanitizeUTF8(text)
 
 	// Remove "UNICODE" prefix if present
@@ -302,38 +370,94 @@ func (app *App) cleanUnicodeText(text string) string {
 	return cleanText
 }
 
-func extractParam(text, prefix, suffix string) string {
-	start := strings.Index(text, prefix)
-	if start == -1 {
-		return ""
+// decodeEXIFUnicodeComment decodes a UserComment with the UNICODE character
+// code. The standard makes it UCS-2 in the file's byte order, which is lost by
+// then, so the order is guessed from where the zero bytes of ASCII text fall.
+func decodeEXIFUnicodeComment(text string) (string, bool) {
+	data, found := strings.CutPrefix(text, exifUnicodeCharacterCode)
+	if !found || len(data) < 2 || len(data)%2 != 0 {
+		return "", false
 	}
-	start += len(prefix)
 
-	end := strings.Index(text[start:], suffix)
-	if end == -1 {
-		return strings.TrimSpace(text[start:])
+	evenZeros, oddZeros := 0, 0
+	for i := 0; i+1 < len(data) && i < 200; i += 2 {
+		if data[i] == 0 {
+			evenZeros++
+		}
+		if data[i+1] == 0 {
+			oddZeros++
+		}
+	}
+	var order binary.ByteOrder = binary.BigEndian
+	if oddZeros > evenZeros {
+		order = binary.LittleEndian
 	}
 
-	return strings.TrimSpace(text[start : start+end])
+	units := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		units = append(units, order.Uint16([]byte(data[i:i+2])))
+	}
+	return string(utf16.Decode(units)), true
 }
 
 func (app *App) extractPNGMetadata(filePath string, metadata *ImageMetadata) {
+	sources := readPNGTextChunks(filePath)
+	for _, source := range sources {
+		if source.Key == xmpPNGKeyword {
+			sources = append(sources, applyXMPPacket([]byte(source.Text), metadata)...)
+		}
+	}
+	applyFooocusScheme(sources)
+	if !metadata.ParametersWritten {
+		app.parseMetadataSources(sources, metadata)
+		return
+	}
+
+	// Corrections written back by -write-metadata win over the chunks the
+	// generator left, such as the ComfyUI prompt and workflow
+	app.parseWrittenMetadataSources(sources, metadata, func(source MetadataSource) bool {
+		return source.Container == "png" && source.Key == "parameters"
+	})
+}
+
+// parseWrittenMetadataSources parses the sources of a file whose parameters
+// were written back by -write-metadata. Other sources a parser would claim,
+// left by the generator or kept in the XMP packet, stay in the file and the
+// raw metadata but are marked superseded instead of parsed.
+func (app *App) parseWrittenMetadataSources(sources []MetadataSource, metadata *ImageMetadata, written func(MetadataSource) bool) {
+	var kept, superseded []MetadataSource
+	for _, source := range sources {
+		if !written(source) && metadataParsers.detects(source) {
+			source.Parser = supersededMetadataParser
+			superseded = append(superseded, source)
+		} else {
+			kept = append(kept, source)
+		}
+	}
+	app.parseMetadataSources(kept, metadata)
+	metadata.MetadataSources = append(metadata.MetadataSources, superseded...)
+}
+
+// readPNGTextChunks returns the tEXt and iTXt chunks of a PNG in file order.
+func readPNGTextChunks(filePath string) []MetadataSource {
+	var sources []MetadataSource
+
 	file, err := os.Open(filePath)
 	if err != nil {
-		return
+		return nil
 	}
 	defer file.Close()
 
 	// Read PNG signature (8 bytes)
 	signature := make([]byte, 8)
 	if _, err := file.Read(signature); err != nil {
-		return
+		return nil
 	}
 
 	// Verify PNG signature
 	pngSignature := []byte{137, 80, 78, 71, 13, 10, 26, 10}
 	if !bytes.Equal(signature, pngSignature) {
-		return
+		return nil
 	}
 
 	// Read chunks looking for text chunks
@@ -364,46 +488,51 @@ func (app *App) extractPNGMetadata(filePath string, metadata *ImageMetadata) {
 		// Process text chunks
 		switch chunkType {
 		case "tEXt":
-			app.processPNGTextChunk(data, metadata)
+			if source, ok := processPNGTextChunk(data); ok {
+				sources = append(sources, source)
+			}
 		case "zTXt":
-			app.processPNGzTextChunk(data, metadata)
+			processPNGzTextChunk(data)
 		case "iTXt":
-			app.processPNGiTextChunk(data, metadata)
+			if source, ok := processPNGiTextChunk(data); ok {
+				sources = append(sources, source)
+			}
 		case "IEND":
-			return // End of PNG file
+			return sources // End of PNG file
 		}
 	}
+	return sources
 }
 
-func (app *App) processPNGTextChunk(data []byte, metadata *ImageMetadata) {
+func processPNGTextChunk(data []byte) (MetadataSource, bool) {
 	// tEXt format: keyword\0text
 	nullIndex := bytes.IndexByte(data, 0)
 	if nullIndex == -1 {
-		return
+		return MetadataSource{}, false
 	}
 
 	keyword := string(data[:nullIndex])
 	text := string(data[nullIndex+1:])
 
 	log.Printf("PNG tEXt chunk - %s: %s", keyword, text)
-	app.checkPNGTextForParams(keyword, text, metadata)
+	return MetadataSource{Container: "png", Key: keyword, Text: text}, true
 }
 
-func (app *App) processPNGzTextChunk(_ []byte, _ *ImageMetadata) {
+func processPNGzTextChunk(_ []byte) {
 	// zTXt format: keyword\0compression_method\0compressed_text
 	// For now, we'll skip compressed text chunks as they're more complex
 	log.Printf("Found zTXt chunk, skipping compressed text parsing")
 }
 
-func (app *App) processPNGiTextChunk(data []byte, metadata *ImageMetadata) {
+func processPNGiTextChunk(data []byte) (MetadataSource, bool) {
 	keyword, text, err := decodePNGiTextChunk(data)
 	if err != nil {
 		log.Printf("Unable to decode PNG iTXt chunk: %v", err)
-		return
+		return MetadataSource{}, false
 	}
 
 	log.Printf("PNG iTXt chunk - %s: %s", keyword, text)
-	app.checkPNGTextForParams(keyword, text, metadata)
+	return MetadataSource{Container: "png", Key: keyword, Text: text}, true
 }
 
 func decodePNGiTextChunk(data []byte) (string, string, error) {
@@ -560,16 +689,3 @@ func (app *App) parseComfyUIWorkflow(jsonText string, metadata *ImageMetadata) b
 		metadata.Prompt[:min(50, len(metadata.Prompt))], metadata.Steps)
 	return true
 }
-
-func (app *App) checkPNGTextForParams(keyword, text string, metadata *ImageMetadata) {
-	// Check common keys used by AI image generators
-	switch strings.ToLower(keyword) {
-	case "parameters", "workflow", "prompt", "generation_data", "usercomment", "description":
-		app.parseGenerationParams(text, metadata)
-	case "software":
-		if strings.Contains(strings.ToLower(text), "comfyui") {
-			// ComfyUI often stores params in workflow
-			app.parseGenerationParams(text, metadata)
-		}
-	}
-}
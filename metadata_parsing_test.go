@@ -193,3 +193,87 @@ func buildPNGiTextChunk(t *testing.T, keyword, text string, compressed bool) []b
 	data = append(data, textBytes...)
 	return data
 }
+
+func TestA1111ExtendedParams(t *testing.T) {
+	app := &App{}
+	metadata := &ImageMetadata{}
+	text := "a lighthouse at dusk, <lora:film_grain:0.6>\n" +
+		"Negative prompt: blurry, lowres\n" +
+		`Steps: 30, Sampler: DPM++ 2M, Schedule type: Karras, CFG scale: 5.5, Seed: 3050912, Size: 832x1216, ` +
+		`Model hash: 6ce0161689, Model: sdxl_base, VAE hash: 235745af8d, VAE: sdxl_vae.safetensors, ` +
+		`Clip skip: 2, Denoising strength: 0.35, Hires upscale: 1.5, Hires steps: 12, Hires upscaler: 4x-UltraSharp, ` +
+		`ADetailer model: face_yolov8n.pt, Variation seed: 42, ` +
+		`Lora hashes: "film_grain: a1b2c3d4e5f6, detail_tweaker: 0f9e8d7c6b5a", Version: v1.10.1`
+
+	app.parseGenerationParams(text, metadata)
+
+	if metadata.Prompt != "a lighthouse at dusk," {
+		t.Errorf("Expected prompt without LoRA tag, got: %q", metadata.Prompt)
+	}
+	if metadata.NegPrompt != "blurry, lowres" {
+		t.Errorf("Expected negative prompt: blurry, lowres, got: %q", metadata.NegPrompt)
+	}
+	if metadata.Steps != 30 || metadata.CFGScale != 5.5 || metadata.Seed != 3050912 {
+		t.Errorf("Unexpected core params: steps=%d cfg=%f seed=%d", metadata.Steps, metadata.CFGScale, metadata.Seed)
+	}
+	if metadata.Sampler != "DPM++ 2M" || metadata.Scheduler != "Karras" {
+		t.Errorf("Unexpected sampler/scheduler: %q/%q", metadata.Sampler, metadata.Scheduler)
+	}
+	if metadata.Model != "sdxl_base" || metadata.ModelHash != "6ce0161689" {
+		t.Errorf("Unexpected model: %q (%q)", metadata.Model, metadata.ModelHash)
+	}
+	if metadata.ClipSkip != 2 {
+		t.Errorf("Expected clip skip: 2, got: %d", metadata.ClipSkip)
+	}
+	if metadata.VAE != "sdxl_vae.safetensors" || metadata.VAEHash != "235745af8d" {
+		t.Errorf("Unexpected VAE: %q (%q)", metadata.VAE, metadata.VAEHash)
+	}
+	if metadata.DenoisingStrength != 0.35 || metadata.HiresUpscale != 1.5 || metadata.HiresSteps != 12 || metadata.HiresUpscaler != "4x-UltraSharp" {
+		t.Errorf("Unexpected hires params: %+v", metadata)
+	}
+	if metadata.ADetailerModel != "face_yolov8n.pt" {
+		t.Errorf("Expected ADetailer model: face_yolov8n.pt, got: %q", metadata.ADetailerModel)
+	}
+	if metadata.VariationSeed != 42 {
+		t.Errorf("Expected variation seed: 42, got: %d", metadata.VariationSeed)
+	}
+	if metadata.LoraHashes != "film_grain: a1b2c3d4e5f6, detail_tweaker: 0f9e8d7c6b5a" {
+		t.Errorf("Expected quoted Lora hashes to keep their commas, got: %q", metadata.LoraHashes)
+	}
+	if metadata.GeneratorVersion != "v1.10.1" {
+		t.Errorf("Expected version: v1.10.1, got: %q", metadata.GeneratorVersion)
+	}
+
+	// Keys without a dedicated field are still kept, in order
+	if len(metadata.Params) != 19 {
+		t.Fatalf("Expected 19 params, got %d: %+v", len(metadata.Params), metadata.Params)
+	}
+	if metadata.Params[0].Key != "Steps" || metadata.Params[5] != (GenerationParam{Key: "Size", Value: "832x1216"}) {
+		t.Errorf("Unexpected param order: %+v", metadata.Params)
+	}
+}
+
+func TestParseA1111ParamsLineQuotedValues(t *testing.T) {
+	params := parseA1111ParamsLine(`Steps: 20, TI hashes: "easynegative: c74b4e810b03, \"odd\": 1234", Seed: 7, Seed: 8`)
+
+	want := []GenerationParam{
+		{Key: "Steps", Value: "20"},
+		{Key: "TI hashes", Value: `easynegative: c74b4e810b03, "odd": 1234`},
+		{Key: "Seed", Value: "8"},
+	}
+	if len(params) != len(want) {
+		t.Fatalf("Expected %d params, got %d: %+v", len(want), len(params), params)
+	}
+	for i := range want {
+		if params[i] != want[i] {
+			t.Errorf("Param %d: expected %+v, got %+v", i, want[i], params[i])
+		}
+	}
+}
+
+func TestFindA1111ParamsLineInlineSettings(t *testing.T) {
+	line := findA1111ParamsLine("portrait of a cat Steps: 25, Sampler: Euler a, Seed: 99")
+	if line != "Steps: 25, Sampler: Euler a, Seed: 99" {
+		t.Errorf("Expected settings to start at Steps:, got: %q", line)
+	}
+}
@@ -0,0 +1,956 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/gorilla/mux"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+const (
+	pngSignature   = "\x89PNG\r\n\x1a\n"
+	exifJPEGPrefix = "Exif\x00\x00"
+
+	// EXIF character code for UCS-2 text, as written by A1111 (piexif)
+	exifUnicodeCharacterCode = "UNICODE\x00"
+
+	// JPEG segment payloads are limited to 64 KiB including the length field
+	maxJPEGSegmentPayload = 0xFFFF - 2
+
+	xmpNamespaceRDF = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+
+	exifIFDPointerTag  = 0x8769
+	exifUserCommentTag = 0x9286
+)
+
+// XMP labels recording the viewer's category
+const (
+	xmpLabelNSFW = "NSFW"
+	xmpLabelSFW  = "SFW"
+)
+
+// a1111CoreParamKeys are written first, in A1111's order, from the image
+// columns so that corrections made in the viewer win over the original line.
+var a1111CoreParamKeys = []string{"Steps", "Sampler", "Schedule type", "CFG scale", "Seed", "Size", "Model hash", "Model"}
+
+type WriteMetadataResponse struct {
+	Success  bool   `json:"success"`
+	Filename string `json:"filename,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// quoteA1111Value quotes parameter values the way A1111 does, so that commas
+// and colons inside a value don't split the settings line.
+func quoteA1111Value(value string) string {
+	if !strings.ContainsAny(value, ",:\n") {
+		return value
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+	return string(encoded)
+}
+
+// formatA1111Parameters rebuilds an A1111 parameters string from an image
+// record: the prompt with its LoRA tags, the negative prompt, and a settings
+// line holding the core columns followed by every other stored parameter.
+func formatA1111Parameters(img ImageMetadata) string {
+	prompt := img.Prompt
+	for _, lora := range img.LoRAs {
+		tag := fmt.Sprintf("<lora:%s:%s>", lora.Name, strconv.FormatFloat(lora.Weight, 'f', -1, 64))
+		if prompt == "" {
+			prompt = tag
+		} else {
+			prompt += " " + tag
+		}
+	}
+
+	var text strings.Builder
+	text.WriteString(prompt)
+	if img.NegPrompt != "" {
+		text.WriteString("\nNegative prompt: " + img.NegPrompt)
+	}
+
+	model := img.ModelFile
+	for _, param := range img.Params {
+		if param.Key == "Model" && param.Value != "" {
+			model = param.Value
+		}
+	}
+	if model == "" && img.Model != "Unknown Model" {
+		model = img.Model
+	}
+
+	core := map[string]string{"Model hash": img.ModelHash, "Model": model, "Sampler": img.Sampler, "Schedule type": img.Scheduler}
+	if img.Steps > 0 {
+		core["Steps"] = strconv.Itoa(img.Steps)
+	}
+	if img.CFGScale > 0 {
+		core["CFG scale"] = strconv.FormatFloat(img.CFGScale, 'f', -1, 64)
+	}
+	if img.Seed != 0 {
+		core["Seed"] = strconv.FormatInt(img.Seed, 10)
+	}
+	if img.Width > 0 && img.Height > 0 {
+		core["Size"] = fmt.Sprintf("%dx%d", img.Width, img.Height)
+	}
+
+	var settings []string
+	for _, key := range a1111CoreParamKeys {
+		if value := core[key]; value != "" {
+			settings = append(settings, key+": "+quoteA1111Value(value))
+		}
+	}
+	for _, param := range img.Params {
+		if slices.Contains(a1111CoreParamKeys, param.Key) {
+			continue
+		}
+		settings = append(settings, param.Key+": "+quoteA1111Value(param.Value))
+	}
+	if len(settings) > 0 {
+		text.WriteString("\n" + strings.Join(settings, ", "))
+	}
+	return text.String()
+}
+
+// viewerXMPDescription returns an rdf:Description carrying the image category
+// as xmp:Label, the star rating and the favorite flag. aiv:ParametersWritten
+// tells a rebuild that the parameters chunk holds the viewer's corrections.
+func viewerXMPDescription(rdfPrefix string, isNSFW bool, rating int, favorite bool) string {
+	label := xmpLabelSFW
+	if isNSFW {
+		label = xmpLabelNSFW
+	}
+	var extraAttributes string
+	if rating != 0 {
+		extraAttributes = fmt.Sprintf("\n    xmp:Rating=\"%d\"", rating)
+	}
+	if favorite {
+		extraAttributes += "\n    aiv:Favorite=\"True\""
+	}
+	return `<` + rdfPrefix + `:Description ` + rdfPrefix + `:about=""
+    xmlns:xmp="` + xmpNamespaceXMP + `"
+    xmlns:aiv="` + xmpNamespaceViewer + `"
+    xmp:Label="` + html.EscapeString(label) + `"
+    aiv:ParametersWritten="True"` + extraAttributes + `/>`
+}
+
+// buildXMPPacket returns a new XMP packet holding only the viewer's
+// properties, for files that have none yet.
+func buildXMPPacket(isNSFW bool, rating int, favorite bool) []byte {
+	return []byte(`<?xpacket begin="` + "\uFEFF" + `" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="` + xmpNamespaceRDF + `">
+  ` + viewerXMPDescription("rdf", isNSFW, rating, favorite) + `
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>`)
+}
+
+// viewerXMPProperty reports whether a property is one the viewer writes, so
+// that an earlier value of it is dropped when the packet is merged.
+func viewerXMPProperty(name xml.Name) bool {
+	if name.Space == xmpNamespaceXMP {
+		return name.Local == "Label" || name.Local == "Rating"
+	}
+	return name.Space == xmpNamespaceViewer
+}
+
+// mergeXMPPacket adds the viewer's properties to an existing XMP packet as a
+// new rdf:Description. Earlier values of those properties are removed, both
+// as attributes and as elements; everything else other tools wrote, such as
+// keywords, captions and camera data, is kept as it was.
+func mergeXMPPacket(existing []byte, isNSFW bool, rating int, favorite bool) ([]byte, error) {
+	type edit struct {
+		start, end  int
+		replacement string
+	}
+	var edits []edit
+
+	decoder := xml.NewDecoder(bytes.NewReader(existing))
+	scopes := []map[string]string{{"xml": "http://www.w3.org/XML/1998/namespace"}}
+	resolve := func(prefix string) string {
+		for i := len(scopes) - 1; i >= 0; i-- {
+			if uri, ok := scopes[i][prefix]; ok {
+				return uri
+			}
+		}
+		return prefix
+	}
+	description := xml.Name{Space: xmpNamespaceRDF, Local: "Description"}
+
+	var stack []xml.Name
+	rdfPrefix, rdfEnd := "", -1
+	removeFrom, removeDepth := -1, 0
+	for {
+		start := int(decoder.InputOffset())
+		token, err := decoder.RawToken()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decode XMP: %w", err)
+		}
+		end := int(decoder.InputOffset())
+
+		switch element := token.(type) {
+		case xml.StartElement:
+			scope := make(map[string]string)
+			for _, attr := range element.Attr {
+				switch {
+				case attr.Name.Space == "xmlns":
+					scope[attr.Name.Local] = attr.Value
+				case attr.Name.Space == "" && attr.Name.Local == "xmlns":
+					scope[""] = attr.Value
+				}
+			}
+			scopes = append(scopes, scope)
+			name := xml.Name{Space: resolve(element.Name.Space), Local: element.Name.Local}
+			parent := xml.Name{}
+			if len(stack) > 0 {
+				parent = stack[len(stack)-1]
+			}
+			stack = append(stack, name)
+			if removeFrom >= 0 {
+				continue
+			}
+
+			switch {
+			case name.Space == xmpNamespaceRDF && name.Local == "RDF":
+				rdfPrefix = element.Name.Space
+			case parent == description && viewerXMPProperty(name):
+				removeFrom, removeDepth = start, len(stack)
+			case name == description:
+				var kept []xml.Attr
+				properties := 0
+				for _, attr := range element.Attr {
+					// Unprefixed attributes are in no namespace
+					space := ""
+					if attr.Name.Space != "" {
+						space = resolve(attr.Name.Space)
+					}
+					if viewerXMPProperty(xml.Name{Space: space, Local: attr.Name.Local}) {
+						continue
+					}
+					if attr.Name.Space != "xmlns" && attr.Name.Local != "xmlns" && space != xmpNamespaceRDF {
+						properties++
+					}
+					kept = append(kept, attr)
+				}
+				selfClosing := bytes.HasSuffix(existing[start:end], []byte("/>"))
+				switch {
+				case len(kept) == len(element.Attr):
+				case selfClosing && properties == 0:
+					// A description left empty, such as one an earlier write added
+					edits = append(edits, edit{trimXMPIndent(existing, start), end, ""})
+				default:
+					edits = append(edits, edit{start, end, encodeXMPStartTag(element.Name, kept, selfClosing)})
+				}
+			}
+		case xml.EndElement:
+			if len(stack) == 0 {
+				return nil, errors.New("unbalanced XMP element")
+			}
+			if removeFrom >= 0 && len(stack) == removeDepth {
+				edits = append(edits, edit{trimXMPIndent(existing, removeFrom), end, ""})
+				removeFrom = -1
+			}
+			if name := stack[len(stack)-1]; name.Space == xmpNamespaceRDF && name.Local == "RDF" && start < end {
+				rdfEnd = start
+			}
+			stack = stack[:len(stack)-1]
+			scopes = scopes[:len(scopes)-1]
+		}
+	}
+	if rdfEnd < 0 {
+		return nil, errors.New("no rdf:RDF element in XMP packet")
+	}
+
+	edits = append(edits, edit{rdfEnd, rdfEnd, " " + viewerXMPDescription(rdfPrefix, isNSFW, rating, favorite) + "\n "})
+	var merged []byte
+	offset := 0
+	for _, e := range edits {
+		merged = append(merged, existing[offset:e.start]...)
+		merged = append(merged, e.replacement...)
+		offset = e.end
+	}
+	return append(merged, existing[offset:]...), nil
+}
+
+// trimXMPIndent moves the start of a removed element back over the line
+// break and indentation before it.
+func trimXMPIndent(data []byte, start int) int {
+	for start > 0 && strings.ContainsRune(" \t\r\n", rune(data[start-1])) {
+		start--
+	}
+	return start
+}
+
+// encodeXMPStartTag writes a start tag with raw (prefixed) names, as
+// returned by xml.Decoder.RawToken.
+func encodeXMPStartTag(name xml.Name, attrs []xml.Attr, selfClosing bool) string {
+	qualified := func(name xml.Name) string {
+		if name.Space == "" {
+			return name.Local
+		}
+		return name.Space + ":" + name.Local
+	}
+
+	var tag strings.Builder
+	tag.WriteString("<" + qualified(name))
+	for i, attr := range attrs {
+		separator := "\n    "
+		if i == 0 {
+			separator = " "
+		}
+		tag.WriteString(separator + qualified(attr.Name) + `="`)
+		_ = xml.EscapeText(&tag, []byte(attr.Value))
+		tag.WriteString(`"`)
+	}
+	if selfClosing {
+		tag.WriteString("/>")
+	} else {
+		tag.WriteString(">")
+	}
+	return tag.String()
+}
+
+func pngChunk(chunkType string, data []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, chunkType...)
+	chunk = append(chunk, data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+// pngTextChunk encodes a text chunk as tEXt when the text is plain ASCII, and
+// as an uncompressed iTXt chunk otherwise. tEXt is Latin-1 by the standard,
+// but most readers, this one included, take it as UTF-8.
+func pngTextChunk(keyword, text string) []byte {
+	ascii := true
+	for i := 0; i < len(text); i++ {
+		if text[i] >= 0x80 {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return pngChunk("tEXt", append(append([]byte(keyword), 0), text...))
+	}
+
+	// Compression flag and method, then empty language tag and translated keyword
+	data := append([]byte(keyword), 0, 0, 0, 0, 0)
+	data = append(data, text...)
+	return pngChunk("iTXt", data)
+}
+
+// rewritePNGMetadata replaces the parameters and XMP text chunks of a PNG,
+// placing the new ones right after IHDR. Every other chunk is kept.
+func rewritePNGMetadata(data []byte, parameters string, xmp []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(pngSignature)) {
+		return nil, errors.New("not a PNG file")
+	}
+
+	output := append([]byte{}, pngSignature...)
+	offset := len(pngSignature)
+	for offset < len(data) {
+		if len(data) < offset+12 {
+			return nil, errors.New("truncated PNG chunk")
+		}
+		length := int(binary.BigEndian.Uint32(data[offset : offset+4]))
+		end := offset + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, errors.New("truncated PNG chunk")
+		}
+		chunkType := string(data[offset+4 : offset+8])
+		chunkData := data[offset+8 : offset+8+length]
+
+		replaced := false
+		switch chunkType {
+		case "tEXt", "iTXt", "zTXt":
+			keyword, _, _ := bytes.Cut(chunkData, []byte{0})
+			replaced = string(keyword) == "parameters" || string(keyword) == xmpPNGKeyword
+		}
+		if !replaced {
+			output = append(output, data[offset:end]...)
+		}
+		if chunkType == "IHDR" {
+			output = append(output, pngTextChunk("parameters", parameters)...)
+			output = append(output, pngTextChunk(xmpPNGKeyword, string(xmp))...)
+		}
+
+		offset = end
+		if chunkType == "IEND" {
+			break
+		}
+	}
+	return output, nil
+}
+
+// tiffByteOrder reads and appends the integers of a TIFF structure.
+type tiffByteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+// tiffEntry encodes a 12-byte IFD entry.
+func tiffEntry(order tiffByteOrder, tag, fieldType uint16, count, value uint32) []byte {
+	entry := order.AppendUint16(nil, tag)
+	entry = order.AppendUint16(entry, fieldType)
+	entry = order.AppendUint32(entry, count)
+	return order.AppendUint32(entry, value)
+}
+
+// exifUserComment encodes a UserComment value as UCS-2 in the byte order of
+// the TIFF structure holding it.
+func exifUserComment(comment string, order tiffByteOrder) []byte {
+	userComment := []byte(exifUnicodeCharacterCode)
+	for _, unit := range utf16.Encode([]rune(comment)) {
+		userComment = order.AppendUint16(userComment, unit)
+	}
+	return userComment
+}
+
+// exifUserCommentSegment builds a minimal EXIF APP1 payload holding the
+// UserComment as UCS-2, plus the orientation of the original file if it had one.
+func exifUserCommentSegment(comment string, orientation uint16) []byte {
+	order := binary.BigEndian
+	userComment := exifUserComment(comment, order)
+
+	entries := uint16(1)
+	if orientation != 0 {
+		entries++
+	}
+	exifIFDOffset := uint32(8 + 2 + 12*int(entries) + 4)
+
+	tiff := []byte("MM\x00\x2A")
+	tiff = order.AppendUint32(tiff, 8)
+	tiff = order.AppendUint16(tiff, entries)
+	if orientation != 0 {
+		// SHORT values are left-justified in the value field
+		tiff = append(tiff, tiffEntry(order, 0x0112, 3, 1, uint32(orientation)<<16)...)
+	}
+	tiff = append(tiff, tiffEntry(order, exifIFDPointerTag, 4, 1, exifIFDOffset)...)
+	tiff = order.AppendUint32(tiff, 0)
+
+	tiff = order.AppendUint16(tiff, 1)
+	tiff = append(tiff, tiffEntry(order, exifUserCommentTag, 7, uint32(len(userComment)), exifIFDOffset+2+12+4)...)
+	tiff = order.AppendUint32(tiff, 0)
+	tiff = append(tiff, userComment...)
+
+	return append([]byte(exifJPEGPrefix), tiff...)
+}
+
+// readTIFFIFD returns the 12-byte entries of the IFD at offset and the
+// offset of the next IFD.
+func readTIFFIFD(tiff []byte, order tiffByteOrder, offset uint32) ([][]byte, uint32, error) {
+	if offset < 8 || int(offset)+2 > len(tiff) {
+		return nil, 0, errors.New("IFD offset out of range")
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	end := int(offset) + 2 + 12*count
+	if end+4 > len(tiff) {
+		return nil, 0, errors.New("truncated IFD")
+	}
+	entries := make([][]byte, count)
+	for i := range entries {
+		start := int(offset) + 2 + 12*i
+		entries[i] = tiff[start : start+12]
+	}
+	return entries, order.Uint32(tiff[end:]), nil
+}
+
+// appendTIFFIFD writes an IFD at the end of tiff, word-aligned and sorted by
+// tag as the standard requires, and returns its offset.
+func appendTIFFIFD(tiff []byte, order tiffByteOrder, entries [][]byte, next uint32) ([]byte, uint32) {
+	slices.SortStableFunc(entries, func(a, b []byte) int {
+		return int(order.Uint16(a)) - int(order.Uint16(b))
+	})
+	if len(tiff)%2 != 0 {
+		tiff = append(tiff, 0)
+	}
+	offset := uint32(len(tiff))
+	tiff = order.AppendUint16(tiff, uint16(len(entries)))
+	for _, entry := range entries {
+		tiff = append(tiff, entry...)
+	}
+	return order.AppendUint32(tiff, next), offset
+}
+
+// rewriteEXIFUserComment replaces the UserComment of an existing EXIF TIFF
+// structure and keeps every other entry: camera data, GPS, orientation and
+// the thumbnail. The original bytes stay where they are, so the offsets
+// inside them remain valid; a new Exif IFD holding the new comment is
+// appended and IFD0 is pointed at it. The Exif IFD and comment a previous
+// write appended are cut off first, so repeated writes don't grow the file.
+func rewriteEXIFUserComment(tiff []byte, comment string) ([]byte, error) {
+	if len(tiff) < 8 {
+		return nil, errors.New("truncated TIFF header")
+	}
+	var order tiffByteOrder
+	switch string(tiff[:4]) {
+	case "II\x2A\x00":
+		order = binary.LittleEndian
+	case "MM\x00\x2A":
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("invalid TIFF header")
+	}
+
+	ifd0Offset := order.Uint32(tiff[4:])
+	ifd0, next, err := readTIFFIFD(tiff, order, ifd0Offset)
+	if err != nil {
+		return nil, fmt.Errorf("IFD0: %w", err)
+	}
+	pointerIndex := slices.IndexFunc(ifd0, func(entry []byte) bool { return order.Uint16(entry) == exifIFDPointerTag })
+
+	var exifEntries [][]byte
+	if pointerIndex >= 0 {
+		exifIFDOffset := order.Uint32(ifd0[pointerIndex][8:])
+		entries, _, err := readTIFFIFD(tiff, order, exifIFDOffset)
+		if err != nil {
+			return nil, fmt.Errorf("Exif IFD: %w", err)
+		}
+		var commentOffset, commentEnd uint32
+		for _, entry := range entries {
+			if order.Uint16(entry) == exifUserCommentTag {
+				if count := order.Uint32(entry[4:]); count > 4 {
+					commentOffset = order.Uint32(entry[8:])
+					commentEnd = commentOffset + count
+				}
+				continue
+			}
+			exifEntries = append(exifEntries, slices.Clone(entry))
+		}
+
+		// An Exif IFD directly followed by its comment at the very end is
+		// what a previous write appended, and nothing else points into it
+		ifdEnd := exifIFDOffset + 2 + 12*uint32(len(entries)) + 4
+		if commentOffset == ifdEnd && commentEnd == uint32(len(tiff)) {
+			tiff = tiff[:exifIFDOffset]
+		}
+	}
+	tiff = slices.Clone(tiff)
+
+	var pointerOffset uint32
+	if pointerIndex >= 0 {
+		pointerOffset = ifd0Offset + 2 + 12*uint32(pointerIndex) + 8
+	} else {
+		// IFD0 has no room for the pointer, so a copy holding it is appended
+		entries := append(slices.Clone(ifd0), tiffEntry(order, exifIFDPointerTag, 4, 1, 0))
+		tiff, ifd0Offset = appendTIFFIFD(tiff, order, entries, next)
+		order.PutUint32(tiff[4:], ifd0Offset)
+		pointerIndex = slices.IndexFunc(entries, func(entry []byte) bool { return order.Uint16(entry) == exifIFDPointerTag })
+		pointerOffset = ifd0Offset + 2 + 12*uint32(pointerIndex) + 8
+	}
+
+	if len(tiff)%2 != 0 {
+		tiff = append(tiff, 0)
+	}
+	userComment := exifUserComment(comment, order)
+	commentOffset := uint32(len(tiff)) + 2 + 12*uint32(len(exifEntries)+1) + 4
+	entry := tiffEntry(order, exifUserCommentTag, 7, uint32(len(userComment)), commentOffset)
+
+	tiff, exifIFDOffset := appendTIFFIFD(tiff, order, append(exifEntries, entry), 0)
+	tiff = append(tiff, userComment...)
+	order.PutUint32(tiff[pointerOffset:], exifIFDOffset)
+	return tiff, nil
+}
+
+// jpegEXIFPayload returns the TIFF structure of the first EXIF segment of a
+// JPEG, or nil when it has none.
+func jpegEXIFPayload(data []byte) []byte {
+	offset := 2
+	for len(data) >= offset+4 && data[offset] == 0xFF {
+		marker := data[offset+1]
+		if marker == 0xDA || marker == 0xD9 {
+			return nil
+		}
+		end := offset + 2 + int(binary.BigEndian.Uint16(data[offset+2:offset+4]))
+		if end > len(data) {
+			return nil
+		}
+		if payload := data[offset+4 : end]; marker == 0xE1 && bytes.HasPrefix(payload, []byte(exifJPEGPrefix)) {
+			return payload[len(exifJPEGPrefix):]
+		}
+		offset = end
+	}
+	return nil
+}
+
+// rewriteJPEGMetadata replaces the EXIF and XMP segments of a JPEG with new
+// ones placed after the JFIF header. The new EXIF segment keeps every field
+// of the old one but the UserComment; when the old one can't be read, only
+// the orientation is carried over.
+func rewriteJPEGMetadata(data []byte, parameters string, xmp []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errors.New("not a JPEG file")
+	}
+
+	var exifPayload []byte
+	if existing := jpegEXIFPayload(data); existing != nil {
+		if tiff, err := rewriteEXIFUserComment(existing, parameters); err == nil {
+			exifPayload = append([]byte(exifJPEGPrefix), tiff...)
+		}
+	}
+	if exifPayload == nil {
+		var orientation uint16
+		if exifData, err := exif.Decode(bytes.NewReader(data)); err == nil {
+			if tag, err := exifData.Get(exif.Orientation); err == nil {
+				if value, err := tag.Int(0); err == nil {
+					orientation = uint16(value)
+				}
+			}
+		}
+		exifPayload = exifUserCommentSegment(parameters, orientation)
+	}
+	xmpPayload := append([]byte(xmpJPEGPrefix), xmp...)
+	if len(exifPayload) > maxJPEGSegmentPayload || len(xmpPayload) > maxJPEGSegmentPayload {
+		return nil, errors.New("metadata too large for a JPEG segment")
+	}
+
+	var kept [][]byte
+	offset := 2
+	inserted := false
+	output := append([]byte{}, data[:2]...)
+	insert := func() {
+		for _, segment := range kept {
+			output = append(output, segment...)
+		}
+		kept = nil
+		if !inserted {
+			output = append(output, jpegSegment(0xE1, exifPayload)...)
+			output = append(output, jpegSegment(0xE1, xmpPayload)...)
+			inserted = true
+		}
+	}
+
+	for {
+		if len(data) < offset+4 || data[offset] != 0xFF {
+			return nil, errors.New("invalid JPEG segment")
+		}
+		marker := data[offset+1]
+		if marker == 0xDA || marker == 0xD9 {
+			// Scan data and everything after it is copied as is
+			insert()
+			output = append(output, data[offset:]...)
+			return output, nil
+		}
+
+		end := offset + 2 + int(binary.BigEndian.Uint16(data[offset+2:offset+4]))
+		if end > len(data) {
+			return nil, errors.New("truncated JPEG segment")
+		}
+		payload := data[offset+4 : end]
+
+		switch {
+		case marker == 0xE1 && (bytes.HasPrefix(payload, []byte(exifJPEGPrefix)) || bytes.HasPrefix(payload, []byte(xmpJPEGPrefix))):
+			// Replaced
+		case marker == 0xE0 && !inserted:
+			kept = append(kept, data[offset:end])
+		default:
+			insert()
+			output = append(output, data[offset:end]...)
+		}
+		offset = end
+	}
+}
+
+// jpegSegment encodes a marker segment with its length field.
+func jpegSegment(marker byte, payload []byte) []byte {
+	segment := []byte{0xFF, marker}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// replaceFileAtomically writes data to a temporary file next to path and
+// renames it over the original, keeping its permissions and modification
+// time (local images are dated by mtime).
+func replaceFileAtomically(path string, data []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("create temporary file: %w", err)
+	}
+	tempPath := temp.Name()
+	cleanup := func() {
+		_ = temp.Close()
+		_ = os.Remove(tempPath)
+	}
+
+	if _, err := temp.Write(data); err != nil {
+		cleanup()
+		return fmt.Errorf("write temporary file: %w", err)
+	}
+	if err := temp.Sync(); err != nil {
+		cleanup()
+		return fmt.Errorf("sync temporary file: %w", err)
+	}
+	if err := temp.Close(); err != nil {
+		_ = os.Remove(tempPath)
+		return fmt.Errorf("close temporary file: %w", err)
+	}
+	if err := os.Chmod(tempPath, info.Mode().Perm()); err != nil {
+		_ = os.Remove(tempPath)
+		return fmt.Errorf("set permissions: %w", err)
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		_ = os.Remove(tempPath)
+		return fmt.Errorf("replace %s: %w", path, err)
+	}
+	if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+		return fmt.Errorf("restore modification time: %w", err)
+	}
+	return nil
+}
+
+// loadImageForMetadataWrite returns the stored record of an image with its
+// LoRAs and generic parameters, and hand edits applied.
+func (app *App) loadImageForMetadataWrite(imageID int) (ImageMetadata, error) {
+	var img ImageMetadata
+	var edits imageEditColumns
+	err := app.db.QueryRow(`
+		SELECT i.id, i.filename, i.width, i.height, i.is_nsfw,
+		       COALESCE(i.prompt, ''), COALESCE(i.neg_prompt, ''), COALESCE(i.steps, 0), COALESCE(i.cfg_scale, 0),
+		       COALESCE(i.sampler, ''), COALESCE(i.scheduler, ''), COALESCE(i.seed, 0), COALESCE(i.model_hash, ''),
+		       COALESCE(m.name, ''), COALESCE(m.local_filename, ''), COALESCE(i.xmp_rating, 0),
+		       COALESCE(i.rating, 0), COALESCE(i.favorite, 0), `+imageEditSelectColumns+`
+		FROM images i
+		LEFT JOIN models m ON i.model_id = m.id
+		`+imageEditsJoin+`
+		WHERE i.id = ?
+	`, imageID).Scan(append([]any{&img.ID, &img.Filename, &img.Width, &img.Height, &img.IsNSFW,
+		&img.Prompt, &img.NegPrompt, &img.Steps, &img.CFGScale,
+		&img.Sampler, &img.Scheduler, &img.Seed, &img.ModelHash,
+		&img.Model, &img.ModelFile, &img.XMPRating,
+		&img.Rating, &img.Favorite}, edits.scanTargets()...)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return img, errImageNotFound
+	}
+	if err != nil {
+		return img, fmt.Errorf("load image: %w", err)
+	}
+	img.ModelFile = strings.TrimSuffix(img.ModelFile, filepath.Ext(img.ModelFile))
+	edits.apply(&img)
+
+	rows, err := app.db.Query("SELECT DISTINCT name, weight FROM loras WHERE image_id = ? ORDER BY id", imageID)
+	if err != nil {
+		return img, fmt.Errorf("load LoRAs: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var lora LoraData
+		if err := rows.Scan(&lora.Name, &lora.Weight); err != nil {
+			return img, fmt.Errorf("load LoRAs: %w", err)
+		}
+		img.LoRAs = append(img.LoRAs, lora)
+	}
+	if err := rows.Err(); err != nil {
+		return img, fmt.Errorf("load LoRAs: %w", err)
+	}
+
+	params, err := app.loadImageParams([]int{imageID})
+	if err != nil {
+		return img, fmt.Errorf("load parameters: %w", err)
+	}
+	img.Params = params[imageID]
+
+	// A corrected model replaces the parsed Model value
+	if edits.Model.Valid {
+		img.ModelFile = edits.Model.String
+		kept := img.Params[:0]
+		for _, param := range img.Params {
+			if param.Key != "Model" {
+				kept = append(kept, param)
+			}
+		}
+		img.Params = kept
+	}
+	return img, nil
+}
+
+// existingXMPPacket returns the XMP packet a PNG or JPEG already holds, so
+// that writing back keeps what other tools stored in it.
+func existingXMPPacket(path string, data []byte) []byte {
+	if bytes.HasPrefix(data, []byte(pngSignature)) {
+		for _, source := range readPNGTextChunks(path) {
+			if source.Key == xmpPNGKeyword {
+				return []byte(source.Text)
+			}
+		}
+		return nil
+	}
+	xmpData, _, _ := readJPEGMetadataSegments(path)
+	return xmpData
+}
+
+// writeImageMetadata embeds the stored prompt, parameters and category of an
+// image into its file, so that a rebuilt database reads them back.
+func (app *App) writeImageMetadata(imageID int) (string, error) {
+	img, err := app.loadImageForMetadataWrite(imageID)
+	if err != nil {
+		return "", err
+	}
+	file, _, err := app.loadImageFile(imageID)
+	if err != nil {
+		return img.Filename, err
+	}
+	if file.Location.readOnly() {
+		return img.Filename, errLibraryRootReadOnly
+	}
+	path, err := app.imageFilePath(file.Location)
+	if err != nil {
+		return img.Filename, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return img.Filename, fmt.Errorf("read image: %w", err)
+	}
+
+	parameters := formatA1111Parameters(img)
+	// The viewer's rating wins; a rejection (-1) from another tool is kept
+	rating := img.Rating
+	if rating == 0 && img.XMPRating < 0 {
+		rating = img.XMPRating
+	}
+	xmp := buildXMPPacket(img.IsNSFW, rating, img.Favorite)
+	if existing := existingXMPPacket(path, data); len(existing) > 0 {
+		merged, err := mergeXMPPacket(existing, img.IsNSFW, rating, img.Favorite)
+		if err != nil {
+			log.Printf("Unable to merge the XMP packet of %s, writing a new one: %v", img.Filename, err)
+		} else {
+			xmp = merged
+		}
+	}
+
+	var output []byte
+	switch {
+	case bytes.HasPrefix(data, []byte(pngSignature)):
+		output, err = rewritePNGMetadata(data, parameters, xmp)
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		output, err = rewriteJPEGMetadata(data, parameters, xmp)
+	default:
+		return img.Filename, errors.New("unsupported image format")
+	}
+	if err != nil {
+		return img.Filename, err
+	}
+
+	if err := replaceFileAtomically(path, output); err != nil {
+		return img.Filename, err
+	}
+
+	// The file changed, so does its hash
+	hash, err := contentHash(bytes.NewReader(output))
+	if err != nil {
+		return img.Filename, err
+	}
+	if _, err := app.db.Exec("UPDATE images SET content_hash = ? WHERE id = ?", hash, imageID); err != nil {
+		return img.Filename, fmt.Errorf("update content hash: %w", err)
+	}
+	return img.Filename, nil
+}
+
+// writeMetadataToFiles writes the metadata of the images named by filename,
+// path or ID, or of every image when names is ["all"].
+func (app *App) writeMetadataToFiles(names []string) (int, error) {
+	var files []imageFile
+	if len(names) == 1 && names[0] == "all" {
+		stored, err := app.loadImageFiles("i.trashed_at IS NULL")
+		if err != nil {
+			return 0, err
+		}
+		for _, file := range stored {
+			files = append(files, file.imageFile)
+		}
+	} else {
+		for _, name := range names {
+			file, err := app.findImageByName(name)
+			if err != nil {
+				fmt.Printf("Error: Image %s: %v\n", name, err)
+				continue
+			}
+			files = append(files, file)
+		}
+	}
+
+	fmt.Printf("Writing metadata to %d images...\n", len(files))
+
+	writtenCount := 0
+	for _, file := range files {
+		if _, err := app.writeImageMetadata(file.ID); err != nil {
+			fmt.Printf("Error: Failed to write metadata to %s: %v\n", file.Location.path(), err)
+			continue
+		}
+		writtenCount++
+	}
+	return writtenCount, nil
+}
+
+func (app *App) handleWriteImageMetadata(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	imageID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || imageID <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(WriteMetadataResponse{
+			Success: false,
+			Error:   "Invalid image ID",
+		})
+		return
+	}
+
+	filename, err := app.writeImageMetadata(imageID)
+	if errors.Is(err, errImageNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(WriteMetadataResponse{
+			Success: false,
+			Error:   "Image not found",
+		})
+		return
+	}
+	if errors.Is(err, errLibraryRootReadOnly) {
+		w.WriteHeader(http.StatusConflict)
+		_ = json.NewEncoder(w).Encode(WriteMetadataResponse{
+			Success: false,
+			Error:   "The image is in a read-only library root",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to write metadata to image %d: %v", imageID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(WriteMetadataResponse{
+			Success: false,
+			Error:   "Failed to write metadata",
+		})
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(WriteMetadataResponse{
+		Success:  true,
+		Filename: filename,
+	})
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+func TestFormatA1111Parameters(t *testing.T) {
+	img := ImageMetadata{
+		Width:     832,
+		Height:    1216,
+		Prompt:    "a lantern festival, night",
+		NegPrompt: "blurry",
+		Steps:     30,
+		CFGScale:  5.5,
+		Sampler:   "DPM++ 2M",
+		Scheduler: "Karras",
+		Seed:      12345,
+		ModelHash: "abcdef1234",
+		Model:     "Unknown Model",
+		LoRAs:     []LoraData{{Name: "paperLanterns", Weight: 0.8}},
+		Params: []GenerationParam{
+			{Key: "Steps", Value: "20"},
+			{Key: "Model", Value: "dreamshaper_8"},
+			{Key: "Clip skip", Value: "2"},
+			{Key: "Hires upscaler", Value: "4x-UltraSharp"},
+			{Key: "Lora hashes", Value: "paperLanterns: 0123456789ab"},
+		},
+	}
+
+	want := "a lantern festival, night <lora:paperLanterns:0.8>\n" +
+		"Negative prompt: blurry\n" +
+		"Steps: 30, Sampler: DPM++ 2M, Schedule type: Karras, CFG scale: 5.5, Seed: 12345, Size: 832x1216, " +
+		"Model hash: abcdef1234, Model: dreamshaper_8, Clip skip: 2, Hires upscaler: 4x-UltraSharp, " +
+		`Lora hashes: "paperLanterns: 0123456789ab"`
+	if got := formatA1111Parameters(img); got != want {
+		t.Errorf("Unexpected parameters:\n got: %q\nwant: %q", got, want)
+	}
+
+	// The written string must parse back into the same record
+	parsed := &ImageMetadata{}
+	(&App{}).parseGenerationParams(formatA1111Parameters(img), parsed)
+	if parsed.Prompt != img.Prompt || parsed.Steps != 30 || parsed.Seed != 12345 || parsed.LoraHashes != "paperLanterns: 0123456789ab" {
+		t.Errorf("Round trip lost parameters: %+v", parsed)
+	}
+	if len(parsed.LoRAs) != 1 || parsed.LoRAs[0].Name != "paperLanterns" || parsed.LoRAs[0].Weight != 0.8 {
+		t.Errorf("Round trip lost LoRAs: %+v", parsed.LoRAs)
+	}
+}
+
+func TestWriteImageMetadata(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	for _, folder := range []string{"images", "images_nsfw", "thumbnails"} {
+		if err := os.Mkdir(folder, 0755); err != nil {
+			t.Fatalf("create %s: %v", folder, err)
+		}
+	}
+
+	// initDB opens ./images.db in the temporary directory
+	app := &App{}
+	setupTestDB(t, app).Close()
+	t.Cleanup(func() { app.db.Close() })
+
+	if _, err := app.db.Exec(`
+		INSERT INTO images (id, filename, width, height, prompt, neg_prompt, steps, cfg_scale, sampler, scheduler, seed, is_nsfw, rating, favorite) VALUES
+			(1, 'local.png', 1, 1, 'a corrected prompt', 'lowres', 25, 6, 'Euler a', '', 4242, 1, 3, 1),
+			(2, 'photo.jpeg', 8, 8, 'café terrace at night, 油絵', '', 40, 7, 'DPM++ 2M', 'Karras', 99, 0, 0, 0),
+			(3, 'cafe.png', 1, 1, 'café au lait', 'crème', 20, 5, 'Euler', '', 7, 0, 0, 0),
+			(4, 'comfy.png', 1, 1, 'a corrected ComfyUI prompt', '', 40, 3.5, 'dpmpp_2m', '', 1966159266, 0, 0, 0);
+		INSERT INTO loras (image_id, name, weight) VALUES (1, 'detailTweaker', 0.5);
+	`); err != nil {
+		t.Fatalf("insert test images: %v", err)
+	}
+
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("PNG", func(t *testing.T) {
+		path := filepath.Join("images_nsfw", "local.png")
+		writePNGWithTextChunks(t, path, [][2]string{
+			{"parameters", "an old prompt\nSteps: 10, Seed: 1"},
+			{"Software", "ComfyUI"},
+		})
+		if err := os.Chtimes(path, modified, modified); err != nil {
+			t.Fatalf("set modification time: %v", err)
+		}
+
+		if _, err := app.writeImageMetadata(1); err != nil {
+			t.Fatalf("write metadata: %v", err)
+		}
+
+		metadata := &ImageMetadata{}
+		app.extractPNGMetadata(path, metadata)
+		if metadata.Prompt != "a corrected prompt" || metadata.Steps != 25 || metadata.Seed != 4242 {
+			t.Errorf("Unexpected parameters after write: prompt=%q steps=%d seed=%d", metadata.Prompt, metadata.Steps, metadata.Seed)
+		}
+		if len(metadata.LoRAs) != 1 || metadata.LoRAs[0].Name != "detailTweaker" {
+			t.Errorf("Expected the LoRA to be written, got %+v", metadata.LoRAs)
+		}
+		if metadata.XMPLabel != xmpLabelNSFW || metadata.XMPRating != 3 {
+			t.Errorf("Unexpected XMP label/rating: %q/%d", metadata.XMPLabel, metadata.XMPRating)
+		}
+		if metadata.Rating != 3 || !metadata.Favorite {
+			t.Errorf("Expected the rating and favorite to survive a rebuild, got %d/%t", metadata.Rating, metadata.Favorite)
+		}
+
+		keys := make(map[string]int)
+		for _, source := range readPNGTextChunks(path) {
+			keys[source.Key]++
+		}
+		if keys["parameters"] != 1 || keys["Software"] != 1 || keys[xmpPNGKeyword] != 1 {
+			t.Errorf("Unexpected text chunks after write: %v", keys)
+		}
+
+		assertModTime(t, path, modified)
+	})
+
+	t.Run("JPEG", func(t *testing.T) {
+		// Camera EXIF and XMP keywords written by other tools must survive
+		keywords := "<dc:subject>\n    <rdf:Bag>\n     <rdf:li>koi</rdf:li>\n     <rdf:li>autumn</rdf:li>\n    </rdf:Bag>\n   </dc:subject>\n  </rdf:Description>"
+		packet := strings.Replace(xmpTestPacket, "</rdf:Description>", keywords, 1)
+		path := filepath.Join("images", "photo.jpeg")
+		writeJPEGWithSegments(t, path,
+			jpegSegment(0xE1, append([]byte(exifJPEGPrefix), cameraEXIFTestData()...)),
+			jpegSegment(0xE1, append([]byte(xmpJPEGPrefix), packet...)))
+		if err := os.Chtimes(path, modified, modified); err != nil {
+			t.Fatalf("set modification time: %v", err)
+		}
+
+		if _, err := app.writeImageMetadata(2); err != nil {
+			t.Fatalf("write metadata: %v", err)
+		}
+
+		metadata, err := app.extractImageMetadata(path, false, "")
+		if err != nil {
+			t.Fatalf("extract metadata: %v", err)
+		}
+		if metadata.Prompt != "café terrace at night, 油絵" || metadata.Steps != 40 || metadata.Scheduler != "Karras" {
+			t.Errorf("Unexpected parameters after write: prompt=%q steps=%d scheduler=%q", metadata.Prompt, metadata.Steps, metadata.Scheduler)
+		}
+		if metadata.XMPLabel != xmpLabelSFW || metadata.XMPRating != 0 {
+			t.Errorf("Expected the viewer's label and rating to replace the old ones, got %q/%d", metadata.XMPLabel, metadata.XMPRating)
+		}
+
+		xmpData, _, err := readJPEGMetadataSegments(path)
+		if err != nil {
+			t.Fatalf("read JPEG segments: %v", err)
+		}
+		if !bytes.Contains(xmpData, []byte("<rdf:li>koi</rdf:li>")) || !bytes.Contains(xmpData, []byte("a koi pond in autumn")) {
+			t.Errorf("Expected the XMP keywords and description to be kept, got:\n%s", xmpData)
+		}
+		if bytes.Count(xmpData, []byte("Label=")) != 1 || bytes.Contains(xmpData, []byte("Rating=")) {
+			t.Errorf("Expected the old label and rating to be removed, got:\n%s", xmpData)
+		}
+
+		assertCameraEXIF := func() {
+			t.Helper()
+			file, err := os.Open(path)
+			if err != nil {
+				t.Fatalf("open image: %v", err)
+			}
+			defer file.Close()
+			exifData, err := exif.Decode(file)
+			if err != nil {
+				t.Fatalf("decode EXIF: %v", err)
+			}
+			if tag, err := exifData.Get(exif.Make); err != nil || tag.String() != `"Canon"` {
+				t.Errorf("Expected the camera make to be kept, got %v (%v)", tag, err)
+			}
+			if tag, err := exifData.Get(exif.ISOSpeedRatings); err != nil || tag.String() != "200" {
+				t.Errorf("Expected the ISO speed to be kept, got %v (%v)", tag, err)
+			}
+		}
+		assertCameraEXIF()
+
+		// Writing again replaces the comment instead of piling up copies
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("stat image: %v", err)
+		}
+		if _, err := app.writeImageMetadata(2); err != nil {
+			t.Fatalf("write metadata again: %v", err)
+		}
+		if again, err := os.Stat(path); err != nil || again.Size() != info.Size() {
+			t.Errorf("Expected a second write to keep the size of %d bytes, got %v (%v)", info.Size(), again, err)
+		}
+		assertCameraEXIF()
+
+		assertModTime(t, path, modified)
+	})
+
+	t.Run("NonASCIIPNG", func(t *testing.T) {
+		// Latin-1 text must not land in a tEXt chunk, which is read as UTF-8
+		path := filepath.Join("images", "cafe.png")
+		writePNGWithTextChunks(t, path, [][2]string{{"parameters", "an old prompt\nSteps: 10, Seed: 1"}})
+
+		if _, err := app.writeImageMetadata(3); err != nil {
+			t.Fatalf("write metadata: %v", err)
+		}
+
+		metadata := &ImageMetadata{}
+		app.extractPNGMetadata(path, metadata)
+		if metadata.Prompt != "café au lait" || metadata.NegPrompt != "crème" {
+			t.Errorf("Unexpected prompts after write: %q / %q", metadata.Prompt, metadata.NegPrompt)
+		}
+	})
+
+	t.Run("ComfyUIPNG", func(t *testing.T) {
+		path := filepath.Join("images", "comfy.png")
+		writePNGWithTextChunks(t, path, [][2]string{
+			{"prompt", comfyUITestData},
+			{"workflow", `{"nodes": []}`},
+		})
+
+		if _, err := app.writeImageMetadata(4); err != nil {
+			t.Fatalf("write metadata: %v", err)
+		}
+		if _, err := app.fixImageMetadata([]string{"comfy.png"}); err != nil {
+			t.Fatalf("fix metadata: %v", err)
+		}
+
+		// The workflow stays in the file, but the correction wins on rebuild
+		var prompt, parser string
+		if err := app.db.QueryRow("SELECT prompt, metadata_parser FROM images WHERE id = 4").Scan(&prompt, &parser); err != nil {
+			t.Fatalf("read image: %v", err)
+		}
+		if prompt != "a corrected ComfyUI prompt" || parser != "a1111" {
+			t.Errorf("Expected the correction to survive -fix-metadata, got %q (parser %s)", prompt, parser)
+		}
+		keys := make(map[string]int)
+		for _, source := range readPNGTextChunks(path) {
+			keys[source.Key]++
+		}
+		if keys["prompt"] != 1 || keys["workflow"] != 1 {
+			t.Errorf("Expected the ComfyUI chunks to be kept, got %v", keys)
+		}
+	})
+
+	t.Run("Handler", func(t *testing.T) {
+		request := func(id string) *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			req := mux.SetURLVars(httptest.NewRequest(http.MethodPost, "/api/images/"+id+"/write-metadata", nil), map[string]string{"id": id})
+			app.handleWriteImageMetadata(recorder, req)
+			return recorder
+		}
+
+		recorder := request("1")
+		var response WriteMetadataResponse
+		if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+		if recorder.Code != http.StatusOK || !response.Success || response.Filename != "local.png" {
+			t.Errorf("Unexpected response: %d %+v", recorder.Code, response)
+		}
+
+		if recorder := request("9"); recorder.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for a missing image, got %d", recorder.Code)
+		}
+		if recorder := request("abc"); recorder.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for an invalid ID, got %d", recorder.Code)
+		}
+	})
+}
+
+// cameraEXIFTestData returns a little-endian TIFF structure with a camera
+// make in IFD0 and an ISO speed and ASCII comment in the Exif IFD.
+func cameraEXIFTestData() []byte {
+	order := binary.LittleEndian
+	tiff := []byte("II\x2A\x00")
+	tiff = order.AppendUint32(tiff, 8)
+
+	// IFD0 at 8, the make at 38, the Exif IFD at 44 and the comment at 74
+	tiff = order.AppendUint16(tiff, 2)
+	tiff = append(tiff, tiffEntry(order, 0x010F, 2, 6, 38)...)
+	tiff = append(tiff, tiffEntry(order, exifIFDPointerTag, 4, 1, 44)...)
+	tiff = order.AppendUint32(tiff, 0)
+	tiff = append(tiff, "Canon\x00"...)
+
+	comment := "ASCII\x00\x00\x00a snapshot"
+	tiff = order.AppendUint16(tiff, 2)
+	tiff = append(tiff, tiffEntry(order, 0x8827, 3, 1, 200)...)
+	tiff = append(tiff, tiffEntry(order, exifUserCommentTag, 7, uint32(len(comment)), 74)...)
+	tiff = order.AppendUint32(tiff, 0)
+	return append(tiff, comment...)
+}
+
+func TestDecodeEXIFUnicodeComment(t *testing.T) {
+	app := &App{}
+
+	bigEndian := string(exifUserCommentSegment("Steps: 20, Seed: 7", 0))
+	bigEndian = bigEndian[strings.Index(bigEndian, exifUnicodeCharacterCode):]
+	if got := app.cleanUnicodeText(bigEndian); got != "Steps: 20, Seed: 7" {
+		t.Errorf("Unexpected big-endian decode: %q", got)
+	}
+
+	littleEndian := exifUnicodeCharacterCode + "n\x00\xe9\x00e\x00"
+	if got := app.cleanUnicodeText(littleEndian); got != "née" {
+		t.Errorf("Unexpected little-endian decode: %q", got)
+	}
+}
+
+func assertModTime(t *testing.T, path string, want time.Time) {
+	t.Helper()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat %s: %v", path, err)
+	}
+	if !info.ModTime().Equal(want) {
+		t.Errorf("Expected modification time %v to be kept, got %v", want, info.ModTime())
+	}
+}
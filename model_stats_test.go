@@ -22,23 +22,25 @@ func TestGetModelStatsFiltersByImageCategory(t *testing.T) {
 		CREATE TABLE images (
 			id INTEGER PRIMARY KEY,
 			model_id INTEGER,
-			is_nsfw BOOLEAN NOT NULL
+			is_nsfw BOOLEAN NOT NULL,
+			content_level INTEGER,
+			trashed_at DATETIME
 		);
 		INSERT INTO models (id, name, version_name) VALUES
 			(1, 'Mixed', 'v1'),
 			(2, 'SFW only', ''),
 			(3, 'NSFW only', 'v2'),
 			(4, 'Unused', '');
-		INSERT INTO images (id, model_id, is_nsfw) VALUES
-			(1, 1, 0),
-			(2, 1, 0),
-			(3, 1, 0),
-			(4, 1, 1),
-			(5, 2, 0),
-			(6, 2, 0),
-			(7, 3, 1),
-			(8, 3, 1),
-			(9, 3, 1);
+		INSERT INTO images (id, model_id, is_nsfw, content_level) VALUES
+			(1, 1, 0, 0),
+			(2, 1, 0, 1),
+			(3, 1, 0, 2),
+			(4, 1, 1, 3),
+			(5, 2, 0, 0),
+			(6, 2, 0, 0),
+			(7, 3, 1, 3),
+			(8, 3, 1, 3),
+			(9, 3, 1, 3);
 	`); err != nil {
 		t.Fatalf("seed test database: %v", err)
 	}
@@ -93,7 +95,7 @@ func TestGetModelStatsFiltersByImageCategory(t *testing.T) {
 			condition, args := modelFilterCondition("OTHERS", filter)
 			var gotCount int
 			whereConditions := []string{condition}
-			if categoryCondition := nsfwFilterCondition(filter); categoryCondition != "" {
+			if categoryCondition := contentLevelCondition(filter); categoryCondition != "" {
 				whereConditions = append(whereConditions, categoryCondition)
 			}
 			query := "SELECT COUNT(*) FROM images i WHERE " + strings.Join(whereConditions, " AND ")
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"image"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Each image has a small palette, found by k-means clustering of its color
+// sample, with the share of the image each color covers. Palette colors are
+// named after their color family for the color filter, and the brightness and
+// chroma of the whole image back the tone filter.
+
+const (
+	paletteSize       = 5
+	paletteIterations = 12
+
+	// A color family must cover this share of an image to match the filter
+	colorFilterMinWeight = 0.2
+)
+
+type PaletteColor struct {
+	Color  string  `json:"color"`  // #rrggbb
+	Weight float64 `json:"weight"` // Share of the image, 0 to 1
+	Family string  `json:"family"`
+}
+
+type imagePalette struct {
+	Colors     []PaletteColor
+	Brightness float64 // Mean luma, 0 black to 1 white
+	Chroma     float64 // Mean chroma, 0 gray to 1 fully saturated
+}
+
+// colorFamilies are the values of the color filter, in the order they are
+// offered.
+var colorFamilies = []string{"red", "orange", "yellow", "green", "teal", "blue", "purple", "pink", "brown", "black", "gray", "white"}
+
+// imageTones are the values of the tone filter.
+var imageTones = map[string]string{
+	"dark":        "i.brightness < 0.3",
+	"bright":      "i.brightness > 0.65",
+	"desaturated": "i.chroma < 0.12",
+}
+
+// computeImagePalette clusters the pixels of a color sample into at most
+// paletteSize colors, heaviest first. The clusters start from pixels spread
+// across the sample sorted by luma, so the same image always gets the same
+// palette.
+func computeImagePalette(sample *image.RGBA) imagePalette {
+	bounds := sample.Bounds()
+	pixels := make([][3]float64, 0, bounds.Dx()*bounds.Dy())
+	var palette imagePalette
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			offset := sample.PixOffset(x, y)
+			pixel := [3]float64{float64(sample.Pix[offset]), float64(sample.Pix[offset+1]), float64(sample.Pix[offset+2])}
+			pixels = append(pixels, pixel)
+			palette.Brightness += luma(pixel) / 255
+			palette.Chroma += chroma(pixel) / 255
+		}
+	}
+	if len(pixels) == 0 {
+		return palette
+	}
+	palette.Brightness /= float64(len(pixels))
+	palette.Chroma /= float64(len(pixels))
+
+	sorted := append([][3]float64(nil), pixels...)
+	sort.SliceStable(sorted, func(a, b int) bool { return luma(sorted[a]) < luma(sorted[b]) })
+	k := min(paletteSize, len(pixels))
+	centers := make([][3]float64, k)
+	for i := range centers {
+		centers[i] = sorted[(2*i+1)*len(sorted)/(2*k)]
+	}
+
+	assignments := make([]int, len(pixels))
+	counts := make([]int, k)
+	for iteration := 0; iteration < paletteIterations; iteration++ {
+		changed := iteration == 0
+		for i, pixel := range pixels {
+			nearest := 0
+			for c := 1; c < k; c++ {
+				if colorDistance(pixel, centers[c]) < colorDistance(pixel, centers[nearest]) {
+					nearest = c
+				}
+			}
+			if assignments[i] != nearest {
+				assignments[i] = nearest
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+
+		sums := make([][3]float64, k)
+		counts = make([]int, k)
+		for i, pixel := range pixels {
+			c := assignments[i]
+			counts[c]++
+			for channel := range pixel {
+				sums[c][channel] += pixel[channel]
+			}
+		}
+		for c := range centers {
+			// An empty cluster keeps its center
+			if counts[c] == 0 {
+				continue
+			}
+			for channel := range centers[c] {
+				centers[c][channel] = sums[c][channel] / float64(counts[c])
+			}
+		}
+	}
+
+	for c, center := range centers {
+		if counts[c] == 0 {
+			continue
+		}
+		r, g, b := uint8(math.Round(center[0])), uint8(math.Round(center[1])), uint8(math.Round(center[2]))
+		palette.Colors = append(palette.Colors, PaletteColor{
+			Color:  fmt.Sprintf("#%02x%02x%02x", r, g, b),
+			Weight: float64(counts[c]) / float64(len(pixels)),
+			Family: colorFamily(r, g, b),
+		})
+	}
+	sort.SliceStable(palette.Colors, func(a, b int) bool {
+		return palette.Colors[a].Weight > palette.Colors[b].Weight
+	})
+	return palette
+}
+
+func colorDistance(a, b [3]float64) float64 {
+	dr, dg, db := a[0]-b[0], a[1]-b[1], a[2]-b[2]
+	return dr*dr + dg*dg + db*db
+}
+
+func luma(pixel [3]float64) float64 {
+	return 0.2126*pixel[0] + 0.7152*pixel[1] + 0.0722*pixel[2]
+}
+
+func chroma(pixel [3]float64) float64 {
+	return math.Max(pixel[0], math.Max(pixel[1], pixel[2])) - math.Min(pixel[0], math.Min(pixel[1], pixel[2]))
+}
+
+// colorFamily names a color: black, gray or white when it has little color,
+// otherwise after its hue, dark oranges being brown.
+func colorFamily(r, g, b uint8) string {
+	red, green, blue := float64(r)/255, float64(g)/255, float64(b)/255
+	maximum := math.Max(red, math.Max(green, blue))
+	minimum := math.Min(red, math.Min(green, blue))
+	lightness := (maximum + minimum) / 2
+	colorfulness := maximum - minimum
+
+	switch {
+	case lightness < 0.12:
+		return "black"
+	case colorfulness < 0.1 && lightness > 0.85:
+		return "white"
+	case colorfulness < 0.1:
+		return "gray"
+	}
+
+	var hue float64
+	switch maximum {
+	case red:
+		hue = math.Mod((green-blue)/colorfulness, 6) * 60
+	case green:
+		hue = ((blue-red)/colorfulness + 2) * 60
+	default:
+		hue = ((red-green)/colorfulness + 4) * 60
+	}
+	if hue < 0 {
+		hue += 360
+	}
+
+	switch {
+	case hue < 15 || hue >= 345:
+		return "red"
+	case hue < 45:
+		if lightness < 0.4 {
+			return "brown"
+		}
+		return "orange"
+	case hue < 70:
+		return "yellow"
+	case hue < 165:
+		return "green"
+	case hue < 195:
+		return "teal"
+	case hue < 255:
+		return "blue"
+	case hue < 290:
+		return "purple"
+	default:
+		return "pink"
+	}
+}
+
+// cleanColorFilter returns a known color family, or "" for any color.
+func cleanColorFilter(filter string) string {
+	filter = strings.ToLower(strings.TrimSpace(filter))
+	for _, family := range colorFamilies {
+		if family == filter {
+			return family
+		}
+	}
+	return ""
+}
+
+// cleanToneFilter returns a known tone, or "" for any tone.
+func cleanToneFilter(filter string) string {
+	filter = strings.ToLower(strings.TrimSpace(filter))
+	if _, ok := imageTones[filter]; ok {
+		return filter
+	}
+	return ""
+}
+
+// colorFilterCondition matches images where a color family covers at least
+// colorFilterMinWeight of the image.
+func colorFilterCondition(filter string) (string, []any) {
+	family := cleanColorFilter(filter)
+	if family == "" {
+		return "", nil
+	}
+	return `(SELECT COALESCE(SUM(p.weight), 0) FROM image_palette p WHERE p.image_id = i.id AND p.family = ?) >= ?`,
+		[]any{family, colorFilterMinWeight}
+}
+
+func toneFilterCondition(filter string) string {
+	return imageTones[cleanToneFilter(filter)]
+}
+
+// migratePaletteTable adds the palette of images and their overall
+// brightness and chroma.
+func (app *App) migratePaletteTable() error {
+	columns := []struct{ name, definition string }{
+		{"brightness", "REAL"},
+		{"chroma", "REAL"},
+	}
+	for _, column := range columns {
+		if err := app.addColumnIfMissing("images", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+
+	_, err := app.db.Exec(`
+		CREATE TABLE IF NOT EXISTS image_palette (
+			image_id INTEGER NOT NULL,
+			position INTEGER NOT NULL,
+			color TEXT NOT NULL,
+			weight REAL NOT NULL,
+			family TEXT NOT NULL,
+			PRIMARY KEY (image_id, position),
+			FOREIGN KEY (image_id) REFERENCES images(id) ON DELETE CASCADE
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_image_palette_family ON image_palette(family, image_id);
+		CREATE INDEX IF NOT EXISTS idx_images_brightness ON images(brightness);
+		CREATE INDEX IF NOT EXISTS idx_images_chroma ON images(chroma);
+	`)
+	return err
+}
+
+// storeImagePalette replaces the palette of an image.
+func (app *App) storeImagePalette(imageID int, palette imagePalette) error {
+	tx, err := app.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM image_palette WHERE image_id = ?", imageID); err != nil {
+		return err
+	}
+	for i, color := range palette.Colors {
+		if _, err := tx.Exec("INSERT INTO image_palette (image_id, position, color, weight, family) VALUES (?, ?, ?, ?, ?)",
+			imageID, i, color.Color, color.Weight, color.Family); err != nil {
+			return err
+		}
+	}
+
+	// Images that could not be decoded have no palette, and no tone
+	var brightness, chroma sql.NullFloat64
+	if len(palette.Colors) > 0 {
+		brightness = sql.NullFloat64{Float64: palette.Brightness, Valid: true}
+		chroma = sql.NullFloat64{Float64: palette.Chroma, Valid: true}
+	}
+	if _, err := tx.Exec("UPDATE images SET brightness = ?, chroma = ? WHERE id = ?", brightness, chroma, imageID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
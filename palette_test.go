@@ -0,0 +1,147 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestColorFamily(t *testing.T) {
+	tests := []struct {
+		r, g, b uint8
+		want    string
+	}{
+		{0, 0, 0, "black"},
+		{255, 255, 255, "white"},
+		{128, 128, 128, "gray"},
+		{220, 20, 30, "red"},
+		{240, 140, 20, "orange"},
+		{110, 60, 20, "brown"},
+		{240, 220, 30, "yellow"},
+		{40, 180, 60, "green"},
+		{30, 180, 180, "teal"},
+		{30, 60, 220, "blue"},
+		{130, 40, 200, "purple"},
+		{230, 80, 170, "pink"},
+	}
+	for _, test := range tests {
+		if got := colorFamily(test.r, test.g, test.b); got != test.want {
+			t.Errorf("colorFamily(%d, %d, %d) = %q, want %q", test.r, test.g, test.b, got, test.want)
+		}
+	}
+}
+
+func TestComputeImagePalette(t *testing.T) {
+	// Two thirds blue, one third white
+	img := image.NewRGBA(image.Rect(0, 0, 30, 30))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{B: 255, A: 255}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(0, 0, 30, 10), image.NewUniform(color.White), image.Point{}, draw.Src)
+
+	palette := computeImagePalette(img)
+	if len(palette.Colors) != 2 {
+		t.Fatalf("expected 2 palette colors, got %+v", palette.Colors)
+	}
+	want := []PaletteColor{
+		{Color: "#0000ff", Weight: 2.0 / 3, Family: "blue"},
+		{Color: "#ffffff", Weight: 1.0 / 3, Family: "white"},
+	}
+	for i, color := range palette.Colors {
+		if color.Color != want[i].Color || color.Family != want[i].Family || math.Abs(color.Weight-want[i].Weight) > 1e-9 {
+			t.Errorf("palette color %d = %+v, want %+v", i, color, want[i])
+		}
+	}
+	if palette.Chroma < 0.6 || palette.Chroma > 0.7 {
+		t.Errorf("unexpected chroma %f", palette.Chroma)
+	}
+
+	if got := computeImagePalette(image.NewRGBA(image.Rect(0, 0, 0, 0))); len(got.Colors) != 0 {
+		t.Errorf("expected an empty image to have no palette, got %+v", got)
+	}
+}
+
+func TestColorAndToneFilters(t *testing.T) {
+	t.Chdir(t.TempDir())
+	app := &App{}
+	setupTestDB(t, app).Close()
+	t.Cleanup(func() { app.db.Close() })
+
+	if _, err := app.db.Exec(`
+		INSERT INTO images (id, filename, width, height, prompt, neg_prompt, steps, cfg_scale, sampler, scheduler, seed, thumbnail_path, is_nsfw, library_root, relative_path) VALUES
+			(1, 'night.png', 1, 1, '', '', 20, 7, '', '', 1, '', 0, 'images', 'night.png'),
+			(2, 'beach.png', 1, 1, '', '', 20, 7, '', '', 2, '', 0, 'images', 'beach.png'),
+			(3, 'sketch.png', 1, 1, '', '', 20, 7, '', '', 3, '', 0, 'images', 'sketch.png'),
+			(4, 'new.png', 1, 1, '', '', 20, 7, '', '', 4, '', 0, 'images', 'new.png');
+	`); err != nil {
+		t.Fatalf("insert test images: %v", err)
+	}
+	if err := app.gradeContentLevels(); err != nil {
+		t.Fatalf("grade content levels: %v", err)
+	}
+	palettes := map[int]imagePalette{
+		1: {Brightness: 0.1, Chroma: 0.3, Colors: []PaletteColor{
+			{Color: "#050510", Weight: 0.85, Family: "black"},
+			{Color: "#2040c0", Weight: 0.15, Family: "blue"},
+		}},
+		2: {Brightness: 0.7, Chroma: 0.5, Colors: []PaletteColor{
+			{Color: "#3080e0", Weight: 0.5, Family: "blue"},
+			{Color: "#f0e0a0", Weight: 0.5, Family: "yellow"},
+		}},
+		3: {Brightness: 0.8, Chroma: 0.02, Colors: []PaletteColor{
+			{Color: "#f8f8f8", Weight: 0.9, Family: "white"},
+			{Color: "#808080", Weight: 0.1, Family: "gray"},
+		}},
+	}
+	for id, palette := range palettes {
+		if err := app.storeImagePalette(id, palette); err != nil {
+			t.Fatalf("store palette of image %d: %v", id, err)
+		}
+	}
+	// Storing a palette again replaces it
+	if err := app.storeImagePalette(3, palettes[3]); err != nil {
+		t.Fatalf("store palette again: %v", err)
+	}
+
+	ids := func(params ImageSearchParams) []int {
+		t.Helper()
+		params.Page, params.Limit = 1, 10
+		images, _, err := app.queryImages(params)
+		if err != nil {
+			t.Fatalf("query images: %v", err)
+		}
+		var got []int
+		for _, img := range images {
+			got = append(got, img.ID)
+		}
+		sort.Ints(got)
+		return got
+	}
+	tests := []struct {
+		params ImageSearchParams
+		want   []int
+	}{
+		// Image 1 has too little blue to be blue
+		{ImageSearchParams{ColorFilter: "blue"}, []int{2}},
+		{ImageSearchParams{ColorFilter: "white"}, []int{3}},
+		{ImageSearchParams{ColorFilter: "green"}, nil},
+		{ImageSearchParams{ToneFilter: "dark"}, []int{1}},
+		{ImageSearchParams{ToneFilter: "bright"}, []int{2, 3}},
+		{ImageSearchParams{ToneFilter: "desaturated"}, []int{3}},
+		{ImageSearchParams{ColorFilter: "blue", ToneFilter: "bright"}, []int{2}},
+		// Unknown colors and tones are ignored
+		{ImageSearchParams{ColorFilter: "unknown", ToneFilter: "unknown"}, []int{1, 2, 3, 4}},
+	}
+	for _, test := range tests {
+		if got := ids(test.params); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("color %q tone %q = %v, want %v", test.params.ColorFilter, test.params.ToneFilter, got, test.want)
+		}
+	}
+
+	params := imageSearchParamsFromQuery(map[string][]string{"color": {" Blue "}, "tone": {"neon"}})
+	if params.ColorFilter != "blue" || params.ToneFilter != "" {
+		t.Errorf("unexpected filters %q %q", params.ColorFilter, params.ToneFilter)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/nfnt/resize"
+)
+
+// The grid shows a placeholder for each image while its thumbnail loads: a
+// BlurHash (https://blurha.sh) of the image over its dominant color. Both are
+// computed from a small sample of the image when it is indexed, together with
+// its palette.
+
+const (
+	placeholderSampleSize = 32
+	blurHashCharacters    = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+)
+
+type imagePlaceholder struct {
+	BlurHash      string
+	DominantColor string
+}
+
+func analyzeImageColorsFile(imagePath string) (imagePlaceholder, imagePalette, error) {
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return imagePlaceholder{}, imagePalette{}, err
+	}
+	defer file.Close()
+	return analyzeImageColors(file)
+}
+
+// analyzeImageColors decodes an image once for its placeholder and palette.
+// Animations are analyzed by their first frame.
+func analyzeImageColors(source io.Reader) (imagePlaceholder, imagePalette, error) {
+	decoded, err := decodeImage(source)
+	if err != nil {
+		return imagePlaceholder{}, imagePalette{}, fmt.Errorf("decode image: %w", err)
+	}
+	sample := colorSample(decoded)
+	return computeImagePlaceholder(decoded, sample), computeImagePalette(sample), nil
+}
+
+// colorSample shrinks an image to a few pixels, showing it the way its
+// thumbnails do, with transparency on white.
+func colorSample(img image.Image) *image.RGBA {
+	return flattenOnWhite(resize.Resize(placeholderSampleSize, placeholderSampleSize, img, resize.Bilinear))
+}
+
+// computeImagePlaceholder encodes the color sample of an image. The BlurHash
+// has more components along the longer side of the image.
+func computeImagePlaceholder(img image.Image, sample *image.RGBA) imagePlaceholder {
+	componentsX, componentsY := 4, 3
+	if img.Bounds().Dy() > img.Bounds().Dx() {
+		componentsX, componentsY = 3, 4
+	}
+	return imagePlaceholder{
+		BlurHash:      encodeBlurHash(sample, componentsX, componentsY),
+		DominantColor: dominantColor(sample),
+	}
+}
+
+// encodeBlurHash encodes an image as a BlurHash of componentsX by componentsY
+// cosine components (1 to 9 each).
+func encodeBlurHash(img *image.RGBA, componentsX, componentsY int) string {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+
+	// The image in linear RGB
+	linear := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			offset := img.PixOffset(x, y)
+			linear[y*width+x] = [3]float64{
+				sRGBToLinear(img.Pix[offset]),
+				sRGBToLinear(img.Pix[offset+1]),
+				sRGBToLinear(img.Pix[offset+2]),
+			}
+		}
+	}
+
+	factors := make([][3]float64, 0, componentsX*componentsY)
+	for j := 0; j < componentsY; j++ {
+		for i := 0; i < componentsX; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			var factor [3]float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := normalisation *
+						math.Cos(math.Pi*float64(i)*float64(x)/float64(width)) *
+						math.Cos(math.Pi*float64(j)*float64(y)/float64(height))
+					pixel := linear[y*width+x]
+					factor[0] += basis * pixel[0]
+					factor[1] += basis * pixel[1]
+					factor[2] += basis * pixel[2]
+				}
+			}
+			scale := 1 / float64(width*height)
+			factors = append(factors, [3]float64{factor[0] * scale, factor[1] * scale, factor[2] * scale})
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(encodeBase83((componentsX-1)+(componentsY-1)*9, 1))
+
+	dc, ac := factors[0], factors[1:]
+	maximumValue := 1.0
+	if len(ac) > 0 {
+		actualMaximum := 0.0
+		for _, factor := range ac {
+			actualMaximum = math.Max(actualMaximum, math.Max(math.Abs(factor[0]), math.Max(math.Abs(factor[1]), math.Abs(factor[2]))))
+		}
+		quantisedMaximum := int(math.Max(0, math.Min(82, math.Floor(actualMaximum*166-0.5))))
+		maximumValue = float64(quantisedMaximum+1) / 166
+		hash.WriteString(encodeBase83(quantisedMaximum, 1))
+	} else {
+		hash.WriteString(encodeBase83(0, 1))
+	}
+
+	hash.WriteString(encodeBase83(linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4))
+	for _, factor := range ac {
+		quantise := func(value float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(value/maximumValue, 0.5)*9+9.5))))
+		}
+		hash.WriteString(encodeBase83(quantise(factor[0])*19*19+quantise(factor[1])*19+quantise(factor[2]), 2))
+	}
+	return hash.String()
+}
+
+func encodeBase83(value, length int) string {
+	encoded := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		encoded[i] = blurHashCharacters[value%83]
+		value /= 83
+	}
+	return string(encoded)
+}
+
+func sRGBToLinear(value uint8) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value, exponent float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exponent), value)
+}
+
+// dominantColor returns the most common color of an image as "#rrggbb":
+// pixels are grouped by their color with 4 bits per channel, and the average
+// of the largest group is used.
+func dominantColor(img *image.RGBA) string {
+	type bucket struct {
+		count   int
+		r, g, b int
+	}
+	buckets := make(map[int]*bucket)
+	var largest *bucket
+	for y := 0; y < img.Bounds().Dy(); y++ {
+		for x := 0; x < img.Bounds().Dx(); x++ {
+			offset := img.PixOffset(x, y)
+			r, g, b := int(img.Pix[offset]), int(img.Pix[offset+1]), int(img.Pix[offset+2])
+			key := r>>4<<8 | g>>4<<4 | b>>4
+			current := buckets[key]
+			if current == nil {
+				current = &bucket{}
+				buckets[key] = current
+			}
+			current.count++
+			current.r += r
+			current.g += g
+			current.b += b
+			if largest == nil || current.count > largest.count {
+				largest = current
+			}
+		}
+	}
+	if largest == nil {
+		return ""
+	}
+	return fmt.Sprintf("#%02x%02x%02x", largest.r/largest.count, largest.g/largest.count, largest.b/largest.count)
+}
+
+// migratePlaceholderColumns adds the BlurHash and dominant color of images.
+// Images indexed before have them computed by fillMissingImageColors.
+func (app *App) migratePlaceholderColumns() error {
+	columns := []struct{ name, definition string }{
+		{"blurhash", "TEXT"},
+		{"dominant_color", "TEXT"},
+	}
+	for _, column := range columns {
+		if err := app.addColumnIfMissing("images", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fillMissingImageColors computes the placeholders and palettes of images
+// indexed before they existed. An image that cannot be decoded gets an empty
+// placeholder, so that it is not tried again on every start.
+func (app *App) fillMissingImageColors() (int, error) {
+	files, err := app.loadImageFiles("i.blurhash IS NULL OR (i.blurhash != '' AND i.brightness IS NULL)")
+	if err != nil {
+		return 0, err
+	}
+
+	filledCount := 0
+	for _, file := range files {
+		if err := file.Location.check(); err != nil {
+			continue
+		}
+		imagePath := file.Location.path()
+		if file.Trashed {
+			imagePath = file.trashPath()
+		}
+		placeholder, palette, err := analyzeImageColorsFile(app.libraryPath(imagePath))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Error computing colors of %s: %v", file.Filename, err)
+		}
+		if _, err := app.db.Exec("UPDATE images SET blurhash = ?, dominant_color = ? WHERE id = ?",
+			placeholder.BlurHash, placeholder.DominantColor, file.ID); err != nil {
+			return filledCount, err
+		}
+		if placeholder.BlurHash == "" {
+			continue
+		}
+		if err := app.storeImagePalette(file.ID, palette); err != nil {
+			return filledCount, err
+		}
+		filledCount++
+	}
+	return filledCount, nil
+}
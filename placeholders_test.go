@@ -0,0 +1,75 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestComputeImagePlaceholder(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 300, 200))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{R: 255, A: 255}), image.Point{}, draw.Src)
+
+	placeholder := computeImagePlaceholder(img, colorSample(img))
+	// 4x3 components, with the average color red
+	if !strings.HasPrefix(placeholder.BlurHash, "L") || len(placeholder.BlurHash) != 28 ||
+		placeholder.BlurHash[2:6] != encodeBase83(0xff0000, 4) {
+		t.Errorf("unexpected BlurHash %q", placeholder.BlurHash)
+	}
+	if placeholder.DominantColor != "#ff0000" {
+		t.Errorf("dominant color = %q", placeholder.DominantColor)
+	}
+
+	// Portrait images have more vertical components
+	portrait := image.NewRGBA(image.Rect(0, 0, 200, 300))
+	draw.Draw(portrait, portrait.Bounds(), image.NewUniform(color.RGBA{B: 255, A: 255}), image.Point{}, draw.Src)
+	draw.Draw(portrait, image.Rect(0, 0, 200, 100), image.NewUniform(color.RGBA{R: 255, A: 255}), image.Point{}, draw.Src)
+	placeholder = computeImagePlaceholder(portrait, colorSample(portrait))
+	if !strings.HasPrefix(placeholder.BlurHash, "T") || len(placeholder.BlurHash) != 28 {
+		t.Errorf("unexpected portrait BlurHash %q", placeholder.BlurHash)
+	}
+	if !strings.HasPrefix(placeholder.DominantColor, "#0000f") {
+		t.Errorf("expected the larger blue area to dominate, got %q", placeholder.DominantColor)
+	}
+
+	// Transparent areas are white, as in thumbnails
+	transparent := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	if got := computeImagePlaceholder(transparent, colorSample(transparent)).DominantColor; got != "#ffffff" {
+		t.Errorf("expected a transparent image to be white, got %q", got)
+	}
+}
+
+func TestPlaceholdersAreStoredAndShownInGrid(t *testing.T) {
+	t.Chdir(t.TempDir())
+	app := &App{}
+	setupTestDB(t, app).Close()
+	t.Cleanup(func() { app.db.Close() })
+
+	writeTestPNG(t, filepath.Join("images", "new.png"), 4)
+	writeTestPNG(t, filepath.Join("images", "old.png"), 6)
+	if _, err := app.db.Exec(`
+		INSERT INTO images (id, filename, width, height, prompt, neg_prompt, steps, cfg_scale, sampler, scheduler, seed, thumbnail_path, is_nsfw, library_root, relative_path, content_hash) VALUES
+			(1, 'old.png', 6, 1, '', '', 20, 7, '', '', 1, '', 0, 'images', 'old.png', 'old');
+	`); err != nil {
+		t.Fatalf("insert indexed image: %v", err)
+	}
+	if err := app.processImages(); err != nil {
+		t.Fatalf("process images: %v", err)
+	}
+
+	images, _, err := app.queryImages(ImageSearchParams{Page: 1, Limit: 10})
+	if err != nil {
+		t.Fatalf("query images: %v", err)
+	}
+	if len(images) != 2 {
+		t.Fatalf("expected 2 images, got %d", len(images))
+	}
+	for _, img := range images {
+		if len(img.BlurHash) != 28 || img.DominantColor != "#000000" {
+			t.Errorf("unexpected placeholder for %s: %q %q", img.Filename, img.BlurHash, img.DominantColor)
+		}
+	}
+}
@@ -435,9 +435,9 @@ func (app *App) handleGeneratePrompt(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var sourcePrompt, filename string
-	var isNSFW bool
-	if err := app.db.QueryRowContext(r.Context(), "SELECT prompt, filename, is_nsfw FROM images WHERE id = ?", request.ImageID).Scan(&sourcePrompt, &filename, &isNSFW); err != nil {
+	var sourcePrompt string
+	file, err := scanImageFile(app.db.QueryRowContext(r.Context(), "SELECT "+imageFileColumns+", "+effectivePromptColumn+" FROM images i WHERE i.id = ?", request.ImageID), &sourcePrompt)
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			writeGeneratePromptJSON(w, http.StatusNotFound, generatePromptResponse{Error: "Image not found"})
 			return
@@ -450,7 +450,7 @@ func (app *App) handleGeneratePrompt(w http.ResponseWriter, r *http.Request) {
 		writeGeneratePromptJSON(w, http.StatusUnprocessableEntity, generatePromptResponse{Error: "This image has no prompt to remix"})
 		return
 	}
-	imagePath, err := app.promptImagePath(filename, isNSFW)
+	imagePath, err := app.imageFilePath(file.Location)
 	if err != nil {
 		log.Printf("Failed to resolve image %d for prompt generation: %v", request.ImageID, err)
 		writeGeneratePromptJSON(w, http.StatusInternalServerError, generatePromptResponse{Error: "The source image could not be loaded"})
@@ -255,7 +255,7 @@ func TestHandleGeneratePrompt(t *testing.T) {
 	writePromptTestImage(t, imagePath, 2048, 1024)
 
 	generator := &recordingPromptGenerator{}
-	app := &App{db: db, promptGenerator: generator, promptImageBaseDir: imageBaseDir}
+	app := &App{db: db, promptGenerator: generator, libraryBaseDir: imageBaseDir}
 	req := httptest.NewRequest(http.MethodPost, "/api/generate-prompt", strings.NewReader(
 		`{"image_id":42,"target_model":"anima","concept":"next","steering":"Exactly two seconds later"}`,
 	))
@@ -325,7 +325,7 @@ func TestHandleGeneratePromptReturnsErrorWhenSourceImageIsMissing(t *testing.T)
 		t.Fatalf("insert image: %v", err)
 	}
 	generator := &recordingPromptGenerator{}
-	app := &App{db: db, promptGenerator: generator, promptImageBaseDir: t.TempDir()}
+	app := &App{db: db, promptGenerator: generator, libraryBaseDir: t.TempDir()}
 	req := httptest.NewRequest(http.MethodPost, "/api/generate-prompt", strings.NewReader(`{"image_id":42,"target_model":"anima"}`))
 	recorder := httptest.NewRecorder()
 
@@ -339,10 +339,10 @@ func TestHandleGeneratePromptReturnsErrorWhenSourceImageIsMissing(t *testing.T)
 	}
 }
 
-func TestPromptImagePathRejectsNestedFilename(t *testing.T) {
-	app := &App{promptImageBaseDir: t.TempDir()}
-	if _, err := app.promptImagePath("../source.png", false); err == nil {
-		t.Fatal("expected nested filename to be rejected")
+func TestImageFilePathRejectsPathOutsideRoot(t *testing.T) {
+	app := &App{libraryBaseDir: t.TempDir()}
+	if _, err := app.imageFilePath(imageLocation{Root: "images", RelativePath: "../source.png"}); err == nil {
+		t.Fatal("expected a path outside the library root to be rejected")
 	}
 }
 
@@ -404,7 +404,16 @@ func openPromptTestDB(t *testing.T) *sql.DB {
 		id INTEGER PRIMARY KEY,
 		prompt TEXT NOT NULL,
 		filename TEXT NOT NULL,
-		is_nsfw BOOLEAN NOT NULL DEFAULT FALSE
+		is_nsfw BOOLEAN NOT NULL DEFAULT FALSE,
+		library_root TEXT,
+		relative_path TEXT,
+		thumbnail_path TEXT
+	);
+	CREATE TABLE image_edits (
+		library_root TEXT NOT NULL,
+		relative_path TEXT NOT NULL,
+		prompt TEXT,
+		PRIMARY KEY (library_root, relative_path)
 	)`); err != nil {
 		t.Fatalf("create images table: %v", err)
 	}
@@ -2,15 +2,9 @@ package main
 
 import (
 	"bytes"
-	"errors"
 	"fmt"
-	"image"
-	"image/jpeg"
 	"io"
 	"os"
-	"path/filepath"
-
-	"github.com/nfnt/resize"
 )
 
 const (
@@ -40,15 +34,9 @@ func preparePromptImageFromBytes(data []byte) (*PromptImage, error) {
 }
 
 func preparePromptImageFromReader(source io.Reader) (*PromptImage, error) {
-	decoded, _, err := image.Decode(source)
-	if err != nil {
-		return nil, fmt.Errorf("decode prompt image: %w", err)
-	}
-	resized := resize.Thumbnail(promptImageMaxDimension, promptImageMaxDimension, decoded, resize.Lanczos3)
-
 	var encoded bytes.Buffer
-	if err := jpeg.Encode(&encoded, resized, &jpeg.Options{Quality: promptImageJPEGQuality}); err != nil {
-		return nil, fmt.Errorf("encode prompt image: %w", err)
+	if err := encodeResizedJPEG(&encoded, source, promptImageMaxDimension, promptImageMaxDimension, promptImageJPEGQuality); err != nil {
+		return nil, fmt.Errorf("prepare prompt image: %w", err)
 	}
 
 	return &PromptImage{
@@ -57,14 +45,3 @@ func preparePromptImageFromReader(source io.Reader) (*PromptImage, error) {
 		Detail:    promptImageDetail,
 	}, nil
 }
-
-func (app *App) promptImagePath(filename string, isNSFW bool) (string, error) {
-	if filename == "" || filepath.Base(filename) != filename {
-		return "", errors.New("invalid image filename")
-	}
-	directory := "images"
-	if isNSFW {
-		directory = "images_nsfw"
-	}
-	return filepath.Join(app.promptImageBaseDir, directory, filename), nil
-}
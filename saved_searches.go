@@ -0,0 +1,319 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxSavedSearchNameLength  = 100
+	maxSavedSearchQueryLength = 4096
+)
+
+var (
+	errSavedSearchNotFound = errors.New("saved search not found")
+	errInvalidSavedSearch  = errors.New("invalid saved search")
+)
+
+// SavedSearch is a named set of grid filters. The filters are kept as the
+// URL query of the grid, so filters added to ImageSearchParams later are
+// saved and restored without a schema change.
+type SavedSearch struct {
+	ID         int    `json:"id"`
+	Name       string `json:"name"`
+	Query      string `json:"query"`
+	ImageCount int    `json:"image_count"`
+	URL        string `json:"url"`
+}
+
+type SavedSearchesResponse struct {
+	SavedSearches []SavedSearch `json:"saved_searches"`
+	Error         string        `json:"error,omitempty"`
+}
+
+// SavedSearchRequest creates a saved search, or renames it and replaces its
+// filters; empty fields are left unchanged on update.
+type SavedSearchRequest struct {
+	Name  string `json:"name"`
+	Query string `json:"query"`
+}
+
+type SavedSearchResponse struct {
+	Success     bool         `json:"success"`
+	SavedSearch *SavedSearch `json:"saved_search,omitempty"`
+	Error       string       `json:"error,omitempty"`
+}
+
+func savedSearchURL(id int) string {
+	return "/saved/" + strconv.Itoa(id)
+}
+
+// normalizeSavedSearchQuery drops the page and empty values from a grid
+// query and sorts the rest, so the same filters always store the same text.
+func normalizeSavedSearchQuery(query string) (string, error) {
+	values, err := url.ParseQuery(strings.TrimPrefix(query, "?"))
+	if err != nil || len(query) > maxSavedSearchQueryLength {
+		return "", fmt.Errorf("%w: query is not a valid filter list", errInvalidSavedSearch)
+	}
+
+	values.Del("page")
+	values.Del("saved")
+	for key, list := range values {
+		if len(list) == 0 || list[0] == "" {
+			values.Del(key)
+		}
+	}
+	return values.Encode(), nil
+}
+
+func normalizeSavedSearchName(name string) (string, error) {
+	name = strings.Join(strings.Fields(name), " ")
+	if name == "" || utf8.RuneCountInString(name) > maxSavedSearchNameLength {
+		return "", fmt.Errorf("%w: name must be 1 to %d characters", errInvalidSavedSearch, maxSavedSearchNameLength)
+	}
+	return name, nil
+}
+
+// savedSearchImageCount counts the current matches of a saved query.
+func (app *App) savedSearchImageCount(query string) (int, error) {
+	params, err := imageSearchParamsFromSnapshot(query)
+	if err != nil {
+		return 0, err
+	}
+	return app.countImages(params)
+}
+
+// listSavedSearches returns every saved search by name, with live counts.
+func (app *App) listSavedSearches() ([]SavedSearch, error) {
+	rows, err := app.db.Query("SELECT id, name, query FROM saved_searches ORDER BY name COLLATE NOCASE ASC, id ASC")
+	if err != nil {
+		return nil, err
+	}
+
+	searches := make([]SavedSearch, 0)
+	for rows.Next() {
+		var search SavedSearch
+		if err := rows.Scan(&search.ID, &search.Name, &search.Query); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		search.URL = savedSearchURL(search.ID)
+		searches = append(searches, search)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+
+	// Counted after the rows are closed, so a single connection is enough
+	for i := range searches {
+		count, err := app.savedSearchImageCount(searches[i].Query)
+		if err != nil {
+			return nil, fmt.Errorf("count saved search %d: %w", searches[i].ID, err)
+		}
+		searches[i].ImageCount = count
+	}
+	return searches, nil
+}
+
+func (app *App) getSavedSearch(id int) (*SavedSearch, error) {
+	search := SavedSearch{ID: id, URL: savedSearchURL(id)}
+	err := app.db.QueryRow("SELECT name, query FROM saved_searches WHERE id = ?", id).Scan(&search.Name, &search.Query)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errSavedSearchNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("find saved search: %w", err)
+	}
+
+	search.ImageCount, err = app.savedSearchImageCount(search.Query)
+	if err != nil {
+		return nil, fmt.Errorf("count saved search: %w", err)
+	}
+	return &search, nil
+}
+
+func (app *App) createSavedSearch(req SavedSearchRequest) (*SavedSearch, error) {
+	name, err := normalizeSavedSearchName(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	query, err := normalizeSavedSearchQuery(req.Query)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := app.db.Exec("INSERT INTO saved_searches (name, query) VALUES (?, ?)", name, query)
+	if err != nil {
+		return nil, fmt.Errorf("create saved search: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("create saved search: %w", err)
+	}
+	return app.getSavedSearch(int(id))
+}
+
+func (app *App) updateSavedSearch(id int, req SavedSearchRequest) (*SavedSearch, error) {
+	search, err := app.getSavedSearch(id)
+	if err != nil {
+		return nil, err
+	}
+
+	name, query := search.Name, search.Query
+	if req.Name != "" {
+		if name, err = normalizeSavedSearchName(req.Name); err != nil {
+			return nil, err
+		}
+	}
+	if req.Query != "" {
+		if query, err = normalizeSavedSearchQuery(req.Query); err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = app.db.Exec("UPDATE saved_searches SET name = ?, query = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", name, query, id)
+	if err != nil {
+		return nil, fmt.Errorf("update saved search: %w", err)
+	}
+	return app.getSavedSearch(id)
+}
+
+func (app *App) deleteSavedSearch(id int) error {
+	result, err := app.db.Exec("DELETE FROM saved_searches WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("delete saved search: %w", err)
+	}
+	if deleted, err := result.RowsAffected(); err == nil && deleted == 0 {
+		return errSavedSearchNotFound
+	}
+	return nil
+}
+
+func (app *App) handleListSavedSearches(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	searches, err := app.listSavedSearches()
+	if err != nil {
+		log.Printf("Error listing saved searches: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(SavedSearchesResponse{SavedSearches: []SavedSearch{}, Error: "Failed to load saved searches"})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(SavedSearchesResponse{SavedSearches: searches})
+}
+
+func (app *App) handleCreateSavedSearch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req SavedSearchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeSavedSearchError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	search, err := app.createSavedSearch(req)
+	if err != nil {
+		writeSavedSearchResult(w, "save search", err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(SavedSearchResponse{Success: true, SavedSearch: search})
+}
+
+func (app *App) handleUpdateSavedSearch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || id <= 0 {
+		writeSavedSearchError(w, http.StatusBadRequest, "Invalid saved search ID")
+		return
+	}
+
+	var req SavedSearchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Name == "" && req.Query == "") {
+		writeSavedSearchError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+
+	search, err := app.updateSavedSearch(id, req)
+	if err != nil {
+		writeSavedSearchResult(w, "update saved search", err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(SavedSearchResponse{Success: true, SavedSearch: search})
+}
+
+func (app *App) handleDeleteSavedSearch(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || id <= 0 {
+		writeSavedSearchError(w, http.StatusBadRequest, "Invalid saved search ID")
+		return
+	}
+
+	if err := app.deleteSavedSearch(id); err != nil {
+		writeSavedSearchResult(w, "delete saved search", err)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(SavedSearchResponse{Success: true})
+}
+
+// handleSavedSearchPage restores the filters of a saved search on the index
+// page, so /saved/{id} stays valid when the filters are edited later.
+func (app *App) handleSavedSearchPage(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || id <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	var query string
+	err = app.db.QueryRow("SELECT query FROM saved_searches WHERE id = ?", id).Scan(&query)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		http.Error(w, "stored filters are invalid", http.StatusInternalServerError)
+		return
+	}
+	values.Set("saved", strconv.Itoa(id))
+	r.URL.RawQuery = values.Encode()
+	app.handleIndex(w, r)
+}
+
+func writeSavedSearchResult(w http.ResponseWriter, action string, err error) {
+	switch {
+	case errors.Is(err, errInvalidSavedSearch):
+		writeSavedSearchError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, errSavedSearchNotFound):
+		writeSavedSearchError(w, http.StatusNotFound, "Saved search not found")
+	default:
+		log.Printf("Failed to %s: %v", action, err)
+		writeSavedSearchError(w, http.StatusInternalServerError, "Failed to "+action)
+	}
+}
+
+func writeSavedSearchError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(SavedSearchResponse{
+		Success: false,
+		Error:   message,
+	})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestNormalizeSavedSearchQuery(t *testing.T) {
+	got, err := normalizeSavedSearchQuery("?q=red+fox&page=4&nsfw=all&model=&saved=2&tags=forest,night")
+	if err != nil {
+		t.Fatalf("normalize: %v", err)
+	}
+	if want := "nsfw=all&q=red+fox&tags=forest%2Cnight"; got != want {
+		t.Errorf("normalizeSavedSearchQuery = %q, want %q", got, want)
+	}
+
+	if _, err := normalizeSavedSearchQuery("q=%zz"); !errors.Is(err, errInvalidSavedSearch) {
+		t.Errorf("Expected an invalid query to be rejected, got %v", err)
+	}
+}
+
+func TestSavedSearches(t *testing.T) {
+	t.Chdir(t.TempDir())
+	app := &App{}
+	setupTestDB(t, app).Close()
+	t.Cleanup(func() { app.db.Close() })
+
+	if _, err := app.db.Exec(`
+		INSERT INTO images (id, filename, width, height, prompt, neg_prompt, steps, cfg_scale, sampler, scheduler, seed, thumbnail_path, is_nsfw, rating) VALUES
+			(1, '1.png', 1, 1, 'red fox in snow', '', 20, 7, '', '', 1, '', 0, 4),
+			(2, '2.png', 1, 1, 'red fox at night', '', 20, 7, '', '', 2, '', 1, 5),
+			(3, '3.png', 1, 1, 'grey wolf', '', 20, 7, '', '', 3, '', 0, 5);
+	`); err != nil {
+		t.Fatalf("insert test images: %v", err)
+	}
+	if err := app.gradeContentLevels(); err != nil {
+		t.Fatalf("grade test images: %v", err)
+	}
+
+	search, err := app.createSavedSearch(SavedSearchRequest{Name: "Foxes", Query: "q=fox&nsfw=all"})
+	if err != nil {
+		t.Fatalf("create saved search: %v", err)
+	}
+	if search.ImageCount != 2 || search.URL != "/saved/1" {
+		t.Errorf("Unexpected saved search: %+v", search)
+	}
+
+	// Without an NSFW filter the index page shows SFW images, and so do counts
+	if _, err := app.createSavedSearch(SavedSearchRequest{Name: "Best", Query: "rating=5"}); err != nil {
+		t.Fatalf("create saved search: %v", err)
+	}
+
+	searches, err := app.listSavedSearches()
+	if err != nil {
+		t.Fatalf("list saved searches: %v", err)
+	}
+	if len(searches) != 2 || searches[0].Name != "Best" || searches[0].ImageCount != 1 || searches[1].ImageCount != 2 {
+		t.Errorf("Unexpected saved searches: %+v", searches)
+	}
+
+	// Replacing the filters keeps the name and URL
+	search, err = app.updateSavedSearch(1, SavedSearchRequest{Query: "q=fox&nsfw=sfw"})
+	if err != nil {
+		t.Fatalf("update saved search: %v", err)
+	}
+	if search.Name != "Foxes" || search.ImageCount != 1 || search.URL != "/saved/1" {
+		t.Errorf("Unexpected updated search: %+v", search)
+	}
+
+	t.Run("Handlers", func(t *testing.T) {
+		request := func(handler http.HandlerFunc, method, id, body string) *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			req := mux.SetURLVars(httptest.NewRequest(method, "/api/saved-searches/"+id, strings.NewReader(body)), map[string]string{"id": id})
+			handler(recorder, req)
+			return recorder
+		}
+
+		recorder := request(app.handleCreateSavedSearch, http.MethodPost, "", `{"name": "Wolves", "query": "q=wolf"}`)
+		var response SavedSearchResponse
+		if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+			t.Fatalf("decode response: %v", err)
+		}
+		if recorder.Code != http.StatusOK || !response.Success || response.SavedSearch.ImageCount != 1 {
+			t.Errorf("Unexpected create response: %d %+v", recorder.Code, response)
+		}
+
+		for _, tc := range []struct {
+			handler http.HandlerFunc
+			id      string
+			body    string
+			code    int
+		}{
+			{app.handleCreateSavedSearch, "", `{"name": "", "query": "q=x"}`, http.StatusBadRequest},
+			{app.handleUpdateSavedSearch, "1", `{}`, http.StatusBadRequest},
+			{app.handleUpdateSavedSearch, "9", `{"name": "x"}`, http.StatusNotFound},
+			{app.handleDeleteSavedSearch, "2", ``, http.StatusOK},
+			{app.handleDeleteSavedSearch, "2", ``, http.StatusNotFound},
+		} {
+			if recorder := request(tc.handler, http.MethodPost, tc.id, tc.body); recorder.Code != tc.code {
+				t.Errorf("Saved search %s %s: expected %d, got %d", tc.id, tc.body, tc.code, recorder.Code)
+			}
+		}
+
+		if recorder := request(app.handleSavedSearchPage, http.MethodGet, "2", ""); recorder.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for a deleted saved search page, got %d", recorder.Code)
+		}
+	})
+}
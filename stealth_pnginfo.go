@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"os"
+	"sort"
+)
+
+// Stealth pnginfo hides the parameters in the least significant bits of the
+// pixels, read column by column: one bit per pixel from the alpha channel, or
+// three from RGB. A signature names the mode, followed by the payload length
+// in bits as a big-endian uint32.
+const (
+	stealthAlphaSignature           = "stealth_pnginfo"
+	stealthAlphaCompressedSignature = "stealth_pngcomp"
+	stealthRGBSignature             = "stealth_rgbinfo"
+	stealthRGBCompressedSignature   = "stealth_rgbcomp"
+
+	// Payloads are a parameters string; anything larger is noise
+	maxStealthPayloadBytes = 16 << 20
+)
+
+var errNoStealthMetadata = errors.New("no stealth metadata")
+
+// novelAIStealthKeys is the order NovelAI writes its text chunks in, which
+// the parsers rely on (description before comment).
+var novelAIStealthKeys = []string{"Title", "Description", "Software", "Source", "Generation time", "Comment"}
+
+type stealthBitReader struct {
+	img     image.Image
+	bounds  image.Rectangle
+	rgb     bool
+	x, y    int
+	channel int
+	pixel   [3]uint8
+}
+
+func newStealthBitReader(img image.Image, rgb bool) *stealthBitReader {
+	bounds := img.Bounds()
+	return &stealthBitReader{img: img, bounds: bounds, rgb: rgb, x: bounds.Min.X, y: bounds.Min.Y}
+}
+
+// remainingBits is how many bits the image can still hold from the current position.
+func (reader *stealthBitReader) remainingBits() int {
+	height := reader.bounds.Dy()
+	pixels := (reader.bounds.Max.X-reader.x)*height - (reader.y - reader.bounds.Min.Y)
+	if !reader.rgb {
+		return pixels
+	}
+	return pixels*3 - reader.channel
+}
+
+func (reader *stealthBitReader) nextBit() (byte, bool) {
+	if reader.x >= reader.bounds.Max.X {
+		return 0, false
+	}
+
+	if reader.channel == 0 {
+		pixel := color.NRGBAModel.Convert(reader.img.At(reader.x, reader.y)).(color.NRGBA)
+		if !reader.rgb {
+			reader.advancePixel()
+			return pixel.A & 1, true
+		}
+		reader.pixel = [3]uint8{pixel.R, pixel.G, pixel.B}
+	}
+
+	bit := reader.pixel[reader.channel] & 1
+	reader.channel++
+	if reader.channel == 3 {
+		reader.channel = 0
+		reader.advancePixel()
+	}
+	return bit, true
+}
+
+func (reader *stealthBitReader) advancePixel() {
+	reader.y++
+	if reader.y >= reader.bounds.Max.Y {
+		reader.y = reader.bounds.Min.Y
+		reader.x++
+	}
+}
+
+func (reader *stealthBitReader) readBytes(count int) ([]byte, bool) {
+	data := make([]byte, count)
+	for i := range data {
+		for bit := 0; bit < 8; bit++ {
+			value, ok := reader.nextBit()
+			if !ok {
+				return nil, false
+			}
+			data[i] = data[i]<<1 | value
+		}
+	}
+	return data, true
+}
+
+// decodeStealthPNGInfo returns the text hidden in an image's pixels, trying
+// the alpha channel first as the extensions and NovelAI do.
+func decodeStealthPNGInfo(img image.Image) (string, error) {
+	for _, rgb := range []bool{false, true} {
+		reader := newStealthBitReader(img, rgb)
+		signature, ok := reader.readBytes(len(stealthAlphaSignature))
+		if !ok {
+			return "", errNoStealthMetadata
+		}
+
+		var compressed bool
+		switch string(signature) {
+		case stealthAlphaSignature, stealthRGBSignature:
+		case stealthAlphaCompressedSignature, stealthRGBCompressedSignature:
+			compressed = true
+		default:
+			continue
+		}
+		if rgb != (string(signature[8:11]) == "rgb") {
+			continue
+		}
+
+		lengthBytes, ok := reader.readBytes(4)
+		if !ok {
+			return "", fmt.Errorf("truncated stealth metadata length")
+		}
+		bitLength := int(binary.BigEndian.Uint32(lengthBytes))
+		if bitLength <= 0 || bitLength/8 > maxStealthPayloadBytes || bitLength > reader.remainingBits() {
+			return "", fmt.Errorf("invalid stealth metadata length %d", bitLength)
+		}
+
+		payload, ok := reader.readBytes(bitLength / 8)
+		if !ok {
+			return "", fmt.Errorf("truncated stealth metadata")
+		}
+		if compressed {
+			gzipReader, err := gzip.NewReader(bytes.NewReader(payload))
+			if err != nil {
+				return "", fmt.Errorf("open compressed stealth metadata: %w", err)
+			}
+			defer gzipReader.Close()
+
+			payload, err = io.ReadAll(io.LimitReader(gzipReader, maxStealthPayloadBytes))
+			if err != nil {
+				return "", fmt.Errorf("read compressed stealth metadata: %w", err)
+			}
+		}
+		return sanitizeUTF8(string(payload)), nil
+	}
+	return "", errNoStealthMetadata
+}
+
+// stealthMetadataSources turns a stealth payload into parser sources. NovelAI
+// embeds all of its text chunks as one JSON object; everything else is an
+// A1111 parameters string.
+func stealthMetadataSources(text string) []MetadataSource {
+	var chunks map[string]interface{}
+	if err := json.Unmarshal([]byte(text), &chunks); err != nil || chunks["Comment"] == nil {
+		return []MetadataSource{{Container: "stealth", Key: "parameters", Text: text}}
+	}
+
+	known := make(map[string]bool)
+	for _, key := range novelAIStealthKeys {
+		known[key] = true
+	}
+	var others []string
+	for key := range chunks {
+		if !known[key] {
+			others = append(others, key)
+		}
+	}
+	sort.Strings(others)
+	keys := append(append([]string{}, novelAIStealthKeys...), others...)
+
+	var sources []MetadataSource
+	for _, key := range keys {
+		var value string
+		switch typed := chunks[key].(type) {
+		case nil:
+			continue
+		case string:
+			value = typed
+		default:
+			encoded, err := json.Marshal(typed)
+			if err != nil {
+				continue
+			}
+			value = string(encoded)
+		}
+		sources = append(sources, MetadataSource{Container: "stealth", Key: key, Text: value})
+	}
+	return sources
+}
+
+// extractStealthPNGInfo decodes the pixels of a PNG whose text chunks gave no
+// prompt, and parses any stealth metadata found in them.
+func (app *App) extractStealthPNGInfo(imagePath string, metadata *ImageMetadata) {
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		log.Printf("Unable to decode %s for stealth metadata: %v", metadata.Filename, err)
+		return
+	}
+
+	text, err := decodeStealthPNGInfo(img)
+	if err != nil {
+		if !errors.Is(err, errNoStealthMetadata) {
+			log.Printf("Unable to read stealth metadata of %s: %v", metadata.Filename, err)
+		}
+		return
+	}
+
+	log.Printf("Found stealth metadata in %s", metadata.Filename)
+	app.parseMetadataSources(stealthMetadataSources(text), metadata)
+}
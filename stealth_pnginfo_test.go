@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const stealthTestParameters = "a paper boat on a puddle, macro\nNegative prompt: lowres\nSteps: 18, Sampler: DPM++ SDE, CFG scale: 4.5, Seed: 8080, Model hash: 1a2b3c4d5e"
+
+func TestDecodeStealthPNGInfo(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		signature string
+	}{
+		{"AlphaCompressed", stealthAlphaCompressedSignature},
+		{"Alpha", stealthAlphaSignature},
+		{"RGB", stealthRGBSignature},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			img := stealthTestImage(t, 64, 48, tc.signature, stealthTestParameters)
+
+			text, err := decodeStealthPNGInfo(img)
+			if err != nil {
+				t.Fatalf("decode stealth metadata: %v", err)
+			}
+			if text != stealthTestParameters {
+				t.Errorf("Unexpected payload: %q", text)
+			}
+		})
+	}
+
+	t.Run("None", func(t *testing.T) {
+		img := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+		for i := range img.Pix {
+			img.Pix[i] = 0xFF
+		}
+		if _, err := decodeStealthPNGInfo(img); err != errNoStealthMetadata {
+			t.Errorf("Expected errNoStealthMetadata, got %v", err)
+		}
+	})
+}
+
+func TestExtractStealthPNGInfo(t *testing.T) {
+	app := &App{}
+
+	t.Run("A1111", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "stealth.png")
+		writeStealthTestPNG(t, path, stealthTestImage(t, 80, 60, stealthAlphaCompressedSignature, stealthTestParameters))
+
+		metadata := &ImageMetadata{Filename: "stealth.png"}
+		app.extractStealthPNGInfo(path, metadata)
+
+		if metadata.Prompt != "a paper boat on a puddle, macro" || metadata.Steps != 18 || metadata.ModelHash != "1a2b3c4d5e" {
+			t.Errorf("Unexpected parameters: prompt=%q steps=%d hash=%q", metadata.Prompt, metadata.Steps, metadata.ModelHash)
+		}
+		if len(metadata.MetadataSources) != 1 || metadata.MetadataSources[0].Container != "stealth" {
+			t.Errorf("Unexpected sources: %+v", metadata.MetadataSources)
+		}
+	})
+
+	t.Run("NovelAI", func(t *testing.T) {
+		encoded, err := json.Marshal(map[string]string{
+			"Title":       "NovelAI generated image",
+			"Description": novelAIDescriptionFixture,
+			"Software":    "NovelAI",
+			"Comment":     novelAICommentFixture,
+		})
+		if err != nil {
+			t.Fatalf("encode payload: %v", err)
+		}
+		payload := string(encoded)
+		path := filepath.Join(t.TempDir(), "novelai.png")
+		writeStealthTestPNG(t, path, stealthTestImage(t, 200, 120, stealthAlphaCompressedSignature, payload))
+
+		metadata := &ImageMetadata{Filename: "novelai.png"}
+		app.extractStealthPNGInfo(path, metadata)
+
+		if metadata.MetadataParser != "novelai" {
+			t.Errorf("Expected the NovelAI comment to be parsed, got parser %q", metadata.MetadataParser)
+		}
+		if metadata.NegPrompt != "lowres, bad anatomy, bad hands, text, error" || metadata.Steps != 28 {
+			t.Errorf("Unexpected parameters: neg=%q steps=%d", metadata.NegPrompt, metadata.Steps)
+		}
+	})
+}
+
+// stealthTestImage hides text in an image the way the stealth pnginfo
+// extension writes it.
+func stealthTestImage(t *testing.T, width, height int, signature, text string) *image.NRGBA {
+	t.Helper()
+
+	payload := []byte(text)
+	if signature == stealthAlphaCompressedSignature || signature == stealthRGBCompressedSignature {
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		if _, err := writer.Write(payload); err != nil {
+			t.Fatalf("compress payload: %v", err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("finish compression: %v", err)
+		}
+		payload = compressed.Bytes()
+	}
+
+	data := []byte(signature)
+	data = binary.BigEndian.AppendUint32(data, uint32(len(payload)*8))
+	data = append(data, payload...)
+
+	var bits []uint8
+	for _, value := range data {
+		for shift := 7; shift >= 0; shift-- {
+			bits = append(bits, (value>>shift)&1)
+		}
+	}
+
+	rgb := signature == stealthRGBSignature || signature == stealthRGBCompressedSignature
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	index := 0
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			pixel := color.NRGBA{R: 0x80, G: 0x80, B: 0x80, A: 0xFE}
+			channels := []*uint8{&pixel.A}
+			if rgb {
+				pixel.A = 0xFF
+				channels = []*uint8{&pixel.R, &pixel.G, &pixel.B}
+			}
+			for _, channel := range channels {
+				if index < len(bits) {
+					*channel = *channel&^1 | bits[index]
+					index++
+				}
+			}
+			img.SetNRGBA(x, y, pixel)
+		}
+	}
+	if index < len(bits) {
+		t.Fatalf("image too small for %d bits", len(bits))
+	}
+	return img
+}
+
+func writeStealthTestPNG(t *testing.T, path string, img image.Image) {
+	t.Helper()
+
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("create PNG: %v", err)
+	}
+	defer file.Close()
+	if err := png.Encode(file, img); err != nil {
+		t.Fatalf("encode PNG: %v", err)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/nfnt/resize"
+)
+
+// Thumbnails and lightbox previews are cached as JPEG under
+// thumbnailDir/<size>/<image ID>.jpg. They are created on first request and
+// again whenever the image file is newer, so rewritten or replaced files are
+// picked up. Animations are shown by their first frame. Only JPEG is
+// produced: Go has no WebP encoder, and none is vendored.
+
+const (
+	thumbnailJPEGQuality = 80
+	previewJPEGQuality   = 85
+	defaultPreviewWidth  = 1920
+)
+
+type thumbnailSize struct {
+	Name          string
+	Width, Height uint
+	Quality       int
+}
+
+// thumbnailSizes are the renditions served by /media/{id}/thumbnail?size=,
+// the first one being the default.
+var thumbnailSizes = []thumbnailSize{
+	{Name: "grid", Width: 400, Height: 600, Quality: thumbnailJPEGQuality},
+	{Name: "grid2x", Width: 800, Height: 1200, Quality: thumbnailJPEGQuality},
+}
+
+// previewWidths are the renditions served by /api/images/{id}/preview?w=.
+// A requested width is rounded up to one of them, so that only a few
+// previews are cached per image whatever the screen.
+var previewWidths = []uint{960, 1280, 1920, 2560, 3840}
+
+var errUnknownThumbnailSize = errors.New("unknown thumbnail size")
+
+// thumbnailLocks serializes the creation of each thumbnail file, and
+// thumbnailSlots limits how many images are decoded at once, since a grid page
+// requests dozens of thumbnails together.
+var (
+	thumbnailLocks sync.Map
+	thumbnailSlots = make(chan struct{}, runtime.NumCPU())
+)
+
+func findThumbnailSize(name string) (thumbnailSize, error) {
+	if name == "" {
+		return thumbnailSizes[0], nil
+	}
+	for _, size := range thumbnailSizes {
+		if size.Name == name {
+			return size, nil
+		}
+	}
+	return thumbnailSize{}, fmt.Errorf("%w: %q", errUnknownThumbnailSize, name)
+}
+
+// previewSize returns the preview rendition for a screen of the given width.
+// Previews fit in a square, so that portrait images are as sharp as landscape
+// ones.
+func previewSize(width int) thumbnailSize {
+	previewWidth := previewWidths[len(previewWidths)-1]
+	for _, candidate := range previewWidths {
+		if uint(width) <= candidate {
+			previewWidth = candidate
+			break
+		}
+	}
+	return thumbnailSize{
+		Name:    path.Join("preview", strconv.FormatUint(uint64(previewWidth), 10)),
+		Width:   previewWidth,
+		Height:  previewWidth,
+		Quality: previewJPEGQuality,
+	}
+}
+
+// thumbnailFilePath returns where the thumbnail of an image is cached.
+func thumbnailFilePath(imageID int, size thumbnailSize) string {
+	return filepath.Join(thumbnailDir, filepath.FromSlash(size.Name), strconv.Itoa(imageID)+".jpg")
+}
+
+// legacyThumbnailPath returns the single-size thumbnail created at indexing
+// before thumbnails were cached by ID.
+func legacyThumbnailPath(file imageFile) string {
+	if file.ThumbnailPath != "" {
+		return file.ThumbnailPath
+	}
+	return filepath.Join(thumbnailDir, file.Filename)
+}
+
+// imagePreviewPaths lists the cached previews an image may have.
+func imagePreviewPaths(imageID int) []string {
+	paths := make([]string, 0, len(previewWidths))
+	for _, width := range previewWidths {
+		paths = append(paths, thumbnailFilePath(imageID, previewSize(int(width))))
+	}
+	return paths
+}
+
+// imageThumbnailPaths lists every thumbnail and preview file of an image.
+func imageThumbnailPaths(file imageFile) []string {
+	paths := make([]string, 0, len(thumbnailSizes)+len(previewWidths)+1)
+	for _, size := range thumbnailSizes {
+		paths = append(paths, thumbnailFilePath(file.ID, size))
+	}
+	paths = append(paths, imagePreviewPaths(file.ID)...)
+	return append(paths, legacyThumbnailPath(file))
+}
+
+// imageThumbnail returns the thumbnail of an image, creating it when it is
+// missing, older than the image file, or force is set.
+func (app *App) imageThumbnail(file imageFile, trashed bool, size thumbnailSize, force bool) (string, error) {
+	if err := file.Location.check(); err != nil {
+		return "", err
+	}
+	sourcePath := file.Location.path()
+	if trashed {
+		sourcePath = file.trashPath()
+	}
+	sourcePath = app.libraryPath(sourcePath)
+	thumbnailPath := app.libraryPath(thumbnailFilePath(file.ID, size))
+
+	lock, _ := thumbnailLocks.LoadOrStore(thumbnailPath, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	source, err := os.Stat(sourcePath)
+	if err != nil {
+		return "", err
+	}
+	if !force {
+		if thumbnail, err := os.Stat(thumbnailPath); err == nil && !thumbnail.ModTime().Before(source.ModTime()) {
+			return thumbnailPath, nil
+		}
+	}
+
+	thumbnailSlots <- struct{}{}
+	defer func() { <-thumbnailSlots }()
+
+	if err := writeThumbnail(sourcePath, thumbnailPath, size); err != nil {
+		return "", fmt.Errorf("create %s thumbnail of image %d: %w", size.Name, file.ID, err)
+	}
+	return thumbnailPath, nil
+}
+
+// encodeResizedJPEG fits an image in maxWidth x maxHeight, keeping its aspect
+// ratio, and encodes it as JPEG. Thumbnails, lightbox previews and the images
+// sent with prompt requests are all resized this way.
+func encodeResizedJPEG(w io.Writer, source io.Reader, maxWidth, maxHeight uint, quality int) error {
+	decoded, err := decodeImage(source)
+	if err != nil {
+		return fmt.Errorf("decode image: %w", err)
+	}
+	resized := resize.Thumbnail(maxWidth, maxHeight, decoded, resize.Lanczos3)
+
+	// JPEG has no transparency
+	if err := jpeg.Encode(w, flattenOnWhite(resized), &jpeg.Options{Quality: quality}); err != nil {
+		return fmt.Errorf("encode image: %w", err)
+	}
+	return nil
+}
+
+// flattenOnWhite shows the transparent areas of an image as white.
+func flattenOnWhite(img image.Image) *image.RGBA {
+	flattened := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(flattened, flattened.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flattened, flattened.Bounds(), img, img.Bounds().Min, draw.Over)
+	return flattened
+}
+
+// writeThumbnail writes a thumbnail next to its destination and renames it,
+// so a thumbnail being served is never partially written.
+func writeThumbnail(sourcePath, thumbnailPath string, size thumbnailSize) error {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	if err := os.MkdirAll(filepath.Dir(thumbnailPath), 0755); err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(thumbnailPath), ".thumbnail-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if err := encodeResizedJPEG(temp, source, size.Width, size.Height, size.Quality); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), thumbnailPath)
+}
+
+// handleImageThumbnail serves a thumbnail of an image by ID, in the size given
+// by the size parameter.
+func (app *App) handleImageThumbnail(w http.ResponseWriter, r *http.Request) {
+	size, err := findThumbnailSize(r.URL.Query().Get("size"))
+	if err != nil {
+		http.Error(w, "Unknown thumbnail size", http.StatusBadRequest)
+		return
+	}
+	app.serveThumbnail(w, r, size)
+}
+
+// handleImagePreview serves an image resized for the lightbox. w is the
+// longest side of the screen in device pixels.
+func (app *App) handleImagePreview(w http.ResponseWriter, r *http.Request) {
+	width := defaultPreviewWidth
+	if value := r.URL.Query().Get("w"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid preview width", http.StatusBadRequest)
+			return
+		}
+		width = parsed
+	}
+	app.serveThumbnail(w, r, previewSize(width))
+}
+
+func (app *App) serveThumbnail(w http.ResponseWriter, r *http.Request, size thumbnailSize) {
+	imageID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || imageID <= 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	file, trashed, err := app.loadImageFile(imageID)
+	if err != nil {
+		if !errors.Is(err, errImageNotFound) {
+			log.Printf("Failed to serve %s thumbnail of image %d: %v", size.Name, imageID, err)
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	thumbnailPath, err := app.imageThumbnail(file, trashed, size, false)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, errInvalidImagePath) || errors.Is(err, errNoStillImage) {
+			http.NotFound(w, r)
+			return
+		}
+		log.Printf("Failed to serve %s thumbnail of image %d: %v", size.Name, imageID, err)
+		http.Error(w, "Failed to create thumbnail", http.StatusInternalServerError)
+		return
+	}
+	http.ServeFile(w, r, thumbnailPath)
+}
+
+// rebuildThumbnails creates every thumbnail size of every image again. Cached
+// previews are removed, to be created again when next viewed, as are the
+// single-size thumbnails of earlier versions. Videos have no thumbnails.
+func (app *App) rebuildThumbnails() (int, error) {
+	files, err := app.loadImageFiles("i.media_type != ?", mediaTypeVideo)
+	if err != nil {
+		return 0, err
+	}
+
+	rebuiltCount := 0
+	for _, file := range files {
+		rebuilt := true
+		for _, size := range thumbnailSizes {
+			if _, err := app.imageThumbnail(file.imageFile, file.Trashed, size, true); err != nil {
+				log.Printf("Error rebuilding thumbnails of %s: %v", file.Filename, err)
+				rebuilt = false
+				break
+			}
+		}
+		if !rebuilt {
+			continue
+		}
+		rebuiltCount++
+
+		removed := true
+		for _, oldPath := range append(imagePreviewPaths(file.ID), legacyThumbnailPath(file.imageFile)) {
+			if err := os.Remove(app.libraryPath(oldPath)); err != nil && !os.IsNotExist(err) {
+				log.Printf("Error removing old thumbnail %s: %v", oldPath, err)
+				removed = false
+			}
+		}
+		if !removed || file.ThumbnailPath == "" {
+			continue
+		}
+		if _, err := app.db.Exec("UPDATE images SET thumbnail_path = NULL WHERE id = ?", file.ID); err != nil {
+			return rebuiltCount, err
+		}
+	}
+	return rebuiltCount, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestThumbnailsAndPreviewsAreCreatedOnDemand(t *testing.T) {
+	t.Chdir(t.TempDir())
+	app := &App{}
+	setupTestDB(t, app).Close()
+	t.Cleanup(func() { app.db.Close() })
+
+	if _, err := app.db.Exec(`
+		INSERT INTO images (id, filename, width, height, prompt, neg_prompt, steps, cfg_scale, sampler, scheduler, seed, thumbnail_path, is_nsfw, library_root, relative_path) VALUES
+			(1, 'a.png', 1000, 3000, '', '', 20, 7, '', '', 1, '', 0, 'images', 'nested/a.png');
+	`); err != nil {
+		t.Fatalf("insert test image: %v", err)
+	}
+	sourcePath := filepath.Join("images", "nested", "a.png")
+	// A transparent PNG, which JPEG thumbnails show on white
+	if err := os.MkdirAll(filepath.Dir(sourcePath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	source, err := os.Create(sourcePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(source, image.NewNRGBA(image.Rect(0, 0, 1000, 3000))); err != nil {
+		t.Fatal(err)
+	}
+	source.Close()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/media/{id}/thumbnail", app.handleImageThumbnail)
+	router.HandleFunc("/api/images/{id}/preview", app.handleImagePreview)
+	get := func(url string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, url, nil))
+		return recorder
+	}
+
+	tests := []struct {
+		url           string
+		width, height int
+	}{
+		{"/media/1/thumbnail", 200, 600},
+		{"/media/1/thumbnail?size=grid2x", 400, 1200},
+		{"/api/images/1/preview?w=1500", 640, 1920},
+		{"/api/images/1/preview?w=9000", 1000, 3000},
+	}
+	for _, test := range tests {
+		recorder := get(test.url)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d", test.url, recorder.Code)
+		}
+		thumbnail, err := jpeg.Decode(recorder.Body)
+		if err != nil {
+			t.Fatalf("GET %s did not return a JPEG: %v", test.url, err)
+		}
+		if bounds := thumbnail.Bounds(); bounds.Dx() != test.width || bounds.Dy() != test.height {
+			t.Errorf("GET %s = %dx%d, want %dx%d", test.url, bounds.Dx(), bounds.Dy(), test.width, test.height)
+		}
+		if r, g, b, _ := thumbnail.At(0, 0).RGBA(); r>>8 < 250 || g>>8 < 250 || b>>8 < 250 {
+			t.Errorf("GET %s: expected transparency to be white, got %v", test.url, color.RGBA64Model.Convert(thumbnail.At(0, 0)))
+		}
+	}
+
+	// The cached thumbnail is served until the image file changes
+	gridPath := filepath.Join("thumbnails", "grid", "1.jpg")
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(gridPath, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(sourcePath, old.Add(-time.Hour), old.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	get("/media/1/thumbnail")
+	if info, err := os.Stat(gridPath); err != nil || !info.ModTime().Equal(old) {
+		t.Errorf("expected the cached thumbnail to be reused (%v)", err)
+	}
+	writeTestPNG(t, sourcePath, 40)
+	get("/media/1/thumbnail")
+	if info, err := os.Stat(gridPath); err != nil || info.ModTime().Equal(old) {
+		t.Errorf("expected the thumbnail of a changed file to be created again (%v)", err)
+	}
+
+	if recorder := get("/media/1/thumbnail?size=huge"); recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected an unknown size to be rejected, got %d", recorder.Code)
+	}
+	if recorder := get("/api/images/1/preview?w=-1"); recorder.Code != http.StatusBadRequest {
+		t.Errorf("expected an invalid preview width to be rejected, got %d", recorder.Code)
+	}
+	if recorder := get("/media/2/thumbnail"); recorder.Code != http.StatusNotFound {
+		t.Errorf("expected a missing image to be 404, got %d", recorder.Code)
+	}
+}
+
+func TestRebuildThumbnailsReplacesLegacyThumbnails(t *testing.T) {
+	t.Chdir(t.TempDir())
+	app := &App{}
+	setupTestDB(t, app).Close()
+	t.Cleanup(func() { app.db.Close() })
+
+	if _, err := app.db.Exec(`
+		INSERT INTO images (id, filename, width, height, prompt, neg_prompt, steps, cfg_scale, sampler, scheduler, seed, thumbnail_path, is_nsfw, library_root, relative_path) VALUES
+			(1, 'a.png', 8, 1, '', '', 20, 7, '', '', 1, 'thumbnails/a.png', 0, 'images', 'a.png'),
+			(2, 'missing.png', 8, 1, '', '', 20, 7, '', '', 2, '', 0, 'images', 'missing.png');
+	`); err != nil {
+		t.Fatalf("insert test images: %v", err)
+	}
+	writeTestPNG(t, filepath.Join("images", "a.png"), 8)
+	writeDeletionTestFile(t, filepath.Join("thumbnails", "a.png"))
+	writeDeletionTestFile(t, filepath.Join("thumbnails", "preview", "1920", "1.jpg"))
+
+	rebuiltCount, err := app.rebuildThumbnails()
+	if err != nil {
+		t.Fatalf("rebuild thumbnails: %v", err)
+	}
+	if rebuiltCount != 1 {
+		t.Errorf("expected 1 image rebuilt, got %d", rebuiltCount)
+	}
+	for _, size := range thumbnailSizes {
+		if _, err := os.Stat(filepath.Join("thumbnails", size.Name, "1.jpg")); err != nil {
+			t.Errorf("expected a %s thumbnail: %v", size.Name, err)
+		}
+	}
+	for _, path := range []string{filepath.Join("thumbnails", "a.png"), filepath.Join("thumbnails", "preview", "1920", "1.jpg")} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, stat error: %v", path, err)
+		}
+	}
+	var thumbnailPath *string
+	if err := app.db.QueryRow("SELECT thumbnail_path FROM images WHERE id = 1").Scan(&thumbnailPath); err != nil || thumbnailPath != nil {
+		t.Errorf("expected the legacy thumbnail path to be cleared, got %v (%v)", thumbnailPath, err)
+	}
+}
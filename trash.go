@@ -0,0 +1,424 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Deleting an image moves it to the trash: its row is kept with trashed_at
+// set and its original file moves to the trash folder of its library root, so
+// the deletion can be undone until the image is purged for good.
+const (
+	defaultTrashRetentionDays = 30
+	trashPurgeInterval        = time.Hour
+)
+
+var (
+	errImageNotInTrash = errors.New("image is not in the trash")
+	errImageFileExists = errors.New("a file with the same name is already in the library")
+)
+
+type RestoreImageResponse struct {
+	Success    bool   `json:"success"`
+	RestoredID int    `json:"restored_id,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// trashRetentionDaysFromEnv reads TRASH_RETENTION_DAYS; 0 keeps trashed
+// images until they are purged by hand.
+func trashRetentionDaysFromEnv() int {
+	value := getEnvOrDefault("TRASH_RETENTION_DAYS", strconv.Itoa(defaultTrashRetentionDays))
+	days, err := strconv.Atoi(value)
+	if err != nil || days < 0 {
+		log.Printf("Warning: Invalid TRASH_RETENTION_DAYS %q, using %d days", value, defaultTrashRetentionDays)
+		return defaultTrashRetentionDays
+	}
+	return days
+}
+
+type fileMove struct {
+	from string
+	to   string
+}
+
+// trashFileMoves maps the file of an image to its place in the trash of its
+// library root, keeping its path so a restore puts it back.
+func trashFileMoves(file imageFile) ([]fileMove, error) {
+	if err := file.Location.check(); err != nil {
+		return nil, err
+	}
+	if file.Location.readOnly() {
+		return nil, errLibraryRootReadOnly
+	}
+	return []fileMove{{from: file.Location.path(), to: file.trashPath()}}, nil
+}
+
+func restoreFileMoves(file imageFile) ([]fileMove, error) {
+	moves, err := trashFileMoves(file)
+	for i := range moves {
+		moves[i].from, moves[i].to = moves[i].to, moves[i].from
+	}
+	return moves, err
+}
+
+// moveFiles moves the files that exist and never overwrites a target. When a
+// move fails, the files already moved are put back.
+func moveFiles(moves []fileMove) ([]fileMove, error) {
+	moved := make([]fileMove, 0, len(moves))
+
+	for _, move := range moves {
+		if _, err := os.Lstat(move.from); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			undoFileMoves(moved)
+			return nil, fmt.Errorf("inspect %s: %w", move.from, err)
+		}
+		if _, err := os.Lstat(move.to); err == nil {
+			undoFileMoves(moved)
+			return nil, fmt.Errorf("%w: %s", errImageFileExists, move.to)
+		}
+
+		if err := os.MkdirAll(filepath.Dir(move.to), 0755); err != nil {
+			undoFileMoves(moved)
+			return nil, fmt.Errorf("create %s: %w", filepath.Dir(move.to), err)
+		}
+		if err := os.Rename(move.from, move.to); err != nil {
+			undoFileMoves(moved)
+			return nil, fmt.Errorf("move %s: %w", move.from, err)
+		}
+		moved = append(moved, move)
+	}
+
+	return moved, nil
+}
+
+func undoFileMoves(moved []fileMove) {
+	for i := len(moved) - 1; i >= 0; i-- {
+		if err := os.Rename(moved[i].to, moved[i].from); err != nil {
+			log.Printf("Failed to move %s back: %v", moved[i].from, err)
+		}
+	}
+}
+
+// imageFileChange changes the files and the records of an image inside tx.
+// undo puts the files back when the transaction fails, and cleanup runs once
+// it has committed.
+type imageFileChange func(tx *sql.Tx, file imageFile) (undo, cleanup func(), err error)
+
+// trashImageFiles moves an image to the trash. Civitai images are blacklisted
+// right away, so imports do not bring them back while they are in the trash.
+func trashImageFiles(tx *sql.Tx, file imageFile) (undo, cleanup func(), err error) {
+	moves, err := trashFileMoves(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	moved, err := moveFiles(moves)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := blacklistCivitaiImage(tx, file.ID); err != nil {
+		undoFileMoves(moved)
+		return nil, nil, err
+	}
+	result, err := tx.Exec("UPDATE images SET trashed_at = CURRENT_TIMESTAMP WHERE id = ? AND trashed_at IS NULL", file.ID)
+	if err == nil {
+		err = expectOneRow(result, errImageNotFound)
+	}
+	if err != nil {
+		undoFileMoves(moved)
+		return nil, nil, fmt.Errorf("move image record to trash: %w", err)
+	}
+
+	return func() { undoFileMoves(moved) }, nil, nil
+}
+
+// restoreImageFiles moves an image back from the trash and lifts the Civitai
+// blacklist entry added when it was deleted. Its LoRAs, tags, ratings and
+// edits were kept with the row.
+func restoreImageFiles(tx *sql.Tx, file imageFile) (undo, cleanup func(), err error) {
+	moves, err := restoreFileMoves(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	moved, err := moveFiles(moves)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result, err := tx.Exec("UPDATE images SET trashed_at = NULL WHERE id = ? AND trashed_at IS NOT NULL", file.ID)
+	if err == nil {
+		err = expectOneRow(result, errImageNotInTrash)
+	}
+	if err != nil {
+		undoFileMoves(moved)
+		return nil, nil, fmt.Errorf("restore image record: %w", err)
+	}
+	if _, err := tx.Exec(`
+		DELETE FROM deleted_civitai_images
+		WHERE civitai_image_id = (SELECT civitai_image_id FROM images WHERE id = ?)
+	`, file.ID); err != nil {
+		undoFileMoves(moved)
+		return nil, nil, fmt.Errorf("remove Civitai blacklist entry: %w", err)
+	}
+
+	return func() { undoFileMoves(moved) }, nil, nil
+}
+
+// purgeImageFiles deletes a trashed image for good. Its files are staged and
+// only removed once the transaction commits.
+func purgeImageFiles(tx *sql.Tx, file imageFile) (undo, cleanup func(), err error) {
+	if err := file.Location.check(); err != nil {
+		return nil, nil, err
+	}
+
+	stagedFiles, err := stageFilesForDeletion(append([]string{file.trashPath()}, imageThumbnailPaths(file)...))
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := deleteImageRecord(tx, file.ID); err != nil {
+		restoreStagedDeletionFiles(stagedFiles)
+		return nil, nil, err
+	}
+
+	return func() { restoreStagedDeletionFiles(stagedFiles) },
+		func() { removeStagedDeletionFiles(stagedFiles) },
+		nil
+}
+
+func expectOneRow(result sql.Result, errNoRow error) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected != 1 {
+		return errNoRow
+	}
+	return nil
+}
+
+// findImageFile looks up an image in the library, or in the trash when
+// trashed is set.
+func (app *App) findImageFile(imageID int, trashed bool) (imageFile, error) {
+	file, isTrashed, err := app.loadImageFile(imageID)
+	if err != nil {
+		return file, err
+	}
+	if isTrashed != trashed {
+		if trashed {
+			return file, errImageNotInTrash
+		}
+		// Trashed images are not part of the library
+		return file, errImageNotFound
+	}
+	return file, nil
+}
+
+// applyImageFileChange runs a change on one image in its own transaction.
+func (app *App) applyImageFileChange(imageID int, trashed bool, change imageFileChange) (string, error) {
+	file, err := app.findImageFile(imageID, trashed)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := app.db.Begin()
+	if err != nil {
+		return "", fmt.Errorf("begin image change: %w", err)
+	}
+
+	undo, cleanup, err := change(tx, file)
+	if err != nil {
+		_ = tx.Rollback()
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		undo()
+		return "", fmt.Errorf("commit image change: %w", err)
+	}
+	if cleanup != nil {
+		cleanup()
+	}
+	return file.Filename, nil
+}
+
+// trashImage moves an image to the trash and reports whether it was added to
+// the Civitai blacklist.
+func (app *App) trashImage(imageID int) (bool, error) {
+	if _, err := app.applyImageFileChange(imageID, false, trashImageFiles); err != nil {
+		return false, err
+	}
+	var blacklisted bool
+	if err := app.db.QueryRow("SELECT civitai_image_id IS NOT NULL FROM images WHERE id = ?", imageID).Scan(&blacklisted); err != nil {
+		return false, fmt.Errorf("find Civitai image ID: %w", err)
+	}
+	return blacklisted, nil
+}
+
+func (app *App) restoreImage(imageID int) error {
+	_, err := app.applyImageFileChange(imageID, true, restoreImageFiles)
+	return err
+}
+
+func (app *App) purgeImage(imageID int) error {
+	_, err := app.applyImageFileChange(imageID, true, purgeImageFiles)
+	return err
+}
+
+// purgeExpiredTrash deletes the images trashed longer than retention ago.
+func (app *App) purgeExpiredTrash(retention time.Duration) (int, error) {
+	// trashed_at is stored as CURRENT_TIMESTAMP, in UTC
+	cutoff := time.Now().Add(-retention).UTC().Format("2006-01-02 15:04:05")
+	rows, err := app.db.Query("SELECT id FROM images WHERE trashed_at IS NOT NULL AND trashed_at <= ? ORDER BY trashed_at", cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("find expired images: %w", err)
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("find expired images: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("find expired images: %w", err)
+	}
+
+	purged := 0
+	for _, id := range ids {
+		// An image restored in the meantime is skipped
+		if err := app.purgeImage(id); err != nil {
+			if !errors.Is(err, errImageNotInTrash) && !errors.Is(err, errImageNotFound) {
+				log.Printf("Failed to purge image %d: %v", id, err)
+			}
+			continue
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// runTrashPurge purges expired images from the trash periodically, for as
+// long as the server runs.
+func (app *App) runTrashPurge() {
+	if app.trashRetentionDays <= 0 {
+		log.Println("Trash purge disabled: deleted images are kept until purged from the trash")
+		return
+	}
+
+	retention := time.Duration(app.trashRetentionDays) * 24 * time.Hour
+	for {
+		purged, err := app.purgeExpiredTrash(retention)
+		if err != nil {
+			log.Printf("Warning: Trash purge failed: %v", err)
+		} else if purged > 0 {
+			log.Printf("Purged %d images from the trash", purged)
+		}
+		time.Sleep(trashPurgeInterval)
+	}
+}
+
+func (app *App) handleRestoreImage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	imageID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || imageID <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(RestoreImageResponse{
+			Success: false,
+			Error:   "Invalid image ID",
+		})
+		return
+	}
+
+	err = app.restoreImage(imageID)
+	switch {
+	case errors.Is(err, errImageNotFound), errors.Is(err, errImageNotInTrash):
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(RestoreImageResponse{
+			Success: false,
+			Error:   "Image not found in the trash",
+		})
+		return
+	case errors.Is(err, errImageFileExists):
+		w.WriteHeader(http.StatusConflict)
+		_ = json.NewEncoder(w).Encode(RestoreImageResponse{
+			Success: false,
+			Error:   "A file with the same name is already in the library",
+		})
+		return
+	case err != nil:
+		log.Printf("Failed to restore image %d: %v", imageID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(RestoreImageResponse{
+			Success: false,
+			Error:   "Failed to restore image",
+		})
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(RestoreImageResponse{
+		Success:    true,
+		RestoredID: imageID,
+	})
+}
+
+func (app *App) handlePurgeImage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	imageID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || imageID <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(DeleteImageResponse{
+			Success: false,
+			Error:   "Invalid image ID",
+		})
+		return
+	}
+
+	err = app.purgeImage(imageID)
+	if errors.Is(err, errImageNotFound) || errors.Is(err, errImageNotInTrash) {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(DeleteImageResponse{
+			Success: false,
+			Error:   "Image not found in the trash",
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to purge image %d: %v", imageID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(DeleteImageResponse{
+			Success: false,
+			Error:   "Failed to delete image",
+		})
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(DeleteImageResponse{
+		Success:   true,
+		DeletedID: imageID,
+	})
+}
+
+// handleTrashPage shows the trash with the index page.
+func (app *App) handleTrashPage(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	query.Set("trash", "1")
+	r.URL.RawQuery = query.Encode()
+	app.handleIndex(w, r)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRestoreImageUndoesTrash(t *testing.T) {
+	t.Chdir(t.TempDir())
+	db := openImageDeletionTestDB(t)
+	app := &App{db: db}
+
+	if _, err := db.Exec(`
+		INSERT INTO images (id, filename, civitai_image_id) VALUES (123, '123.jpg', 123);
+		INSERT INTO loras (image_id, name, weight) VALUES (123, 'detail', 0.8);
+	`); err != nil {
+		t.Fatalf("insert image: %v", err)
+	}
+	writeDeletionTestFile(t, filepath.Join("images", "123.jpg"))
+
+	if err := app.restoreImage(123); !errors.Is(err, errImageNotInTrash) {
+		t.Fatalf("expected an image outside the trash to be rejected, got %v", err)
+	}
+	if _, err := app.trashImage(123); err != nil {
+		t.Fatalf("trash image: %v", err)
+	}
+	if err := app.restoreImage(123); err != nil {
+		t.Fatalf("restore image: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join("images", "123.jpg")); err != nil {
+		t.Fatalf("expected the file back in the library: %v", err)
+	}
+	var trashedCount, loraCount, blacklistCount int
+	if err := db.QueryRow("SELECT COUNT(*) FROM images WHERE trashed_at IS NOT NULL").Scan(&trashedCount); err != nil {
+		t.Fatalf("count images: %v", err)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM loras WHERE image_id = 123").Scan(&loraCount); err != nil {
+		t.Fatalf("count LoRAs: %v", err)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM deleted_civitai_images").Scan(&blacklistCount); err != nil {
+		t.Fatalf("count blacklist entries: %v", err)
+	}
+	if trashedCount != 0 || loraCount != 1 || blacklistCount != 0 {
+		t.Fatalf("unexpected database state: trashed=%d loras=%d blacklist=%d", trashedCount, loraCount, blacklistCount)
+	}
+}
+
+func TestRestoreImageKeepsTrashWhenNameIsTaken(t *testing.T) {
+	t.Chdir(t.TempDir())
+	db := openImageDeletionTestDB(t)
+	app := &App{db: db}
+
+	if _, err := db.Exec("INSERT INTO images (id, filename, trashed_at) VALUES (5, 'taken.png', CURRENT_TIMESTAMP)"); err != nil {
+		t.Fatalf("insert image: %v", err)
+	}
+	writeDeletionTestFile(t, filepath.Join("images", libraryTrashDir, "5-taken.png"))
+	writeDeletionTestFile(t, filepath.Join("images", "taken.png"))
+
+	if err := app.restoreImage(5); !errors.Is(err, errImageFileExists) {
+		t.Fatalf("expected a name conflict, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join("images", libraryTrashDir, "5-taken.png")); err != nil {
+		t.Fatalf("expected the trashed file to stay: %v", err)
+	}
+}
+
+func TestPurgeImageDeletesTrashedImage(t *testing.T) {
+	t.Chdir(t.TempDir())
+	db := openImageDeletionTestDB(t)
+	app := &App{db: db}
+
+	if _, err := db.Exec(`
+		INSERT INTO images (id, filename, civitai_image_id) VALUES (123, '123.jpg', 123);
+		INSERT INTO loras (image_id, name, weight) VALUES (123, 'detail', 0.8);
+	`); err != nil {
+		t.Fatalf("insert image: %v", err)
+	}
+	writeDeletionTestFile(t, filepath.Join("images", "123.jpg"))
+	writeDeletionTestFile(t, filepath.Join("thumbnails", "123.jpg"))
+	writeDeletionTestFile(t, filepath.Join("thumbnails", "grid2x", "123.jpg"))
+
+	if err := app.purgeImage(123); !errors.Is(err, errImageNotInTrash) {
+		t.Fatalf("expected an image outside the trash to be rejected, got %v", err)
+	}
+	if _, err := app.trashImage(123); err != nil {
+		t.Fatalf("trash image: %v", err)
+	}
+	if err := app.purgeImage(123); err != nil {
+		t.Fatalf("purge image: %v", err)
+	}
+
+	for _, path := range []string{
+		filepath.Join("images", libraryTrashDir, "123-123.jpg"),
+		filepath.Join("thumbnails", "123.jpg"),
+		filepath.Join("thumbnails", "grid2x", "123.jpg"),
+	} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("expected %s to be deleted, stat error: %v", path, err)
+		}
+	}
+	var imageCount, loraCount, blacklistCount int
+	if err := db.QueryRow("SELECT COUNT(*) FROM images").Scan(&imageCount); err != nil {
+		t.Fatalf("count images: %v", err)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM loras").Scan(&loraCount); err != nil {
+		t.Fatalf("count LoRAs: %v", err)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM deleted_civitai_images WHERE civitai_image_id = 123").Scan(&blacklistCount); err != nil {
+		t.Fatalf("count blacklist entries: %v", err)
+	}
+	if imageCount != 0 || loraCount != 0 || blacklistCount != 1 {
+		t.Fatalf("unexpected database state: images=%d loras=%d blacklist=%d", imageCount, loraCount, blacklistCount)
+	}
+}
+
+func TestPurgeExpiredTrash(t *testing.T) {
+	t.Chdir(t.TempDir())
+	db := openImageDeletionTestDB(t)
+	app := &App{db: db}
+
+	if _, err := db.Exec(`
+		INSERT INTO images (id, filename, trashed_at) VALUES
+			(1, 'old.png', datetime('now', '-31 days')),
+			(2, 'recent.png', datetime('now', '-1 day')),
+			(3, 'library.png', NULL);
+	`); err != nil {
+		t.Fatalf("insert images: %v", err)
+	}
+
+	purged, err := app.purgeExpiredTrash(30 * 24 * time.Hour)
+	if err != nil {
+		t.Fatalf("purge trash: %v", err)
+	}
+	if purged != 1 {
+		t.Fatalf("expected 1 purged image, got %d", purged)
+	}
+
+	var remaining int
+	if err := db.QueryRow("SELECT COUNT(*) FROM images WHERE id IN (2, 3)").Scan(&remaining); err != nil {
+		t.Fatalf("count images: %v", err)
+	}
+	if remaining != 2 {
+		t.Fatalf("expected the recent and library images to be kept, got %d", remaining)
+	}
+}
+
+func TestTrashUsesStoredCivitaiImageID(t *testing.T) {
+	t.Chdir(t.TempDir())
+	db := openImageDeletionTestDB(t)
+	app := &App{db: db}
+
+	// A Civitai download renamed in the library keeps its Civitai image ID
+	if _, err := db.Exec("INSERT INTO images (id, filename, civitai_image_id, content_hash) VALUES (7, 'fox.png', 555, 'abc')"); err != nil {
+		t.Fatalf("insert image: %v", err)
+	}
+	writeDeletionTestFile(t, filepath.Join("images", "fox.png"))
+
+	blacklisted, err := app.trashImage(7)
+	if err != nil {
+		t.Fatalf("trash image: %v", err)
+	}
+	var filename, hash string
+	if err := db.QueryRow("SELECT filename, content_hash FROM deleted_civitai_images WHERE civitai_image_id = 555").Scan(&filename, &hash); err != nil {
+		t.Fatalf("expected a blacklist entry for the renamed image: %v", err)
+	}
+	if !blacklisted || filename != "fox.png" || hash != "abc" {
+		t.Errorf("unexpected blacklist entry: blacklisted=%v filename=%s hash=%s", blacklisted, filename, hash)
+	}
+
+	if err := app.restoreImage(7); err != nil {
+		t.Fatalf("restore image: %v", err)
+	}
+	if blacklisted, err := app.isCivitaiImageBlacklisted(555); err != nil || blacklisted {
+		t.Errorf("expected restoring to lift the blacklist entry, got %v (%v)", blacklisted, err)
+	}
+}
+
+func TestTrashKeepsFilesTrashedFromTheSamePath(t *testing.T) {
+	t.Chdir(t.TempDir())
+	db := openImageDeletionTestDB(t)
+	app := &App{db: db}
+
+	// A new file at the path of a trashed image is trashed in turn
+	if _, err := db.Exec("INSERT INTO images (id, filename) VALUES (1, 'fox.png')"); err != nil {
+		t.Fatalf("insert image: %v", err)
+	}
+	writeDeletionTestFile(t, filepath.Join("images", "fox.png"))
+	if _, err := app.trashImage(1); err != nil {
+		t.Fatalf("trash first image: %v", err)
+	}
+	if _, err := db.Exec("INSERT INTO images (id, filename) VALUES (2, 'fox.png')"); err != nil {
+		t.Fatalf("insert image: %v", err)
+	}
+	writeDeletionTestFile(t, filepath.Join("images", "fox.png"))
+	if _, err := app.trashImage(2); err != nil {
+		t.Fatalf("trash second image: %v", err)
+	}
+
+	for _, name := range []string{"1-fox.png", "2-fox.png"} {
+		if _, err := os.Stat(filepath.Join("images", libraryTrashDir, name)); err != nil {
+			t.Errorf("expected %s in the trash: %v", name, err)
+		}
+	}
+
+	if err := app.restoreImage(2); err != nil {
+		t.Fatalf("restore second image: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join("images", "fox.png")); err != nil {
+		t.Fatalf("expected the second file back in the library: %v", err)
+	}
+	if err := app.purgeImage(1); err != nil {
+		t.Fatalf("purge first image: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join("images", libraryTrashDir, "1-fox.png")); !os.IsNotExist(err) {
+		t.Errorf("expected the first file to be deleted, stat error: %v", err)
+	}
+}
+
+func TestMigrateTrashFileNames(t *testing.T) {
+	t.Chdir(t.TempDir())
+	db := openImageDeletionTestDB(t)
+	app := &App{db: db}
+
+	if _, err := db.Exec(`
+		INSERT INTO images (id, filename, library_root, relative_path, trashed_at) VALUES
+			(3, 'old.png', 'images', 'sub/old.png', CURRENT_TIMESTAMP),
+			(4, 'new.png', 'images', 'new.png', CURRENT_TIMESTAMP);
+	`); err != nil {
+		t.Fatalf("insert images: %v", err)
+	}
+	writeDeletionTestFile(t, filepath.Join("images", libraryTrashDir, "sub", "old.png"))
+	writeDeletionTestFile(t, filepath.Join("images", libraryTrashDir, "4-new.png"))
+
+	if err := app.migrateTrashFileNames(); err != nil {
+		t.Fatalf("migrate trash: %v", err)
+	}
+	for _, path := range []string{
+		filepath.Join("images", libraryTrashDir, "sub", "3-old.png"),
+		filepath.Join("images", libraryTrashDir, "4-new.png"),
+	} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("expected %s in the trash: %v", path, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join("images", libraryTrashDir, "sub", "old.png")); !os.IsNotExist(err) {
+		t.Errorf("expected the plain name to be gone, stat error: %v", err)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	xmpJPEGPrefix      = "http://ns.adobe.com/xap/1.0/\x00"
+	photoshopIRBPrefix = "Photoshop 3.0\x00"
+	xmpPNGKeyword      = "XML:com.adobe.xmp"
+
+	// Photoshop image resource holding the IPTC-NAA record
+	iptcResourceID = 0x0404
+)
+
+// XMP namespaces of the properties the viewer reads
+const (
+	xmpNamespaceDC   = "http://purl.org/dc/elements/1.1/"
+	xmpNamespaceXMP  = "http://ns.adobe.com/xap/1.0/"
+	xmpNamespaceEXIF = "http://ns.adobe.com/exif/1.0/"
+	xmpNamespaceTIFF = "http://ns.adobe.com/tiff/1.0/"
+
+	// Properties written by the viewer itself (aiv:Favorite, aiv:ParametersWritten)
+	xmpNamespaceViewer = "http://ns.ai-generated-image-viewer/1.0/"
+)
+
+// xmpPacket holds the XMP properties that can carry a prompt, plus the
+// rating and color label set in Lightroom, Bridge and most DAM tools.
+type xmpPacket struct {
+	Description      string
+	UserComment      string
+	ImageDescription string
+	Rating           int
+	Label            string
+	Favorite         bool
+
+	// Set by -write-metadata, whose parameters chunk replaces the generator's
+	ParametersWritten bool
+}
+
+// parseXMPPacket reads the simple properties of an XMP packet. Language
+// alternatives keep their first entry, which is x-default in practice.
+func parseXMPPacket(data []byte) (xmpPacket, error) {
+	var packet xmpPacket
+	values := make(map[xml.Name]string)
+
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	var stack []xml.Name
+	for {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return packet, fmt.Errorf("decode XMP: %w", err)
+		}
+
+		switch element := token.(type) {
+		case xml.StartElement:
+			stack = append(stack, element.Name)
+			if element.Name.Local == "Description" {
+				// Properties may also be written as attributes of rdf:Description
+				for _, attr := range element.Attr {
+					if _, exists := values[attr.Name]; !exists {
+						values[attr.Name] = strings.TrimSpace(attr.Value)
+					}
+				}
+			}
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			text := strings.TrimSpace(string(element))
+			if text == "" {
+				continue
+			}
+			for i := len(stack) - 2; i >= 0; i-- {
+				if stack[i].Local == "Description" {
+					property := stack[i+1]
+					if _, exists := values[property]; !exists {
+						values[property] = text
+					}
+					break
+				}
+			}
+		}
+	}
+
+	packet.Description = values[xml.Name{Space: xmpNamespaceDC, Local: "description"}]
+	packet.UserComment = values[xml.Name{Space: xmpNamespaceEXIF, Local: "UserComment"}]
+	packet.ImageDescription = values[xml.Name{Space: xmpNamespaceTIFF, Local: "ImageDescription"}]
+	packet.Label = values[xml.Name{Space: xmpNamespaceXMP, Local: "Label"}]
+	packet.Favorite = strings.EqualFold(values[xml.Name{Space: xmpNamespaceViewer, Local: "Favorite"}], "true")
+	packet.ParametersWritten = strings.EqualFold(values[xml.Name{Space: xmpNamespaceViewer, Local: "ParametersWritten"}], "true")
+	if rating := values[xml.Name{Space: xmpNamespaceXMP, Local: "Rating"}]; rating != "" {
+		// Ratings are integers, but some tools write "3.0"
+		if value, err := strconv.ParseFloat(rating, 64); err == nil {
+			packet.Rating = int(value)
+		}
+	}
+	return packet, nil
+}
+
+// sources returns the XMP properties that may hold generation parameters.
+func (packet xmpPacket) sources() []MetadataSource {
+	var sources []MetadataSource
+	for _, property := range []struct{ key, text string }{
+		{"exif:UserComment", packet.UserComment},
+		{"dc:description", packet.Description},
+		{"tiff:ImageDescription", packet.ImageDescription},
+	} {
+		if property.text != "" {
+			sources = append(sources, MetadataSource{Container: "xmp", Key: property.key, Text: property.text})
+		}
+	}
+	return sources
+}
+
+// applyXMPPacket parses an XMP packet into the image's rating and label and
+// returns its text properties for the parser registry. A star rating and
+// favorite flag written by -write-metadata seed the viewer's own rating.
+func applyXMPPacket(data []byte, metadata *ImageMetadata) []MetadataSource {
+	packet, err := parseXMPPacket(data)
+	if err != nil {
+		log.Printf("Unable to read XMP packet of %s: %v", metadata.Filename, err)
+		return nil
+	}
+	metadata.XMPRating = packet.Rating
+	metadata.XMPLabel = packet.Label
+	if packet.Rating >= 1 && packet.Rating <= maxImageRating {
+		metadata.Rating = packet.Rating
+	}
+	metadata.Favorite = packet.Favorite
+	metadata.ParametersWritten = packet.ParametersWritten
+	return packet.sources()
+}
+
+// readJPEGMetadataSegments returns the XMP packet (APP1) and the Photoshop
+// resource block (APP13) of a JPEG, stopping at the image data.
+func readJPEGMetadataSegments(path string) (xmpData, photoshopData []byte, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+
+	var soi [2]byte
+	if _, err := io.ReadFull(reader, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return nil, nil, fmt.Errorf("not a JPEG file")
+	}
+
+	for {
+		prefix, err := reader.ReadByte()
+		if err != nil {
+			return xmpData, photoshopData, nil
+		}
+		if prefix != 0xFF {
+			return xmpData, photoshopData, fmt.Errorf("invalid JPEG marker 0x%02X", prefix)
+		}
+		marker, err := reader.ReadByte()
+		for err == nil && marker == 0xFF {
+			marker, err = reader.ReadByte() // Fill bytes
+		}
+		if err != nil {
+			return xmpData, photoshopData, nil
+		}
+
+		switch {
+		case marker == 0xDA || marker == 0xD9:
+			// Start of scan or end of image: no metadata segments follow
+			return xmpData, photoshopData, nil
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+			continue // Markers without a payload
+		}
+
+		var length uint16
+		if err := binary.Read(reader, binary.BigEndian, &length); err != nil || length < 2 {
+			return xmpData, photoshopData, fmt.Errorf("invalid JPEG segment length")
+		}
+		segment := make([]byte, length-2)
+		if _, err := io.ReadFull(reader, segment); err != nil {
+			return xmpData, photoshopData, fmt.Errorf("read JPEG segment: %w", err)
+		}
+
+		switch {
+		case marker == 0xE1 && xmpData == nil && bytes.HasPrefix(segment, []byte(xmpJPEGPrefix)):
+			xmpData = segment[len(xmpJPEGPrefix):]
+		case marker == 0xED && bytes.HasPrefix(segment, []byte(photoshopIRBPrefix)):
+			photoshopData = append(photoshopData, segment[len(photoshopIRBPrefix):]...)
+		}
+	}
+}
+
+// findPhotoshopResource returns the data of an image resource block ("8BIM")
+// from an APP13 segment.
+func findPhotoshopResource(data []byte, resourceID uint16) []byte {
+	for len(data) >= 12 && bytes.HasPrefix(data, []byte("8BIM")) {
+		id := binary.BigEndian.Uint16(data[4:6])
+
+		// Pascal string name, padded to an even length including its length byte
+		nameLength := int(data[6]) + 1
+		if nameLength%2 != 0 {
+			nameLength++
+		}
+		offset := 6 + nameLength
+		if len(data) < offset+4 {
+			return nil
+		}
+		size := int(binary.BigEndian.Uint32(data[offset : offset+4]))
+		offset += 4
+		if size < 0 || len(data) < offset+size {
+			return nil
+		}
+		if id == resourceID {
+			return data[offset : offset+size]
+		}
+
+		offset += size
+		if size%2 != 0 {
+			offset++
+		}
+		if offset > len(data) {
+			return nil
+		}
+		data = data[offset:]
+	}
+	return nil
+}
+
+// parseIPTCCaption returns the Caption/Abstract (2:120) dataset of an
+// IPTC-NAA record, which Photoshop shows as the image description.
+func parseIPTCCaption(data []byte) string {
+	for len(data) >= 5 && data[0] == 0x1C {
+		record, dataset := data[1], data[2]
+		length := int(binary.BigEndian.Uint16(data[3:5]))
+		if length&0x8000 != 0 {
+			return "" // Extended datasets are not used for text
+		}
+		if len(data) < 5+length {
+			return ""
+		}
+		if record == 2 && dataset == 120 {
+			return sanitizeUTF8(string(data[5 : 5+length]))
+		}
+		data = data[5+length:]
+	}
+	return ""
+}
+
+// extractJPEGXMPAndIPTC reads the XMP and IPTC segments that exif.Decode
+// ignores and runs their text through the parser registry.
+func (app *App) extractJPEGXMPAndIPTC(path string, metadata *ImageMetadata) {
+	xmpData, photoshopData, err := readJPEGMetadataSegments(path)
+	if err != nil {
+		log.Printf("Unable to read JPEG metadata segments of %s: %v", metadata.Filename, err)
+	}
+
+	var sources []MetadataSource
+	if xmpData != nil {
+		sources = append(sources, applyXMPPacket(xmpData, metadata)...)
+	}
+	if iptc := findPhotoshopResource(photoshopData, iptcResourceID); iptc != nil {
+		if caption := parseIPTCCaption(iptc); caption != "" {
+			sources = append(sources, MetadataSource{Container: "iptc", Key: "Caption-Abstract", Text: caption})
+		}
+	}
+	switch {
+	case len(sources) == 0:
+	case metadata.ParametersWritten:
+		// The EXIF UserComment holds the written parameters
+		app.parseWrittenMetadataSources(sources, metadata, func(MetadataSource) bool { return false })
+	default:
+		app.parseMetadataSources(sources, metadata)
+	}
+}
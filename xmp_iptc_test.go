@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const xmpTestPacket = `<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about=""
+    xmlns:xmp="http://ns.adobe.com/xap/1.0/"
+    xmlns:dc="http://purl.org/dc/elements/1.1/"
+    xmp:Rating="4"
+    xmp:Label="Green">
+   <dc:description>
+    <rdf:Alt>
+     <rdf:li xml:lang="x-default">a koi pond in autumn, ukiyo-e
+Negative prompt: photo
+Steps: 24, Sampler: Euler a, CFG scale: 6, Seed: 5150</rdf:li>
+    </rdf:Alt>
+   </dc:description>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>`
+
+func TestParseXMPPacket(t *testing.T) {
+	packet, err := parseXMPPacket([]byte(xmpTestPacket))
+	if err != nil {
+		t.Fatalf("parse XMP: %v", err)
+	}
+	if packet.Rating != 4 || packet.Label != "Green" {
+		t.Errorf("Unexpected rating/label: %d/%q", packet.Rating, packet.Label)
+	}
+	if packet.Description == "" || packet.Description[:10] != "a koi pond" {
+		t.Errorf("Unexpected description: %q", packet.Description)
+	}
+
+	// Element form, as written by exiftool
+	packet, err = parseXMPPacket([]byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+		<rdf:Description xmlns:xmp="http://ns.adobe.com/xap/1.0/"><xmp:Rating>2.0</xmp:Rating></rdf:Description></rdf:RDF></x:xmpmeta>`))
+	if err != nil {
+		t.Fatalf("parse XMP: %v", err)
+	}
+	if packet.Rating != 2 || len(packet.sources()) != 0 {
+		t.Errorf("Unexpected packet: %+v", packet)
+	}
+}
+
+func TestExtractJPEGXMPAndIPTC(t *testing.T) {
+	app := &App{}
+
+	t.Run("XMP", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "xmp.jpeg")
+		writeJPEGWithSegments(t, path, jpegSegment(0xE1, append([]byte(xmpJPEGPrefix), xmpTestPacket...)))
+
+		metadata := &ImageMetadata{Filename: "xmp.jpeg"}
+		app.extractJPEGXMPAndIPTC(path, metadata)
+
+		if metadata.Prompt != "a koi pond in autumn, ukiyo-e" || metadata.Steps != 24 || metadata.Seed != 5150 {
+			t.Errorf("Unexpected parameters from XMP: prompt=%q steps=%d seed=%d", metadata.Prompt, metadata.Steps, metadata.Seed)
+		}
+		if metadata.XMPRating != 4 || metadata.XMPLabel != "Green" {
+			t.Errorf("Unexpected rating/label: %d/%q", metadata.XMPRating, metadata.XMPLabel)
+		}
+		if len(metadata.MetadataSources) != 1 || metadata.MetadataSources[0].Key != "dc:description" {
+			t.Errorf("Unexpected sources: %+v", metadata.MetadataSources)
+		}
+	})
+
+	t.Run("IPTC", func(t *testing.T) {
+		caption := []byte("lighthouse on a cliff, storm")
+		iptc := []byte{0x1C, 0x01, 0x5A, 0x00, 0x03, 0x1B, 0x25, 0x47} // 1:90 coded character set (UTF-8)
+		iptc = append(iptc, 0x1C, 0x02, 0x78, 0x00, byte(len(caption)))
+		iptc = append(iptc, caption...)
+
+		resource := []byte("8BIM")
+		resource = binary.BigEndian.AppendUint16(resource, iptcResourceID)
+		resource = append(resource, 0, 0) // Empty name, padded
+		resource = binary.BigEndian.AppendUint32(resource, uint32(len(iptc)))
+		resource = append(resource, iptc...)
+
+		path := filepath.Join(t.TempDir(), "iptc.jpeg")
+		writeJPEGWithSegments(t, path, jpegSegment(0xED, append([]byte(photoshopIRBPrefix), resource...)))
+
+		metadata := &ImageMetadata{Filename: "iptc.jpeg"}
+		app.extractJPEGXMPAndIPTC(path, metadata)
+
+		if metadata.Prompt != "lighthouse on a cliff, storm" {
+			t.Errorf("Expected IPTC caption as prompt, got %q", metadata.Prompt)
+		}
+		if metadata.MetadataParser != "a1111" {
+			t.Errorf("Expected the caption to go through the parser registry, got %q", metadata.MetadataParser)
+		}
+	})
+}
+
+func TestExtractPNGMetadataReadsXMPChunk(t *testing.T) {
+	app := &App{}
+	path := filepath.Join(t.TempDir(), "xmp.png")
+	writePNGWithTextChunks(t, path, [][2]string{{xmpPNGKeyword, xmpTestPacket}})
+
+	metadata := &ImageMetadata{}
+	app.extractPNGMetadata(path, metadata)
+
+	if metadata.Prompt != "a koi pond in autumn, ukiyo-e" || metadata.CFGScale != 6 {
+		t.Errorf("Unexpected parameters from PNG XMP: prompt=%q cfg=%f", metadata.Prompt, metadata.CFGScale)
+	}
+	if metadata.XMPRating != 4 || metadata.XMPLabel != "Green" {
+		t.Errorf("Unexpected rating/label: %d/%q", metadata.XMPRating, metadata.XMPLabel)
+	}
+}
+
+// writeJPEGWithSegments writes a small JPEG with extra segments right after
+// the SOI marker, where editors put their metadata.
+func writeJPEGWithSegments(t *testing.T, path string, segments ...[]byte) {
+	t.Helper()
+
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, image.NewRGBA(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatalf("encode JPEG: %v", err)
+	}
+	data := encoded.Bytes()
+
+	output := append([]byte{}, data[:2]...)
+	for _, segment := range segments {
+		output = append(output, segment...)
+	}
+	output = append(output, data[2:]...)
+
+	if err := os.WriteFile(path, output, 0644); err != nil {
+		t.Fatalf("write JPEG: %v", err)
+	}
+}